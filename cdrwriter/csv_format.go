@@ -71,7 +71,8 @@ func (w *CSVFormat) GetRadiusCDRString(rp *core.RadiusPacket) string {
 		if len(avps) > 0 {
 
 			radiusType := avps[0].DictItem.RadiusType
-			if (radiusType == core.RadiusTypeInteger || radiusType == core.RadiusTypeInteger64) && !w.parseInts {
+			if (radiusType == core.RadiusTypeInteger || radiusType == core.RadiusTypeInteger64 ||
+				radiusType == core.RadiusTypeByte || radiusType == core.RadiusTypeShort || radiusType == core.RadiusTypeSigned) && !w.parseInts {
 				// Write as integer
 				for j := range avps {
 					builder.WriteString(fmt.Sprintf("%d", avps[j].GetInt()))
@@ -302,7 +302,7 @@ func (ew *ElasticFormat) writeStringAVP(sb *strings.Builder, avps []core.RadiusA
 	var values []string
 	var writeAsString = false
 	switch avps[0].DictItem.RadiusType {
-	case core.RadiusTypeInteger, core.RadiusTypeInteger64:
+	case core.RadiusTypeInteger, core.RadiusTypeInteger64, core.RadiusTypeByte, core.RadiusTypeShort, core.RadiusTypeSigned:
 		for i, avp := range avps {
 			if val, found := avp.DictItem.EnumCodes[int(avp.GetInt())]; found {
 				// Write as string
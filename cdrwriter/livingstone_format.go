@@ -55,13 +55,14 @@ func (w *LivingstoneFormat) GetRadiusCDRString(rp *core.RadiusPacket) string {
 
 		switch rp.AVPs[i].DictItem.RadiusType {
 
-		case core.RadiusTypeNone, core.RadiusTypeOctets, core.RadiusTypeString, core.RadiusTypeInterfaceId, core.RadiusTypeAddress, core.RadiusTypeIPv6Address, core.RadiusTypeIPv6Prefix:
+		case core.RadiusTypeNone, core.RadiusTypeOctets, core.RadiusTypeString, core.RadiusTypeInterfaceId, core.RadiusTypeAddress, core.RadiusTypeIPv6Address, core.RadiusTypeIPv6Prefix,
+			core.RadiusTypeIPv4Prefix, core.RadiusTypeEther, core.RadiusTypeComboIP, core.RadiusTypeABinary:
 			// Write as a string
 			builder.WriteString("=\"")
 			builder.WriteString(rp.AVPs[i].GetTaggedString())
 			builder.WriteString("\"\n")
 
-		case core.RadiusTypeInteger:
+		case core.RadiusTypeInteger, core.RadiusTypeByte, core.RadiusTypeShort, core.RadiusTypeSigned:
 			// Try dictionary, if not found use integer value
 			var intValue, _ = rp.AVPs[i].Value.(int64)
 			if stringValue, ok := rp.AVPs[i].DictItem.EnumCodes[int(intValue)]; ok {
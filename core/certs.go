@@ -4,10 +4,13 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	"math/big"
+	"net"
 	"os"
 	"path"
 	"sync"
@@ -74,15 +77,16 @@ func EnsureCertificates() (string, string) {
 		NotBefore:             time.Now(),
 		NotAfter:              time.Now().AddDate(10, 0, 0),
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, // This certificate is for a CA
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 	}
 
 	// Add the endpoints to the certificate. It will be valid for the hostname and for "localhost"
 	// Most likely the client will ingore verification of the certifiate anyway, since this is not
-	// easy to get right in Kubernetes
+	// easy to get right in Kubernetes. RadSec does verify it, so the loopback addresses are also included
 	myHostname, _ := os.Hostname()
 	certTemplate.DNSNames = append(certTemplate.DNSNames, myHostname, "localhost")
+	certTemplate.IPAddresses = append(certTemplate.IPAddresses, net.IPv4(127, 0, 0, 1), net.IPv6loopback)
 
 	// Serialize the certificate
 	derBytes, err := x509.CreateCertificate(rand.Reader, &certTemplate, &certTemplate, publicKey, privKey)
@@ -123,3 +127,57 @@ func EnsureCertificates() (string, string) {
 
 	return certFile, keyFile
 }
+
+// Builds the TLS configuration for RadSec, as server or as client.
+// The certificate and key files are used to authenticate to the peer. If not specified, the ones
+// generated by EnsureCertificates are used.
+// The CA file is mandatory. The certificate of the peer is always verified against it and, as a
+// server, the client is required to present a certificate
+func NewRadSecTLSConfig(certFile string, keyFile string, caFile string, isServer bool) (*tls.Config, error) {
+
+	if caFile == "" {
+		return nil, fmt.Errorf("a CA file is required for RadSec")
+	}
+
+	if certFile == "" || keyFile == "" {
+		certFile, keyFile = EnsureCertificates()
+	} else {
+		certFile, keyFile = configFilePath(certFile), configFilePath(keyFile)
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load RadSec certificate: %w", err)
+	}
+
+	tlsConfig := tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	caBytes, err := os.ReadFile(configFilePath(caFile))
+	if err != nil {
+		return nil, fmt.Errorf("could not read RadSec CA file: %w", err)
+	}
+	caPool := x509.NewCertPool()
+	if !caPool.AppendCertsFromPEM(caBytes) {
+		return nil, fmt.Errorf("no valid certificates in RadSec CA file %s", caFile)
+	}
+
+	if isServer {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		tlsConfig.ClientCAs = caPool
+	} else {
+		tlsConfig.RootCAs = caPool
+	}
+
+	return &tlsConfig, nil
+}
+
+// Relative file names are interpreted as relative to the base config directory
+func configFilePath(fileName string) string {
+	if path.IsAbs(fileName) {
+		return fileName
+	}
+	return igorConfigBase + fileName
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
@@ -179,6 +180,19 @@ func toFloat64(value interface{}) (float64, error) {
 	}
 }
 
+// Returns the network to use for listening in the specified address, for the "udp" or "tcp" protocol.
+// "::" listens in both IPv4 and IPv6, but "0.0.0.0" only in IPv4
+func ListenNetwork(protocol string, bindAddress string) string {
+	if ip := net.ParseIP(bindAddress); ip != nil {
+		if ip.To4() != nil {
+			return protocol + "4"
+		} else if !ip.IsUnspecified() {
+			return protocol + "6"
+		}
+	}
+	return protocol
+}
+
 // Helper function for tests
 func HttpGet(location string) (string, error) {
 
@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -24,6 +25,29 @@ const (
 	HTTP_TIMEOUT_SECONDS = 5
 )
 
+// Returned, wrapped, when the configuration object does not exist in the origin, whatever
+// the type of origin, so that optional objects may be detected using errors.Is
+var ErrObjectNotFound = errors.New("configuration object not found")
+
+// Error for a configuration object that does not exist. Is ErrObjectNotFound and
+// also wraps the original error, if any
+type objectNotFoundError struct {
+	location string
+	cause    error
+}
+
+func (e *objectNotFoundError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrObjectNotFound, e.location)
+}
+
+func (e *objectNotFoundError) Is(target error) bool {
+	return target == ErrObjectNotFound
+}
+
+func (e *objectNotFoundError) Unwrap() error {
+	return e.cause
+}
+
 // Holds a SearchRule, which specifies where to look for a configuration object
 type SearchRule struct {
 	// Regex for the name of the object. If matching, we'll try to locate
@@ -302,6 +326,9 @@ func (c *ConfigurationManager) readResource(location string, retry bool) ([]byte
 			return nil, err
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, &objectNotFoundError{location: location}
+		}
 		if resp.StatusCode != http.StatusOK {
 			if (resp.StatusCode < 300 || resp.StatusCode >= 400) && retry {
 				return nil, fmt.Errorf("got status code %d while retrieving %s", resp.StatusCode, location)
@@ -325,6 +352,9 @@ func (c *ConfigurationManager) readResource(location string, retry bool) ([]byte
 	} else {
 		// Read from file
 		if resp, err := os.ReadFile(igorConfigBase + location); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil, &objectNotFoundError{location: location, cause: err}
+			}
 			return nil, err
 		} else {
 			return resp, nil
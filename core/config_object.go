@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"sync/atomic"
 	"text/template"
 )
 
@@ -15,7 +16,8 @@ type Initializable interface {
 
 // Represents an object that will be populated from the configuration resources
 type ConfigObject[T any] struct {
-	o          *T
+	// Holds a *T. Atomic, because the object may be updated while being used
+	o          atomic.Value
 	objectName string
 }
 
@@ -40,7 +42,7 @@ func (co *ConfigObject[T]) Update(cm *ConfigurationManager) error {
 				return err
 			}
 		}
-		co.o = &theObject
+		co.o.Store(&theObject)
 		return nil
 	}
 }
@@ -48,7 +50,16 @@ func (co *ConfigObject[T]) Update(cm *ConfigurationManager) error {
 // Provides access to the configuration object. Returns a copy, so the underlying
 // object may be modified safely
 func (co *ConfigObject[T]) Get() T {
-	return *co.o
+	return *co.o.Load().(*T)
+}
+
+// Same as Get, but returns false instead of panicking if the object has not been read yet
+func (co *ConfigObject[T]) getIfLoaded() (T, bool) {
+	if o, ok := co.o.Load().(*T); ok {
+		return *o, true
+	}
+	var zero T
+	return zero, false
 }
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -61,7 +72,8 @@ func (co *ConfigObject[T]) Get() T {
 // The end result will be a map of the keys in the ParametersObject to RadiusUserFile built from
 // the specified template and parameters replaced.
 type TemplatedMapConfigObject[T, P any] struct {
-	o                    *map[string]T
+	// Holds a *map[string]T. Atomic, because the object may be updated while being used
+	o                    atomic.Value
 	templateObjectName   string
 	parametersObjectName string
 }
@@ -111,19 +123,19 @@ func (tco *TemplatedMapConfigObject[T, P]) Update(cm *ConfigurationManager) erro
 		theMap[k] = v
 	}
 
-	tco.o = &theMap
+	tco.o.Store(&theMap)
 
 	return nil
 }
 
 // Provides access to the configuration object.
 func (tco *TemplatedMapConfigObject[T, P]) Get() map[string]T {
-	return *tco.o
+	return *tco.o.Load().(*map[string]T)
 }
 
 // Provides access to the specified entry of the configuration object.
 func (tco *TemplatedMapConfigObject[T, P]) GetKey(key string) (T, error) {
-	var theMap = *tco.o
+	var theMap = tco.Get()
 	if co, found := theMap[key]; !found {
 		return co, fmt.Errorf("key %s not found", key)
 	} else {
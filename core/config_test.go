@@ -1,6 +1,9 @@
 package core
 
 import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"net"
 	"strings"
 	"testing"
@@ -18,6 +21,20 @@ func TestHttpRetrieval(t *testing.T) {
 	}
 }
 
+func TestObjectNotFound(t *testing.T) {
+	cm := &GetPolicyConfig().CM
+
+	// File origin
+	if _, err := cm.GetBytesConfigObject("nonExistingObject.json"); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("non existing file object did not return ErrObjectNotFound: %v", err)
+	}
+
+	// Http origin
+	if _, err := cm.readResource("http://localhost:8100/nonExistingObject.json", false); !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("non existing http object did not return ErrObjectNotFound: %v", err)
+	}
+}
+
 // Requires that the test database is populated with
 // INSERT INTO accessNodes (AccessNodeId, Parameters) values ("RepublicaHW01", '{"originIP": "127.0.0.1", "secret": "mysecret", "attributes": [{"Redback-Client_DNS_Pri": "1.2.3.4"}, {"Session-Timeout": 3600}]}');
 // INSERT INTO accessNodes (AccessNodeId, Parameters) values ("RepublicaHW02", '{"originIP": "127.0.0.2", "secret": "mysecret", "attributes": [{"Redback-Client_DNS_Pri": "1.2.3.4"}, {"Session-Timeout": 7200}]}');
@@ -71,6 +88,33 @@ func TestDiamConfig(t *testing.T) {
 	if dsc.BindAddress != "127.0.0.1" {
 		t.Fatalf("BindAddress retreived is <%s>", dsc.BindAddress)
 	}
+	if len(dsc.BindAddresses) != 1 || dsc.BindAddresses[0] != "127.0.0.1" {
+		t.Fatalf("BindAddresses retreived is <%v>", dsc.BindAddresses)
+	}
+
+	// Multiple bind addresses
+	msc := DiameterServerConfig{BindAddresses: []string{"127.0.0.1", "::1", "127.0.0.1"}}
+	if err := msc.initialize(); err != nil {
+		t.Fatalf("error initializing server configuration %s", err)
+	}
+	if msc.BindAddress != "127.0.0.1" {
+		t.Fatalf("BindAddress is <%s>", msc.BindAddress)
+	}
+	hostIPAddresses := msc.HostIPAddresses()
+	if len(hostIPAddresses) != 2 || !hostIPAddresses[1].Equal(net.ParseIP("::1")) {
+		t.Fatalf("Host IP addresses are %v", hostIPAddresses)
+	}
+	wsc := DiameterServerConfig{BindAddress: "0.0.0.0"}
+	wsc.initialize()
+	for _, ipAddress := range wsc.HostIPAddresses() {
+		if ipAddress.To4() == nil || ipAddress.IsLoopback() {
+			t.Fatalf("got bad Host IP address %s for 0.0.0.0", ipAddress)
+		}
+	}
+	bsc := DiameterServerConfig{BindAddresses: []string{"localhost"}}
+	if err := bsc.initialize(); err == nil {
+		t.Fatal("bad bind address was accepted")
+	}
 
 	// Diameter Peers configuration
 	dp := GetPolicyConfig().DiameterPeers()
@@ -87,6 +131,9 @@ func TestDiamConfig(t *testing.T) {
 	if peer.DiameterHost != "client.igorclient" || peer.ConnectionPolicy != "passive" {
 		t.Fatal("Found peer is not conforming to expected attributes", peer)
 	}
+	if len(peer.IPAddresses) != 1 || peer.IPAddresses[0] != "127.0.0.1" {
+		t.Fatalf("IPAddresses for client.igorclient are %v", peer.IPAddresses)
+	}
 
 	// Routing rules configuration
 	// Find the rule {"realm": "igorsuperserver", "applicationId": "*", "peers": ["superserver.igorsuperserver"], "policy": "fixed"}
@@ -117,6 +164,31 @@ func TestRadiusConfig(t *testing.T) {
 	if dsc.OriginPorts[1] != 9001 {
 		t.Fatalf("Origin port 9001 not found")
 	}
+	if len(dsc.BindAddresses) != 1 || dsc.BindAddresses[0] != "0.0.0.0" || len(dsc.AuthBindAddresses) != 1 {
+		t.Fatalf("bind addresses were %v, auth bind addresses were %v", dsc.BindAddresses, dsc.AuthBindAddresses)
+	}
+	if len(dsc.CoABindAddresses) != 2 || dsc.CoABindAddresses[1] != "::1" {
+		t.Fatalf("CoA bind addresses were %v", dsc.CoABindAddresses)
+	}
+	// Wildcard bind address, so no origin address
+	if dsc.OriginAddress != "" {
+		t.Fatalf("origin address was <%s>", dsc.OriginAddress)
+	}
+
+	// Ports without bind address listen in all the addresses
+	rsc := RadiusServerConfig{AuthPort: 1812}
+	if err := rsc.initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if rsc.BindAddress != "::" || len(rsc.AuthBindAddresses) != 1 || rsc.AuthBindAddresses[0] != "::" {
+		t.Fatalf("bad default bind addresses %s %v", rsc.BindAddress, rsc.AuthBindAddresses)
+	}
+
+	// RadSec requires a CA
+	rsc = RadiusServerConfig{BindAddress: "127.0.0.1", RadSecPort: 2083}
+	if err := rsc.initialize(); err == nil {
+		t.Fatal("RadSec configuration without CA was accepted")
+	}
 
 	// Radius Clients configuration
 	rc := GetPolicyConfig().RadiusClients()
@@ -139,6 +211,27 @@ func TestRadiusConfig(t *testing.T) {
 		t.Fatalf("Radius client 1.2.3.4 not found")
 	}
 
+	// Find IPv6 radius client
+	ipv6Client, err := rc.FindRadiusClient(net.ParseIP("::1"))
+	if err != nil {
+		t.Fatalf("Radius client ::1 not found")
+	}
+	if ipv6Client.OriginIP != "::1/128" {
+		t.Fatalf("origin IP of IPv6 client was %s", ipv6Client.OriginIP)
+	}
+
+	// Find radius client by certificate
+	radSecClient, err := rc.FindRadiusClientByCertificate(&x509.Certificate{DNSNames: []string{"other.example.com", "radsec.example.com"}})
+	if err != nil {
+		t.Fatalf("Radius client for radsec.example.com not found")
+	}
+	if radSecClient.Name != "radsec_client" {
+		t.Fatalf("Radius client for radsec.example.com was %s", radSecClient.Name)
+	}
+	if _, err := rc.FindRadiusClientByCertificate(&x509.Certificate{Subject: pkix.Name{CommonName: "unknown.example.com"}}); err == nil {
+		t.Fatalf("Radius client found for unknown certificate")
+	}
+
 	// Get Radius Servers configuration
 	rs := GetPolicyConfig().RadiusServers()
 	if rs.Servers["non-existing-server"].IPAddress != "127.0.0.2" {
@@ -150,6 +243,19 @@ func TestRadiusConfig(t *testing.T) {
 	if rs.ServerGroups["igor-superserver-group"].Policy != "random" {
 		t.Fatalf("igor-supserserver server group has not policy random")
 	}
+	if rs.ServerGroups["igor-superserver-group"].OriginAddress != "127.0.0.1" {
+		t.Fatalf("igor-supserserver server group has origin address %s", rs.ServerGroups["igor-superserver-group"].OriginAddress)
+	}
+	if rs.Servers["igor-superserver"].Transport != RadiusTransportUDP {
+		t.Fatalf("igor-superserver has transport %s", rs.Servers["igor-superserver"].Transport)
+	}
+	radSecServer := rs.Servers["radsec-server"]
+	if radSecServer.Secret != RADSEC_SECRET {
+		t.Fatalf("radsec-server has secret %s", radSecServer.Secret)
+	}
+	if radSecServer.AuthPort != RADSEC_DEFAULT_PORT || radSecServer.AcctPort != 12083 {
+		t.Fatalf("radsec-server has ports %d and %d", radSecServer.AuthPort, radSecServer.AcctPort)
+	}
 
 	// Get Radius handlers configuration
 	rh := GetPolicyConfig().RadiusHttpHandlers()
@@ -158,6 +264,70 @@ func TestRadiusConfig(t *testing.T) {
 	}
 }
 
+func TestRadiusRoutesConfig(t *testing.T) {
+	rr := GetPolicyConfig().RadiusRoutingRules()
+
+	// Suffix realm, stripped, with accounting handled locally
+	rule, userName, err := rr.FindRadiusRoutingRule("user@IgorSuperServer.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userName != "user" {
+		t.Errorf("realm not stripped: %s", userName)
+	}
+	if rule.ServerGroupFor(ACCESS_REQUEST) != "igor-superserver-group" || rule.ServerGroupFor(ACCOUNTING_REQUEST) != "" {
+		t.Errorf("bad server groups for rule %v", rule)
+	}
+	if rule.PerRequestTimeoutMillis != 500 || rule.Tries != 2 {
+		t.Errorf("bad proxy parameters for rule %v", rule)
+	}
+
+	// Prefix realm, not stripped, with only CoA proxied
+	rule, userName, _ = rr.FindRadiusRoutingRule("prefixed/user@other.com")
+	if rule.Realm != "PREFIXED" || userName != "prefixed/user@other.com" {
+		t.Errorf("bad rule for prefixed realm %v, user name %s", rule, userName)
+	}
+	if rule.ServerGroupFor(DISCONNECT_REQUEST) != "igor-superserver-group" || rule.ServerGroupFor(ACCESS_REQUEST) != "" {
+		t.Errorf("bad server groups for rule %v", rule)
+	}
+
+	// No realm
+	if rule, _, _ = rr.FindRadiusRoutingRule("user"); rule.ServerGroupFor(ACCESS_REQUEST) != "igor-superserver-group" {
+		t.Errorf("bad rule for user without realm %v", rule)
+	}
+
+	// Default
+	if rule, _, _ = rr.FindRadiusRoutingRule("user@other.com"); rule.Realm != "*" {
+		t.Errorf("bad default rule %v", rule)
+	}
+
+	// Bad realm type
+	if err := (RadiusRoutingRules{{Realm: "*", RealmType: "infix"}}).initialize(); err == nil {
+		t.Errorf("bad realm type accepted")
+	}
+
+	// Rules may be used while being updated. To be run with -race
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			if err := GetPolicyConfig().UpdateRadiusRoutingRules(); err != nil {
+				t.Errorf("could not update radius routing rules: %s", err)
+			}
+		}
+		close(done)
+	}()
+	for updating := true; updating; {
+		select {
+		case <-done:
+			updating = false
+		default:
+			if len(GetPolicyConfig().RadiusRoutingRules()) == 0 {
+				t.Fatal("no radius routing rules while updating")
+			}
+		}
+	}
+}
+
 func TestHttpHandlerConfig(t *testing.T) {
 	hc := GetHttpHandlerConfig().HttpHandlerConf()
 	if hc.BindAddress != "0.0.0.0" {
@@ -7,6 +7,7 @@ import (
 	"net"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -1095,3 +1096,251 @@ func TestCheckDiameterMessage(t *testing.T) {
 		t.Error("undetected duplicate Session-Id")
 	}
 }
+
+func TestDiameterLazyDecoding(t *testing.T) {
+
+	messageBytes := buildBenchmarkDiameterMessage()
+
+	var dm DiameterMessage
+	if _, err := dm.ReadFrom(bytes.NewReader(messageBytes)); err != nil {
+		t.Fatalf("could not read diameter message: %s", err)
+	}
+
+	// Values are not decoded until accessed
+	for i := range dm.AVPs {
+		if dm.AVPs[i].Value != nil {
+			t.Errorf("%s was decoded before being accessed", dm.AVPs[i].Name)
+		}
+	}
+
+	// Untouched message is written back with the same bytes
+	if rewritten, err := dm.MarshalBinary(); err != nil {
+		t.Fatalf("could not serialize diameter message: %s", err)
+	} else if !bytes.Equal(rewritten, messageBytes) {
+		t.Errorf("untouched message was not serialized as received")
+	}
+
+	// Access some values, concurrently. Accessing the values does not modify the message
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if dm.GetStringAVP("Destination-Realm") != "igorserver" {
+				t.Errorf("bad Destination-Realm %s", dm.GetStringAVP("Destination-Realm"))
+			}
+			if dm.GetIntAVP("Multiple-Services-Credit-Control.Used-Service-Unit.CC-Total-Octets") != 1000000 {
+				t.Errorf("bad CC-Total-Octets %d", dm.GetIntAVP("Multiple-Services-Credit-Control.Used-Service-Unit.CC-Total-Octets"))
+			}
+			if rewritten, err := dm.MarshalBinary(); err != nil {
+				t.Errorf("could not serialize diameter message: %s", err)
+			} else if !bytes.Equal(rewritten, messageBytes) {
+				t.Errorf("message with accessed values was not serialized as received")
+			}
+		}()
+	}
+	wg.Wait()
+	for i := range dm.AVPs {
+		if dm.AVPs[i].Value != nil {
+			t.Errorf("%s was modified when accessed", dm.AVPs[i].Name)
+		}
+	}
+
+	// Modify a grouped attribute
+	dm.AVPs[len(dm.AVPs)-1].AddAVP(BuildDiameterAVP("Service-Identifier", 1))
+	rewritten, err := dm.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not serialize diameter message: %s", err)
+	}
+	if len(rewritten) != len(messageBytes)+12 {
+		t.Errorf("modified message has size %d instead of %d", len(rewritten), len(messageBytes)+12)
+	}
+	recovered, _, err := NewDiameterMessageFromBytes(rewritten)
+	if err != nil {
+		t.Fatalf("could not read modified diameter message: %s", err)
+	}
+	msccs := recovered.GetAllAVP("Multiple-Services-Credit-Control")
+	if si, err := msccs[len(msccs)-1].GetAVP("Service-Identifier"); err != nil || si.GetInt() != 1 {
+		t.Errorf("added Service-Identifier not found")
+	}
+
+	// Truncated message
+	if _, _, err := NewDiameterMessageFromBytes(messageBytes[:len(messageBytes)-10]); err == nil {
+		t.Errorf("truncated message did not generate an error")
+	}
+
+	// Bad size of fixed length attribute (CC-Request-Type with 5 bytes)
+	badAVP := []byte{0, 0, 1, 160, 0x40, 0, 0, 13, 0, 0, 0, 1, 0, 0, 0, 0}
+	if _, _, err := DiameterAVPFromBytes(badAVP); err == nil {
+		t.Errorf("bad size of enumerated attribute did not generate an error")
+	}
+
+	// Bad inner attribute is reported when the grouped value is decoded (Used-Service-Unit with CC-Time of 5 bytes)
+	badGroupedAVP := []byte{0, 0, 1, 190, 0x40, 0, 0, 24, 0, 0, 1, 164, 0x40, 0, 0, 13, 0, 0, 0, 1, 0, 0, 0, 0}
+	if avp, _, err := DiameterAVPFromBytes(badGroupedAVP); err != nil {
+		t.Errorf("bad inner attribute generated an error when reading the header: %s", err)
+	} else if err := avp.Check(); err == nil {
+		t.Errorf("bad inner attribute did not generate an error")
+	}
+}
+
+func TestBigDiameterMessage(t *testing.T) {
+
+	// Use a length that does not fit in 16 bits
+	request, _ := NewDiameterRequest("TestApplication", "TestRequest")
+	request.Add("Session-Id", "big-session")
+	request.Add("Igor-myOctetString", make([]byte, 70000))
+
+	messageBytes, err := request.MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not serialize diameter message: %s", err)
+	}
+	if messageLength := int(messageBytes[1])<<16 | int(messageBytes[2])<<8 | int(messageBytes[3]); messageLength != len(messageBytes) {
+		t.Errorf("bad message length %d for %d bytes", messageLength, len(messageBytes))
+	}
+
+	recovered, n, err := NewDiameterMessageFromBytes(messageBytes)
+	if err != nil {
+		t.Fatalf("could not read big diameter message: %s", err)
+	}
+	if int(n) != len(messageBytes) {
+		t.Errorf("read %d bytes instead of %d", n, len(messageBytes))
+	}
+	avp, _ := recovered.GetAVP("Igor-myOctetString")
+	if len(avp.GetOctets()) != 70000 {
+		t.Errorf("bad size of recovered octets attribute: %d", len(avp.GetOctets()))
+	}
+}
+
+// Builds a Credit-Control request with multiple grouped attributes, similar to what a relay would handle
+func buildBenchmarkDiameterMessage() []byte {
+	ccr, _ := NewDiameterRequest("Credit-Control", "Credit-Control")
+	ccr.Add("Session-Id", "igor.server;1234567890;1")
+	ccr.Add("Origin-Host", "client.igorclient")
+	ccr.Add("Origin-Realm", "igorclient")
+	ccr.Add("Destination-Realm", "igorserver")
+	ccr.Add("Auth-Application-Id", 4)
+	ccr.Add("Service-Context-Id", "32251@3gpp.org")
+	ccr.Add("CC-Request-Type", "Update")
+	ccr.Add("CC-Request-Number", 1)
+	ccr.Add("Event-Timestamp", time.Now())
+	for i := 0; i < 10; i++ {
+		mscc, _ := NewDiameterAVP("Multiple-Services-Credit-Control", nil)
+		usu, _ := NewDiameterAVP("Used-Service-Unit", nil)
+		usu.AddAVPs(
+			BuildDiameterAVP("CC-Time", 3600),
+			BuildDiameterAVP("CC-Total-Octets", 1000000+i),
+			BuildDiameterAVP("CC-Input-Octets", 400000+i),
+			BuildDiameterAVP("CC-Output-Octets", 600000),
+		)
+		rsu, _ := NewDiameterAVP("Requested-Service-Unit", nil)
+		rsu.AddAVP(BuildDiameterAVP("CC-Time", 3600))
+		mscc.AddAVPs(usu, rsu, BuildDiameterAVP("Rating-Group", 100+i))
+		ccr.AddAVP(mscc)
+	}
+
+	messageBytes, err := ccr.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return messageBytes
+}
+
+// Sets the values of all the AVPs, including the inner ones, as they would be if decoded eagerly
+// when the message is read, to compare with lazy decoding
+func setDiameterValues(avps []DiameterAVP) {
+	for i := range avps {
+		avps[i].Value = avps[i].value()
+		if groupedValue, ok := avps[i].Value.([]DiameterAVP); ok {
+			setDiameterValues(groupedValue)
+		}
+	}
+}
+
+// Reads the message, decoding all the values eagerly if so specified
+func readBenchmarkDiameterMessage(b *testing.B, messageBytes []byte, eager bool) *DiameterMessage {
+	var dm DiameterMessage
+	if _, err := dm.ReadFrom(bytes.NewReader(messageBytes)); err != nil {
+		b.Fatal(err)
+	}
+	if eager {
+		setDiameterValues(dm.AVPs)
+	}
+	return &dm
+}
+
+// Runs the benchmark with lazy and eager decoding
+func benchmarkDiameterDecoding(b *testing.B, f func(b *testing.B, eager bool)) {
+	b.Run("Lazy", func(b *testing.B) { f(b, false) })
+	b.Run("Eager", func(b *testing.B) { f(b, true) })
+}
+
+// Decoding only
+func BenchmarkDiameterMessageDecode(b *testing.B) {
+	messageBytes := buildBenchmarkDiameterMessage()
+
+	benchmarkDiameterDecoding(b, func(b *testing.B, eager bool) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			readBenchmarkDiameterMessage(b, messageBytes, eager)
+		}
+	})
+}
+
+// Decoding, accessing the attributes used for routing and encoding again, as a relay would do
+func BenchmarkDiameterMessageRelay(b *testing.B) {
+	messageBytes := buildBenchmarkDiameterMessage()
+	var out bytes.Buffer
+
+	benchmarkDiameterDecoding(b, func(b *testing.B, eager bool) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dm := readBenchmarkDiameterMessage(b, messageBytes, eager)
+			if dm.GetStringAVP("Destination-Realm") != "igorserver" {
+				b.Fatal("bad Destination-Realm")
+			}
+			dm.GetStringAVP("Session-Id")
+			out.Reset()
+			if _, err := dm.WriteTo(&out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// Decoding and accessing all the values
+func BenchmarkDiameterMessageDecodeAll(b *testing.B) {
+	messageBytes := buildBenchmarkDiameterMessage()
+
+	benchmarkDiameterDecoding(b, func(b *testing.B, eager bool) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dm := readBenchmarkDiameterMessage(b, messageBytes, eager)
+			for _, mscc := range dm.GetAllAVP("Multiple-Services-Credit-Control") {
+				usu, _ := mscc.GetAVP("Used-Service-Unit")
+				if usu.GetAllAVP("CC-Total-Octets")[0].GetInt() < 1000000 {
+					b.Fatal("bad CC-Total-Octets")
+				}
+			}
+		}
+	})
+}
+
+// Encoding only. Untouched AVPs are written with the bytes received, and decoded AVPs are
+// encoded from their values
+func BenchmarkDiameterMessageEncode(b *testing.B) {
+	messageBytes := buildBenchmarkDiameterMessage()
+	var out bytes.Buffer
+
+	benchmarkDiameterDecoding(b, func(b *testing.B, eager bool) {
+		dm := readBenchmarkDiameterMessage(b, messageBytes, eager)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			out.Reset()
+			if _, err := dm.WriteTo(&out); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -148,61 +148,383 @@ func (dd *DiameterDict) GetCommand(appId uint32, commandCode uint32) (*DiameterC
 	}
 }
 
-// Returns a Diameter Dictionary object from its serialized representation
+// Returns a Diameter Dictionary object from its serialized representation.
+// Include directives are not resolved here, since there is no ConfigurationManager
+// to retrieve them from. Use Merge to add other modules.
+// Panics if the dictionary is not valid. Use ParseDiameterDictionaryJSON to get an error instead
 func NewDiameterDictionaryFromJSON(data []byte) *DiameterDict {
+	dict, err := ParseDiameterDictionaryJSON(data)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return dict
+}
+
+// Same as NewDiameterDictionaryFromJSON, but reports an invalid dictionary, for instance one using
+// vendors not declared in it, as an error
+func ParseDiameterDictionaryJSON(data []byte) (*DiameterDict, error) {
 
 	// Unmarshall from JSON
 	var jDict jDiameterDict
 	if err := json.Unmarshal(data, &jDict); err != nil {
-		panic("bad diameter dictionary format " + err.Error())
+		return nil, fmt.Errorf("bad diameter dictionary format: %w", err)
+	}
+
+	dict, err := newDiameterDictionaryFromJDict(&jDict, nil)
+	if err != nil {
+		return nil, fmt.Errorf("bad diameter dictionary: %w", err)
+	}
+
+	return dict, nil
+}
+
+// Reads the Diameter Dictionary object with the specified name, resolving recursively the
+// modules specified in the "includes" property, which are also configuration objects. The
+// included modules are merged before the contents of the including object. A conflict (same code
+// with different name or type) between modules is reported as an error
+func NewDiameterDictionaryFromConfig(cm *ConfigurationManager, objectName string) (*DiameterDict, error) {
+
+	// Retrieve all the modules, in the order in which they have to be merged
+	var modules []jDiameterDictModule
+	if err := readDiameterDictModules(cm, objectName, make(map[string]bool), &modules); err != nil {
+		return nil, err
+	}
+
+	// The vendors may be declared in any of the modules, and used in others
+	vendors := newDiameterDict()
+	for _, module := range modules {
+		for _, v := range module.dict.Vendors {
+			if err := vendors.addVendor(v.VendorId, v.VendorName); err != nil {
+				return nil, fmt.Errorf("%s: %w", module.name, err)
+			}
+		}
+	}
+
+	dict := newDiameterDict()
+	for _, module := range modules {
+		moduleDict, err := newDiameterDictionaryFromJDict(&module.dict, vendors.VendorById)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", module.name, err)
+		}
+		if err := dict.Merge(moduleDict); err != nil {
+			return nil, fmt.Errorf("%s: %w", module.name, err)
+		}
+	}
+
+	return dict, nil
+}
+
+// Retrieves the specified dictionary object and the ones included, recursively, appending them to the
+// modules slice so that the included ones come first. The visited map is used to detect include cycles
+// and to skip modules already read through another path
+func readDiameterDictModules(cm *ConfigurationManager, objectName string, visited map[string]bool, modules *[]jDiameterDictModule) error {
+
+	if done, found := visited[objectName]; found {
+		if !done {
+			return fmt.Errorf("include cycle detected in diameter dictionary %s", objectName)
+		}
+		return nil
+	}
+	visited[objectName] = false
+
+	dictJSON, err := cm.GetBytesConfigObject(objectName)
+	if err != nil {
+		return fmt.Errorf("could not read diameter dictionary %s: %w", objectName, err)
+	}
+
+	var jDict jDiameterDict
+	if err := json.Unmarshal(dictJSON, &jDict); err != nil {
+		return fmt.Errorf("bad diameter dictionary format in %s: %w", objectName, err)
 	}
 
-	// Build the dictionary
-	var dict DiameterDict
+	for _, include := range jDict.Includes {
+		if err := readDiameterDictModules(cm, include, visited, modules); err != nil {
+			return err
+		}
+	}
+
+	visited[objectName] = true
+	*modules = append(*modules, jDiameterDictModule{name: objectName, dict: jDict})
+
+	return nil
+}
+
+// Builds a dictionary from the unserialized JSON object. The names of the vendors are taken
+// from the object itself and from the knownVendors map, if not nil, which may contain vendors
+// declared in other modules
+func newDiameterDictionaryFromJDict(jDict *jDiameterDict, knownVendors map[uint32]string) (*DiameterDict, error) {
+
+	dict := newDiameterDict()
 
 	// Build the vendor maps
-	dict.VendorById = make(map[uint32]string)
-	dict.VendorByName = make(map[string]uint32)
 	for _, v := range jDict.Vendors {
-		dict.VendorById[v.VendorId] = v.VendorName
-		dict.VendorByName[v.VendorName] = v.VendorId
+		if err := dict.addVendor(v.VendorId, v.VendorName); err != nil {
+			return nil, err
+		}
 	}
 
 	// Build the AVP maps
-	dict.AVPByCode = make(map[DiameterAVPCode]*DiameterAVPDictItem)
-	dict.AVPByName = make(map[string]*DiameterAVPDictItem)
 	for _, vendorAVPs := range jDict.Avps {
 		vendorId := vendorAVPs.VendorId
-		vendorName := dict.VendorById[vendorId]
+		vendorName, found := dict.VendorById[vendorId]
+		if !found && vendorId != 0 {
+			if vendorName, found = knownVendors[vendorId]; !found {
+				return nil, fmt.Errorf("vendor %d not declared", vendorId)
+			}
+		}
 
 		// Map all atttributtes from this vendor
 		for _, attr := range vendorAVPs.Attributes {
-			avpDictItem := attr.toAVPDictItem(vendorId, vendorName)
-			dict.AVPByCode[DiameterAVPCode{vendorId, attr.Code}] = &avpDictItem
-			dict.AVPByName[avpDictItem.Name] = &avpDictItem
+			avpDictItem, err := attr.toAVPDictItem(vendorId, vendorName)
+			if err != nil {
+				return nil, err
+			}
+			if err := dict.addAVP(&avpDictItem); err != nil {
+				return nil, err
+			}
 		}
 	}
 
 	// Build the applications map
-	dict.AppByCode = make(map[uint32]*DiameterApplication)
-	dict.AppByName = make(map[string]*DiameterApplication)
 	for i := range jDict.Applications {
-		// Fill the Applications map
-		// Do not use the value in the range. Copy the pointer as done here!
-		app := &jDict.Applications[i]
-		dict.AppByCode[app.Code] = app
-		dict.AppByName[app.Name] = app
-
-		// Fill the commands map for the application
-		app.CommandByCode = make(map[uint32]*DiameterCommand)
-		app.CommandByName = make(map[string]*DiameterCommand)
-		for j, command := range app.Commands {
-			app.CommandByCode[command.Code] = &app.Commands[j]
-			app.CommandByName[command.Name] = &app.Commands[j]
+		if err := dict.addApplication(&jDict.Applications[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	return dict, nil
+}
+
+// Creates a dictionary with the maps initialized
+func newDiameterDict() *DiameterDict {
+	return &DiameterDict{
+		VendorById:   make(map[uint32]string),
+		VendorByName: make(map[string]uint32),
+		AVPByCode:    make(map[DiameterAVPCode]*DiameterAVPDictItem),
+		AVPByName:    make(map[string]*DiameterAVPDictItem),
+		AppByCode:    make(map[uint32]*DiameterApplication),
+		AppByName:    make(map[string]*DiameterApplication),
+	}
+}
+
+// Adds the contents of the other dictionary to this one. Vendors, AVPs and Applications not yet
+// present are added. If already present, enumerated values, grouped AVP members and commands are merged.
+// It is an error to have the same vendor, AVP, application or command code with a different name or
+// type, and in that case the dictionary is not modified.
+// Intended to be used at startup to register additional applications. Not safe to use while the
+// dictionary is being used by other goroutines
+func (dd *DiameterDict) Merge(other *DiameterDict) error {
+
+	// Check first, so that the dictionary is not left half merged
+	if err := dd.checkMerge(other); err != nil {
+		return err
+	}
+
+	for vendorId, vendorName := range other.VendorById {
+		dd.addVendor(vendorId, vendorName)
+	}
+	for _, avp := range other.AVPByCode {
+		dd.addAVP(avp)
+	}
+	for _, app := range other.AppByCode {
+		dd.addApplication(app)
+	}
+
+	return nil
+}
+
+// Verifies that the other dictionary does not have conflicting definitions
+func (dd *DiameterDict) checkMerge(other *DiameterDict) error {
+
+	for vendorId, vendorName := range other.VendorById {
+		if err := dd.checkVendor(vendorId, vendorName); err != nil {
+			return err
+		}
+	}
+
+	for _, avp := range other.AVPByCode {
+		if err := dd.checkAVP(avp); err != nil {
+			return err
 		}
 	}
 
-	return &dict
+	for _, app := range other.AppByCode {
+		if err := dd.checkApplication(app); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns an error if the vendor id or name is already defined with a different name or id
+func (dd *DiameterDict) checkVendor(vendorId uint32, vendorName string) error {
+	if name, found := dd.VendorById[vendorId]; found && name != vendorName {
+		return fmt.Errorf("vendor %d defined as %s and %s", vendorId, name, vendorName)
+	}
+	if id, found := dd.VendorByName[vendorName]; found && id != vendorId {
+		return fmt.Errorf("vendor %s defined with ids %d and %d", vendorName, id, vendorId)
+	}
+	return nil
+}
+
+// Adds the vendor to the dictionary, if not conflicting with an existing one
+func (dd *DiameterDict) addVendor(vendorId uint32, vendorName string) error {
+	if err := dd.checkVendor(vendorId, vendorName); err != nil {
+		return err
+	}
+	dd.VendorById[vendorId] = vendorName
+	dd.VendorByName[vendorName] = vendorId
+	return nil
+}
+
+// Returns an error if the AVP code or name is already defined with different attributes
+func (dd *DiameterDict) checkAVP(avp *DiameterAVPDictItem) error {
+	code := DiameterAVPCode{avp.VendorId, avp.Code}
+	if existing, found := dd.AVPByCode[code]; found {
+		if existing.Name != avp.Name || existing.DiameterType != avp.DiameterType {
+			return fmt.Errorf("AVP %v defined as %s (%s) and %s (%s)", code,
+				existing.Name, diameterTypeName(existing.DiameterType), avp.Name, diameterTypeName(avp.DiameterType))
+		}
+		for enumName, enumValue := range avp.EnumValues {
+			if existingValue, found := existing.EnumValues[enumName]; found && existingValue != enumValue {
+				return fmt.Errorf("AVP %s has enumerated value %s defined as %d and %d", avp.Name, enumName, existingValue, enumValue)
+			}
+		}
+		for enumValue, enumName := range avp.EnumCodes {
+			if existingName, found := existing.EnumCodes[enumValue]; found && existingName != enumName {
+				return fmt.Errorf("AVP %s has enumerated value %d defined as %s and %s", avp.Name, enumValue, existingName, enumName)
+			}
+		}
+	}
+	if existing, found := dd.AVPByName[avp.Name]; found {
+		if existing.VendorId != avp.VendorId || existing.Code != avp.Code {
+			return fmt.Errorf("AVP %s defined with codes %v and %v", avp.Name,
+				DiameterAVPCode{existing.VendorId, existing.Code}, DiameterAVPCode{avp.VendorId, avp.Code})
+		}
+	}
+	return nil
+}
+
+// Adds the AVP to the dictionary, if not conflicting with an existing one. If already
+// present, the enumerated values and group members are merged in a new item
+func (dd *DiameterDict) addAVP(avp *DiameterAVPDictItem) error {
+	if err := dd.checkAVP(avp); err != nil {
+		return err
+	}
+
+	code := DiameterAVPCode{avp.VendorId, avp.Code}
+	item := *avp
+	if existing, found := dd.AVPByCode[code]; found {
+		item = *existing
+		if avp.EnumValues != nil {
+			item.EnumValues = make(map[string]int)
+			item.EnumCodes = make(map[int]string)
+			for _, values := range []map[string]int{existing.EnumValues, avp.EnumValues} {
+				for enumName, enumValue := range values {
+					item.EnumValues[enumName] = enumValue
+					item.EnumCodes[enumValue] = enumName
+				}
+			}
+		}
+		if avp.Group != nil {
+			item.Group = make(map[string]GroupedProperties)
+			for _, group := range []map[string]GroupedProperties{existing.Group, avp.Group} {
+				for memberName, props := range group {
+					item.Group[memberName] = props
+				}
+			}
+		}
+	}
+
+	dd.AVPByCode[code] = &item
+	dd.AVPByName[item.Name] = &item
+	return nil
+}
+
+// Returns an error if the application or any of its commands are already defined with
+// a different name or code
+func (dd *DiameterDict) checkApplication(app *DiameterApplication) error {
+	if existing, found := dd.AppByCode[app.Code]; found {
+		if existing.Name != app.Name {
+			return fmt.Errorf("application %d defined as %s and %s", app.Code, existing.Name, app.Name)
+		}
+		for _, command := range app.Commands {
+			if existingCommand, found := existing.CommandByCode[command.Code]; found && existingCommand.Name != command.Name {
+				return fmt.Errorf("command %d in application %s defined as %s and %s", command.Code, app.Name, existingCommand.Name, command.Name)
+			}
+			if existingCommand, found := existing.CommandByName[command.Name]; found && existingCommand.Code != command.Code {
+				return fmt.Errorf("command %s in application %s defined with codes %d and %d", command.Name, app.Name, existingCommand.Code, command.Code)
+			}
+		}
+	}
+	if existing, found := dd.AppByName[app.Name]; found && existing.Code != app.Code {
+		return fmt.Errorf("application %s defined with codes %d and %d", app.Name, existing.Code, app.Code)
+	}
+	return nil
+}
+
+// Adds the application to the dictionary, if not conflicting with an existing one. If already
+// present, the commands are merged in a new application object
+func (dd *DiameterDict) addApplication(app *DiameterApplication) error {
+	if err := dd.checkApplication(app); err != nil {
+		return err
+	}
+
+	newApp := DiameterApplication{
+		Name:    app.Name,
+		Code:    app.Code,
+		AppType: app.AppType,
+	}
+
+	// Merge the commands, if the application already existed
+	var commands []DiameterCommand
+	if existing, found := dd.AppByCode[app.Code]; found {
+		commands = append(commands, existing.Commands...)
+	}
+	for _, command := range app.Commands {
+		merged := false
+		for i := range commands {
+			if commands[i].Code == command.Code {
+				commands[i].Request = mergeGroupedProperties(commands[i].Request, command.Request)
+				commands[i].Response = mergeGroupedProperties(commands[i].Response, command.Response)
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			commands = append(commands, command)
+		}
+	}
+	newApp.Commands = commands
+
+	// Fill the commands map for the application
+	// Do not use the value in the range. Copy the pointer as done here!
+	newApp.CommandByCode = make(map[uint32]*DiameterCommand)
+	newApp.CommandByName = make(map[string]*DiameterCommand)
+	for j, command := range newApp.Commands {
+		newApp.CommandByCode[command.Code] = &newApp.Commands[j]
+		newApp.CommandByName[command.Name] = &newApp.Commands[j]
+	}
+
+	dd.AppByCode[newApp.Code] = &newApp
+	dd.AppByName[newApp.Name] = &newApp
+	return nil
+}
+
+// Returns a new map with the contents of both parameters. Used to merge the definitions of commands
+func mergeGroupedProperties(a map[string]GroupedProperties, b map[string]GroupedProperties) map[string]GroupedProperties {
+	if a == nil && b == nil {
+		return nil
+	}
+	merged := make(map[string]GroupedProperties)
+	for _, props := range []map[string]GroupedProperties{a, b} {
+		for name, prop := range props {
+			merged[name] = prop
+		}
+	}
+	return merged
 }
 
 /*
@@ -224,8 +546,9 @@ type jDiameterVendorAVPs struct {
 }
 
 type jDiameterDict struct {
-	Version int
-	Vendors []struct {
+	Version  int
+	Includes []string
+	Vendors  []struct {
 		VendorId   uint32
 		VendorName string
 	}
@@ -233,51 +556,51 @@ type jDiameterDict struct {
 	Applications []DiameterApplication
 }
 
-func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) DiameterAVPDictItem {
-	var diameterType DiameterAVPType
-	switch javp.Type {
-	case "None":
-		diameterType = DiameterTypeNone
-	case "OctetString":
-		diameterType = DiameterTypeOctetString
-	case "Integer32":
-		diameterType = DiameterTypeInteger32
-	case "Integer64":
-		diameterType = DiameterTypeInteger64
-	case "Unsigned32":
-		diameterType = DiameterTypeUnsigned32
-	case "Unsigned64":
-		diameterType = DiameterTypeUnsigned64
-	case "Float32":
-		diameterType = DiameterTypeFloat32
-	case "Float64":
-		diameterType = DiameterTypeFloat64
-	case "Grouped":
-		diameterType = DiameterTypeGrouped
-	case "Address":
-		diameterType = DiameterTypeAddress
-	case "Time":
-		diameterType = DiameterTypeTime
-	case "UTF8String":
-		diameterType = DiameterTypeUTF8String
-	case "DiamIdent":
-		diameterType = DiameterTypeDiamIdent
-	case "DiameterURI":
-		diameterType = DiameterTypeDiameterURI
-	case "Enumerated":
-		diameterType = DiameterTypeEnumerated
-	case "IPFilterRule":
-		diameterType = DiameterTypeIPFilterRule
+// A dictionary module, as read from a configuration object
+type jDiameterDictModule struct {
+	name string
+	dict jDiameterDict
+}
+
+// Mapping of the type names used in the JSON dictionary
+var diameterTypes = map[string]DiameterAVPType{
+	"None":         DiameterTypeNone,
+	"OctetString":  DiameterTypeOctetString,
+	"Integer32":    DiameterTypeInteger32,
+	"Integer64":    DiameterTypeInteger64,
+	"Unsigned32":   DiameterTypeUnsigned32,
+	"Unsigned64":   DiameterTypeUnsigned64,
+	"Float32":      DiameterTypeFloat32,
+	"Float64":      DiameterTypeFloat64,
+	"Grouped":      DiameterTypeGrouped,
+	"Address":      DiameterTypeAddress,
+	"Time":         DiameterTypeTime,
+	"UTF8String":   DiameterTypeUTF8String,
+	"DiamIdent":    DiameterTypeDiamIdent,
+	"DiameterURI":  DiameterTypeDiameterURI,
+	"Enumerated":   DiameterTypeEnumerated,
+	"IPFilterRule": DiameterTypeIPFilterRule,
 
 	// Radius types
-	case "IPv4Address":
-		diameterType = DiameterTypeIPv4Address
-	case "IPv6Address":
-		diameterType = DiameterTypeIPv6Address
-	case "IPv6Prefix":
-		diameterType = DiameterTypeIPv6Prefix
-	default:
-		panic(javp.Type + " is not a valid DiameterType")
+	"IPv4Address": DiameterTypeIPv4Address,
+	"IPv6Address": DiameterTypeIPv6Address,
+	"IPv6Prefix":  DiameterTypeIPv6Prefix,
+}
+
+// Returns the name of the type, as used in the JSON dictionary. For error reporting
+func diameterTypeName(diameterType DiameterAVPType) string {
+	for name, t := range diameterTypes {
+		if t == diameterType {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", diameterType)
+}
+
+func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) (DiameterAVPDictItem, error) {
+	diameterType, found := diameterTypes[javp.Type]
+	if !found {
+		return DiameterAVPDictItem{}, fmt.Errorf("%s is not a valid DiameterType in %s", javp.Type, javp.Name)
 	}
 
 	var codes map[int]string
@@ -301,5 +624,5 @@ func (javp jDiameterAVP) toAVPDictItem(v uint32, vs string) DiameterAVPDictItem
 		EnumValues:   javp.EnumValues,
 		EnumCodes:    codes,
 		Group:        javp.Group,
-	}
+	}, nil
 }
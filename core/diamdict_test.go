@@ -0,0 +1,188 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+// An additional application, as a library user would register it
+var extraApplicationDict = `{
+	"version": 1,
+	"vendors": [{"vendorId": 1001, "vendorName": "Igor"}],
+	"avps": [
+		{
+			"vendorId": 0,
+			"attributes": [
+				{"code": 263, "name": "Session-Id", "type": "UTF8String"},
+				{"code": 416, "name": "CC-Request-Type", "type": "Enumerated", "enumValues": {"Extra-Request": 10}}
+			]
+		},
+		{
+			"vendorId": 1001,
+			"attributes": [
+				{"code": 5000, "name": "extraAttribute", "type": "UTF8String"}
+			]
+		}
+	],
+	"applications": [
+		{
+			"name": "ExtraApplication",
+			"code": 1001,
+			"appType": "auth",
+			"commands": [
+				{"name": "ExtraRequest", "code": 3000, "request": {"Session-Id": {"minOccurs": 1, "maxOccurs": 1}}, "response": {}}
+			]
+		},
+		{
+			"name": "Base",
+			"code": 0,
+			"appType": "auth",
+			"commands": [
+				{"name": "Extra-Base", "code": 3001, "request": {}, "response": {}}
+			]
+		}
+	]
+}`
+
+func TestDiameterDictModules(t *testing.T) {
+
+	dict := GetDDict()
+
+	// Applications defined in the different modules
+	for _, appName := range []string{"Base", "NASREQ", "Credit-Control", "Gx", "TestApplication"} {
+		if _, found := dict.AppByName[appName]; !found {
+			t.Errorf("application %s not found", appName)
+		}
+	}
+
+	// Attributes defined in the different modules
+	for _, avpName := range []string{"Origin-Host", "Framed-IP-Address", "Multiple-Services-Credit-Control", "3GPP-Charging-Rule-Install", "Igor-myTestAllGrouped"} {
+		if _, err := dict.GetAVPFromName(avpName); err != nil {
+			t.Errorf("attribute %s not found", avpName)
+		}
+	}
+
+	// The vendor is declared in a module and used in another one
+	if avp, _ := dict.GetAVPFromCode(DiameterAVPCode{10415, 1051}); avp.Name != "3GPP-Charging-Rule-Install" {
+		t.Errorf("attribute with code 1051 of 3GPP vendor is %s", avp.Name)
+	}
+
+	// Redirect-Server-Address has its own code, distinct from the one of Redirect-Address-Type (RFC 4006)
+	if avp, _ := dict.GetAVPFromName("Redirect-Server-Address"); avp.Code != 435 {
+		t.Errorf("Redirect-Server-Address has code %d", avp.Code)
+	}
+
+	// Undeclared vendors are reported as errors
+	undeclaredVendor := []byte(`{"avps": [{"vendorId": 9999, "attributes": [{"code": 1, "name": "Unknown-Vendor-AVP", "type": "UTF8String"}]}]}`)
+	if _, err := ParseDiameterDictionaryJSON(undeclaredVendor); err == nil {
+		t.Errorf("undeclared vendor not detected")
+	}
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Errorf("undeclared vendor did not panic")
+			}
+		}()
+		NewDiameterDictionaryFromJSON(undeclaredVendor)
+	}()
+
+	// Include cycles are detected
+	if _, err := NewDiameterDictionaryFromConfig(&GetPolicyConfig().CM, "diameterDictionaryCycle.json"); err == nil {
+		t.Errorf("include cycle not detected")
+	} else if !strings.Contains(err.Error(), "cycle") {
+		t.Errorf("unexpected error for include cycle: %s", err)
+	}
+}
+
+func TestDiameterDictMerge(t *testing.T) {
+
+	dict, err := NewDiameterDictionaryFromConfig(&GetPolicyConfig().CM, "diameterDictionary.json")
+	if err != nil {
+		t.Fatalf("could not read diameter dictionary: %s", err)
+	}
+	baseCommands := len(dict.AppByName["Base"].Commands)
+
+	extraDict := NewDiameterDictionaryFromJSON([]byte(extraApplicationDict))
+	if err := dict.Merge(extraDict); err != nil {
+		t.Fatalf("could not merge dictionary: %s", err)
+	}
+
+	// New application
+	if command, err := dict.GetCommand(1001, 3000); err != nil {
+		t.Errorf("command of merged application not found")
+	} else if command.Name != "ExtraRequest" {
+		t.Errorf("merged command name is %s", command.Name)
+	}
+	if _, err := dict.GetAVPFromName("Igor-extraAttribute"); err != nil {
+		t.Errorf("merged attribute not found")
+	}
+
+	// Commands in existing application are merged
+	if len(dict.AppByName["Base"].Commands) != baseCommands+1 {
+		t.Errorf("commands in Base application not merged")
+	}
+	if _, err := dict.GetCommand(0, 257); err != nil {
+		t.Errorf("original command of Base application not found after merge")
+	}
+
+	// Enumerated values are merged
+	avp, _ := dict.GetAVPFromName("CC-Request-Type")
+	if avp.EnumValues["Extra-Request"] != 10 || avp.EnumValues["Initial"] != 1 || avp.EnumCodes[10] != "Extra-Request" {
+		t.Errorf("enumerated values not merged: %v", avp.EnumValues)
+	}
+
+	// The global dictionary was not touched
+	if _, err := GetDDict().GetAVPFromName("Igor-extraAttribute"); err == nil {
+		t.Errorf("global dictionary was modified")
+	}
+}
+
+func TestDiameterDictMergeConflicts(t *testing.T) {
+
+	var conflicts = []string{
+		// Same code, different name
+		`{"avps": [{"vendorId": 0, "attributes": [{"code": 263, "name": "Other-Session-Id", "type": "UTF8String"}]}]}`,
+		// Same code, different type
+		`{"avps": [{"vendorId": 0, "attributes": [{"code": 263, "name": "Session-Id", "type": "OctetString"}]}]}`,
+		// Same name, different code
+		`{"avps": [{"vendorId": 0, "attributes": [{"code": 9263, "name": "Session-Id", "type": "UTF8String"}]}]}`,
+		// Same enumerated value with different code
+		`{"avps": [{"vendorId": 0, "attributes": [{"code": 416, "name": "CC-Request-Type", "type": "Enumerated", "enumValues": {"Initial": 7}}]}]}`,
+		// Same vendor id with different name
+		`{"vendors": [{"vendorId": 10415, "vendorName": "ThreeGPP"}]}`,
+		// Same application code with different name
+		`{"applications": [{"name": "NotGx", "code": 16777238, "appType": "auth"}]}`,
+		// Same command code with different name
+		`{"applications": [{"name": "Base", "code": 0, "appType": "auth", "commands": [{"name": "Other-Watchdog", "code": 280}]}]}`,
+	}
+
+	for _, conflict := range conflicts {
+		dict, err := NewDiameterDictionaryFromConfig(&GetPolicyConfig().CM, "diameterDictionary.json")
+		if err != nil {
+			t.Fatalf("could not read diameter dictionary: %s", err)
+		}
+		avpCount := len(dict.AVPByCode)
+
+		conflictDict, err := ParseDiameterDictionaryJSON([]byte(conflict))
+		if err != nil {
+			t.Fatalf("could not parse dictionary %s: %s", conflict, err)
+		}
+		if err := dict.Merge(conflictDict); err == nil {
+			t.Errorf("conflict not detected for %s", conflict)
+		}
+		if len(dict.AVPByCode) != avpCount {
+			t.Errorf("dictionary modified after conflict")
+		}
+	}
+
+	// Conflicts inside the same module are also detected
+	_, err := newDiameterDictionaryFromJDict(&jDiameterDict{
+		Avps: []jDiameterVendorAVPs{{VendorId: 0, Attributes: []jDiameterAVP{
+			{Code: 1, Name: "User-Name", Type: "UTF8String"},
+			{Code: 1, Name: "User-Name", Type: "OctetString"},
+		}}},
+	}, nil)
+	if err == nil {
+		t.Errorf("conflict inside module not detected")
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -27,6 +29,21 @@ type DiameterAVP struct {
 
 	// Dictionary item
 	DictItem *DiameterAVPDictItem
+
+	// Wire representation of the value, for AVPs read from the network. Only meaningful
+	// if Value is nil, that is, if the value has not been set. The value is decoded on
+	// access, and if never set, the AVP is written using these same bytes
+	raw *diameterRawValue
+}
+
+// Value of an AVP as received, decoded on first access. It is shared by all the copies of
+// the AVP, and it is never modified after decoding, so that the AVPs of a message may be
+// read concurrently
+type diameterRawValue struct {
+	once  sync.Once
+	bytes []byte
+	value interface{}
+	err   error
 }
 
 // AVP Header in the wire is
@@ -40,63 +57,85 @@ type DiameterAVP struct {
 // Build a DiameterAVP from a binary byte reader.
 // Returns the number of bytes read, plus padding
 func (avp *DiameterAVP) ReadFrom(reader io.Reader) (n int64, err error) {
-	var lenHigh uint8
-	var lenLow uint16
-	var avpLen uint32 // Only 24 bytes are relevant. Does not take into account 4 byte padding
-	var padLen uint32 // Length of paddding to make multiple of 4 bytes
-	var dataLen uint32
-	var flags uint8
-	var avpBytes []byte
-
-	var isVendorSpecific bool
 
-	currentIndex := int64(0)
+	// Read the fixed part of the header to get the length
+	scratch := getDiameterBuffer()
+	defer putDiameterBuffer(scratch)
+	header := (*scratch)[:8]
+	if n, err := io.ReadFull(reader, header); err != nil {
+		return int64(n), err
+	}
 
-	// Get Header
-	if err := binary.Read(reader, binary.BigEndian, &avp.Code); err != nil {
-		return 0, err
+	avpLen, err := diameterAVPLen(header)
+	if err != nil {
+		return 8, err
 	}
-	currentIndex += 4
 
-	// Get Flags
-	if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
-		return currentIndex, err
+	// The AVP keeps a reference to this buffer, used for lazy decoding
+	avpBytes := make([]byte, avpLen)
+	copy(avpBytes, header)
+	if n, err := io.ReadFull(reader, avpBytes[8:]); err != nil {
+		return int64(8 + n), err
 	}
-	isVendorSpecific = flags&0x80 != 0
-	avp.IsMandatory = flags&0x40 != 0
-	avp.IsProtected = flags&0x20 != 0
-	currentIndex += 1
 
-	// Get Len
-	if err := binary.Read(reader, binary.BigEndian, &lenHigh); err != nil {
-		return currentIndex, err
+	if _, err := avp.decodeHeader(avpBytes, new(diameterRawValue)); err != nil {
+		return int64(avpLen), err
 	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &lenLow); err != nil {
-		return currentIndex, err
+
+	return int64(avpLen), nil
+}
+
+// Returns the length of the AVP whose bytes start in the data passed as parameter, including padding.
+// Only the fixed part of the header, 8 bytes, is required
+func diameterAVPLen(data []byte) (int, error) {
+	if len(data) < 8 {
+		return 0, fmt.Errorf("diameter avp too short: %d bytes", len(data))
 	}
-	currentIndex += 2
 
 	// The Len field contains the full size of the AVP, but not considering the padding
+	avpLen := int(data[5])<<16 | int(data[6])<<8 | int(data[7])
+	isVendorSpecific := data[4]&0x80 != 0
+	if avpLen < 8 || (isVendorSpecific && avpLen < 12) {
+		return 0, fmt.Errorf("bad diameter avp length %d", avpLen)
+	}
+
 	// Pad until the total length is a multiple of 4
-	avpLen = uint32(lenHigh)*65535 + uint32(lenLow)
-	if avpLen%4 == 0 {
-		padLen = 0
-	} else {
-		padLen = 4 - (avpLen % 4)
+	return (avpLen + 3) &^ 3, nil
+}
+
+// Fills the header fields of the AVP from the bytes passed as parameter, and keeps a reference to
+// the bytes of the value in the raw value passed as parameter, to be decoded later. Returns the number
+// of bytes consumed, including padding. The size of the values of fixed length types is validated here,
+// so that decoding them later cannot fail
+func (avp *DiameterAVP) decodeHeader(data []byte, raw *diameterRawValue) (int, error) {
+
+	paddedLen, err := diameterAVPLen(data)
+	if err != nil {
+		return 0, err
 	}
+	if paddedLen > len(data) {
+		// Padding may be missing in the last AVP of a group
+		if avpLen := int(data[5])<<16 | int(data[6])<<8 | int(data[7]); avpLen > len(data) {
+			return 0, fmt.Errorf("diameter avp length %d exceeds available %d bytes", avpLen, len(data))
+		}
+		paddedLen = len(data)
+	}
+	avpLen := int(data[5])<<16 | int(data[6])<<8 | int(data[7])
+
+	avp.Code = binary.BigEndian.Uint32(data[0:4])
+	flags := data[4]
+	avp.IsMandatory = flags&0x40 != 0
+	avp.IsProtected = flags&0x20 != 0
 
-	// Get VendorId and data length.
+	// Get VendorId and data.
 	// The size of the data is the size of the AVP minus size of the the headers, which is
 	// different depending on whether the attribute is vendor specific or not.
-	if isVendorSpecific {
-		if err := binary.Read(reader, binary.BigEndian, &avp.VendorId); err != nil {
-			return currentIndex, err
-		}
-		currentIndex += 4
-		dataLen = avpLen - 12
+	dataStart := 8
+	if flags&0x80 != 0 {
+		avp.VendorId = binary.BigEndian.Uint32(data[8:12])
+		dataStart = 12
 	} else {
-		dataLen = avpLen - 8
+		avp.VendorId = 0
 	}
 
 	// Get the relevant info from the dictionary
@@ -104,185 +143,187 @@ func (avp *DiameterAVP) ReadFrom(reader io.Reader) (n int64, err error) {
 	avp.DictItem, _ = GetDDict().GetAVPFromCode(DiameterAVPCode{VendorId: avp.VendorId, Code: avp.Code})
 	avp.Name = avp.DictItem.Name
 
-	// Parse according to type
+	// Full slice expression, so that appending to the value never overwrites the next AVP
+	value := data[dataStart:avpLen:avpLen]
+	raw.bytes = value
+	avp.raw = raw
+	avp.Value = nil
+
+	// Sanity check of the size of fixed length types
+	expectedLen := -1
 	switch avp.DictItem.DiameterType {
+	case DiameterTypeInteger32, DiameterTypeUnsigned32, DiameterTypeFloat32, DiameterTypeTime, DiameterTypeEnumerated, DiameterTypeIPv4Address:
+		expectedLen = 4
+	case DiameterTypeInteger64, DiameterTypeUnsigned64, DiameterTypeFloat64:
+		expectedLen = 8
+	case DiameterTypeIPv6Address:
+		expectedLen = 16
+	case DiameterTypeAddress:
+		if len(value) != 6 && len(value) != 18 {
+			return paddedLen, fmt.Errorf("bad length %d for address avp %s", len(value), avp.Name)
+		}
+	case DiameterTypeIPv6Prefix:
+		if len(value) < 2 || len(value) > 18 {
+			return paddedLen, fmt.Errorf("bad length %d for ipv6 prefix avp %s", len(value), avp.Name)
+		}
+	}
+	if expectedLen >= 0 && len(value) != expectedLen {
+		return paddedLen, fmt.Errorf("bad length %d for avp %s", len(value), avp.Name)
+	}
 
-	// OctetString
-	case DiameterTypeNone, DiameterTypeOctetString:
-		// Read including padding
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
+	return paddedLen, nil
+}
+
+// Builds a list of AVPs from the bytes passed as parameter, which contain a sequence of them.
+// Only the headers are decoded, and the AVPs keep a reference to the data
+func decodeDiameterAVPs(data []byte) ([]DiameterAVP, error) {
+
+	// Count first, to allocate the slice only once
+	count := 0
+	for offset := 0; offset < len(data); count++ {
+		avpLen, err := diameterAVPLen(data[offset:])
+		if err != nil {
+			return nil, err
+		}
+		offset += avpLen
+	}
 
-		// Use only dataLen bytes. The rest is padding
-		avp.Value = avpBytes[0:dataLen]
+	avps := make([]DiameterAVP, count)
+	raws := make([]diameterRawValue, count)
+	offset := 0
+	for i := range avps {
+		n, err := avps[i].decodeHeader(data[offset:], &raws[i])
+		if err != nil {
+			return nil, err
+		}
+		offset += n
+	}
+
+	return avps, nil
+}
+
+// Returns the value of the AVP, decoding it from the bytes received if not done yet.
+// Grouped AVPs get their inner AVPs with only the headers decoded
+func (avp *DiameterAVP) decode() (interface{}, error) {
 
-		return currentIndex + int64(dataLen+padLen), err
+	if avp.Value != nil || avp.raw == nil {
+		return avp.Value, nil
+	}
+
+	raw := avp.raw
+	raw.once.Do(func() {
+		raw.value, raw.err = avp.decodeValue(raw.bytes)
+	})
+
+	return raw.value, raw.err
+}
+
+// Returns the value of the AVP, logging the decoding error, if any. To be used in getters
+func (avp *DiameterAVP) value() interface{} {
+	value, err := avp.decode()
+	if err != nil {
+		GetLogger().Errorf("%s", err)
+	}
+	return value
+}
+
+// Returns the value represented by the wire bytes passed as parameter, whose size has already
+// been validated. The value may keep references to the data
+func (avp *DiameterAVP) decodeValue(data []byte) (interface{}, error) {
+
+	switch avp.DictItem.DiameterType {
+
+	// OctetString
+	case DiameterTypeNone, DiameterTypeOctetString:
+		return data, nil
 
 	// Int32
-	case DiameterTypeInteger32:
-		var value int32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+	case DiameterTypeInteger32, DiameterTypeEnumerated:
+		return int64(int32(binary.BigEndian.Uint32(data))), nil
 
 	// Int64
 	case DiameterTypeInteger64:
-		var value int64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 8, err
+		return int64(binary.BigEndian.Uint64(data)), nil
 
 	// UInt32
 	case DiameterTypeUnsigned32:
-		var value uint32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+		return int64(binary.BigEndian.Uint32(data)), nil
 
 	// UInt64
 	// Stored internally as an int64. This is a limitation!
 	case DiameterTypeUnsigned64:
-		var value uint64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 8, err
+		return int64(binary.BigEndian.Uint64(data)), nil
 
 	// Float32
 	case DiameterTypeFloat32:
-		var value float32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = float64(value)
-		return currentIndex + 4, err
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), nil
 
 	// Float64
 	case DiameterTypeFloat64:
-		var value float64
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = value
-		return currentIndex + 8, err
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
 
 	// Grouped
 	case DiameterTypeGrouped:
-		for currentIndex < int64(avpLen+padLen) {
-			nextAVP := DiameterAVP{}
-			bytesRead, err := nextAVP.ReadFrom(reader)
-			if err != nil {
-				return currentIndex + bytesRead, err
-			}
-			// Make array if this is the first attribute we are inserting
-			if avp.Value == nil {
-				avp.Value = make([]DiameterAVP, 0)
-			}
-			avp.Value = append(avp.Value.([]DiameterAVP), nextAVP)
-			currentIndex += bytesRead
+		avps, err := decodeDiameterAVPs(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not decode grouped avp %s: %w", avp.Name, err)
 		}
-
-		return currentIndex, err
+		return avps, nil
 
 	// Address
 	// Two bytes for address type, and 4 /16 bytes for address
 	case DiameterTypeAddress:
-		var addrType uint16
-		var padding uint16
-
-		if err := binary.Read(reader, binary.BigEndian, &addrType); err != nil {
-			return currentIndex, err
-		}
-		if addrType == 1 {
-			var ipv4Addr [4]byte
-
-			if err := binary.Read(reader, binary.BigEndian, &ipv4Addr); err != nil {
-				return currentIndex + 2, err
-			}
-			avp.Value = net.IP(ipv4Addr[:])
-			// Drain 2 bytes
-			binary.Read(reader, binary.BigEndian, &padding)
-
-			return currentIndex + 8, nil
-		} else {
-			// IPv6
-			var ipv6Addr [16]byte
-			if err := binary.Read(reader, binary.BigEndian, &ipv6Addr); err != nil {
-				return currentIndex + 2, err
-			}
-			avp.Value = net.IP(ipv6Addr[:])
-			// Drain 2 bytes
-			binary.Read(reader, binary.BigEndian, &padding)
-
-			return currentIndex + 20, nil
-		}
+		return net.IP(data[2:]), nil
 
 	// Time
 	case DiameterTypeTime:
-		var value uint32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = ZeroDiameterTime.Add(time.Second * time.Duration(value))
-		return currentIndex + 4, err
+		return ZeroDiameterTime.Add(time.Second * time.Duration(binary.BigEndian.Uint32(data))), nil
 
 	// UTF8 String
 	case DiameterTypeUTF8String, DiameterTypeDiamIdent, DiameterTypeDiameterURI, DiameterTypeIPFilterRule:
-		// Read including padding
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
-
-		// Use only dataLen bytes. The rest is padding
-		avp.Value = string(avpBytes[0:dataLen])
-
-		return currentIndex + int64(dataLen+padLen), err
-
-	case DiameterTypeEnumerated:
-		var value int32
-		err := binary.Read(reader, binary.BigEndian, &value)
-		avp.Value = int64(value)
-		return currentIndex + 4, err
+		return string(data), nil
 
 	case DiameterTypeIPv4Address, DiameterTypeIPv6Address:
-		avpBytes = make([]byte, int(dataLen+padLen))
-		_, err := io.ReadAtLeast(reader, avpBytes, int(dataLen+padLen))
-		avp.Value = net.IP(avpBytes)
-		return currentIndex + int64(dataLen+padLen), err
+		return net.IP(data), nil
 
 		// First byte is ignored
 		// Second byte is prefix size
-		// Rest is an IPv6 Address
+		// Rest is an IPv6 Address, which may be truncated
 	case DiameterTypeIPv6Prefix:
-		var dummy byte
-		var prefixLen byte
-		var padding uint16
 		address := make([]byte, 16)
-		if err := binary.Read(reader, binary.BigEndian, &dummy); err != nil {
-			return currentIndex, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &prefixLen); err != nil {
-			return currentIndex + 1, err
-		}
-		if err := binary.Read(reader, binary.BigEndian, &address); err != nil {
-			return currentIndex + 2, err
-		}
-
-		// Drain 2 bytes
-		binary.Read(reader, binary.BigEndian, &padding)
-
-		avp.Value = net.IP(address).String() + "/" + fmt.Sprintf("%d", prefixLen)
+		copy(address, data[2:])
+		return net.IP(address).String() + "/" + strconv.Itoa(int(data[1])), nil
 
-		return currentIndex + 20, err
+	default:
+		return nil, fmt.Errorf("unknown type: %d", avp.DictItem.DiameterType)
 	}
-
-	return currentIndex, fmt.Errorf("unknown type: %d", avp.DictItem.DiameterType)
 }
 
 // Writes the AVP to the specified writer
 // Returns the number of bytes written including padding
 func (avp *DiameterAVP) WriteTo(buffer io.Writer) (int64, error) {
 
-	var bytesWritten = 0
-	var err error
+	scratch := getDiameterBuffer()
+	defer putDiameterBuffer(scratch)
 
-	// Write Code
-	if err = binary.Write(buffer, binary.BigEndian, avp.Code); err != nil {
-		return int64(bytesWritten), err
+	avpBytes, err := avp.appendTo((*scratch)[:0])
+	*scratch = avpBytes
+	if err != nil {
+		return 0, err
 	}
-	bytesWritten += 4
+
+	n, err := buffer.Write(avpBytes)
+	return int64(n), err
+}
+
+// Appends the wire representation of the AVP to the specified buffer, including padding,
+// and returns the extended buffer
+func (avp *DiameterAVP) appendTo(b []byte) ([]byte, error) {
+
+	start := len(b)
+
+	// Write Code
+	b = appendUint32(b, avp.Code)
 
 	// Write Flags
 	var flags uint8
@@ -295,258 +336,172 @@ func (avp *DiameterAVP) WriteTo(buffer io.Writer) (int64, error) {
 	if avp.IsProtected {
 		flags += 0x20
 	}
-	if err = binary.Write(buffer, binary.BigEndian, flags); err != nil {
-		return int64(bytesWritten), err
-	}
-	bytesWritten += 1
+	b = append(b, flags)
 
 	// Write Len (this is without padding)
 	avpLen := avp.DataLen()
-	// Optimization to avoid division in most cases
-	var lenHighByte uint8
-	var lenLowWord uint16
-	if avpLen < 65535 {
-		lenHighByte = 0
-		lenLowWord = uint16(avpLen)
-	} else {
-		lenHighByte = uint8(avpLen / 65535)
-		lenLowWord = uint16(avpLen % 65535)
-	}
-	if err = binary.Write(buffer, binary.BigEndian, lenHighByte); err != nil {
-		return int64(bytesWritten), err
-	}
-	if err = binary.Write(buffer, binary.BigEndian, lenLowWord); err != nil {
-		return int64(bytesWritten), err
-	}
-	bytesWritten += 3
+	b = append(b, byte(avpLen>>16), byte(avpLen>>8), byte(avpLen))
 
 	// Write vendor Id
 	if avp.VendorId > 0 {
-		if err = binary.Write(buffer, binary.BigEndian, avp.VendorId); err != nil {
-			return int64(bytesWritten), err
+		b = appendUint32(b, avp.VendorId)
+	}
+
+	// Untouched AVP. Write the same bytes as received
+	if avp.Value == nil && avp.raw != nil {
+		b = append(b, avp.raw.bytes...)
+	} else {
+		var err error
+		if b, err = avp.appendValueTo(b); err != nil {
+			return b[:start], err
 		}
-		bytesWritten += 4
 	}
 
+	// Saninty check
+	if len(b)-start != avpLen {
+		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", len(b)-start, avpLen))
+	}
+
+	// Padding
+	for i := avpLen; i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+
+	return b, nil
+}
+
+// Appends the wire representation of the value of the AVP to the specified buffer
+func (avp *DiameterAVP) appendValueTo(b []byte) ([]byte, error) {
+
 	switch avp.DictItem.DiameterType {
 
 	case DiameterTypeNone, DiameterTypeOctetString:
-		var octetsValue, ok = avp.Value.([]byte)
+		var octetsValue, ok = avp.value().([]byte)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, octetsValue); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += len(octetsValue)
+		b = append(b, octetsValue...)
 
-	case DiameterTypeInteger32:
-		var value, ok = avp.Value.(int64)
+	case DiameterTypeInteger32, DiameterTypeEnumerated:
+		var value, ok = avp.value().(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, int32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = appendUint32(b, uint32(int32(value)))
 
-	case DiameterTypeInteger64:
-		var value, ok = avp.Value.(int64)
+	case DiameterTypeInteger64, DiameterTypeUnsigned64:
+		var value, ok = avp.value().(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, int64(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 8
+		b = appendUint64(b, uint64(value))
 
 	case DiameterTypeUnsigned32:
-		var value, ok = avp.Value.(int64)
-		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, uint32(value)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
-
-	case DiameterTypeUnsigned64:
-		var value, ok = avp.Value.(int64)
+		var value, ok = avp.value().(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, uint64(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 8
+		b = appendUint32(b, uint32(value))
 
 	case DiameterTypeFloat32:
-		var value, ok = avp.Value.(float64)
+		var value, ok = avp.value().(float64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, float32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = appendUint32(b, math.Float32bits(float32(value)))
 
 	case DiameterTypeFloat64:
-		var value, ok = avp.Value.(float64)
+		var value, ok = avp.value().(float64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, float64(value)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 8
+		b = appendUint64(b, math.Float64bits(value))
 
 	case DiameterTypeGrouped:
-		var groupedValue, ok = avp.Value.([]DiameterAVP)
+		var groupedValue, ok = avp.value().([]DiameterAVP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
 		for i := range groupedValue {
-			if n, err := groupedValue[i].WriteTo(buffer); err != nil {
-				return int64(bytesWritten) + n, err
-			} else {
-				bytesWritten += int(n)
+			var err error
+			if b, err = groupedValue[i].appendTo(b); err != nil {
+				return b, err
 			}
 		}
 
 	case DiameterTypeAddress:
-		var addressValue, ok = avp.Value.(net.IP)
+		var addressValue, ok = avp.value().(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
 		if addressValue.To4() != nil {
 			// Address Type
-			if err = binary.Write(buffer, binary.BigEndian, int16(1)); err != nil {
-				return int64(bytesWritten), err
-			}
-			if err = binary.Write(buffer, binary.BigEndian, addressValue.To4()); err != nil {
-				return int64(bytesWritten), err
-			}
-			bytesWritten += 6
+			b = append(b, 0, 1)
+			b = append(b, addressValue.To4()...)
 		} else {
 			// Address Type
-			if err = binary.Write(buffer, binary.BigEndian, int16(2)); err != nil {
-				return int64(bytesWritten), err
-			}
-			if err = binary.Write(buffer, binary.BigEndian, addressValue.To16()); err != nil {
-				return int64(bytesWritten), err
-			}
-			bytesWritten += 18
+			b = append(b, 0, 2)
+			b = append(b, addressValue.To16()...)
 		}
 
 	case DiameterTypeTime:
-		var timeValue, ok = avp.Value.(time.Time)
+		var timeValue, ok = avp.value().(time.Time)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, uint32(timeValue.Sub(ZeroDiameterTime).Seconds())); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = appendUint32(b, uint32(timeValue.Sub(ZeroDiameterTime).Seconds()))
 
 	case DiameterTypeUTF8String, DiameterTypeDiamIdent, DiameterTypeDiameterURI, DiameterTypeIPFilterRule:
-		var stringValue, ok = avp.Value.(string)
+		var stringValue, ok = avp.value().(string)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, []byte(stringValue)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += len(stringValue)
-
-	case DiameterTypeEnumerated:
-		var value, ok = avp.Value.(int64)
-		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, int32(value)); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 4
+		b = append(b, stringValue...)
 
 	case DiameterTypeIPv4Address:
-		var ipAddress, ok = avp.Value.(net.IP)
+		var ipAddress, ok = avp.value().(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
-		if err = binary.Write(buffer, binary.BigEndian, ipAddress.To4()); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
+		b = append(b, ipAddress.To4()...)
 
 	case DiameterTypeIPv6Address:
-		var ipAddress, ok = avp.Value.(net.IP)
+		var ipAddress, ok = avp.value().(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(buffer, binary.BigEndian, ipAddress.To16()); err != nil {
-			return int64(bytesWritten), err
+			return b, avp.marshalError()
 		}
-		bytesWritten += 16
+		b = append(b, ipAddress.To16()...)
 
 	case DiameterTypeIPv6Prefix:
-		var ipv6Prefix, ok = avp.Value.(string)
+		var ipv6Prefix, ok = avp.value().(string)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+			return b, avp.marshalError()
 		}
 		addrPrefix := strings.Split(ipv6Prefix, "/")
-		if len(addrPrefix) == 2 {
-			prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
-			ipv6 := net.ParseIP(addrPrefix[0])
-			if err == nil && ipv6 != nil {
-				// To ignore
-				if err = binary.Write(buffer, binary.BigEndian, byte(0)); err != nil {
-					return int64(bytesWritten), err
-				}
-				bytesWritten += 1
-				// Prefix
-				if err = binary.Write(buffer, binary.BigEndian, uint8(prefix)); err != nil {
-					return int64(bytesWritten), err
-				}
-				bytesWritten += 1
-				// Address
-				binary.Write(buffer, binary.BigEndian, ipv6.To16())
-				bytesWritten += 16
-			} else {
-				return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
-			}
-		} else {
-			return int64(bytesWritten), fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
+		if len(addrPrefix) != 2 {
+			return b, avp.marshalError()
 		}
-	}
-
-	// Saninty check
-	if bytesWritten != avpLen {
-		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", bytesWritten, avpLen))
-	}
-
-	// Padding
-	var padSize = 0
-	if avpLen%4 != 0 {
-		padSize = 4 - (avpLen % 4)
-		padBytes := make([]byte, padSize)
-		if err = binary.Write(buffer, binary.BigEndian, padBytes); err != nil {
-			return int64(bytesWritten), err
+		prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
+		ipv6 := net.ParseIP(addrPrefix[0])
+		if err != nil || ipv6 == nil {
+			return b, avp.marshalError()
 		}
+		// First byte to ignore, then prefix and address
+		b = append(b, 0, uint8(prefix))
+		b = append(b, ipv6.To16()...)
 	}
 
-	return int64(avpLen + padSize), nil
+	return b, nil
+}
+
+// Error to report when the value does not correspond to the type of the AVP
+func (avp *DiameterAVP) marshalError() error {
+	return fmt.Errorf("error marshaling diameter type %d and value %T %v", avp.DictItem.DiameterType, avp.Value, avp.Value)
 }
 
 // To implement the BinaryMarshaler interface
 func (avp *DiameterAVP) MarshalBinary() (data []byte, err error) {
-
-	// Will write the output here
-	var buffer bytes.Buffer
-	if _, err := avp.WriteTo(&buffer); err != nil {
-		return buffer.Bytes(), err
-	}
-
-	return buffer.Bytes(), nil
+	return avp.appendTo(make([]byte, 0, avp.Len()))
 }
 
 // To implement the BinaryUnmarshaler interface
@@ -568,10 +523,29 @@ func DiameterAVPFromBytes(inputBytes []byte) (*DiameterAVP, uint32, error) {
 func (avp *DiameterAVP) DataLen() int {
 	var dataSize = 0
 
+	if avp.Value == nil && avp.raw != nil {
+		dataSize = len(avp.raw.bytes)
+	} else {
+		dataSize = avp.valueLen()
+	}
+
+	if avp.VendorId == 0 {
+		dataSize += 8
+	} else {
+		dataSize += 12
+	}
+
+	return dataSize
+}
+
+// Returns the size of the value of the AVP, once decoded
+func (avp *DiameterAVP) valueLen() int {
+	var dataSize = 0
+
 	switch avp.DictItem.DiameterType {
 
 	case DiameterTypeNone, DiameterTypeOctetString:
-		dataSize = len(avp.Value.([]byte))
+		dataSize = len(avp.value().([]byte))
 
 	case DiameterTypeInteger32:
 		dataSize = 4
@@ -592,13 +566,13 @@ func (avp *DiameterAVP) DataLen() int {
 		dataSize = 8
 
 	case DiameterTypeGrouped:
-		values := avp.Value.([]DiameterAVP)
+		values, _ := avp.value().([]DiameterAVP)
 		for i := range values {
 			dataSize += values[i].Len() // With padding
 		}
 
 	case DiameterTypeAddress:
-		if avp.Value.(net.IP).To4() != nil {
+		if avp.value().(net.IP).To4() != nil {
 			dataSize = 6
 		} else {
 			dataSize = 18
@@ -608,19 +582,19 @@ func (avp *DiameterAVP) DataLen() int {
 		dataSize = 4
 
 	case DiameterTypeUTF8String:
-		dataSize = len(avp.Value.(string))
+		dataSize = len(avp.value().(string))
 
 	case DiameterTypeDiamIdent:
-		dataSize = len(avp.Value.(string))
+		dataSize = len(avp.value().(string))
 
 	case DiameterTypeDiameterURI:
-		dataSize = len(avp.Value.(string))
+		dataSize = len(avp.value().(string))
 
 	case DiameterTypeEnumerated:
 		dataSize = 4
 
 	case DiameterTypeIPFilterRule:
-		dataSize = len(avp.Value.(string))
+		dataSize = len(avp.value().(string))
 
 	case DiameterTypeIPv4Address:
 		dataSize = 4
@@ -632,12 +606,6 @@ func (avp *DiameterAVP) DataLen() int {
 		dataSize = 18
 	}
 
-	if avp.VendorId == 0 {
-		dataSize += 8
-	} else {
-		dataSize += 12
-	}
-
 	return dataSize
 }
 
@@ -660,10 +628,9 @@ func (avp *DiameterAVP) Len() int {
 
 // Returns the value of the AVP as an octet string
 func (avp *DiameterAVP) GetOctets() []byte {
-
-	var value, ok = avp.Value.([]byte)
+	var value, ok = avp.value().([]byte)
 	if !ok {
-		GetLogger().Errorf("cannot convert %T %v to []byte", avp.Value, avp.Value)
+		GetLogger().Errorf("cannot convert %T %v to []byte", avp.value(), avp.value())
 		return nil
 	}
 
@@ -672,24 +639,23 @@ func (avp *DiameterAVP) GetOctets() []byte {
 
 // Returns the value of the AVP as an string
 func (avp *DiameterAVP) GetString() string {
-
 	switch avp.DictItem.DiameterType {
 
 	case DiameterTypeNone, DiameterTypeOctetString:
 		// Treat as octetString
-		var octetsValue, _ = avp.Value.([]byte)
+		var octetsValue, _ = avp.value().([]byte)
 		return fmt.Sprintf("%x", octetsValue)
 
 	case DiameterTypeInteger32, DiameterTypeInteger64, DiameterTypeUnsigned32, DiameterTypeUnsigned64:
-		var value, _ = avp.Value.(int64)
+		var value, _ = avp.value().(int64)
 		return fmt.Sprintf("%d", value)
 
 	case DiameterTypeFloat32, DiameterTypeFloat64:
-		var value, _ = avp.Value.(float64)
+		var value, _ = avp.value().(float64)
 		return fmt.Sprintf("%f", value)
 
 	case DiameterTypeGrouped:
-		var groupedValue, _ = avp.Value.([]DiameterAVP)
+		var groupedValue, _ = avp.value().([]DiameterAVP)
 		var sb strings.Builder
 
 		sb.WriteString("{")
@@ -703,19 +669,19 @@ func (avp *DiameterAVP) GetString() string {
 		return sb.String()
 
 	case DiameterTypeAddress:
-		var addressValue, _ = avp.Value.(net.IP)
+		var addressValue, _ = avp.value().(net.IP)
 		return addressValue.String()
 
 	case DiameterTypeTime:
-		var timeValue = avp.Value.(time.Time)
+		var timeValue = avp.value().(time.Time)
 		return timeValue.Format(TimeFormatString)
 
 	case DiameterTypeUTF8String, DiameterTypeDiamIdent, DiameterTypeDiameterURI, DiameterTypeIPFilterRule, DiameterTypeIPv6Prefix:
-		var stringValue, _ = avp.Value.(string)
+		var stringValue, _ = avp.value().(string)
 		return stringValue
 
 	case DiameterTypeEnumerated:
-		var intValue, _ = avp.Value.(int64)
+		var intValue, _ = avp.value().(int64)
 		if value, found := avp.DictItem.EnumCodes[int(intValue)]; !found {
 			// If no string representation defined, return the string representation as it is
 			return fmt.Sprintf("%d", intValue)
@@ -724,7 +690,7 @@ func (avp *DiameterAVP) GetString() string {
 		}
 
 	case DiameterTypeIPv4Address, DiameterTypeIPv6Address:
-		var ipAddress, _ = avp.Value.(net.IP)
+		var ipAddress, _ = avp.value().(net.IP)
 		return ipAddress.String()
 	}
 
@@ -733,35 +699,32 @@ func (avp *DiameterAVP) GetString() string {
 
 // Returns the value of the AVP as a number
 func (avp *DiameterAVP) GetInt() int64 {
-
 	switch avp.DictItem.DiameterType {
 	case DiameterTypeInteger32, DiameterTypeInteger64, DiameterTypeUnsigned32, DiameterTypeUnsigned64, DiameterTypeEnumerated:
 
-		return avp.Value.(int64)
+		return avp.value().(int64)
 	default:
-		GetLogger().Errorf("cannot convert value to int64 %T %v", avp.Value, avp.Value)
+		GetLogger().Errorf("cannot convert value to int64 %T %v", avp.value(), avp.value())
 		return 0
 	}
 }
 
 // Returns the value of the AVP as a float
 func (avp *DiameterAVP) GetFloat() float64 {
-
 	switch avp.DictItem.DiameterType {
 	case DiameterTypeFloat32, DiameterTypeFloat64:
-		return avp.Value.(float64)
+		return avp.value().(float64)
 	default:
-		GetLogger().Errorf("cannot convert value to float64 %T %v", avp.Value, avp.Value)
+		GetLogger().Errorf("cannot convert value to float64 %T %v", avp.value(), avp.value())
 		return 0
 	}
 }
 
 // Returns the value of the AVP as date
 func (avp *DiameterAVP) GetDate() time.Time {
-
-	var value, ok = avp.Value.(time.Time)
+	var value, ok = avp.value().(time.Time)
 	if !ok {
-		GetLogger().Errorf("cannot convert %T %v to time", avp.Value, avp.Value)
+		GetLogger().Errorf("cannot convert %T %v to time", avp.value(), avp.value())
 		return time.Time{}
 	}
 
@@ -770,10 +733,9 @@ func (avp *DiameterAVP) GetDate() time.Time {
 
 // Returns the value of the AVP as IP address
 func (avp *DiameterAVP) GetIPAddress() net.IP {
-
-	var value, ok = avp.Value.(net.IP)
+	var value, ok = avp.value().(net.IP)
 	if !ok {
-		GetLogger().Errorf("cannot convert %T %v to ip address", avp.Value, avp.Value)
+		GetLogger().Errorf("cannot convert %T %v to ip address", avp.value(), avp.value())
 		return net.IP{}
 	}
 
@@ -945,10 +907,14 @@ func BuildDiameterAVP(name string, value interface{}) *DiameterAVP {
 // If grouped, checks that the embedded AVPs are in the dictionary
 func (avp *DiameterAVP) Check() error {
 
+	if _, err := avp.decode(); err != nil {
+		return err
+	}
+
 	// Do something only if grouped
 	diameterType := avp.DictItem.DiameterType
 	if diameterType == DiameterTypeGrouped {
-		avps := avp.Value.([]DiameterAVP)
+		avps := avp.value().([]DiameterAVP)
 		group := avp.DictItem.Group
 
 		// Check number of occurences as specified in the group
@@ -996,7 +962,7 @@ func (avp *DiameterAVP) AddAVP(gavp *DiameterAVP) *DiameterAVP {
 		return avp
 	}
 
-	var groupedValue, ok = avp.Value.([]DiameterAVP)
+	var groupedValue, ok = avp.value().([]DiameterAVP)
 	if !ok {
 		GetLogger().Error("value is not of type grouped")
 		return avp
@@ -1026,7 +992,7 @@ func (avp *DiameterAVP) Add(name string, value interface{}) *DiameterAVP {
 
 // Deletes all AVP with the specified name
 func (avp *DiameterAVP) DeleteAll(name string) *DiameterAVP {
-	var groupedValue, ok = avp.Value.([]DiameterAVP)
+	var groupedValue, ok = avp.value().([]DiameterAVP)
 	if !ok {
 		GetLogger().Error("value is not of type grouped")
 		return avp
@@ -1045,7 +1011,7 @@ func (avp *DiameterAVP) DeleteAll(name string) *DiameterAVP {
 // Finds and returns the first AVP found in the group with the specified name
 // Notice that a copy is returned
 func (avp *DiameterAVP) GetAVP(name string) (DiameterAVP, error) {
-	var groupedValue, ok = avp.Value.([]DiameterAVP)
+	var groupedValue, ok = avp.value().([]DiameterAVP)
 	if !ok {
 		return DiameterAVP{}, fmt.Errorf("value is not of type grouped %s", name)
 	}
@@ -1061,7 +1027,7 @@ func (avp *DiameterAVP) GetAVP(name string) (DiameterAVP, error) {
 // Returns a slice with all AVP with the specified name
 // Notice that a COPY is returned
 func (avp *DiameterAVP) GetAllAVP(name string) []DiameterAVP {
-	var groupedValue, ok = avp.Value.([]DiameterAVP)
+	var groupedValue, ok = avp.value().([]DiameterAVP)
 	if !ok {
 		GetLogger().Error("value is not of type grouped")
 		return nil
@@ -1093,7 +1059,7 @@ func (avp *DiameterAVP) toMap() map[string]interface{} {
 	case DiameterTypeGrouped:
 		// Grouped AVP. The value is an array of JSON
 		targetGroup := make([]map[string]interface{}, 0)
-		if avpGroup, ok := avp.Value.([]DiameterAVP); ok {
+		if avpGroup, ok := avp.value().([]DiameterAVP); ok {
 			for i := range avpGroup {
 				targetGroup = append(targetGroup, avpGroup[i].toMap())
 			}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/exp/slices"
@@ -32,6 +33,43 @@ const (
 	DIAMETER_UNABLE_TO_COMPLY   = 5012
 )
 
+// Size of the fixed diameter message header
+const diameterHeaderLen = 20
+
+// Buffers used to read headers and to serialize messages, to avoid allocations
+// in the hot path. Buffers that have grown above this size are not reused
+const maxPooledDiameterBufferSize = 65536
+
+var diameterBufferPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 4096)
+		return &b
+	},
+}
+
+// Gets a buffer from the pool
+func getDiameterBuffer() *[]byte {
+	return diameterBufferPool.Get().(*[]byte)
+}
+
+// Equivalent to binary.BigEndian.AppendUint32, not available in go 1.18
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Equivalent to binary.BigEndian.AppendUint64, not available in go 1.18
+func appendUint64(b []byte, v uint64) []byte {
+	return append(b, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// Returns the buffer to the pool
+func putDiameterBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledDiameterBufferSize {
+		*b = (*b)[:0]
+		diameterBufferPool.Put(b)
+	}
+}
+
 // Type for functions that handle the diameter requests received
 type DiameterMessageHandler func(request *DiameterMessage) (*DiameterMessage, error)
 
@@ -63,61 +101,42 @@ type DiameterMessage struct {
 	AVPs []DiameterAVP
 }
 
-// Fills a DiameterMessage with the contents of the stream read in the argument
+// Fills a DiameterMessage with the contents of the stream read in the argument.
+// The header is read into a pooled buffer, and the AVPs into a single buffer owned by
+// the message. Only the headers of the AVPs are decoded here. The values are decoded on
+// first access, and the AVPs keep a reference to the buffer holding the message. Decoding
+// does not modify the message, so that it may be read concurrently
 func (dm *DiameterMessage) ReadFrom(reader io.Reader) (n int64, err error) {
-	var version byte
-	var lenHigh uint8
-	var lenLow uint16
-	var messageLength uint32
-	var flags uint8
-	var commandCodeHigh uint8
-	var commandCodeLow uint16
-
-	currentIndex := int64(0)
-
-	// Get Version
-	if err := binary.Read(reader, binary.BigEndian, &version); err != nil {
-		return 0, err
+
+	scratch := getDiameterBuffer()
+	defer putDiameterBuffer(scratch)
+	header := (*scratch)[:diameterHeaderLen]
+
+	// Get the full header
+	if n, err := io.ReadFull(reader, header); err != nil {
+		return int64(n), err
 	}
-	currentIndex += 1
+
+	// Version is ignored
 
 	// Get Length
-	if err := binary.Read(reader, binary.BigEndian, &lenHigh); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &lenLow); err != nil {
-		return currentIndex, err
+	messageLength := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	if messageLength < diameterHeaderLen {
+		return diameterHeaderLen, fmt.Errorf("bad diameter message length %d", messageLength)
 	}
-	currentIndex += 2
-	messageLength = uint32(lenHigh)*65535 + uint32(lenLow)
 
 	// Get flags
-	if err := binary.Read(reader, binary.BigEndian, &flags); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
+	flags := header[4]
 	dm.IsRequest = flags&128 != 0
 	dm.IsProxyable = flags&64 != 0
 	dm.IsError = flags&32 != 0
 	dm.IsRetransmission = flags&16 != 0
 
 	// Get CommandCode
-	if err := binary.Read(reader, binary.BigEndian, &commandCodeHigh); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err := binary.Read(reader, binary.BigEndian, &commandCodeLow); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
-	dm.CommandCode = uint32(commandCodeHigh)*65535 + uint32(commandCodeLow)
+	dm.CommandCode = uint32(header[5])<<16 | uint32(header[6])<<8 | uint32(header[7])
 
 	// Get the applicationId
-	if err := binary.Read(reader, binary.BigEndian, &dm.ApplicationId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	dm.ApplicationId = binary.BigEndian.Uint32(header[8:12])
 
 	diameterApplication, ok := GetDDict().AppByCode[dm.ApplicationId]
 	if ok {
@@ -128,35 +147,19 @@ func (dm *DiameterMessage) ReadFrom(reader io.Reader) (n int64, err error) {
 	}
 
 	// Get the E2EndId
-	if err := binary.Read(reader, binary.BigEndian, &dm.E2EId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	dm.E2EId = binary.BigEndian.Uint32(header[12:16])
 
 	// Get the HopByHopId
-	if err := binary.Read(reader, binary.BigEndian, &dm.HopByHopId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	dm.HopByHopId = binary.BigEndian.Uint32(header[16:20])
 
 	// Get the AVPs
-	dm.AVPs = make([]DiameterAVP, 0)
-	if currentIndex != 20 {
-		panic("assert failed. Bad header size in diameter message header")
-	}
-	// var currentIndex uint32 = 20 // The header is always 20 bytes
-	for currentIndex < int64(messageLength) {
-		nextAVP := DiameterAVP{}
-		bytesRead, err := nextAVP.ReadFrom(reader)
-		if err != nil {
-			return currentIndex, err
-		}
-		dm.AVPs = append(dm.AVPs, nextAVP)
-		currentIndex += bytesRead
+	avpBytes := make([]byte, messageLength-diameterHeaderLen)
+	if n, err := io.ReadFull(reader, avpBytes); err != nil {
+		return int64(diameterHeaderLen + n), err
 	}
 
-	if int64(messageLength) != currentIndex {
-		panic("assert failed. Bad header size in diameter message")
+	if dm.AVPs, err = decodeDiameterAVPs(avpBytes); err != nil {
+		return int64(messageLength), err
 	}
 
 	return int64(messageLength), nil
@@ -187,36 +190,31 @@ func (m *DiameterMessage) Tidy() *DiameterMessage {
 // Writes the diameter message to the specified writer
 func (m *DiameterMessage) WriteTo(buffer io.Writer) (int64, error) {
 
-	currentIndex := int64(0)
-	var err error
+	scratch := getDiameterBuffer()
+	defer putDiameterBuffer(scratch)
 
-	// Write Version
-	if err = binary.Write(buffer, binary.BigEndian, byte(1)); err != nil {
-		return currentIndex, err
+	messageBytes, err := m.appendTo((*scratch)[:0])
+	*scratch = messageBytes
+	if err != nil {
+		return 0, err
 	}
-	currentIndex += 1
 
-	messageLen := m.Len()
+	n, err := buffer.Write(messageBytes)
+	return int64(n), err
+}
+
+// Appends the wire representation of the message to the specified buffer, and returns
+// the extended buffer
+func (m *DiameterMessage) appendTo(b []byte) ([]byte, error) {
+
+	start := len(b)
+
+	// Write Version
+	b = append(b, 1)
 
 	// Write Len
-	// Optimization to avoid division in most cases
-	var lenHighByte uint8
-	var lenLowWord uint16
-	if messageLen < 65535 {
-		lenHighByte = 0
-		lenLowWord = uint16(messageLen)
-	} else {
-		lenHighByte = uint8(messageLen / 65535)
-		lenLowWord = uint16(messageLen % 65535)
-	}
-	if err = binary.Write(buffer, binary.BigEndian, lenHighByte); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err = binary.Write(buffer, binary.BigEndian, lenLowWord); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
+	messageLen := m.Len()
+	b = append(b, byte(messageLen>>16), byte(messageLen>>8), byte(messageLen))
 
 	// Write flags
 	var flags byte
@@ -232,36 +230,15 @@ func (m *DiameterMessage) WriteTo(buffer io.Writer) (int64, error) {
 	if m.IsRetransmission {
 		flags += 16
 	}
-	if err = binary.Write(buffer, binary.BigEndian, flags); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
+	b = append(b, flags)
 
 	// Write command code
-	if err = binary.Write(buffer, binary.BigEndian, byte(m.CommandCode/65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
-	if err = binary.Write(buffer, binary.BigEndian, uint16(m.CommandCode%65535)); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 2
+	b = append(b, byte(m.CommandCode>>16), byte(m.CommandCode>>8), byte(m.CommandCode))
 
 	// Write the rest of the fields
-	if err = binary.Write(buffer, binary.BigEndian, m.ApplicationId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	if err = binary.Write(buffer, binary.BigEndian, m.E2EId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
-
-	if err = binary.Write(buffer, binary.BigEndian, m.HopByHopId); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 4
+	b = appendUint32(b, m.ApplicationId)
+	b = appendUint32(b, m.E2EId)
+	b = appendUint32(b, m.HopByHopId)
 
 	// Get the command to be used to enforce the mandatory bit
 	command, errNotInDict := GetDDict().GetCommand(m.ApplicationId, m.CommandCode)
@@ -275,19 +252,18 @@ func (m *DiameterMessage) WriteTo(buffer io.Writer) (int64, error) {
 			}
 		}
 
-		n, err := m.AVPs[i].WriteTo(buffer)
-		if err != nil {
-			return currentIndex, err
+		var err error
+		if b, err = m.AVPs[i].appendTo(b); err != nil {
+			return b[:start], err
 		}
-		currentIndex += int64(n)
 	}
 
 	// Saninty check
-	if currentIndex != int64(messageLen) {
+	if len(b)-start != messageLen {
 		panic("assert failed. Bad message size")
 	}
 
-	return currentIndex, nil
+	return b, nil
 }
 
 // Returns a DiameterMessage decoded from the specified input bytes
@@ -302,9 +278,7 @@ func NewDiameterMessageFromBytes(inputBytes []byte) (*DiameterMessage, uint32, e
 
 // Implement the BinaryMarshaler interface
 func (dm *DiameterMessage) MarshalBinary() ([]byte, error) {
-	var buffer bytes.Buffer
-	_, err := dm.WriteTo(&buffer)
-	return buffer.Bytes(), err
+	return dm.appendTo(make([]byte, 0, dm.Len()))
 }
 
 // Implement the BinaryUnmarshaler interface
@@ -9,12 +9,12 @@ func initDiameterDict(cm *ConfigurationManager) {
 
 	// Load dictionaries
 
-	// Diameter
-	coreJSON, err := cm.GetBytesConfigObject("diameterDictionary.json")
+	// Diameter. May include other modules
+	dict, err := NewDiameterDictionaryFromConfig(cm, "diameterDictionary.json")
 	if err != nil {
-		panic("Could not read diameterDictionary.json")
+		panic("Could not read diameterDictionary.json: " + err.Error())
 	}
-	diameterDict = NewDiameterDictionaryFromJSON([]byte(coreJSON))
+	diameterDict = dict
 }
 
 // Loads the Radius dictionary
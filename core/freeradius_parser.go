@@ -29,6 +29,16 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 		dict.Avps = append(dict.Avps, jRadiusVendorAVPs{VendorId: 0, Attributes: make([]jRadiusAVP, 0)})
 	}
 
+	// OID of the last attribute that may contain others and was defined with an absolute OID.
+	// The attributes defined with relative OIDs (starting with a dot) are inside it
+	var baseOID string
+
+	// OID of the last struct attribute, to which the MEMBER lines are added, the number of members and whether
+	// the last one has variable size. Empty if there is no such struct or its members are not supported
+	var structOID string
+	var structMembers int
+	var structVariable bool
+
 	// Iterate through the dictionary lines
 	var scanner = bufio.NewScanner(bytes.NewReader(dictBytes))
 	for scanner.Scan() {
@@ -62,11 +72,24 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 				return errors.New("invalid VENDOR " + line)
 			}
 
+			// The layout of the vendor specific attributes may be specified as format=t,l[,c]
+			var format string
+			for _, option := range words[3:] {
+				if strings.HasPrefix(option, "format=") {
+					format = strings.TrimPrefix(option, "format=")
+					if _, err := parseRadiusVendorFormat(format); err != nil {
+						return errors.New("invalid VENDOR " + line)
+					}
+				}
+			}
+
 			// Insert into vendors field
 			dict.Vendors = append(dict.Vendors, jVendor{
 				VendorId:   uint32(vendorId),
 				VendorName: words[1],
+				Format:     format,
 			})
+			structOID = ""
 
 			// Initialize avps slice item for vendor
 			dict.Avps = append(dict.Avps,
@@ -89,30 +112,100 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 
 			if vendorId == 0 {
 				return errors.New("vendor " + words[1] + " not found")
-			} else {
-				// Get the index for that vendorId
-				for i := range dict.Avps {
-					if dict.Avps[i].VendorId == vendorId {
-						currentVendorAVPsIndex = i
-						break
-					}
+			}
+
+			// The attributes of the vendor may be in the Extended-Vendor-Specific space
+			// parent=.Extended-Attribute-5.Extended-Vendor-Specific-5 or format=Extended-Vendor-Specific-5
+			var evsOID string
+			for _, option := range words[2:] {
+				var evsName string
+				if strings.HasPrefix(option, "parent=") {
+					evsName = option[strings.LastIndexByte(option, '.')+1:]
+				} else if strings.HasPrefix(option, "format=Extended-Vendor-Specific-") {
+					evsName = strings.TrimPrefix(option, "format=")
+				} else {
+					continue
+				}
+				evsAttr := findAttribute(dict.Avps[0].Attributes, evsName)
+				if evsAttr == nil || evsAttr.Type != "EVS" {
+					return errors.New("invalid BEGIN-VENDOR " + line)
+				}
+				evsOID = evsAttr.oid()
+			}
+
+			// Get the index for that vendorId, creating it if in a new Extended-Vendor-Specific space
+			currentVendorAVPsIndex = -1
+			for i := range dict.Avps {
+				if dict.Avps[i].VendorId == vendorId && dict.Avps[i].Parent == evsOID {
+					currentVendorAVPsIndex = i
+					break
 				}
 			}
+			if currentVendorAVPsIndex < 0 {
+				dict.Avps = append(dict.Avps,
+					jRadiusVendorAVPs{
+						VendorId:   vendorId,
+						Attributes: make([]jRadiusAVP, 0),
+						Parent:     evsOID,
+					})
+				currentVendorAVPsIndex = len(dict.Avps) - 1
+			}
+			baseOID = ""
+			structOID = ""
 
 		case "END-VENDOR":
 			// Reset to default attributes
 			currentVendorAVPsIndex = 0
+			baseOID = ""
+			structOID = ""
 
 		case "ATTRIBUTE":
+			structOID = ""
 			if len(words) < 4 {
 				return errors.New("invalid ATTRIBUTE " + line)
 			}
-			// Removing a possible dot in the begining of the code
-			code, err := strconv.Atoi(strings.TrimPrefix(words[2], "."))
-			if err != nil {
+			// The code may be a relative OID (.<code>), or an absolute OID (<parentOID>.<code>)
+			oid := words[2]
+			if strings.HasPrefix(oid, ".") {
+				if baseOID == "" {
+					return errors.New("relative OID without parent in ATTRIBUTE " + line)
+				}
+				oid = baseOID + oid
+			}
+			var parentOID string
+			codeString := oid
+			if lastDot := strings.LastIndexByte(oid, '.'); lastDot >= 0 {
+				parentOID = oid[:lastDot]
+				codeString = oid[lastDot+1:]
+			}
+			var code uint64
+			if strings.HasPrefix(codeString, "0x") {
+				code, err = strconv.ParseUint(codeString[2:], 16, 32)
+			} else {
+				code, err = strconv.ParseUint(codeString, 10, 32)
+			}
+			if err != nil || (parentOID != "" && code > 255) {
 				return errors.New("invalid ATTRIBUTE " + line)
 			}
 
+			// Attributes with codes that do not fit in the type of the vendor cannot be encoded, and are ignored
+			if parentOID == "" && uint32(code) > vendorAVPsFormat(dict, currentVendorAVPsIndex).maxCode() {
+				continue
+			}
+
+			// Check that the parent exists and may contain other attributes
+			var parentType string
+			if parentOID != "" {
+				parent := findAttributeByOID(dict.Avps[currentVendorAVPsIndex].Attributes, parentOID)
+				if parent == nil {
+					return errors.New("parent not found in ATTRIBUTE " + line)
+				}
+				parentType = parent.Type
+				if parentType != "TLV" && parentType != "Extended" && parentType != "LongExtended" && parentType != "EVS" {
+					return errors.New("parent is not a container in ATTRIBUTE " + line)
+				}
+			}
+
 			// Options: comma separated value
 			// We only support the has_tag and encrypt attributes
 			// <type>,has_tag,encrypt=[1,2,3]
@@ -122,6 +215,7 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 			salted := false
 			withLen := false
 			concat := false
+			var cloneOf string
 			if len(words) > 4 {
 				options := strings.Split(words[4], ",")
 				for _, option := range options {
@@ -146,26 +240,116 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 						concat = true
 					} else if option == "array" {
 						radiusType = "Octets"
-					} else if option == "abinary" || option == "extended" || option == "long-extended" {
-						// Ignore this ones
+					} else if option == "extended" {
+						radiusType = "Extended"
+					} else if option == "long-extended" {
+						radiusType = "LongExtended"
+					} else if strings.HasPrefix(option, "clone=") {
+						cloneOf = option[strings.LastIndexByte(option, '.')+1:]
+					} else if option == "abinary" {
+						radiusType = "ABinary"
 					} else {
 						return errors.New("invalid ATTRIBUTE " + line)
 					}
 				}
 			}
 
-			if radiusType != "VSA" {
-				avp := jRadiusAVP{
-					Code:      byte(code),
-					Name:      words[1],
-					Type:      radiusType,
-					Tagged:    tagged,
-					Encrypted: encrypted,
-					Salted:    salted,
-					WithLen:   withLen,
-					Concat:    concat,
+			// Vendor specific attributes inside extended attributes hold the Extended-Vendor-Specific space.
+			// Otherwise, vendor specific attributes are treated specifically and not as any other attribute
+			if radiusType == "VSA" {
+				if parentType != "Extended" && parentType != "LongExtended" {
+					continue
+				}
+				radiusType = "EVS"
+			}
+
+			// Structs are treated as octets until a valid member is found. Structs with options are not supported
+			isStruct := radiusType == "Struct"
+			if isStruct {
+				radiusType = "Octets"
+			}
+
+			avp := jRadiusAVP{
+				Code:      uint32(code),
+				Name:      words[1],
+				Type:      radiusType,
+				Tagged:    tagged,
+				Encrypted: encrypted,
+				Salted:    salted,
+				WithLen:   withLen,
+				Concat:    concat,
+				Parent:    parentOID,
+			}
+			attributes := append(dict.Avps[currentVendorAVPsIndex].Attributes, avp)
+
+			// Copy the contents of the cloned attribute
+			if cloneOf != "" {
+				source := findAttribute(attributes, cloneOf)
+				if source == nil {
+					return errors.New("cloned attribute not found in ATTRIBUTE " + line)
+				}
+				sourceOID := source.oid()
+				for _, attr := range attributes {
+					if attr.Parent == sourceOID || strings.HasPrefix(attr.Parent, sourceOID+".") {
+						attr.Parent = oid + strings.TrimPrefix(attr.Parent, sourceOID)
+						attributes = append(attributes, attr)
+					}
 				}
-				dict.Avps[currentVendorAVPsIndex].Attributes = append(dict.Avps[currentVendorAVPsIndex].Attributes, avp)
+			}
+			dict.Avps[currentVendorAVPsIndex].Attributes = attributes
+
+			// The next MEMBER lines belong to this attribute
+			if isStruct && len(words) == 4 {
+				structOID = oid
+				structMembers = 0
+				structVariable = false
+			}
+
+			// Update the base for the relative OIDs
+			if !strings.HasPrefix(words[2], ".") {
+				switch radiusType {
+				case "TLV", "Extended", "LongExtended":
+					baseOID = oid
+				default:
+					baseOID = ""
+				}
+			}
+
+		case "MEMBER":
+			if structOID == "" {
+				continue
+			}
+			if len(words) < 3 {
+				return errors.New("invalid MEMBER " + line)
+			}
+
+			// Only the members with fixed size are supported, except the last one. If some member is not
+			// supported (such as bit fields or keys for the STRUCT lines), the struct is treated as octets
+			attributes := dict.Avps[currentVendorAVPsIndex].Attributes
+			memberType, size, ok := parseStructMemberType(words[2])
+			if !ok || len(words) > 3 || structVariable {
+				dict.Avps[currentVendorAVPsIndex].Attributes = removeStructMembers(attributes, structOID)
+				structOID = ""
+				continue
+			}
+			structMembers++
+			structVariable = (memberType == "Octets" || memberType == "String") && size == 0
+
+			attributes = append(attributes, jRadiusAVP{
+				Code:   uint32(structMembers),
+				Name:   words[1],
+				Type:   memberType,
+				Size:   size,
+				Parent: structOID,
+			})
+			findAttributeByOID(attributes, structOID).Type = "Struct"
+			dict.Avps[currentVendorAVPsIndex].Attributes = attributes
+
+		case "STRUCT":
+			// Keyed structs are not supported
+			if structOID != "" {
+				dict.Avps[currentVendorAVPsIndex].Attributes = removeStructMembers(dict.Avps[currentVendorAVPsIndex].Attributes, structOID)
+				structOID = ""
 			}
 
 		case "VALUE":
@@ -175,26 +359,24 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 			val, err := strconv.Atoi(words[3])
 			if err != nil {
 				// Try in hexa
-				if val64, err := strconv.ParseInt(strings.TrimPrefix(words[3], "0x"), 16, 32); err != nil {
+				if val64, err := strconv.ParseUint(strings.TrimPrefix(words[3], "0x"), 16, 32); err != nil {
 					return errors.New("invalid VALUE " + line)
 				} else {
 					val = int(val64)
 				}
 			}
 
-			// Look for the attribute name
-			for i, attr := range dict.Avps[currentVendorAVPsIndex].Attributes {
-				if attr.Name == words[1] {
-
-					// Initialize if necessary
-					if attr.EnumValues == nil {
-						dict.Avps[currentVendorAVPsIndex].Attributes[i].EnumValues = make(map[string]int)
-					}
+			// Look for the attribute name. The last one defined, since attributes inside
+			// different TLVs may have the same name
+			if attr := findAttribute(dict.Avps[currentVendorAVPsIndex].Attributes, words[1]); attr != nil {
 
-					// Add item
-					dict.Avps[currentVendorAVPsIndex].Attributes[i].EnumValues[words[2]] = val
-					break
+				// Initialize if necessary
+				if attr.EnumValues == nil {
+					attr.EnumValues = make(map[string]int)
 				}
+
+				// Add item
+				attr.EnumValues[words[2]] = val
 			}
 		}
 	}
@@ -202,14 +384,99 @@ func ParseFreeradiusDictionary(c *ConfigurationManager, configObj string, dict *
 	return nil
 }
 
+// Returns the format of the vendor specific attributes in the list with the specified index. The standard
+// attributes and those in the Extended-Vendor-Specific spaces use 1 byte types
+func vendorAVPsFormat(dict *jRadiusDict, index int) RadiusVendorFormat {
+	vendorAVPs := dict.Avps[index]
+	if vendorAVPs.VendorId == 0 || vendorAVPs.Parent != "" {
+		return DefaultRadiusVendorFormat
+	}
+	for _, vendor := range dict.Vendors {
+		if vendor.VendorId == vendorAVPs.VendorId && vendor.Format != "" {
+			format, _ := parseRadiusVendorFormat(vendor.Format)
+			return format
+		}
+	}
+	return DefaultRadiusVendorFormat
+}
+
+// Removes the members of the struct with the specified OID, which is treated as octets
+func removeStructMembers(attributes []jRadiusAVP, oid string) []jRadiusAVP {
+	if structAttr := findAttributeByOID(attributes, oid); structAttr != nil {
+		structAttr.Type = "Octets"
+	}
+	filtered := make([]jRadiusAVP, 0, len(attributes))
+	for _, attr := range attributes {
+		if attr.Parent != oid {
+			filtered = append(filtered, attr)
+		}
+	}
+	return filtered
+}
+
+// Returns a pointer to the last attribute in the list with the specified name, or nil if not found
+func findAttribute(attributes []jRadiusAVP, name string) *jRadiusAVP {
+	for i := len(attributes) - 1; i >= 0; i-- {
+		if attributes[i].Name == name {
+			return &attributes[i]
+		}
+	}
+	return nil
+}
+
+// Returns a pointer to the last attribute in the list with the specified OID, or nil if not found
+func findAttributeByOID(attributes []jRadiusAVP, oid string) *jRadiusAVP {
+	for i := len(attributes) - 1; i >= 0; i-- {
+		if attributes[i].oid() == oid {
+			return &attributes[i]
+		}
+	}
+	return nil
+}
+
+// Returns the type of a struct member, and the size if octets[size]. Returns false if the type is not supported
+func parseStructMemberType(t string) (string, int, bool) {
+	switch strings.ToLower(t) {
+	case "byte", "uint8", "short", "uint16", "integer", "uint32", "signed", "int32", "integer64",
+		"ipaddr", "ipv6addr", "date", "ether", "ifid", "octets", "string":
+		return parseRadiusType(t), 0, true
+	case "uint64":
+		return "Integer64", 0, true
+	}
+	if strings.HasPrefix(t, "octets[") && strings.HasSuffix(t, "]") {
+		if size, err := strconv.Atoi(t[len("octets[") : len(t)-1]); err == nil && size > 0 {
+			return "Octets", size, true
+		}
+	}
+	return "", 0, false
+}
+
 func parseRadiusType(t string) string {
-	switch t {
-	case "integer", "uint32", "byte", "short", "signed", "time_delta":
+	switch strings.ToLower(t) {
+	case "integer", "uint32", "time_delta":
 		return "Integer"
-	case "string", "ipv4prefix":
+	case "byte", "uint8":
+		return "Byte"
+	case "short", "uint16":
+		return "Short"
+	case "signed", "int32":
+		return "Signed"
+	case "string":
 		return "String"
-	case "octets", "abinary", "struct", "tlv", "combo-ip", "ether":
+	case "ipv4prefix":
+		return "IPv4Prefix"
+	case "ether":
+		return "Ether"
+	case "combo-ip", "combo-ipaddr":
+		return "ComboIP"
+	case "abinary":
+		return "ABinary"
+	case "octets":
 		return "Octets"
+	case "struct":
+		return "Struct"
+	case "tlv":
+		return "TLV"
 	case "ipaddr":
 		return "Address"
 	case "date":
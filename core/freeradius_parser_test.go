@@ -34,4 +34,104 @@ func TestFreeradiusParser(t *testing.T) {
 	if otherAVP.Code != 3 {
 		t.Fatal("SessionStore-Id has not code 3")
 	}
+
+	// Attribute in extended space, with relative OIDs and enumerated values
+	tlvAVP, ok := dict.AVPByName["IP-Port-Limit-Info.Alloc"]
+	if !ok {
+		t.Fatal("Attribute IP-Port-Limit-Info.Alloc not found")
+	}
+	if tlvAVP.Code != 8 || tlvAVP.EnumValues["Allocation"] != 1 {
+		t.Fatal("bad IP-Port-Limit-Info.Alloc")
+	}
+	if tlvAVP.Parent.Name != "IP-Port-Limit-Info" || tlvAVP.Parent.Parent.Name != "Extended-Attribute-1" {
+		t.Fatal("bad parents of IP-Port-Limit-Info.Alloc")
+	}
+
+	// Cloned
+	if _, ok := dict.AVPByName["IP-Port-Forwarding-Map.Alloc"]; !ok {
+		t.Fatal("Attribute IP-Port-Forwarding-Map.Alloc not found")
+	}
+
+	// Nested TLV with absolute OID in vendor space
+	nestedAVP, ok := dict.AVPByName["FreeRADIUS-Stats4.Stats4-Packet-Counters.Stats4-Access-Accept"]
+	if !ok {
+		t.Fatal("Attribute FreeRADIUS-Stats4.Stats4-Packet-Counters.Stats4-Access-Accept not found")
+	}
+	if nestedAVP.Code != 2 || nestedAVP.Parent.Code != 9 || nestedAVP.Parent.Parent != dict.AVPByCode[RadiusAVPCode{VendorId: 11344, Code: 15}] {
+		t.Fatal("bad Stats4-Access-Accept")
+	}
+
+	// Extended vendor specific
+	evsAVP, ok := dict.AVPByName["FreeRADIUS-802_1X-EAPoL-Key-Msg"]
+	if !ok {
+		t.Fatal("Attribute FreeRADIUS-802_1X-EAPoL-Key-Msg not found")
+	}
+	if evsAVP.VendorId != 11344 || evsAVP.Parent.RadiusType != RadiusTypeEVS || evsAVP.Parent.Parent.Code != 245 {
+		t.Fatal("bad FreeRADIUS-802_1X-EAPoL-Key-Msg")
+	}
+}
+
+func TestFreeradiusStructs(t *testing.T) {
+
+	dict := GetRDict()
+
+	// Members are numbered in order
+	structAVP, ok := dict.AVPByName["WLAN-Venue-Info"]
+	if !ok || structAVP.RadiusType != RadiusTypeStruct {
+		t.Fatal("bad WLAN-Venue-Info")
+	}
+	members := structAVP.structMembers()
+	if len(members) != 3 || members[0].Name != "WLAN-Venue-Info.Reserved" || members[0].structMemberSize() != 2 || members[2].RadiusType != RadiusTypeByte {
+		t.Fatalf("bad members of WLAN-Venue-Info %v", members)
+	}
+
+	// Enumerated values in members
+	if directionAVP, ok := dict.AVPByName["3GPP-Packet-Filter.Direction"]; !ok || directionAVP.EnumValues["Uplink"] != 1 {
+		t.Fatal("bad 3GPP-Packet-Filter.Direction")
+	}
+
+	// Keyed structs and bit fields are not supported
+	for _, name := range []string{"3GPP-User-Location-Info", "3GPP-Secondary-RAT-Usage"} {
+		if avp, ok := dict.AVPByName[name]; !ok || avp.RadiusType != RadiusTypeOctets {
+			t.Errorf("%s should be octets", name)
+		}
+	}
+	if _, ok := dict.AVPByName["3GPP-User-Location-Info.Type"]; ok {
+		t.Error("member of unsupported struct was defined")
+	}
+}
+
+func TestFreeradiusVendorFormats(t *testing.T) {
+
+	dict := GetRDict()
+
+	if format := dict.GetVendorFormat(4846); format.TypeSize != 2 || format.LengthSize != 1 || format.Continuation {
+		t.Fatalf("bad Lucent format %v", format)
+	}
+	if format := dict.GetVendorFormat(429); format.TypeSize != 4 || format.LengthSize != 0 {
+		t.Fatalf("bad USR format %v", format)
+	}
+	if format := dict.GetVendorFormat(24757); format.TypeSize != 1 || format.LengthSize != 1 || !format.Continuation {
+		t.Fatalf("bad WiMAX format %v", format)
+	}
+	if format := dict.GetVendorFormat(9); format != DefaultRadiusVendorFormat {
+		t.Fatalf("bad Cisco format %v", format)
+	}
+
+	// Hex codes
+	if avp, ok := dict.AVPByName["USR-Last-Number-Dialed-In-DNIS"]; !ok || avp.Code != 0xE8 {
+		t.Fatal("bad USR-Last-Number-Dialed-In-DNIS")
+	}
+
+	// Codes that do not fit in the type are ignored
+	if _, ok := dict.AVPByName["BroadSoft-Intercept-Group-Routing-Number"]; ok {
+		t.Fatal("BroadSoft-Intercept-Group-Routing-Number with code 256 should have been ignored")
+	}
+
+	// Bad formats
+	for _, format := range []string{"3,1", "1,3", "2,1,c", "1"} {
+		if _, err := parseRadiusVendorFormat(format); err == nil {
+			t.Errorf("format %s should be invalid", format)
+		}
+	}
 }
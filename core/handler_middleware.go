@@ -0,0 +1,294 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Maximum number of handlers that may be still running after a timeout, for each timeout middleware.
+// If reached, the requests are rejected without invoking the handler, until some of them finish
+const MAX_ABANDONED_HANDLERS = 1000
+
+// States of a handler executed under a timeout middleware
+const (
+	handlerRunning   = 0
+	handlerFinished  = 1
+	handlerAbandoned = 2
+)
+
+// Returned by timeoutGuard.run when the handler did not finish in time
+var errHandlerTimeout = errors.New("handler timeout")
+
+// Executes handlers returning a T with a timeout, keeping track of the number of those
+// still running after it
+type timeoutGuard[T any] struct {
+	timeout time.Duration
+
+	// Number of handlers still running after a timeout
+	abandoned int64
+}
+
+// Returns true if MAX_ABANDONED_HANDLERS are still running after a timeout
+func (g *timeoutGuard[T]) saturated() bool {
+	return atomic.LoadInt64(&g.abandoned) >= MAX_ABANDONED_HANDLERS
+}
+
+// Executes the handler in another goroutine and waits for its result. If it does not finish in
+// the timeout, returns errHandlerTimeout and the handler is left running, its result discarded
+func (g *timeoutGuard[T]) run(handler func() (T, error)) (T, error) {
+
+	type result struct {
+		value T
+		err   error
+	}
+
+	// Buffered, so that the goroutine does not block if the result is not waited for
+	resultChan := make(chan result, 1)
+	var state int32 = handlerRunning
+	go func() {
+		value, err := handler()
+		resultChan <- result{value: value, err: err}
+		if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerFinished) {
+			atomic.AddInt64(&g.abandoned, -1)
+		}
+	}()
+
+	timer := time.NewTimer(g.timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-resultChan:
+		return r.value, r.err
+	case <-timer.C:
+		if !atomic.CompareAndSwapInt32(&state, handlerRunning, handlerAbandoned) {
+			// Finished in the meantime
+			r := <-resultChan
+			return r.value, r.err
+		}
+		atomic.AddInt64(&g.abandoned, 1)
+		var zero T
+		return zero, errHandlerTimeout
+	}
+}
+
+// Wraps a RadiusPacketHandler to add functionality before and after its execution
+type RadiusMiddleware func(next RadiusPacketHandler) RadiusPacketHandler
+
+// Wraps a DiameterMessageHandler to add functionality before and after its execution
+type DiameterMiddleware func(next DiameterMessageHandler) DiameterMessageHandler
+
+// Builds a handler that executes the middlewares in the order specified, the first one being the outermost,
+// and finally the handler. If the handler is nil, returns nil
+func ChainRadiusHandler(handler RadiusPacketHandler, middlewares ...RadiusMiddleware) RadiusPacketHandler {
+	if handler == nil {
+		return nil
+	}
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Builds a handler that executes the middlewares in the order specified, the first one being the outermost,
+// and finally the handler. If the handler is nil, returns nil
+func ChainDiameterHandler(handler DiameterMessageHandler, middlewares ...DiameterMiddleware) DiameterMessageHandler {
+	if handler == nil {
+		return nil
+	}
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Radius middlewares
+
+// Transforms a panic in the handler into an error, which is logged together with the stack trace
+func RadiusRecoveryMiddleware(next RadiusPacketHandler) RadiusPacketHandler {
+	return func(request *RadiusPacket) (response *RadiusPacket, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				GetLogger().Errorf("panic in radius handler for packet with code %d: %v\n%s", request.Code, r, debug.Stack())
+				RecordRadiusHandlerPanic(strconv.Itoa(int(request.Code)))
+				response = nil
+				err = fmt.Errorf("panic in radius handler: %v", r)
+			}
+		}()
+
+		return next(request)
+	}
+}
+
+// Returns a middleware that generates an error if the handler does not finish in the specified time.
+// The handler is not interrupted, and its result is discarded when finished. It works on a copy of the
+// request, so that the caller may go on using it after the timeout. No more than MAX_ABANDONED_HANDLERS
+// may be running after a timeout; if reached, the requests fail immediately
+func NewRadiusTimeoutMiddleware(timeout time.Duration) RadiusMiddleware {
+	return func(next RadiusPacketHandler) RadiusPacketHandler {
+
+		// The handler is executed in another goroutine, where the panics must also be recovered
+		recoveringNext := RadiusRecoveryMiddleware(next)
+
+		guard := &timeoutGuard[*RadiusPacket]{timeout: timeout}
+
+		return func(request *RadiusPacket) (*RadiusPacket, error) {
+
+			if guard.saturated() {
+				RecordRadiusHandlerTimeout(strconv.Itoa(int(request.Code)))
+				return nil, fmt.Errorf("radius handler not invoked: too many handlers running after timeout")
+			}
+
+			handlerRequest := request.Copy(nil, nil)
+			response, err := guard.run(func() (*RadiusPacket, error) {
+				return recoveringNext(handlerRequest)
+			})
+			if err == errHandlerTimeout {
+				RecordRadiusHandlerTimeout(strconv.Itoa(int(request.Code)))
+				return nil, fmt.Errorf("radius handler timeout after %s", timeout)
+			}
+
+			return response, err
+		}
+	}
+}
+
+// Logs the request, the response or error and the time taken, with debug level
+func RadiusLoggingMiddleware(next RadiusPacketHandler) RadiusPacketHandler {
+	return func(request *RadiusPacket) (*RadiusPacket, error) {
+		GetLogger().Debugf("radius handler received %s", request)
+
+		startTime := time.Now()
+		response, err := next(request)
+		if err != nil {
+			GetLogger().Debugf("radius handler returned error after %s: %s", time.Since(startTime), err)
+		} else {
+			GetLogger().Debugf("radius handler returned after %s: %s", time.Since(startTime), response)
+		}
+
+		return response, err
+	}
+}
+
+// Records the time taken by the handler in the radius_handler_duration_seconds metric
+func RadiusMetricsMiddleware(next RadiusPacketHandler) RadiusPacketHandler {
+	return func(request *RadiusPacket) (*RadiusPacket, error) {
+		startTime := time.Now()
+		response, err := next(request)
+		RecordRadiusHandlerDuration(strconv.Itoa(int(request.Code)), err == nil, time.Since(startTime))
+
+		return response, err
+	}
+}
+
+// Returns a middleware that executes the specified function before the handler, typically
+// to add attributes to the request. If the function returns an error, the handler is not invoked
+func NewRadiusEnrichmentMiddleware(enrich func(request *RadiusPacket) error) RadiusMiddleware {
+	return func(next RadiusPacketHandler) RadiusPacketHandler {
+		return func(request *RadiusPacket) (*RadiusPacket, error) {
+			if err := enrich(request); err != nil {
+				return nil, fmt.Errorf("could not enrich radius request: %w", err)
+			}
+
+			return next(request)
+		}
+	}
+}
+
+// Diameter middlewares
+
+// Transforms a panic in the handler into an error, which is logged together with the stack trace
+func DiameterRecoveryMiddleware(next DiameterMessageHandler) DiameterMessageHandler {
+	return func(request *DiameterMessage) (answer *DiameterMessage, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				GetLogger().Errorf("panic in diameter handler for %s %s: %v\n%s", request.ApplicationName, request.CommandName, r, debug.Stack())
+				RecordDiameterHandlerPanic(request.ApplicationName, request.CommandName)
+				answer = nil
+				err = fmt.Errorf("panic in diameter handler: %v", r)
+			}
+		}()
+
+		return next(request)
+	}
+}
+
+// Returns a middleware that generates an error if the handler does not finish in the specified time.
+// The handler is not interrupted, and its result is discarded when finished. It works on a copy of the
+// request, so that the caller may go on using it after the timeout. No more than MAX_ABANDONED_HANDLERS
+// may be running after a timeout; if reached, the requests fail immediately
+func NewDiameterTimeoutMiddleware(timeout time.Duration) DiameterMiddleware {
+	return func(next DiameterMessageHandler) DiameterMessageHandler {
+
+		// The handler is executed in another goroutine, where the panics must also be recovered
+		recoveringNext := DiameterRecoveryMiddleware(next)
+
+		guard := &timeoutGuard[*DiameterMessage]{timeout: timeout}
+
+		return func(request *DiameterMessage) (*DiameterMessage, error) {
+
+			if guard.saturated() {
+				RecordDiameterHandlerTimeout(request.ApplicationName, request.CommandName)
+				return nil, fmt.Errorf("diameter handler not invoked: too many handlers running after timeout")
+			}
+
+			handlerRequest := request.Copy(nil, nil)
+			answer, err := guard.run(func() (*DiameterMessage, error) {
+				return recoveringNext(handlerRequest)
+			})
+			if err == errHandlerTimeout {
+				RecordDiameterHandlerTimeout(request.ApplicationName, request.CommandName)
+				return nil, fmt.Errorf("diameter handler timeout after %s", timeout)
+			}
+
+			return answer, err
+		}
+	}
+}
+
+// Logs the request, the answer or error and the time taken, with debug level
+func DiameterLoggingMiddleware(next DiameterMessageHandler) DiameterMessageHandler {
+	return func(request *DiameterMessage) (*DiameterMessage, error) {
+		GetLogger().Debugf("diameter handler received %s", request)
+
+		startTime := time.Now()
+		answer, err := next(request)
+		if err != nil {
+			GetLogger().Debugf("diameter handler returned error after %s: %s", time.Since(startTime), err)
+		} else {
+			GetLogger().Debugf("diameter handler returned after %s: %s", time.Since(startTime), answer)
+		}
+
+		return answer, err
+	}
+}
+
+// Records the time taken by the handler in the diameter_handler_duration_seconds metric
+func DiameterMetricsMiddleware(next DiameterMessageHandler) DiameterMessageHandler {
+	return func(request *DiameterMessage) (*DiameterMessage, error) {
+		startTime := time.Now()
+		answer, err := next(request)
+		RecordDiameterHandlerDuration(request.ApplicationName, request.CommandName, err == nil, time.Since(startTime))
+
+		return answer, err
+	}
+}
+
+// Returns a middleware that executes the specified function before the handler, typically
+// to add attributes to the request. If the function returns an error, the handler is not invoked
+func NewDiameterEnrichmentMiddleware(enrich func(request *DiameterMessage) error) DiameterMiddleware {
+	return func(next DiameterMessageHandler) DiameterMessageHandler {
+		return func(request *DiameterMessage) (*DiameterMessage, error) {
+			if err := enrich(request); err != nil {
+				return nil, fmt.Errorf("could not enrich diameter request: %w", err)
+			}
+
+			return next(request)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRadiusMiddlewareChain(t *testing.T) {
+
+	// Each middleware adds its name to the Class attribute before and after the handler
+	tracer := func(name string) RadiusMiddleware {
+		return func(next RadiusPacketHandler) RadiusPacketHandler {
+			return func(request *RadiusPacket) (*RadiusPacket, error) {
+				request.Add("Class", "before-"+name)
+				response, err := next(request)
+				if response != nil {
+					response.Add("Class", "after-"+name)
+				}
+				return response, err
+			}
+		}
+	}
+
+	handler := func(request *RadiusPacket) (*RadiusPacket, error) {
+		response := NewRadiusResponse(request, true)
+		for _, avp := range request.GetAllAVP("Class") {
+			response.AddAVP(&avp)
+		}
+		return response, nil
+	}
+
+	chained := ChainRadiusHandler(handler, tracer("first"), tracer("second"), RadiusLoggingMiddleware, RadiusMetricsMiddleware)
+	response, err := chained(NewRadiusRequest(ACCESS_REQUEST))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var classes []string
+	for _, avp := range response.GetAllAVP("Class") {
+		classes = append(classes, avp.GetString())
+	}
+	if strings.Join(classes, ",") != "before-first,before-second,after-second,after-first" {
+		t.Fatalf("bad order of execution of middlewares: %v", classes)
+	}
+
+	if ChainRadiusHandler(nil, RadiusRecoveryMiddleware) != nil {
+		t.Fatal("chain of nil handler is not nil")
+	}
+}
+
+func TestRadiusRecoveryAndTimeout(t *testing.T) {
+
+	panicHandler := func(request *RadiusPacket) (*RadiusPacket, error) {
+		panic("handler panic")
+	}
+	slowHandler := func(request *RadiusPacket) (*RadiusPacket, error) {
+		time.Sleep(200 * time.Millisecond)
+		return NewRadiusResponse(request, true), nil
+	}
+
+	// Panic is transformed into an error
+	if _, err := RadiusRecoveryMiddleware(panicHandler)(NewRadiusRequest(ACCESS_REQUEST)); err == nil || !strings.Contains(err.Error(), "handler panic") {
+		t.Fatalf("panic not recovered as error: %v", err)
+	}
+
+	// Also when executed under a timeout
+	if _, err := NewRadiusTimeoutMiddleware(100 * time.Millisecond)(panicHandler)(NewRadiusRequest(ACCESS_REQUEST)); err == nil || !strings.Contains(err.Error(), "handler panic") {
+		t.Fatalf("panic not recovered as error with timeout: %v", err)
+	}
+
+	// Timeout
+	if _, err := NewRadiusTimeoutMiddleware(100 * time.Millisecond)(slowHandler)(NewRadiusRequest(ACCESS_REQUEST)); err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("timeout not reported: %v", err)
+	}
+
+	// No timeout
+	if response, err := NewRadiusTimeoutMiddleware(1 * time.Second)(slowHandler)(NewRadiusRequest(ACCESS_REQUEST)); err != nil || response.Code != ACCESS_ACCEPT {
+		t.Fatalf("unexpected result with timeout not reached: %v", err)
+	}
+}
+
+func TestRadiusTimeoutAbandonedHandlers(t *testing.T) {
+
+	release := make(chan struct{})
+	var invocations int64
+	blockedHandler := func(request *RadiusPacket) (*RadiusPacket, error) {
+		atomic.AddInt64(&invocations, 1)
+		<-release
+		request.Add("Class", "modified")
+		return NewRadiusResponse(request, true), nil
+	}
+	handler := NewRadiusTimeoutMiddleware(10 * time.Millisecond)(blockedHandler)
+
+	// Fill the abandoned handlers
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	requestAVPs := len(request.AVPs)
+	var wg sync.WaitGroup
+	for i := 0; i < MAX_ABANDONED_HANDLERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			handler(request)
+		}()
+	}
+	wg.Wait()
+
+	// Rejected without invoking the handler
+	if _, err := handler(request); err == nil || !strings.Contains(err.Error(), "too many") {
+		t.Fatalf("request not rejected with too many abandoned handlers: %v", err)
+	}
+	if n := atomic.LoadInt64(&invocations); n != MAX_ABANDONED_HANDLERS {
+		t.Fatalf("handler invoked %d times", n)
+	}
+
+	// The abandoned handlers do not modify the original request
+	close(release)
+	time.Sleep(100 * time.Millisecond)
+	if len(request.AVPs) != requestAVPs {
+		t.Fatalf("request modified by abandoned handler: %s", request)
+	}
+
+	// Accepted again once the handlers finish
+	if response, err := handler(request); err != nil || response.Code != ACCESS_ACCEPT {
+		t.Fatalf("request not processed after the abandoned handlers finished: %v", err)
+	}
+}
+
+func TestRadiusEnrichment(t *testing.T) {
+
+	handler := func(request *RadiusPacket) (*RadiusPacket, error) {
+		return NewRadiusResponse(request, true).Add("Reply-Message", request.GetStringAVP("Class")), nil
+	}
+
+	enriched := NewRadiusEnrichmentMiddleware(func(request *RadiusPacket) error {
+		request.Add("Class", "enriched")
+		return nil
+	})(handler)
+	if response, _ := enriched(NewRadiusRequest(ACCESS_REQUEST)); response.GetStringAVP("Reply-Message") != "enriched" {
+		t.Fatalf("request was not enriched")
+	}
+
+	failed := NewRadiusEnrichmentMiddleware(func(request *RadiusPacket) error {
+		return errors.New("no data")
+	})(handler)
+	if _, err := failed(NewRadiusRequest(ACCESS_REQUEST)); err == nil {
+		t.Fatalf("enrichment error not reported")
+	}
+}
+
+func TestDiameterMiddlewares(t *testing.T) {
+
+	panicHandler := func(request *DiameterMessage) (*DiameterMessage, error) {
+		panic("handler panic")
+	}
+	echoHandler := func(request *DiameterMessage) (*DiameterMessage, error) {
+		return NewDiameterAnswer(request).Add("User-Name", request.GetStringAVP("User-Name")), nil
+	}
+
+	request, err := NewDiameterRequest("Gx", "Credit-Control")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ChainDiameterHandler(panicHandler, DiameterRecoveryMiddleware)(request); err == nil {
+		t.Fatal("panic not recovered as error")
+	}
+
+	chained := ChainDiameterHandler(echoHandler,
+		DiameterLoggingMiddleware,
+		DiameterMetricsMiddleware,
+		NewDiameterTimeoutMiddleware(1*time.Second),
+		NewDiameterEnrichmentMiddleware(func(request *DiameterMessage) error {
+			request.Add("User-Name", "enriched")
+			return nil
+		}))
+	answer, err := chained(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if answer.GetStringAVP("User-Name") != "enriched" {
+		t.Fatalf("bad User-Name in answer: %s", answer.GetStringAVP("User-Name"))
+	}
+}
@@ -38,6 +38,11 @@ type RadiusServerTableEntry struct {
 	ServerName       string
 	IsAvailable      bool
 	UnavailableUntil time.Time
+
+	// Status-Server probes of the unavailable servers
+	ProbeSuccesses     int
+	LastProbeTime      time.Time
+	LastProbeRTTMillis float64
 }
 
 type RadiusServersTable []RadiusServerTableEntry
@@ -227,11 +232,20 @@ func (is *InstrumentationServer) metricServerLoop() {
 
 			switch query.Name {
 
+			// A copy is returned, since the maps are updated in this loop
 			case "DiameterPeersTables":
-				query.RChan <- is.diameterPeersTables
+				tables := make(map[string]DiameterPeersTable, len(is.diameterPeersTables))
+				for instanceName, table := range is.diameterPeersTables {
+					tables[instanceName] = table
+				}
+				query.RChan <- tables
 
 			case "RadiusServersTables":
-				query.RChan <- is.radiusServersTables
+				tables := make(map[string]RadiusServersTable, len(is.radiusServersTables))
+				for instanceName, table := range is.radiusServersTables {
+					tables[instanceName] = table
+				}
+				query.RChan <- tables
 			}
 
 			close(query.RChan)
@@ -1,11 +1,40 @@
 package core
 
 import (
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
 )
 
+// Transports for radius
+const (
+	RadiusTransportUDP    = "udp"
+	RadiusTransportTCP    = "tcp"
+	RadiusTransportRadSec = "radsec"
+)
+
+// As specified in RFC 6614, the shared secret to use in RadSec is fixed
+const RADSEC_SECRET = "radsec"
+
+// Default port for RadSec
+const RADSEC_DEFAULT_PORT = 2083
+
+// Realm types for the radius routing rules. In "suffix" the User-Name is <user>@<realm>, and in "prefix"
+// it is <realm>/<user>
+const (
+	RadiusRealmSuffix = "suffix"
+	RadiusRealmPrefix = "prefix"
+)
+
+// Value of the server group in a radius routing rule that forces the requests to be handled locally
+const RadiusLocalServerGroup = "local"
+
+// Default number of successful Status-Server probes in a row for an upstream radius server
+// to be available again
+const DEFAULT_PROBE_SUCCESSES = 2
+
 // Manages the configuration items for policy (radius & diameter).
 // The calls to get the configuration objects return a copy. If Update
 // is called later, the copy returned is not modified.
@@ -20,6 +49,7 @@ type PolicyConfigurationManager struct {
 	radiusClients      *ConfigObject[RadiusClients]
 	radiusServers      *ConfigObject[RadiusServers]
 	radiusHttpHandlers *ConfigObject[RadiusHttpHandlers]
+	radiusRoutes       *ConfigObject[RadiusRoutingRules]
 
 	httpRouterConfig *ConfigObject[HttpRouterConfig]
 }
@@ -53,6 +83,7 @@ func InitPolicyConfigInstance(bootstrapFile string, instanceName string,
 		radiusServers:        NewConfigObject[RadiusServers]("radiusServers.json"),
 		radiusClients:        NewConfigObject[RadiusClients]("radiusClients.json"),
 		radiusHttpHandlers:   NewConfigObject[RadiusHttpHandlers]("radiusHttpHandlers.json"),
+		radiusRoutes:         NewConfigObject[RadiusRoutingRules]("radiusRoutes.json"),
 		httpRouterConfig:     NewConfigObject[HttpRouterConfig]("httpRouter.json"),
 	}
 	policyConfigs = append(policyConfigs, &policyConfig)
@@ -107,6 +138,10 @@ func InitPolicyConfigInstance(bootstrapFile string, instanceName string,
 	if cerr = policyConfig.UpdateRadiusHttpHandlers(); cerr != nil && radiusServerEnabled {
 		panic(cerr)
 	}
+	// The radius routes are optional. If not found, all the requests received are handled locally
+	if cerr = policyConfig.UpdateRadiusRoutingRules(); cerr != nil && !errors.Is(cerr, ErrObjectNotFound) && radiusServerEnabled {
+		panic(cerr)
+	}
 
 	// Load http router configuration
 	if cerr = policyConfig.UpdateHttpRouterConfig(); cerr != nil {
@@ -137,7 +172,10 @@ func GetPolicyConfig() *PolicyConfigurationManager {
 ///////////////////////////////////////////////////////////////////////////////
 
 type DiameterServerConfig struct {
+	// Either BindAddress or BindAddresses may be specified. After initialization, both are filled.
+	// The addresses may be IPv4 or IPv6. "::" listens in all the IPv4 and IPv6 addresses
 	BindAddress          string
+	BindAddresses        []string
 	BindPort             int
 	DiameterHost         string
 	DiameterRealm        string
@@ -147,6 +185,68 @@ type DiameterServerConfig struct {
 	PeerCheckTimeSeconds int
 }
 
+// Implements the Initializable interface
+// Makes BindAddress and BindAddresses consistent
+func (dsc *DiameterServerConfig) initialize() error {
+	if len(dsc.BindAddresses) == 0 {
+		if dsc.BindAddress != "" {
+			dsc.BindAddresses = []string{dsc.BindAddress}
+		}
+	} else if dsc.BindAddress == "" {
+		dsc.BindAddress = dsc.BindAddresses[0]
+	}
+
+	for _, address := range dsc.BindAddresses {
+		if net.ParseIP(address) == nil {
+			return fmt.Errorf("bad diameter bind address %s", address)
+		}
+	}
+
+	return nil
+}
+
+// Returns the IP addresses of this server, to be advertised in the Host-IP-Address AVPs.
+// Wildcard bind addresses are replaced by the addresses of the local interfaces, of the
+// corresponding IP version if "0.0.0.0" or all of them if "::"
+func (dsc DiameterServerConfig) HostIPAddresses() []net.IP {
+	var hostIPAddresses []net.IP
+	for _, address := range dsc.BindAddresses {
+		ipAddress := net.ParseIP(address)
+		if !ipAddress.IsUnspecified() {
+			hostIPAddresses = appendIPAddress(hostIPAddresses, ipAddress)
+			continue
+		}
+
+		interfaceAddrs, err := net.InterfaceAddrs()
+		if err != nil {
+			GetLogger().Errorf("could not get the interface addresses: %s", err)
+			continue
+		}
+		for _, interfaceAddr := range interfaceAddrs {
+			ipNet, ok := interfaceAddr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLoopback() || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipAddress.To4() != nil && ipNet.IP.To4() == nil {
+				continue
+			}
+			hostIPAddresses = appendIPAddress(hostIPAddresses, ipNet.IP)
+		}
+	}
+
+	return hostIPAddresses
+}
+
+// Appends the ip address to the list, if not already there
+func appendIPAddress(ipAddresses []net.IP, ipAddress net.IP) []net.IP {
+	for _, ip := range ipAddresses {
+		if ip.Equal(ipAddress) {
+			return ipAddresses
+		}
+	}
+	return append(ipAddresses, ipAddress)
+}
+
 // Updates the diameter server configuration in the corresponding configuration manager
 func (c *PolicyConfigurationManager) UpdateDiameterServerConfig() error {
 	return c.diameterServerConfig.Update(&c.CM)
@@ -159,12 +259,111 @@ func (c *PolicyConfigurationManager) DiameterServerConf() DiameterServerConfig {
 
 // /////////////////////////////////////////////////////////////////////////////
 type RadiusServerConfig struct {
-	BindAddress               string
+	// Either BindAddress or BindAddresses may be specified. After initialization, both are filled.
+	// The addresses may be IPv4 or IPv6. "::" listens in all the IPv4 and IPv6 addresses, and is the
+	// default if none is specified but some port is
+	BindAddress   string
+	BindAddresses []string
+
+	// Addresses for each service. If not specified, the BindAddresses are used
+	AuthBindAddresses []string
+	AcctBindAddresses []string
+	CoABindAddresses  []string
+
+	// Source address of the packets sent to upstream servers that do not belong to a group with its own
+	// origin address. If not specified, the BindAddress is used, unless it is a wildcard address, in which case
+	// the origin sockets are bound to all the IPv4 and IPv6 addresses
+	OriginAddress string
+
 	AuthPort                  int
 	AcctPort                  int
 	CoAPort                   int
 	OriginPorts               []int
 	HttpHandlerTimeoutSeconds int
+
+	// Time during which the requests received are remembered to detect retransmissions.
+	// If 0, the default is used. If negative, duplicate detection is disabled
+	DuplicateCacheSeconds int
+
+	// If true, TCP connections (RFC 6613) are also accepted in the auth, acct and coa ports
+	EnableTCP bool
+
+	// Port for receiving RadSec connections. If 0, RadSec is not enabled
+	RadSecPort int
+
+	// Certificate and key to use for RadSec, both as server and as client. If not
+	// specified, the ones returned by EnsureCertificates are used
+	RadSecCertFile string
+	RadSecKeyFile  string
+
+	// CA to verify the certificates of the RadSec peers. Mandatory if RadSec is used
+	RadSecCAFile string
+
+	// Limits to the processing of the requests received in each port, UDP, TCP or RadSec
+	RadiusServerLimits
+}
+
+// Limits to the processing of the requests received by a radius server, to protect
+// against overload. The requests exceeding the limits are dropped
+type RadiusServerLimits struct {
+	// Number of goroutines processing the requests. If 0, a default value is used. If negative, a new
+	// goroutine is started for each request, without limit
+	Workers int
+
+	// Maximum number of requests waiting for a worker. Access-Request and the rest of the requests are queued
+	// separately, and Access-Request are processed first. If 0, a default value is used
+	QueueSize int
+
+	// Maximum number of requests from the same radius client being processed or waiting. If 0, there is no limit
+	MaxInFlightPerClient int
+}
+
+// Implements the Initializable interface
+// Makes BindAddress and BindAddresses consistent and fills the addresses of each service
+func (rsc *RadiusServerConfig) initialize() error {
+	if len(rsc.BindAddresses) == 0 {
+		if rsc.BindAddress != "" {
+			rsc.BindAddresses = []string{rsc.BindAddress}
+		} else if rsc.AuthPort != 0 || rsc.AcctPort != 0 || rsc.CoAPort != 0 || rsc.RadSecPort != 0 {
+			// Listen in all the addresses
+			rsc.BindAddress = "::"
+			rsc.BindAddresses = []string{rsc.BindAddress}
+		}
+	} else if rsc.BindAddress == "" {
+		rsc.BindAddress = rsc.BindAddresses[0]
+	}
+
+	if len(rsc.AuthBindAddresses) == 0 {
+		rsc.AuthBindAddresses = rsc.BindAddresses
+	}
+	if len(rsc.AcctBindAddresses) == 0 {
+		rsc.AcctBindAddresses = rsc.BindAddresses
+	}
+	if len(rsc.CoABindAddresses) == 0 {
+		rsc.CoABindAddresses = rsc.BindAddresses
+	}
+
+	for _, addresses := range [][]string{rsc.BindAddresses, rsc.AuthBindAddresses, rsc.AcctBindAddresses, rsc.CoABindAddresses} {
+		for _, address := range addresses {
+			if net.ParseIP(address) == nil {
+				return fmt.Errorf("bad radius bind address %s", address)
+			}
+		}
+	}
+
+	if rsc.OriginAddress == "" {
+		if ip := net.ParseIP(rsc.BindAddress); ip != nil && !ip.IsUnspecified() {
+			rsc.OriginAddress = rsc.BindAddress
+		}
+	} else if net.ParseIP(rsc.OriginAddress) == nil {
+		return fmt.Errorf("bad radius origin address %s", rsc.OriginAddress)
+	}
+
+	if rsc.RadSecPort != 0 && rsc.RadSecCAFile == "" {
+		return fmt.Errorf("radSecCAFile is required when radSecPort is specified")
+	}
+
+	return nil
 }
 
 // Updates the radius server configuration in the corresponding configuration manager
@@ -188,6 +387,15 @@ type RadiusClient struct {
 	RadiusAttributes               []RadiusAVP
 	NonOverridableRadiusAttributes []RadiusAVP
 
+	// Check of the Message-Authenticator in the requests received from this client.
+	// May be "require", "validate-if-present" (the default) or "ignore"
+	MessageAuthenticator string
+
+	// For RadSec clients, the Common Name or DNS name in the certificate that identifies this client.
+	// If a RadSec client does not present a certificate matching any of the configured names, it
+	// is identified by its IP address
+	CertificateName string
+
 	// Cooked attribute, in case the IP address is in reality a CIDR block
 	OriginNetworkCIDR net.IPNet
 }
@@ -203,12 +411,16 @@ func (rc RadiusClients) initialize() error {
 
 		// For completeness only, just copy the key, which should be the IP address
 		if radiusClient.OriginIP == "" {
-			radiusClient.OriginIP = key + "/32"
+			radiusClient.OriginIP = key
 		}
 
 		// Move to CIDR format, if only one IP address was specified
 		if !strings.Contains(radiusClient.OriginIP, "/") {
-			radiusClient.OriginIP = radiusClient.OriginIP + "/32"
+			if strings.Contains(radiusClient.OriginIP, ":") {
+				radiusClient.OriginIP = radiusClient.OriginIP + "/128"
+			} else {
+				radiusClient.OriginIP = radiusClient.OriginIP + "/32"
+			}
 		}
 
 		// Parse and generate the origin network
@@ -219,6 +431,10 @@ func (rc RadiusClients) initialize() error {
 		radiusClient.OriginNetworkCIDR = *ipNet
 		radiusClient.OriginIP = ipNet.String()
 
+		if err := checkMessageAuthenticatorPolicy(radiusClient.MessageAuthenticator); err != nil {
+			return fmt.Errorf("radius client %s: %w", key, err)
+		}
+
 		// Set the value with the new cooked radiusClient
 		rc[key] = radiusClient
 	}
@@ -244,6 +460,26 @@ func (rc RadiusClients) FindRadiusClient(ipAddress net.IP) (RadiusClient, error)
 	return RadiusClient{}, fmt.Errorf("no suitable radius client for %s", ipAddress.String())
 }
 
+// Get the radius client whose CertificateName is the Common Name or one of the DNS names of the specified certificate
+func (rc RadiusClients) FindRadiusClientByCertificate(cert *x509.Certificate) (RadiusClient, error) {
+
+	for _, radiusClient := range rc {
+		if radiusClient.CertificateName == "" {
+			continue
+		}
+		if radiusClient.CertificateName == cert.Subject.CommonName {
+			return radiusClient, nil
+		}
+		for _, dnsName := range cert.DNSNames {
+			if radiusClient.CertificateName == dnsName {
+				return radiusClient, nil
+			}
+		}
+	}
+
+	return RadiusClient{}, fmt.Errorf("no suitable radius client for certificate %s", cert.Subject.String())
+}
+
 // Updates the radius clients configuration in the global variable
 func (c *PolicyConfigurationManager) UpdateRadiusClients() error {
 	return c.radiusClients.Update(&c.CM)
@@ -265,6 +501,20 @@ type RadiusServer struct {
 	OriginPorts           []int
 	ErrorLimit            int
 	QuarantineTimeSeconds int
+
+	// Check of the Message-Authenticator in the responses received from this server.
+	// May be "require", "validate-if-present" (the default) or "ignore"
+	MessageAuthenticator string
+
+	// May be "udp" (the default), "tcp" or "radsec". For RadSec, the ports not specified take the
+	// default value of 2083, and the secret is always "radsec"
+	Transport string
+
+	// If not zero, the server is probed with Status-Server (RFC 5997) every ProbeIntervalSeconds while
+	// unavailable, and it is not available again until the quarantine time has elapsed and ProbeSuccesses
+	// probes in a row have been answered (2 if not specified)
+	ProbeIntervalSeconds int
+	ProbeSuccesses       int
 }
 
 // Holds the configuration of a Radius Server Group
@@ -274,6 +524,10 @@ type RadiusServerGroup struct {
 
 	// policy may be "fixed" or "random"
 	Policy string
+
+	// Source IP address of the packets sent to the servers in this group. If not specified, the
+	// OriginAddress in the radius server configuration is used
+	OriginAddress string
 }
 
 // Holds the RadiusServers and Groups configuration, as stored in the radiusServers.json file
@@ -282,6 +536,58 @@ type RadiusServers struct {
 	ServerGroups map[string]RadiusServerGroup
 }
 
+// Implements the Initializable interface
+func (rs *RadiusServers) initialize() error {
+	for groupName, group := range rs.ServerGroups {
+		if group.OriginAddress != "" && net.ParseIP(group.OriginAddress) == nil {
+			return fmt.Errorf("radius server group %s: bad origin address %s", groupName, group.OriginAddress)
+		}
+	}
+
+	for serverName, server := range rs.Servers {
+		if err := checkMessageAuthenticatorPolicy(server.MessageAuthenticator); err != nil {
+			return fmt.Errorf("radius server %s: %w", serverName, err)
+		}
+
+		switch server.Transport {
+		case "", RadiusTransportUDP:
+			server.Transport = RadiusTransportUDP
+		case RadiusTransportTCP:
+		case RadiusTransportRadSec:
+			server.Secret = RADSEC_SECRET
+			if server.AuthPort == 0 {
+				server.AuthPort = RADSEC_DEFAULT_PORT
+			}
+			if server.AcctPort == 0 {
+				server.AcctPort = RADSEC_DEFAULT_PORT
+			}
+			if server.COAPort == 0 {
+				server.COAPort = RADSEC_DEFAULT_PORT
+			}
+		default:
+			return fmt.Errorf("radius server %s: bad transport %s", serverName, server.Transport)
+		}
+
+		if server.ProbeIntervalSeconds > 0 && server.ProbeSuccesses <= 0 {
+			server.ProbeSuccesses = DEFAULT_PROBE_SUCCESSES
+		}
+
+		rs.Servers[serverName] = server
+	}
+
+	return nil
+}
+
+// Checks that the value for the Message-Authenticator policy is valid
+func checkMessageAuthenticatorPolicy(policy string) error {
+	switch policy {
+	case "", MessageAuthenticatorRequire, MessageAuthenticatorValidateIfPresent, MessageAuthenticatorIgnore:
+		return nil
+	default:
+		return fmt.Errorf("bad Message-Authenticator policy %s", policy)
+	}
+}
+
 // Updates the radius servers configuration in the global variable
 func (c *PolicyConfigurationManager) UpdateRadiusServers() error {
 	return c.radiusServers.Update(&c.CM)
@@ -309,6 +615,129 @@ func (c *PolicyConfigurationManager) RadiusHttpHandlers() RadiusHttpHandlers {
 	return c.radiusHttpHandlers.Get()
 }
 
+// Holds a Radius routing rule, which specifies how to treat the requests received for a realm
+type RadiusRoutingRule struct {
+	// Realm to match. "*" matches any realm, and "" the user names without realm
+	Realm string
+
+	// May be "suffix" (the default) or "prefix"
+	RealmType string
+
+	// Separator between the user and the realm. "@" by default for suffix realms and "/" for prefix realms
+	RealmSeparator string
+
+	// If true, the realm is removed from the User-Name before handling or proxying the request
+	StripRealm bool
+
+	// Server group to send the requests to. If empty, the requests are handled locally.
+	// The server groups per code take precedence, and may be "local" to force local handling
+	// of that code even if the ServerGroup is specified
+	ServerGroup     string
+	AuthServerGroup string
+	AcctServerGroup string
+	COAServerGroup  string
+
+	// Parameters for proxying the requests. If zero, the defaults of the router are used
+	PerRequestTimeoutMillis int
+	Tries                   int
+	ServerTries             int
+
+	// Names of the attribute filters, in radiusFilters.json, to apply to the proxied requests and
+	// to their responses. If empty, the attributes are not filtered
+	RequestFilter  string
+	ResponseFilter string
+}
+
+// Holds all the Radius routing rules, as stored in the radiusRoutes.json file. They are evaluated in order
+type RadiusRoutingRules []RadiusRoutingRule
+
+// Implements the Initializable interface
+// Validates the realm types and sets the default separators
+func (rr RadiusRoutingRules) initialize() error {
+	for i := range rr {
+		switch rr[i].RealmType {
+		case "", RadiusRealmSuffix:
+			rr[i].RealmType = RadiusRealmSuffix
+			if rr[i].RealmSeparator == "" {
+				rr[i].RealmSeparator = "@"
+			}
+		case RadiusRealmPrefix:
+			if rr[i].RealmSeparator == "" {
+				rr[i].RealmSeparator = "/"
+			}
+		default:
+			return fmt.Errorf("radius route for realm %s: bad realm type %s", rr[i].Realm, rr[i].RealmType)
+		}
+	}
+
+	return nil
+}
+
+// Splits the User-Name in the user and realm parts, as specified in the rule. If the User-Name does not
+// have a realm, the user is the full User-Name and the realm is empty
+func (rule RadiusRoutingRule) SplitUserName(userName string) (user string, realm string) {
+	if rule.RealmType == RadiusRealmPrefix {
+		if before, after, found := strings.Cut(userName, rule.RealmSeparator); found {
+			return after, before
+		}
+	} else if i := strings.LastIndex(userName, rule.RealmSeparator); i >= 0 {
+		return userName[:i], userName[i+len(rule.RealmSeparator):]
+	}
+
+	return userName, ""
+}
+
+// Returns the server group to send the requests with the specified code to, or
+// an empty string if they are to be handled locally
+func (rule RadiusRoutingRule) ServerGroupFor(code RadiusPacketType) string {
+	var serverGroup string
+	switch code {
+	case ACCESS_REQUEST:
+		serverGroup = rule.AuthServerGroup
+	case ACCOUNTING_REQUEST:
+		serverGroup = rule.AcctServerGroup
+	case COA_REQUEST, DISCONNECT_REQUEST:
+		serverGroup = rule.COAServerGroup
+	}
+
+	switch serverGroup {
+	case "":
+		return rule.ServerGroup
+	case RadiusLocalServerGroup:
+		return ""
+	default:
+		return serverGroup
+	}
+}
+
+// Finds the first rule whose realm matches the one in the User-Name. Realms are compared
+// case insensitively. Returns also the User-Name to use, with the realm removed if so specified in the rule
+func (rr RadiusRoutingRules) FindRadiusRoutingRule(userName string) (RadiusRoutingRule, string, error) {
+	for _, rule := range rr {
+		user, realm := rule.SplitUserName(userName)
+		if rule.Realm == "*" || strings.EqualFold(rule.Realm, realm) {
+			if rule.StripRealm {
+				return rule, user, nil
+			}
+			return rule, userName, nil
+		}
+	}
+
+	return RadiusRoutingRule{}, userName, fmt.Errorf("radius route not found for %s", userName)
+}
+
+// Updates the radius routing rules configuration in the global variable
+func (c *PolicyConfigurationManager) UpdateRadiusRoutingRules() error {
+	return c.radiusRoutes.Update(&c.CM)
+}
+
+// Retrieves the contents of the global variable containing the radius routing rules configuration.
+// Empty if the configuration was not found
+func (c *PolicyConfigurationManager) RadiusRoutingRules() RadiusRoutingRules {
+	rules, _ := c.radiusRoutes.getIfLoaded()
+	return rules
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 
 // Holds a Diameter Routing rule
@@ -354,7 +783,10 @@ func (c *PolicyConfigurationManager) DiameterRoutingRules() DiameterRoutingRules
 
 // Holds the configuration of a Diameter Peer
 type DiameterPeerConf struct {
+	// Either IPAddress or IPAddresses may be specified. After initialization, both are filled.
+	// For active peers, the connection is tried to each address in order
 	IPAddress               string
+	IPAddresses             []string
 	Port                    int
 	ConnectionPolicy        string // May be "active" or "passive"
 	OriginNetwork           string // CIDR
@@ -380,6 +812,13 @@ func (dps DiameterPeers) initialize() error {
 		}
 		peer.OriginNetworkCIDR = *ipNet
 		peer.DiameterHost = dHost
+		if len(peer.IPAddresses) == 0 {
+			if peer.IPAddress != "" {
+				peer.IPAddresses = []string{peer.IPAddress}
+			}
+		} else if peer.IPAddress == "" {
+			peer.IPAddress = peer.IPAddresses[0]
+		}
 		dps[dHost] = peer
 	}
 
@@ -6,6 +6,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -24,14 +25,21 @@ var pm struct {
 // Metrics definitions
 // ///////////////////////////////////////////////////////////////
 type RadiusPrometheusMetrics struct {
-	RadiusServerRequests         *prometheus.CounterVec
-	RadiusServerResponses        *prometheus.CounterVec
-	RadiusServerDrops            *prometheus.CounterVec
-	RadiusClientRequests         *prometheus.CounterVec
-	RadiusClientResponses        *prometheus.CounterVec
-	RadiusClientTimeouts         *prometheus.CounterVec
-	RadiusClientResponsesStalled *prometheus.CounterVec
-	RadiusClientResponsesDropped *prometheus.CounterVec
+	RadiusServerRequests             *prometheus.CounterVec
+	RadiusServerResponses            *prometheus.CounterVec
+	RadiusServerDrops                *prometheus.CounterVec
+	RadiusClientRequests             *prometheus.CounterVec
+	RadiusClientResponses            *prometheus.CounterVec
+	RadiusClientTimeouts             *prometheus.CounterVec
+	RadiusClientResponsesStalled     *prometheus.CounterVec
+	RadiusClientResponsesDropped     *prometheus.CounterVec
+	RadiusMessageAuthenticatorDrops  *prometheus.CounterVec
+	RadiusServerDuplicateCacheHits   *prometheus.CounterVec
+	RadiusServerDuplicateCacheMisses *prometheus.CounterVec
+	RadiusServerOverloadDrops        *prometheus.CounterVec
+	RadiusHandlerPanics              *prometheus.CounterVec
+	RadiusHandlerTimeouts            *prometheus.CounterVec
+	RadiusHandlerDuration            *prometheus.HistogramVec
 }
 
 func (m *RadiusPrometheusMetrics) reset() {
@@ -43,6 +51,13 @@ func (m *RadiusPrometheusMetrics) reset() {
 	m.RadiusClientTimeouts.Reset()
 	m.RadiusClientResponsesStalled.Reset()
 	m.RadiusClientResponsesDropped.Reset()
+	m.RadiusMessageAuthenticatorDrops.Reset()
+	m.RadiusServerDuplicateCacheHits.Reset()
+	m.RadiusServerDuplicateCacheMisses.Reset()
+	m.RadiusServerOverloadDrops.Reset()
+	m.RadiusHandlerPanics.Reset()
+	m.RadiusHandlerTimeouts.Reset()
+	m.RadiusHandlerDuration.Reset()
 }
 
 type DiameterPrometheusMetrics struct {
@@ -57,6 +72,14 @@ type DiameterPrometheusMetrics struct {
 	RouterPeerNotAvailable *prometheus.CounterVec
 
 	RouterHandlerErrors *prometheus.CounterVec
+
+	PeerWriteQueueDepth *prometheus.GaugeVec
+	PeerWriteQueueDrops *prometheus.CounterVec
+	PeerWriteLatency    *prometheus.HistogramVec
+
+	DiameterHandlerPanics   *prometheus.CounterVec
+	DiameterHandlerTimeouts *prometheus.CounterVec
+	DiameterHandlerDuration *prometheus.HistogramVec
 }
 
 func (m *DiameterPrometheusMetrics) reset() {
@@ -71,6 +94,14 @@ func (m *DiameterPrometheusMetrics) reset() {
 	m.RouterPeerNotAvailable.Reset()
 
 	m.RouterHandlerErrors.Reset()
+
+	m.PeerWriteQueueDepth.Reset()
+	m.PeerWriteQueueDrops.Reset()
+	m.PeerWriteLatency.Reset()
+
+	m.DiameterHandlerPanics.Reset()
+	m.DiameterHandlerTimeouts.Reset()
+	m.DiameterHandlerDuration.Reset()
 }
 
 type HttpClientPrometheusMetrics struct {
@@ -165,6 +196,56 @@ func newRadiusPrometheusMetrics(reg prometheus.Registerer) *RadiusPrometheusMetr
 				Help: "Radius client responses dropped",
 			},
 			[]string{"endpoint", "code"}),
+
+		RadiusMessageAuthenticatorDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_message_authenticator_drops",
+				Help: "Radius packets dropped due to a missing or invalid Message-Authenticator",
+			},
+			[]string{"endpoint", "code"}),
+
+		RadiusServerDuplicateCacheHits: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_server_duplicate_cache_hits",
+				Help: "Radius server retransmitted requests",
+			},
+			[]string{"endpoint", "code"}),
+
+		RadiusServerDuplicateCacheMisses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_server_duplicate_cache_misses",
+				Help: "Radius server requests not found in the duplicates cache",
+			},
+			[]string{"endpoint", "code"}),
+
+		RadiusServerOverloadDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_server_overload_drops",
+				Help: "Radius server requests dropped due to overload",
+			},
+			[]string{"endpoint", "code", "reason"}),
+
+		RadiusHandlerPanics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_handler_panics",
+				Help: "Panics recovered in radius handlers",
+			},
+			[]string{"code"}),
+
+		RadiusHandlerTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "radius_handler_timeouts",
+				Help: "Radius handlers not finished in time",
+			},
+			[]string{"code"}),
+
+		RadiusHandlerDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "radius_handler_duration_seconds",
+				Help:    "Time taken by radius handlers",
+				Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10},
+			},
+			[]string{"code", "result"}),
 	}
 
 	reg.MustRegister(m.RadiusServerRequests)
@@ -175,6 +256,13 @@ func newRadiusPrometheusMetrics(reg prometheus.Registerer) *RadiusPrometheusMetr
 	reg.MustRegister(m.RadiusClientTimeouts)
 	reg.MustRegister(m.RadiusClientResponsesStalled)
 	reg.MustRegister(m.RadiusClientResponsesDropped)
+	reg.MustRegister(m.RadiusMessageAuthenticatorDrops)
+	reg.MustRegister(m.RadiusServerDuplicateCacheHits)
+	reg.MustRegister(m.RadiusServerDuplicateCacheMisses)
+	reg.MustRegister(m.RadiusServerOverloadDrops)
+	reg.MustRegister(m.RadiusHandlerPanics)
+	reg.MustRegister(m.RadiusHandlerTimeouts)
+	reg.MustRegister(m.RadiusHandlerDuration)
 
 	return m
 }
@@ -243,6 +331,50 @@ func newDiameterPrometheusMetrics(reg prometheus.Registerer) *DiameterPrometheus
 				Help: "Errors in diameter handler",
 			},
 			[]string{"peer", "oh", "or", "dh", "dr", "ap", "cm"}),
+
+		PeerWriteQueueDepth: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "diameter_peer_write_queue_depth",
+				Help: "Diameter messages waiting to be written to the peer",
+			},
+			[]string{"peer"}),
+
+		PeerWriteQueueDrops: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "diameter_peer_write_queue_drops",
+				Help: "Diameter messages not sent because the write queue was full",
+			},
+			[]string{"peer", "oh", "or", "dh", "dr", "ap", "cm"}),
+
+		PeerWriteLatency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "diameter_peer_write_latency_seconds",
+				Help:    "Time since a diameter message is queued until it is flushed to the peer",
+				Buckets: []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+			},
+			[]string{"peer"}),
+
+		DiameterHandlerPanics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "diameter_handler_panics",
+				Help: "Panics recovered in diameter handlers",
+			},
+			[]string{"ap", "cm"}),
+
+		DiameterHandlerTimeouts: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "diameter_handler_timeouts",
+				Help: "Diameter handlers not finished in time",
+			},
+			[]string{"ap", "cm"}),
+
+		DiameterHandlerDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "diameter_handler_duration_seconds",
+				Help:    "Time taken by diameter handlers",
+				Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10},
+			},
+			[]string{"ap", "cm", "result"}),
 	}
 
 	reg.MustRegister(m.PeerDiameterRequestsReceived)
@@ -253,6 +385,12 @@ func newDiameterPrometheusMetrics(reg prometheus.Registerer) *DiameterPrometheus
 	reg.MustRegister(m.PeerDiameterAnswersStalled)
 	reg.MustRegister(m.RouterRoutesNotFound)
 	reg.MustRegister(m.RouterHandlerErrors)
+	reg.MustRegister(m.PeerWriteQueueDepth)
+	reg.MustRegister(m.PeerWriteQueueDrops)
+	reg.MustRegister(m.PeerWriteLatency)
+	reg.MustRegister(m.DiameterHandlerPanics)
+	reg.MustRegister(m.DiameterHandlerTimeouts)
+	reg.MustRegister(m.DiameterHandlerDuration)
 
 	return m
 }
@@ -340,6 +478,30 @@ func RecordRadiusServerDrop(endpoint string, code string) {
 	pm.RadiusMetrics.RadiusServerDrops.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
 }
 
+func RecordRadiusServerDuplicateCacheHit(endpoint string, code string) {
+	pm.RadiusMetrics.RadiusServerDuplicateCacheHits.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
+}
+
+func RecordRadiusServerDuplicateCacheMiss(endpoint string, code string) {
+	pm.RadiusMetrics.RadiusServerDuplicateCacheMisses.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
+}
+
+func RecordRadiusServerOverloadDrop(endpoint string, code string, reason string) {
+	pm.RadiusMetrics.RadiusServerOverloadDrops.With(prometheus.Labels{"endpoint": endpoint, "code": code, "reason": reason}).Inc()
+}
+
+func RecordRadiusHandlerPanic(code string) {
+	pm.RadiusMetrics.RadiusHandlerPanics.With(prometheus.Labels{"code": code}).Inc()
+}
+
+func RecordRadiusHandlerTimeout(code string) {
+	pm.RadiusMetrics.RadiusHandlerTimeouts.With(prometheus.Labels{"code": code}).Inc()
+}
+
+func RecordRadiusHandlerDuration(code string, success bool, duration time.Duration) {
+	pm.RadiusMetrics.RadiusHandlerDuration.With(prometheus.Labels{"code": code, "result": handlerResultLabel(success)}).Observe(duration.Seconds())
+}
+
 func RecordRadiusClientRequest(endpoint string, code string) {
 	pm.RadiusMetrics.RadiusClientRequests.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
 }
@@ -360,6 +522,10 @@ func RecordRadiusClientResponseDrop(endpoint string, code string) {
 	pm.RadiusMetrics.RadiusClientResponsesDropped.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
 }
 
+func RecordRadiusMessageAuthenticatorDrop(endpoint string, code string) {
+	pm.RadiusMetrics.RadiusMessageAuthenticatorDrops.With(prometheus.Labels{"endpoint": endpoint, "code": code}).Inc()
+}
+
 // Diameter
 
 func LabelsFromDiameterMessage(peerName string, diameterMessage *DiameterMessage) prometheus.Labels {
@@ -378,12 +544,14 @@ func RecordPeerDiameterRequestReceived(peerName string, diameterMessage *Diamete
 	pm.DiameterMetrics.PeerDiameterRequestsReceived.With(LabelsFromDiameterMessage(peerName, diameterMessage)).Inc()
 }
 
-func RecordPeerDiameterAnswerSent(peerName string, diameterMessage *DiameterMessage) {
-	pm.DiameterMetrics.PeerDiameterAnswersSent.With(LabelsFromDiameterMessage(peerName, diameterMessage)).Inc()
+// Takes the labels instead of the message, which may be being written in another goroutine
+func RecordPeerDiameterAnswerSent(labels prometheus.Labels) {
+	pm.DiameterMetrics.PeerDiameterAnswersSent.With(labels).Inc()
 }
 
-func RecordPeerDiameterRequestSent(peerName string, diameterMessage *DiameterMessage) {
-	pm.DiameterMetrics.PeerDiameterRequestsSent.With(LabelsFromDiameterMessage(peerName, diameterMessage)).Inc()
+// Takes the labels instead of the message, which may be being written in another goroutine
+func RecordPeerDiameterRequestSent(labels prometheus.Labels) {
+	pm.DiameterMetrics.PeerDiameterRequestsSent.With(labels).Inc()
 }
 
 func RecordPeerDiameterAnswerReceived(peerName string, diameterMessage *DiameterMessage) {
@@ -398,6 +566,40 @@ func RecordPeerDiameterAnswerStalled(peerName string, diameterMessage *DiameterM
 	pm.DiameterMetrics.PeerDiameterAnswersStalled.With(LabelsFromDiameterMessage(peerName, diameterMessage)).Inc()
 }
 
+func RecordPeerWriteQueueDepth(peerName string, depth int) {
+	pm.DiameterMetrics.PeerWriteQueueDepth.With(prometheus.Labels{"peer": peerName}).Set(float64(depth))
+}
+
+func RecordPeerWriteQueueDrop(labels prometheus.Labels) {
+	pm.DiameterMetrics.PeerWriteQueueDrops.With(labels).Inc()
+}
+
+func RecordPeerWriteLatency(peerName string, latency time.Duration) {
+	pm.DiameterMetrics.PeerWriteLatency.With(prometheus.Labels{"peer": peerName}).Observe(latency.Seconds())
+}
+
+// Handlers
+
+func RecordDiameterHandlerPanic(applicationName string, commandName string) {
+	pm.DiameterMetrics.DiameterHandlerPanics.With(prometheus.Labels{"ap": applicationName, "cm": commandName}).Inc()
+}
+
+func RecordDiameterHandlerTimeout(applicationName string, commandName string) {
+	pm.DiameterMetrics.DiameterHandlerTimeouts.With(prometheus.Labels{"ap": applicationName, "cm": commandName}).Inc()
+}
+
+func RecordDiameterHandlerDuration(applicationName string, commandName string, success bool, duration time.Duration) {
+	pm.DiameterMetrics.DiameterHandlerDuration.With(prometheus.Labels{"ap": applicationName, "cm": commandName, "result": handlerResultLabel(success)}).Observe(duration.Seconds())
+}
+
+// Value of the result label in the handler metrics
+func handlerResultLabel(success bool) string {
+	if success {
+		return "success"
+	}
+	return "error"
+}
+
 // Router
 
 func RecordRouterRouteNotFound(peerName string, diameterMessage *DiameterMessage) {
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"regexp"
 	"strconv"
@@ -19,7 +20,7 @@ var ipv6PrefixRegex = regexp.MustCompile(`[0-9a-fA-F:\.]+/[0-9]+`)
 
 // Represents the contents of a Radius Attribute-Value pair
 type RadiusAVP struct {
-	Code     byte
+	Code     uint32
 	VendorId uint32
 	Name     string
 	Tag      byte
@@ -38,378 +39,439 @@ type RadiusAVP struct {
 //    length: 1 byte
 //    If code == 26
 //      vendorId: 4 bytes
-//      code: 1 byte
-//      length: 1 byte - the length of the code, length and value in the contents of the VSA
+//      code: 1 byte, or 2 or 4 bytes depending on the format of the vendor
+//      length: 1 byte - the length of the code, length and value in the contents of the VSA. May be 0 or 2 bytes
+//        depending on the format of the vendor
+//      continuation: 1 byte, only if so specified in the format of the vendor (WiMAX). If the first bit is set,
+//        the value continues in the next attribute
 //      value - may be prepended by a 1 byte tag and 2 byte salt
+//    If code is of type Extended (241 to 244) or LongExtended (245 and 246), as in RFC 6929
+//      extended type: 1 byte
+//      flags: 1 byte, only if LongExtended. If the first bit is set, the value continues in the next attribute
+//      If extended type == 26 (Extended-Vendor-Specific)
+//        vendorId: 4 bytes
+//        code: 1 byte
+//      value
 //    Else
 //      value
+//
+// The value of TLV attributes is a sequence of attributes, each one with code: 1 byte, length: 1 byte
+// and value
 
 // Encrypted attributes are padded with 0s when written, and those bytes are not removed when read from the Reader
 // That means the contents will not match
 
+// Maximum size of the value in each fragment of a LongExtended attribute. 255 minus code, length,
+// extended type and flags
+const maxLongExtendedFragmentSize = 251
+
 // Builds a radius AVP read from the specified reader.
 // Returns the number of bytes read
 func (avp *RadiusAVP) FromReader(reader io.Reader, authenticator [16]byte, secret string) (n int64, err error) {
 
-	var avpLen byte
-	var vendorCode byte = 0 // If vendor specific, will be not 26 but the specific vendor code
-	var vendorLen byte = 0
-	var dataLen byte
-	var salt [2]byte
-
-	currentIndex := int64(0)
-
-	// Get Code
-	if err := binary.Read(reader, binary.BigEndian, &avp.Code); err != nil {
+	code, contents, err := readRadiusAttribute(reader)
+	if err != nil {
 		return 0, err
 	}
-	currentIndex += 1
+	n = int64(len(contents)) + 2
 
-	// Get Length
-	if err := binary.Read(reader, binary.BigEndian, &avpLen); err != nil {
-		return currentIndex, err
-	}
-	currentIndex += 1
+	var payload []byte
 
 	// If is vendor specific
-	if avp.Code == 26 {
-		// Get vendorId
-		if err := binary.Read(reader, binary.BigEndian, &avp.VendorId); err != nil {
-			return currentIndex, err
+	if code == 26 {
+		var fragmentBytes int64
+		payload, fragmentBytes, err = avp.decodeVendorSpecific(reader, contents)
+		n += fragmentBytes
+		if err != nil {
+			return n, err
 		}
-		currentIndex += 4
 
-		// Get vendorCode
-		if err := binary.Read(reader, binary.BigEndian, &vendorCode); err != nil {
-			return currentIndex, err
-		}
-		currentIndex += 1
+	} else {
+		avp.Code = uint32(code)
+		avp.DictItem, _ = GetRDict().GetFromCode(RadiusAVPCode{VendorId: 0, Code: avp.Code})
 
-		// Get vendorLen
-		if err := binary.Read(reader, binary.BigEndian, &vendorLen); err != nil {
-			return currentIndex, err
+		if avp.DictItem.RadiusType == RadiusTypeExtended || avp.DictItem.RadiusType == RadiusTypeLongExtended {
+			var fragmentBytes int64
+			payload, fragmentBytes, err = avp.decodeExtended(reader, contents)
+			n += fragmentBytes
+			if err != nil {
+				return n, err
+			}
+		} else {
+			payload = contents
 		}
-		currentIndex += 1
+	}
 
-		avp.Code = vendorCode
+	avp.Name = avp.DictItem.Name
 
-		// SanityCheck
-		if !(vendorLen == avpLen-6) { // Substracting 4 bytes for vendorId, 1 byte for vendorCode and 1 byte for vendorLen
-			return currentIndex, fmt.Errorf("bad avp coding. Expected length of vendor specific attribute does not match")
-		}
+	return n, avp.decodeValue(payload, authenticator, secret)
+}
 
-		dataLen = vendorLen - 2 // Substracting 1 byte for vendor code and 1 byte for vendor length
+// Reads the code and the contents of a radius attribute, that is, the bytes after the length
+func readRadiusAttribute(reader io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, nil, err
+	}
+	if header[1] < 2 {
+		return header[0], nil, fmt.Errorf("invalid AVP length %d", header[1])
+	}
 
-	} else {
-		dataLen = avpLen - 2 // Substracting 1 byte for code and 1 byte for length
+	contents := make([]byte, int(header[1])-2)
+	if _, err := io.ReadFull(reader, contents); err != nil {
+		return header[0], nil, err
+	}
+	return header[0], contents, nil
+}
+
+// Parses the headers of a Vendor-Specific attribute, whose contents after the length are passed as parameter,
+// reading the rest of the fragments from the reader if the vendor uses a continuation byte.
+// Sets the dictionary item, code and vendor of the attribute, and returns its value and the number of bytes
+// read from the reader
+func (avp *RadiusAVP) decodeVendorSpecific(reader io.Reader, contents []byte) ([]byte, int64, error) {
+
+	if len(contents) < 4 {
+		return nil, 0, fmt.Errorf("bad avp coding. Vendor specific attribute too short")
+	}
+	avp.VendorId = binary.BigEndian.Uint32(contents[0:4])
+	format := GetRDict().GetVendorFormat(avp.VendorId)
+
+	value, more, err := format.decodeHeader(contents[4:], &avp.Code)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Reassemble the fragments
+	var bytesRead int64
+	for more {
+		code, fragment, err := readRadiusAttribute(reader)
+		if err != nil {
+			return nil, bytesRead, err
+		}
+		bytesRead += int64(len(fragment)) + 2
+
+		var fragmentCode uint32
+		if code != 26 || len(fragment) < 4 || binary.BigEndian.Uint32(fragment[0:4]) != avp.VendorId {
+			return nil, bytesRead, fmt.Errorf("bad fragment of vendor specific attribute %d:%d", avp.VendorId, avp.Code)
+		}
+		var fragmentValue []byte
+		fragmentValue, more, err = format.decodeHeader(fragment[4:], &fragmentCode)
+		if err != nil {
+			return nil, bytesRead, err
+		}
+		if fragmentCode != avp.Code {
+			return nil, bytesRead, fmt.Errorf("bad fragment of vendor specific attribute %d:%d", avp.VendorId, avp.Code)
+		}
+		value = append(value, fragmentValue...)
 	}
 
 	// Get the relevant info from the dictionary
 	// If not in the dictionary, will get some defaults (unknown code, treated as octect string).
 	// For this reason, the error is ignored
 	avp.DictItem, _ = GetRDict().GetFromCode(RadiusAVPCode{VendorId: avp.VendorId, Code: avp.Code})
-	avp.Name = avp.DictItem.Name
+
+	return value, bytesRead, nil
+}
+
+// Parses the headers of an Extended or LongExtended attribute, whose contents after the length are passed as
+// parameter, reading the rest of the fragments from the reader if necessary.
+// Sets the dictionary item, code and vendor of the attribute, and returns its value and the number of bytes
+// read from the reader
+func (avp *RadiusAVP) decodeExtended(reader io.Reader, contents []byte) ([]byte, int64, error) {
+
+	container := avp.DictItem
+	var bytesRead int64
+
+	if len(contents) < 1 {
+		return nil, 0, fmt.Errorf("extended attribute %d without extended type", container.Code)
+	}
+	extendedType := contents[0]
+	value := contents[1:]
+
+	// Reassemble the fragments
+	if container.RadiusType == RadiusTypeLongExtended {
+		if len(value) < 1 {
+			return nil, 0, fmt.Errorf("long extended attribute %d without flags", container.Code)
+		}
+		more := value[0]&0x80 != 0
+		value = value[1:]
+
+		for more {
+			code, fragment, err := readRadiusAttribute(reader)
+			if err != nil {
+				return nil, bytesRead, err
+			}
+			bytesRead += int64(len(fragment)) + 2
+
+			if uint32(code) != container.Code || len(fragment) < 2 || fragment[0] != extendedType {
+				return nil, bytesRead, fmt.Errorf("bad fragment of long extended attribute %d.%d", container.Code, extendedType)
+			}
+			more = fragment[1]&0x80 != 0
+			value = append(value, fragment[2:]...)
+		}
+	}
+
+	avp.Code = uint32(extendedType)
+	avp.DictItem = container.getSubItem(RadiusAVPCode{VendorId: 0, Code: avp.Code})
+
+	if extendedType == EXTENDED_VENDOR_SPECIFIC_TYPE {
+		if len(value) < 5 {
+			return nil, bytesRead, fmt.Errorf("extended vendor specific attribute %d.%d too short", container.Code, extendedType)
+		}
+		evsItem := avp.DictItem
+		if evsItem.RadiusType != RadiusTypeEVS {
+			// Not in the dictionary
+			evsItem.RadiusType = RadiusTypeEVS
+		}
+		avp.VendorId = binary.BigEndian.Uint32(value[0:4])
+		avp.Code = uint32(value[4])
+		avp.DictItem = evsItem.getSubItem(RadiusAVPCode{VendorId: avp.VendorId, Code: avp.Code})
+		value = value[5:]
+	}
+
+	return value, bytesRead, nil
+}
+
+// Parses the value of the attribute, which may include the tag and salt, decrypting it if necessary
+func (avp *RadiusAVP) decodeValue(payload []byte, authenticator [16]byte, secret string) error {
 
 	// Extract tag if the attribute is tagged in the dictionary
 	if avp.DictItem.Tagged {
-		if err := binary.Read(reader, binary.BigEndian, &avp.Tag); err != nil {
-			return currentIndex, err
+		if len(payload) < 1 {
+			return fmt.Errorf("invalid AVP data length")
 		}
-		currentIndex += 1
-		dataLen = dataLen - 1
+		avp.Tag = payload[0]
+		payload = payload[1:]
 	}
 
 	// Extract salt if necessary. A salt is used to make encryption more difficult to crack, introducing
 	// randomness in each request
+	var salt []byte
 	if avp.DictItem.Salted {
-		if err := binary.Read(reader, binary.BigEndian, &salt); err != nil {
-			return currentIndex, err
+		if len(payload) < 2 {
+			return fmt.Errorf("invalid AVP data length")
 		}
-		currentIndex += 2
-		dataLen = dataLen - 2
+		salt = payload[0:2]
+		payload = payload[2:]
 	}
 
-	// Sanity check
-	if dataLen <= 0 {
-		return currentIndex, fmt.Errorf("invalid AVP data length")
+	// Sanity check. Only TLV may be empty
+	if len(payload) == 0 && avp.DictItem.RadiusType != RadiusTypeTLV {
+		return fmt.Errorf("invalid AVP data length")
 	}
 
-	// The contents of the following variables will be replaced if Encrypted or Salted, so that
-	// we'll read from the intermediate buffer, with decrypted contents, instead of the original
-	var payloadLen = int(dataLen)
-	var payloadReader io.Reader = reader
-	var drained = false
-
 	// Parse encrypted/salted attributes
-	// read to an intermediate buffer
 	if avp.DictItem.Encrypted || avp.DictItem.Salted {
+		payload = decrypt1(payload, authenticator, secret, salt)
 
-		// Read data
-		avpBytes := make([]byte, int(dataLen))
-		if n, err := io.ReadAtLeast(reader, avpBytes, int(dataLen)); err != nil {
-			return currentIndex + int64(n), err
-		}
-		currentIndex += int64(dataLen)
-
-		// Decrypt
-		if avp.DictItem.Salted {
-			avpBytes = decrypt1(avpBytes, authenticator, secret, salt[:])
-		} else if avp.DictItem.Encrypted {
-			avpBytes = decrypt1(avpBytes, authenticator, secret, nil)
-		}
-
-		// If attribute contains its size internally, adjust the length
+		// If attribute contains its size internally, adjust the length. The rest of the bytes are just padding
 		if avp.DictItem.WithLen {
-			size := avpBytes[0]
-			if len(avpBytes) < int(size)+1 {
-				return currentIndex, fmt.Errorf("bad internal length value %d < int(%d)+1, Salted: %t", len(avpBytes), size, avp.DictItem.Salted)
+			size := int(payload[0])
+			if len(payload) < size+1 {
+				return fmt.Errorf("bad internal length value %d < int(%d)+1, Salted: %t", len(payload), size, avp.DictItem.Salted)
 			}
-			avpBytes = avpBytes[1 : size+1] // The rest of the bytes are just padding
-
-			payloadLen = int(size)
+			payload = payload[1 : size+1]
 		}
-
-		payloadReader = bytes.NewReader(avpBytes)
-		drained = true
 	}
 
 	// Parse according to type
 	switch avp.DictItem.RadiusType {
 	case RadiusTypeNone, RadiusTypeOctets, RadiusTypeString:
-
-		avpBytes := make([]byte, payloadLen)
-		if _, err := io.ReadAtLeast(payloadReader, avpBytes, payloadLen); err != nil {
-			return currentIndex, err
-		}
-
 		if avp.DictItem.RadiusType == RadiusTypeString {
-			avp.Value = string(bytes.Trim(avpBytes, "\x00"))
+			avp.Value = string(bytes.Trim(payload, "\x00"))
 		} else {
-			avp.Value = avpBytes
-		}
-
-		if !drained {
-			currentIndex += int64(payloadLen)
+			avp.Value = payload
 		}
-
-		return currentIndex, nil
+		return nil
 
 	case RadiusTypeInteger:
 		if !avp.DictItem.Tagged || avp.DictItem.Salted {
-			var value int32
-			if err := binary.Read(payloadReader, binary.BigEndian, &value); err != nil {
-				return currentIndex, err
-			}
-
-			avp.Value = int64(value)
-
-			if !drained {
-				currentIndex += 4
+			if len(payload) < 4 {
+				return fmt.Errorf("integer type is not 4 bytes long")
 			}
-
-			return currentIndex, err
+			avp.Value = int64(binary.BigEndian.Uint32(payload))
 		} else {
 			// Standard attributes of this type have 3 bytes for the value only (tagged && not salted?)
-			// TODO: Check that only positive integers are represented
-			var valueHigh byte
-			var valueLow uint16
-			if err := binary.Read(payloadReader, binary.BigEndian, &valueHigh); err != nil {
-				return currentIndex, err
+			if len(payload) < 3 {
+				return fmt.Errorf("tagged integer type is not 3 bytes long")
 			}
-			if err := binary.Read(reader, binary.BigEndian, &valueLow); err != nil {
-				return currentIndex, err
-			}
-			avp.Value = int64(65536)*int64(valueHigh) + int64(valueLow)
-
-			if !drained {
-				currentIndex += 3
-			}
-			return currentIndex, err
+			avp.Value = int64(65536)*int64(payload[0]) + int64(binary.BigEndian.Uint16(payload[1:3]))
 		}
+		return nil
 
-	case RadiusTypeAddress:
-		if payloadLen != 4 {
-			return currentIndex, fmt.Errorf("address type is not 4 bytes long")
+	case RadiusTypeByte:
+		if len(payload) != 1 {
+			return fmt.Errorf("byte type is not 1 byte long")
 		}
-		avpBytes := make([]byte, 4)
-		if _, err := io.ReadAtLeast(payloadReader, avpBytes, 4); err != nil {
-			return currentIndex, err
-		}
-
-		avp.Value = net.IP(avpBytes)
+		avp.Value = int64(payload[0])
+		return nil
 
-		if !drained {
-			currentIndex += 4
+	case RadiusTypeShort:
+		if len(payload) != 2 {
+			return fmt.Errorf("short type is not 2 bytes long")
 		}
+		avp.Value = int64(binary.BigEndian.Uint16(payload))
+		return nil
 
-		return currentIndex, nil
-
-	case RadiusTypeIPv6Address:
-		if payloadLen != 16 {
-			return currentIndex, fmt.Errorf("ipv6address type is not 16 bytes long")
+	case RadiusTypeSigned:
+		if len(payload) != 4 {
+			return fmt.Errorf("signed type is not 4 bytes long")
 		}
-		avpBytes := make([]byte, 16)
-		if n, err := io.ReadAtLeast(payloadReader, avpBytes, payloadLen); err != nil {
-			return currentIndex + int64(n), err
-		}
-		avp.Value = net.IP(avpBytes)
+		avp.Value = int64(int32(binary.BigEndian.Uint32(payload)))
+		return nil
 
-		if !drained {
-			currentIndex += 16
+	case RadiusTypeAddress:
+		if len(payload) != 4 {
+			return fmt.Errorf("address type is not 4 bytes long")
 		}
-		return currentIndex, nil
+		avp.Value = net.IP(payload)
+		return nil
 
-	case RadiusTypeTime:
-		var value uint32
-		if err := binary.Read(payloadReader, binary.BigEndian, &value); err != nil {
-			return currentIndex, err
+	case RadiusTypeComboIP:
+		if len(payload) != 4 && len(payload) != 16 {
+			return fmt.Errorf("combo-ip type is not 4 or 16 bytes long")
 		}
-		avp.Value = ZeroRadiusTime.Add(time.Second * time.Duration(value))
+		avp.Value = net.IP(payload)
+		return nil
 
-		if !drained {
-			currentIndex += 4
+	case RadiusTypeIPv4Prefix:
+		// Encoded as 1 byte padding, 1 byte prefix length, and up to 4 bytes with prefix.
+		if len(payload) < 2 || len(payload) > 6 || payload[1] > 32 {
+			return fmt.Errorf("bad ipv4prefix length")
 		}
-		return currentIndex, nil
+		address := make([]byte, 4)
+		copy(address, payload[2:])
+		avp.Value = net.IP(address).String() + "/" + fmt.Sprintf("%d", payload[1])
+		return nil
 
-	case RadiusTypeIPv6Prefix:
-		// Radius Type IPv6 prefix. Encoded as 1 byte padding, 1 byte prefix length, and 16 bytes with prefix.
-		var dummy byte
-		var prefixLen byte
-		address := make([]byte, 16)
-		if err := binary.Read(payloadReader, binary.BigEndian, &dummy); err != nil {
-			return currentIndex, err
-		}
-		if err := binary.Read(payloadReader, binary.BigEndian, &prefixLen); err != nil {
-			return currentIndex + 1, err
-		}
-		if err := binary.Read(payloadReader, binary.BigEndian, &address); err != nil {
-			return currentIndex + 2, err
+	case RadiusTypeEther:
+		if len(payload) != 6 {
+			return fmt.Errorf("ether type is not 6 bytes long")
 		}
+		avp.Value = net.HardwareAddr(payload)
+		return nil
 
-		avp.Value = net.IP(address).String() + "/" + fmt.Sprintf("%d", prefixLen)
+	case RadiusTypeABinary:
+		avp.Value = payload
+		return nil
 
-		if !drained {
-			currentIndex += 18
+	case RadiusTypeIPv6Address:
+		if len(payload) != 16 {
+			return fmt.Errorf("ipv6address type is not 16 bytes long")
 		}
-		return currentIndex, err
+		avp.Value = net.IP(payload)
+		return nil
 
-	case RadiusTypeInterfaceId:
-		// 8 octets
-		if payloadLen != 8 {
-			return currentIndex, fmt.Errorf("interfaceid type is not 8 bytes long")
-		}
-		// Read
-		avpBytes := make([]byte, int(dataLen))
-		if n, err := io.ReadAtLeast(payloadReader, avpBytes, payloadLen); err != nil {
-			return currentIndex + int64(n), err
+	case RadiusTypeTime:
+		if len(payload) < 4 {
+			return fmt.Errorf("time type is not 4 bytes long")
 		}
+		avp.Value = ZeroRadiusTime.Add(time.Second * time.Duration(binary.BigEndian.Uint32(payload)))
+		return nil
 
-		// Use only dataLen bytes. The rest is padding
-		avp.Value = avpBytes
+	case RadiusTypeIPv6Prefix:
+		// Radius Type IPv6 prefix. Encoded as 1 byte padding, 1 byte prefix length, and up to 16 bytes with prefix.
+		if len(payload) < 2 || len(payload) > 18 {
+			return fmt.Errorf("bad ipv6prefix length")
+		}
+		address := make([]byte, 16)
+		copy(address, payload[2:])
+		avp.Value = net.IP(address).String() + "/" + fmt.Sprintf("%d", payload[1])
+		return nil
 
-		if !drained {
-			currentIndex += 8
+	case RadiusTypeInterfaceId:
+		// 8 octets
+		if len(payload) != 8 {
+			return fmt.Errorf("interfaceid type is not 8 bytes long")
 		}
-		return currentIndex, err
+		avp.Value = payload
+		return nil
 
 	case RadiusTypeInteger64:
-		var value int64
-		if err := binary.Read(payloadReader, binary.BigEndian, &value); err != nil {
-			return currentIndex, err
+		if len(payload) < 8 {
+			return fmt.Errorf("integer64 type is not 8 bytes long")
 		}
-		avp.Value = int64(value)
+		avp.Value = int64(binary.BigEndian.Uint64(payload))
+		return nil
 
-		if !drained {
-			currentIndex += 8
+	case RadiusTypeTLV:
+		subAVPs := make([]RadiusAVP, 0)
+		for len(payload) > 0 {
+			if len(payload) < 2 || payload[1] < 2 || int(payload[1]) > len(payload) {
+				return fmt.Errorf("bad coding of TLV attribute %s", avp.Name)
+			}
+			subAVP := RadiusAVP{Code: uint32(payload[0])}
+			subAVP.DictItem = avp.DictItem.getSubItem(RadiusAVPCode{VendorId: 0, Code: subAVP.Code})
+			subAVP.Name = subAVP.DictItem.Name
+			subAVP.VendorId = subAVP.DictItem.VendorId
+			if err := subAVP.decodeValue(payload[2:payload[1]], authenticator, secret); err != nil {
+				return err
+			}
+			subAVPs = append(subAVPs, subAVP)
+			payload = payload[payload[1]:]
 		}
-		return currentIndex, err
+		avp.Value = subAVPs
+		return nil
 
+	case RadiusTypeStruct:
+		members := make([]RadiusAVP, 0)
+		for _, memberItem := range avp.DictItem.structMembers() {
+			size := memberItem.structMemberSize()
+			if size == 0 {
+				// The last member may be absent
+				if len(payload) == 0 {
+					break
+				}
+				size = len(payload)
+			}
+			if len(payload) < size {
+				return fmt.Errorf("bad coding of struct attribute %s", avp.Name)
+			}
+			member := RadiusAVP{Code: memberItem.Code, Name: memberItem.Name, VendorId: memberItem.VendorId, DictItem: memberItem}
+			if err := member.decodeValue(payload[:size], authenticator, secret); err != nil {
+				return err
+			}
+			members = append(members, member)
+			payload = payload[size:]
+		}
+		if len(payload) > 0 {
+			return fmt.Errorf("bad coding of struct attribute %s", avp.Name)
+		}
+		avp.Value = members
+		return nil
 	}
 
-	return currentIndex, fmt.Errorf("unknown type: %d", avp.DictItem.RadiusType)
+	return fmt.Errorf("unknown type: %d", avp.DictItem.RadiusType)
 }
 
 // Writes the AVP to the specified writer
 // Returns the number of bytes written including padding
 func (avp *RadiusAVP) ToWriter(writer io.Writer, authenticator [16]byte, secret string) (int64, error) {
 
-	var bytesWritten int = 0
-	var err error
-	var salt [2]byte
-
-	// Write Code
-	var code byte
-	if avp.VendorId == 0 {
-		code = avp.Code
-	} else {
-		code = 26
-	}
-	if err = binary.Write(writer, binary.BigEndian, code); err != nil {
-		return int64(bytesWritten), err
+	value, err := avp.encodeValue(authenticator, secret)
+	if err != nil {
+		return 0, err
 	}
-	bytesWritten += 1
 
-	// Write Length
-	avpLen := avp.Len()
-	if avpLen > 255 {
-		return 0, fmt.Errorf("size of AVP %s is bigger than 255 bytes", avp.Name)
-	}
-	if err = binary.Write(writer, binary.BigEndian, byte(avpLen)); err != nil {
-		return int64(bytesWritten), err
+	attrBytes, err := avp.encodeHeaders(value)
+	if err != nil {
+		return 0, err
 	}
-	bytesWritten += 1
 
-	// If vendor specific
-	if avp.VendorId != 0 {
-		// Write vendorId
-		if err = binary.Write(writer, binary.BigEndian, avp.VendorId); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 4
-
-		// Write vendorCode
-		if err = binary.Write(writer, binary.BigEndian, avp.Code); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 1
-
-		// Write length. This is the length of the embedded AVP, which is 6 bytes
-		// less, discounting code, len and vendorId
-		if err = binary.Write(writer, binary.BigEndian, byte(avpLen-6)); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 1
+	// Saninty check
+	if len(attrBytes) != avp.Len() {
+		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", len(attrBytes), avp.Len()))
 	}
 
-	// Write tag
-	if avp.DictItem.Tagged {
-		if err = binary.Write(writer, binary.BigEndian, avp.Tag); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 1
-	}
+	n, err := writer.Write(attrBytes)
+	return int64(n), err
+}
 
-	// Write salt
-	if avp.DictItem.Salted {
-		// Generate random value for salt
-		salt = BuildRandomSalt()
-		if err = binary.Write(writer, binary.BigEndian, salt); err != nil {
-			return int64(bytesWritten), err
-		}
-		bytesWritten += 2
-	}
+// Returns the value of the attribute, including the tag and salt and encrypted if so specified in
+// the dictionary
+func (avp *RadiusAVP) encodeValue(authenticator [16]byte, secret string) ([]byte, error) {
 
-	// If Encrypted or Salted, write to an intermediate buffer instead
-	var payloadWriter io.Writer
-	var encryptBuffer bytes.Buffer
-	var written bool
-	if avp.DictItem.Encrypted || avp.DictItem.Salted {
-		payloadWriter = &encryptBuffer
-		written = false
-	} else {
-		payloadWriter = writer
-		written = true
-	}
+	var buffer bytes.Buffer
 
 	// Write data
 	switch avp.DictItem.RadiusType {
@@ -426,192 +488,316 @@ func (avp *RadiusAVP) ToWriter(writer io.Writer, authenticator [16]byte, secret
 			octetsValue, ok = avp.Value.([]byte)
 		}
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		buffer.Write(octetsValue)
 
-		if err = binary.Write(payloadWriter, binary.BigEndian, octetsValue); err != nil {
-			return int64(bytesWritten), err
+	case RadiusTypeInteger:
+		var value, ok = avp.Value.(int64)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 
-		if written {
-			bytesWritten += len(octetsValue)
+		if !avp.DictItem.Tagged || avp.DictItem.Salted {
+			binary.Write(&buffer, binary.BigEndian, int32(value))
+		} else {
+			// Use only 3 bytes for the value if tagged
+			buffer.WriteByte(byte(value / 65536))
+			binary.Write(&buffer, binary.BigEndian, uint16(value%65536))
 		}
 
-	case RadiusTypeInteger:
+	case RadiusTypeByte, RadiusTypeShort, RadiusTypeSigned:
 		var value, ok = avp.Value.(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 
-		if !avp.DictItem.Tagged || avp.DictItem.Salted {
-			if err = binary.Write(payloadWriter, binary.BigEndian, int32(value)); err != nil {
-				return int64(bytesWritten), err
-			}
-			if written {
-				bytesWritten += 4
-			}
+		switch avp.DictItem.RadiusType {
+		case RadiusTypeByte:
+			buffer.WriteByte(byte(value))
+		case RadiusTypeShort:
+			binary.Write(&buffer, binary.BigEndian, uint16(value))
+		default:
+			binary.Write(&buffer, binary.BigEndian, int32(value))
+		}
+
+	case RadiusTypeComboIP:
+		var ipAddress, ok = avp.Value.(net.IP)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
 
+		// Use the IPv4 encoding if possible
+		if ipAddressBytes := ipAddress.To4(); ipAddressBytes != nil {
+			buffer.Write(ipAddressBytes)
+		} else if ipAddressBytes := ipAddress.To16(); ipAddressBytes != nil {
+			buffer.Write(ipAddressBytes)
 		} else {
-			// Use only 3 bytes for the value if tagged
-			var highByte = value / 65536
-			var lowByte = value % 65536
-			if err = binary.Write(payloadWriter, binary.BigEndian, byte(highByte)); err != nil {
-				return int64(bytesWritten), err
-			}
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
 
-			if err = binary.Write(payloadWriter, binary.BigEndian, uint32(lowByte)); err != nil {
-				return int64(bytesWritten), err
-			}
+	case RadiusTypeIPv4Prefix:
+		var ipv4Prefix, ok = avp.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		addrPrefix := strings.Split(ipv4Prefix, "/")
+		if len(addrPrefix) != 2 {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
+		ipv4 := net.ParseIP(addrPrefix[0]).To4()
+		if err != nil || ipv4 == nil || prefix > 32 {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		// Dummy byte, prefix and address
+		buffer.WriteByte(0)
+		buffer.WriteByte(byte(prefix))
+		buffer.Write(ipv4)
 
-			if written {
-				bytesWritten += 3
-			}
+	case RadiusTypeEther:
+		var macValue, ok = avp.Value.(net.HardwareAddr)
+		if !ok || len(macValue) != 6 {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		buffer.Write(macValue)
+
+	case RadiusTypeABinary:
+		var filterValue, ok = avp.Value.([]byte)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		buffer.Write(filterValue)
 
 	case RadiusTypeAddress:
 		var ipAddress, ok = avp.Value.(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 
 		var ipAddressBytes = ipAddress.To4()
 		if ipAddressBytes == nil {
 			// Was not an IPv4 address
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(payloadWriter, binary.BigEndian, ipAddressBytes); err != nil {
-			return int64(bytesWritten), err
-		}
-
-		if written {
-			bytesWritten += 4
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		buffer.Write(ipAddressBytes)
 
 	case RadiusTypeIPv6Address:
 		var ipAddress, ok = avp.Value.(net.IP)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 
 		var ipAddressBytes = ipAddress.To16()
 		if ipAddressBytes == nil {
 			// Was not an IPv6 address
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(payloadWriter, binary.BigEndian, ipAddressBytes); err != nil {
-			return int64(bytesWritten), err
-		}
-
-		if written {
-			bytesWritten += 16
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		buffer.Write(ipAddressBytes)
 
 	case RadiusTypeTime:
 		var timeValue, ok = avp.Value.(time.Time)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
-		}
-		if err = binary.Write(payloadWriter, binary.BigEndian, uint32(timeValue.Sub(ZeroRadiusTime).Seconds())); err != nil {
-			return int64(bytesWritten), err
-		}
-
-		if written {
-			bytesWritten += 4
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		binary.Write(&buffer, binary.BigEndian, uint32(timeValue.Sub(ZeroRadiusTime).Seconds()))
 
 	case RadiusTypeIPv6Prefix:
 		var ipv6Prefix, ok = avp.Value.(string)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 		addrPrefix := strings.Split(ipv6Prefix, "/")
-		if len(addrPrefix) == 2 {
-			prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
-			ipv6 := net.ParseIP(addrPrefix[0])
-			if err == nil && ipv6 != nil {
-				// Dummy byte
-				if err = binary.Write(payloadWriter, binary.BigEndian, byte(0)); err != nil {
-					return int64(bytesWritten), err
-				}
-
-				// Prefix
-				if err = binary.Write(payloadWriter, binary.BigEndian, uint8(prefix)); err != nil {
-					return int64(bytesWritten), err
-				}
-
-				// Address
-				binary.Write(payloadWriter, binary.BigEndian, ipv6.To16())
-
-				if written {
-					bytesWritten += 18
-				}
-			} else {
-				return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
-			}
-		} else {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		if len(addrPrefix) != 2 {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		prefix, err := strconv.ParseUint(addrPrefix[1], 10, 8) // base 10, 8 bits
+		ipv6 := net.ParseIP(addrPrefix[0])
+		if err != nil || ipv6 == nil {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
+		// Dummy byte, prefix and address
+		buffer.WriteByte(0)
+		buffer.WriteByte(byte(prefix))
+		buffer.Write(ipv6.To16())
 
 	case RadiusTypeInterfaceId:
 		var interfaceIdValue, ok = avp.Value.([]byte)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
 		if len(interfaceIdValue) != 8 {
-			return int64(bytesWritten), fmt.Errorf("error marshalling interfaceId. length is not 8 bytes")
-		}
-		if err = binary.Write(payloadWriter, binary.BigEndian, interfaceIdValue); err != nil {
-			return int64(bytesWritten), err
-		}
-
-		if written {
-			bytesWritten += len(interfaceIdValue)
+			return nil, fmt.Errorf("error marshalling interfaceId. length is not 8 bytes")
 		}
+		buffer.Write(interfaceIdValue)
 
 	case RadiusTypeInteger64:
 		var value, ok = avp.Value.(int64)
 		if !ok {
-			return int64(bytesWritten), fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
 		}
-		if err = binary.Write(payloadWriter, binary.BigEndian, value); err != nil {
-			return int64(bytesWritten), err
+		binary.Write(&buffer, binary.BigEndian, value)
+
+	case RadiusTypeTLV:
+		var subAVPs, ok = avp.Value.([]RadiusAVP)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		for i := range subAVPs {
+			subValue, err := subAVPs[i].encodeValue(authenticator, secret)
+			if err != nil {
+				return nil, err
+			}
+			if len(subValue) > 253 {
+				return nil, fmt.Errorf("size of AVP %s is bigger than 255 bytes", subAVPs[i].Name)
+			}
+			buffer.WriteByte(byte(subAVPs[i].Code))
+			buffer.WriteByte(byte(len(subValue) + 2))
+			buffer.Write(subValue)
 		}
 
-		if written {
-			bytesWritten += 8
+	case RadiusTypeStruct:
+		var members, ok = avp.Value.([]RadiusAVP)
+		if !ok {
+			return nil, fmt.Errorf("error marshaling radius type %d and value %T %v", avp.DictItem.RadiusType, avp.Value, avp.Value)
+		}
+		for _, memberItem := range avp.DictItem.structMembers() {
+			size := memberItem.structMemberSize()
+			member := findStructMember(members, memberItem.Code)
+			if member == nil {
+				if size == 0 {
+					continue
+				}
+				return nil, fmt.Errorf("member %s of struct %s not found", memberItem.Name, avp.Name)
+			}
+			memberValue, err := member.encodeValue(authenticator, secret)
+			if err != nil {
+				return nil, err
+			}
+			if size != 0 && len(memberValue) != size {
+				return nil, fmt.Errorf("member %s of struct %s is not %d bytes long", memberItem.Name, avp.Name, size)
+			}
+			buffer.Write(memberValue)
 		}
+
+	default:
+		return nil, fmt.Errorf("error marshaling radius type %d", avp.DictItem.RadiusType)
 	}
 
-	// If it was written to intermediate buffer because encryption is needed
-	if !written {
-		var octetsValue []byte = encryptBuffer.Bytes()
+	octetsValue := buffer.Bytes()
+
+	// Encrypt if so required
+	if avp.DictItem.Encrypted || avp.DictItem.Salted {
 
 		// Write internal length if so required
 		if avp.DictItem.WithLen {
 			octetsValue = append([]byte{byte(len(octetsValue))}, octetsValue...)
 		}
 
-		// Replace value with encrypted one
+		// Replace value with encrypted one, prepended by the salt
 		if avp.DictItem.Salted {
-			octetsValue = encrypt1(octetsValue, authenticator, secret, salt[:])
-		} else if avp.DictItem.Encrypted {
+			// Generate random value for salt
+			salt := BuildRandomSalt()
+			octetsValue = append(salt[:], encrypt1(octetsValue, authenticator, secret, salt[:])...)
+		} else {
 			octetsValue = encrypt1(octetsValue, authenticator, secret, nil)
 		}
+	}
+
+	// Prepend the tag
+	if avp.DictItem.Tagged {
+		octetsValue = append([]byte{avp.Tag}, octetsValue...)
+	}
+
+	return octetsValue, nil
+}
 
-		// Final write
-		if err = binary.Write(writer, binary.BigEndian, octetsValue); err != nil {
-			return int64(len(octetsValue)), err
+// Returns the full attribute, adding to the specified value the code, length and vendor or extended
+// headers as required
+func (avp *RadiusAVP) encodeHeaders(value []byte) ([]byte, error) {
+
+	// Normal and vendor specific attributes
+	if avp.DictItem.Parent == nil {
+		if avp.VendorId == 0 {
+			if len(value)+2 > 255 {
+				return nil, fmt.Errorf("size of AVP %s is bigger than 255 bytes", avp.Name)
+			}
+			return append([]byte{byte(avp.Code), byte(len(value) + 2)}, value...), nil
 		}
 
-		bytesWritten += len(octetsValue)
+		format := GetRDict().GetVendorFormat(avp.VendorId)
+		if avp.Code > format.maxCode() {
+			return nil, fmt.Errorf("code of AVP %s does not fit in the vendor type", avp.Name)
+		}
+		maxFragmentSize := 255 - 6 - format.headerLen()
+
+		// Split in fragments if the vendor uses continuation, setting the more flag in all but the last one
+		var attrBytes []byte
+		for {
+			fragmentSize := len(value)
+			more := false
+			if fragmentSize > maxFragmentSize {
+				if !format.Continuation {
+					return nil, fmt.Errorf("size of AVP %s is bigger than 255 bytes", avp.Name)
+				}
+				fragmentSize = maxFragmentSize
+				more = true
+			}
+			var vendorId [4]byte
+			binary.BigEndian.PutUint32(vendorId[:], avp.VendorId)
+			attrBytes = append(attrBytes, 26, byte(fragmentSize+6+format.headerLen()))
+			attrBytes = append(attrBytes, vendorId[:]...)
+			attrBytes = append(attrBytes, format.encodeHeader(avp.Code, fragmentSize, more)...)
+			attrBytes = append(attrBytes, value[:fragmentSize]...)
+
+			value = value[fragmentSize:]
+			if len(value) == 0 {
+				return attrBytes, nil
+			}
+		}
 	}
 
-	// Saninty check
-	if bytesWritten != avpLen {
-		panic(fmt.Sprintf("Bad AVP size. Bytes Written: %d, reported size: %d", bytesWritten, avpLen))
+	// Extended attributes. For Extended-Vendor-Specific, the vendorId and code are part of the value
+	container := avp.DictItem.Parent
+	extendedType := byte(avp.Code)
+	if container.RadiusType == RadiusTypeEVS {
+		evsHeader := make([]byte, 5, len(value)+5)
+		binary.BigEndian.PutUint32(evsHeader[0:4], avp.VendorId)
+		evsHeader[4] = byte(avp.Code)
+		value = append(evsHeader, value...)
+		extendedType = byte(container.Code)
+		container = container.Parent
 	}
 
-	return int64(bytesWritten), nil
+	switch container.RadiusType {
+	case RadiusTypeExtended:
+		if len(value)+3 > 255 {
+			return nil, fmt.Errorf("size of AVP %s is bigger than 255 bytes", avp.Name)
+		}
+		return append([]byte{byte(container.Code), byte(len(value) + 3), extendedType}, value...), nil
+
+	case RadiusTypeLongExtended:
+		// Split in fragments, setting the more flag in all but the last one
+		var attrBytes []byte
+		for {
+			fragmentSize := len(value)
+			var flags byte
+			if fragmentSize > maxLongExtendedFragmentSize {
+				fragmentSize = maxLongExtendedFragmentSize
+				flags = 0x80
+			}
+			attrBytes = append(attrBytes, byte(container.Code), byte(fragmentSize+4), extendedType, flags)
+			attrBytes = append(attrBytes, value[:fragmentSize]...)
+
+			value = value[fragmentSize:]
+			if len(value) == 0 {
+				return attrBytes, nil
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("AVP %s must be sent inside %s", avp.Name, container.Name)
+	}
 }
 
 // Reads a Radius AVP from a buffer
@@ -633,30 +819,100 @@ func (avp *RadiusAVP) ToBytes(authenticator [16]byte, secret string) ([]byte, er
 	return buffer.Bytes(), err
 }
 
-// Returns the size of the AVP
+// Returns the size of the AVP, including the headers, and all the fragments if LongExtended.
+// For attributes inside a TLV, the size of the sub-attribute
 func (avp *RadiusAVP) Len() int {
+	var dataSize = avp.valueLen()
+
+	// Add the header bytes. Only 2 if not VSA and 4 more for the vendorId plus the vendor header if VSA,
+	// in each of the fragments if the vendor uses continuation
+	if avp.DictItem.Parent == nil {
+		if avp.VendorId == 0 {
+			return dataSize + 2
+		}
+		format := GetRDict().GetVendorFormat(avp.VendorId)
+		headerSize := 6 + format.headerLen()
+		fragments := 1
+		if format.Continuation && dataSize > 0 {
+			fragments = (dataSize + 255 - headerSize - 1) / (255 - headerSize)
+		}
+		return dataSize + headerSize*fragments
+	}
+
+	// Add the vendorId and code if Extended-Vendor-Specific
+	container := avp.DictItem.Parent
+	if container.RadiusType == RadiusTypeEVS {
+		dataSize += 5
+		container = container.Parent
+	}
+
+	switch container.RadiusType {
+	case RadiusTypeExtended:
+		return dataSize + 3
+	case RadiusTypeLongExtended:
+		fragments := (dataSize + maxLongExtendedFragmentSize - 1) / maxLongExtendedFragmentSize
+		if fragments == 0 {
+			fragments = 1
+		}
+		return dataSize + 4*fragments
+	default:
+		// Inside a TLV
+		return dataSize + 2
+	}
+}
+
+// Returns the size of the value, including tag, salt and padding
+func (avp *RadiusAVP) valueLen() int {
 	var dataSize = 0
 
 	switch avp.DictItem.RadiusType {
 
-	case RadiusTypeNone, RadiusTypeOctets, RadiusTypeString:
-		if avp.DictItem.RadiusType == RadiusTypeString {
-			dataSize = len(avp.Value.(string))
+	case RadiusTypeNone, RadiusTypeOctets:
+		octetsValue, _ := avp.Value.([]byte)
+		dataSize = len(octetsValue)
+
+	case RadiusTypeString:
+		stringValue, _ := avp.Value.(string)
+		dataSize = len(stringValue)
+
+	case RadiusTypeInteger:
+		// If tagged and not salted, the tag consumes one byte of the integer
+		if avp.DictItem.Tagged && !avp.DictItem.Salted {
+			dataSize = 3
 		} else {
-			dataSize = len(avp.Value.([]byte))
+			dataSize = 4
 		}
 
-		// Add the internal length attribute
-		if avp.DictItem.WithLen {
-			dataSize += 1
-		}
+	case RadiusTypeByte:
+		dataSize = 1
 
-	case RadiusTypeInteger:
+	case RadiusTypeShort:
+		dataSize = 2
+
+	case RadiusTypeSigned:
 		dataSize = 4
 
 	case RadiusTypeAddress:
 		dataSize = 4
 
+	case RadiusTypeComboIP:
+		addressValue, _ := avp.Value.(net.IP)
+		if addressValue.To4() != nil {
+			dataSize = 4
+		} else {
+			dataSize = 16
+		}
+
+	case RadiusTypeIPv4Prefix:
+		dataSize = 6
+
+	case RadiusTypeEther:
+		dataSize = 6
+
+	case RadiusTypeABinary:
+		filterValue, _ := avp.Value.([]byte)
+		dataSize = len(filterValue)
+
 	case RadiusTypeTime:
 		dataSize = 4
 
@@ -671,11 +927,32 @@ func (avp *RadiusAVP) Len() int {
 
 	case RadiusTypeInteger64:
 		dataSize = 8
+
+	case RadiusTypeTLV:
+		subAVPs, _ := avp.Value.([]RadiusAVP)
+		for i := range subAVPs {
+			dataSize += subAVPs[i].Len()
+		}
+
+	case RadiusTypeStruct:
+		members, _ := avp.Value.([]RadiusAVP)
+		for _, memberItem := range avp.DictItem.structMembers() {
+			if member := findStructMember(members, memberItem.Code); member != nil {
+				dataSize += member.valueLen()
+			}
+		}
 	}
 
-	// Add the padding that will be introduced by the Encrypt function
-	if (avp.DictItem.Encrypted || avp.DictItem.Salted) && dataSize%16 != 0 {
-		dataSize = dataSize + (16 - dataSize%16)
+	if avp.DictItem.Encrypted || avp.DictItem.Salted {
+		// Add the internal length attribute
+		if avp.DictItem.WithLen {
+			dataSize += 1
+		}
+
+		// Add the padding that will be introduced by the Encrypt function
+		if dataSize%16 != 0 {
+			dataSize = dataSize + (16 - dataSize%16)
+		}
 	}
 
 	// Add the salt bytes
@@ -685,17 +962,7 @@ func (avp *RadiusAVP) Len() int {
 
 	// Add the Tag byte. The tag is not encrypted and subject to %16 payload size
 	if avp.DictItem.Tagged {
-		// If intetger, consumes from the payload (i.e., the integer is 3 bytes only)
-		if avp.DictItem.RadiusType != RadiusTypeInteger {
-			dataSize += 1
-		}
-	}
-
-	// Add the header bytes. Only 2 if not VSA and 6 more if VSA
-	if avp.VendorId == 0 {
-		dataSize += 2
-	} else {
-		dataSize += 8
+		dataSize += 1
 	}
 
 	return dataSize
@@ -727,7 +994,7 @@ func (avp *RadiusAVP) GetString() string {
 		var octetsValue, _ = avp.Value.([]byte)
 		return fmt.Sprintf("%x", octetsValue)
 
-	case RadiusTypeInteger, RadiusTypeInteger64:
+	case RadiusTypeInteger, RadiusTypeInteger64, RadiusTypeByte, RadiusTypeShort, RadiusTypeSigned:
 		var intValue, _ = avp.Value.(int64)
 		if stringValue, ok := avp.DictItem.EnumCodes[int(intValue)]; ok {
 			return stringValue
@@ -735,17 +1002,39 @@ func (avp *RadiusAVP) GetString() string {
 			return fmt.Sprintf("%d", intValue)
 		}
 
-	case RadiusTypeString, RadiusTypeIPv6Prefix:
+	case RadiusTypeString, RadiusTypeIPv6Prefix, RadiusTypeIPv4Prefix:
 		var stringValue, _ = avp.Value.(string)
 		return stringValue
 
-	case RadiusTypeAddress, RadiusTypeIPv6Address:
+	case RadiusTypeAddress, RadiusTypeIPv6Address, RadiusTypeComboIP:
 		var addressValue, _ = avp.Value.(net.IP)
 		return addressValue.String()
 
+	case RadiusTypeEther:
+		var macValue, _ = avp.Value.(net.HardwareAddr)
+		return macValue.String()
+
+	case RadiusTypeABinary:
+		var filterValue, _ = avp.Value.([]byte)
+		return abinaryToString(filterValue)
+
 	case RadiusTypeTime:
 		var timeValue, _ = avp.Value.(time.Time)
 		return timeValue.Format(TimeFormatString)
+
+	case RadiusTypeTLV, RadiusTypeStruct:
+		var tlvValue, _ = avp.Value.([]RadiusAVP)
+		var sb strings.Builder
+
+		sb.WriteString("{")
+		stringValues := make([]string, 0, len(tlvValue))
+		for i := range tlvValue {
+			stringValues = append(stringValues, tlvValue[i].Name+"="+tlvValue[i].GetString())
+		}
+		sb.WriteString(strings.Join(stringValues, ","))
+		sb.WriteString("}")
+
+		return sb.String()
 	}
 
 	return ""
@@ -767,7 +1056,7 @@ func (avp *RadiusAVP) GetTaggedString() string {
 func (avp *RadiusAVP) GetInt() int64 {
 
 	switch avp.DictItem.RadiusType {
-	case RadiusTypeInteger, RadiusTypeInteger64:
+	case RadiusTypeInteger, RadiusTypeInteger64, RadiusTypeByte, RadiusTypeShort, RadiusTypeSigned:
 		value, _ := avp.Value.(int64)
 		return value
 
@@ -876,7 +1165,7 @@ func NewRadiusAVP(name string, value interface{}) (*RadiusAVP, error) {
 			avp.Value = octetsValue
 		}
 
-	case RadiusTypeInteger, RadiusTypeInteger64:
+	case RadiusTypeInteger, RadiusTypeInteger64, RadiusTypeByte, RadiusTypeShort, RadiusTypeSigned:
 
 		if isString {
 			// Try dictionary
@@ -896,6 +1185,14 @@ func NewRadiusAVP(name string, value interface{}) (*RadiusAVP, error) {
 			}
 		}
 
+		// Check that the value fits in the attribute
+		intValue := avp.Value.(int64)
+		if (avp.DictItem.RadiusType == RadiusTypeByte && (intValue < 0 || intValue > math.MaxUint8)) ||
+			(avp.DictItem.RadiusType == RadiusTypeShort && (intValue < 0 || intValue > math.MaxUint16)) ||
+			(avp.DictItem.RadiusType == RadiusTypeSigned && (intValue < math.MinInt32 || intValue > math.MaxInt32)) {
+			return &RadiusAVP{}, fmt.Errorf("value %d out of range for %s", intValue, name)
+		}
+
 	case RadiusTypeString:
 		if isString {
 			avp.Value = stringValue
@@ -903,7 +1200,7 @@ func NewRadiusAVP(name string, value interface{}) (*RadiusAVP, error) {
 			return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d and value of type %T", avp.DictItem.RadiusType, value)
 		}
 
-	case RadiusTypeAddress, RadiusTypeIPv6Address:
+	case RadiusTypeAddress, RadiusTypeIPv6Address, RadiusTypeComboIP:
 
 		if isString {
 			addressValue := net.ParseIP(stringValue)
@@ -945,6 +1242,71 @@ func NewRadiusAVP(name string, value interface{}) (*RadiusAVP, error) {
 			return &RadiusAVP{}, fmt.Errorf("error creating diameter avp with type %d and value of type %T", avp.DictItem.RadiusType, value)
 		}
 
+	case RadiusTypeIPv4Prefix:
+		// A string such as 10.0.0.0/8 or a net.IPNet
+		switch v := value.(type) {
+		case string:
+			ip, _, err := net.ParseCIDR(stringValue)
+			if err != nil || ip.To4() == nil {
+				return &RadiusAVP{}, fmt.Errorf("ipv4 prefix %s does not match expected format", stringValue)
+			}
+			avp.Value = stringValue
+		case net.IPNet:
+			avp.Value, err = ipv4PrefixFromIPNet(&v)
+		case *net.IPNet:
+			avp.Value, err = ipv4PrefixFromIPNet(v)
+		default:
+			err = fmt.Errorf("value of type %T", value)
+		}
+		if err != nil {
+			return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d: %s", avp.DictItem.RadiusType, err)
+		}
+
+	case RadiusTypeEther:
+		// A string such as 00:11:22:33:44:55, or a net.HardwareAddr or []byte of 6 bytes
+		var macValue net.HardwareAddr
+		switch v := value.(type) {
+		case string:
+			macValue, err = net.ParseMAC(stringValue)
+		case net.HardwareAddr:
+			macValue = v
+		case []byte:
+			macValue = net.HardwareAddr(v)
+		}
+		if err != nil || len(macValue) != 6 {
+			return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d and value %v", avp.DictItem.RadiusType, value)
+		}
+		avp.Value = macValue
+
+	case RadiusTypeABinary:
+		// The textual representation of the filter, or the binary value
+		if isString {
+			avp.Value, err = abinaryFromString(stringValue)
+			if err != nil {
+				return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d: %s", avp.DictItem.RadiusType, err)
+			}
+		} else {
+			var octetsValue, ok = value.([]byte)
+			if !ok {
+				return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d and value of type %T", avp.DictItem.RadiusType, value)
+			}
+			avp.Value = octetsValue
+		}
+
+	case RadiusTypeTLV, RadiusTypeStruct:
+		switch v := value.(type) {
+		case nil:
+			avp.Value = make([]RadiusAVP, 0)
+		case []RadiusAVP:
+			avp.Value = v
+		case RadiusAVP:
+			avp.Value = []RadiusAVP{v}
+		case *RadiusAVP:
+			avp.Value = []RadiusAVP{*v}
+		default:
+			return &RadiusAVP{}, fmt.Errorf("error creating radius avp with type %d and value of type %T", avp.DictItem.RadiusType, value)
+		}
+
 	default:
 		return &RadiusAVP{}, fmt.Errorf("%d radius type not known", avp.DictItem.RadiusType)
 	}
@@ -952,6 +1314,97 @@ func NewRadiusAVP(name string, value interface{}) (*RadiusAVP, error) {
 	return &avp, nil
 }
 
+// Helper to generate the string representation of an IPv4 prefix
+func ipv4PrefixFromIPNet(ipNet *net.IPNet) (string, error) {
+	ones, bits := ipNet.Mask.Size()
+	if ipNet.IP.To4() == nil || bits != 32 {
+		return "", fmt.Errorf("%s is not an ipv4 prefix", ipNet)
+	}
+	return fmt.Sprintf("%s/%d", ipNet.IP.To4(), ones), nil
+}
+
+///////////////////////////////////////////////////////////////
+// TLV
+///////////////////////////////////////////////////////////////
+
+// Adds a new AVP to the TLV or struct AVP. Does nothing if the current value is not a TLV or the
+// attribute to add is not defined inside this one
+func (avp *RadiusAVP) AddAVP(tavp *RadiusAVP) *RadiusAVP {
+
+	if tavp == nil {
+		return avp
+	}
+
+	var tlvValue, ok = avp.Value.([]RadiusAVP)
+	if !ok {
+		GetLogger().Errorf("value of %s is not of type tlv", avp.Name)
+		return avp
+	}
+
+	if tavp.DictItem.Parent == nil || tavp.DictItem.Parent.Name != avp.DictItem.Name {
+		GetLogger().Errorf("%s is not defined inside %s", tavp.Name, avp.Name)
+		return avp
+	}
+
+	avp.Value = append(tlvValue, *tavp)
+	return avp
+}
+
+// Adds a new AVP to the TLV AVP, specified using name and value. Does nothing if the current value is not a TLV
+// or if the attribute could not be built
+func (avp *RadiusAVP) Add(name string, value interface{}) *RadiusAVP {
+	tavp, err := NewRadiusAVP(name, value)
+	if err != nil {
+		GetLogger().Errorf("could not add %s to %s: %s", name, avp.Name, err)
+		return avp
+	}
+	return avp.AddAVP(tavp)
+}
+
+// Finds and returns the first AVP found in the TLV with the specified name
+// Notice that a copy is returned
+func (avp *RadiusAVP) GetAVP(name string) (RadiusAVP, error) {
+	var tlvValue, ok = avp.Value.([]RadiusAVP)
+	if !ok {
+		return RadiusAVP{}, fmt.Errorf("value of %s is not of type tlv", avp.Name)
+	}
+
+	for i := range tlvValue {
+		if tlvValue[i].Name == name {
+			return tlvValue[i], nil
+		}
+	}
+	return RadiusAVP{}, fmt.Errorf("%s not found", name)
+}
+
+// Returns a slice with all AVP in the TLV with the specified name
+// Notice that a COPY is returned
+func (avp *RadiusAVP) GetAllAVP(name string) []RadiusAVP {
+	var tlvValue, ok = avp.Value.([]RadiusAVP)
+	if !ok {
+		GetLogger().Errorf("value of %s is not of type tlv", avp.Name)
+		return nil
+	}
+
+	avpList := make([]RadiusAVP, 0)
+	for i := range tlvValue {
+		if tlvValue[i].Name == name {
+			avpList = append(avpList, tlvValue[i])
+		}
+	}
+	return avpList
+}
+
+// Returns a pointer to the first attribute in the value of a struct with the specified member code, or nil if not found
+func findStructMember(members []RadiusAVP, code uint32) *RadiusAVP {
+	for i := range members {
+		if members[i].Code == code {
+			return &members[i]
+		}
+	}
+	return nil
+}
+
 /*
 	  On transmission, the password is hidden.  The password is first
       padded at the end with nulls to a multiple of 16 octets.  A one-
@@ -1113,10 +1566,11 @@ func (avp *RadiusAVP) toMap() map[string]interface{} {
 
 	switch avp.DictItem.RadiusType {
 
-	case RadiusTypeNone, RadiusTypeOctets, RadiusTypeString, RadiusTypeInterfaceId, RadiusTypeAddress, RadiusTypeIPv6Address, RadiusTypeIPv6Prefix, RadiusTypeTime:
+	case RadiusTypeNone, RadiusTypeOctets, RadiusTypeString, RadiusTypeInterfaceId, RadiusTypeAddress, RadiusTypeIPv6Address, RadiusTypeIPv6Prefix, RadiusTypeTime,
+		RadiusTypeIPv4Prefix, RadiusTypeEther, RadiusTypeComboIP, RadiusTypeABinary:
 		theMap[avp.Name] = avp.GetTaggedString()
 
-	case RadiusTypeInteger, RadiusTypeInteger64:
+	case RadiusTypeInteger, RadiusTypeInteger64, RadiusTypeByte, RadiusTypeShort, RadiusTypeSigned:
 		// Try dictionary, if not found use integer value
 		var intValue, _ = avp.Value.(int64)
 		if stringValue, ok := avp.DictItem.EnumCodes[int(intValue)]; ok {
@@ -1124,6 +1578,16 @@ func (avp *RadiusAVP) toMap() map[string]interface{} {
 		} else {
 			theMap[avp.Name] = avp.GetInt()
 		}
+
+	case RadiusTypeTLV, RadiusTypeStruct:
+		// The value is an array of JSON
+		targetTLV := make([]map[string]interface{}, 0)
+		if tlvValue, ok := avp.Value.([]RadiusAVP); ok {
+			for i := range tlvValue {
+				targetTLV = append(targetTLV, tlvValue[i].toMap())
+			}
+		}
+		theMap[avp.Name] = targetTLV
 	}
 	return theMap
 }
@@ -1137,8 +1601,30 @@ func aVPFromMap(avpMap map[string]interface{}) (RadiusAVP, error) {
 
 	// There will be only one entry
 	for name := range avpMap {
-		avp, err := NewRadiusAVP(name, avpMap[name])
-		return *avp, err
+		switch avpValue := avpMap[name].(type) {
+		case []interface{}:
+			// AVP is TLV
+			tlvAVP, err := NewRadiusAVP(name, nil)
+			if err != nil {
+				return RadiusAVP{}, err
+			}
+			// Add inner AVPs
+			for i := range avpValue {
+				innerMap, ok := avpValue[i].(map[string]interface{})
+				if !ok {
+					return RadiusAVP{}, fmt.Errorf("bad JSON representation of %s", name)
+				}
+				innerAVP, err := aVPFromMap(innerMap)
+				if err != nil {
+					return RadiusAVP{}, err
+				}
+				tlvAVP.AddAVP(&innerAVP)
+			}
+			return *tlvAVP, nil
+		default:
+			avp, err := NewRadiusAVP(name, avpValue)
+			return *avp, err
+		}
 	}
 
 	// Unreachable code
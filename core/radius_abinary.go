@@ -0,0 +1,200 @@
+package core
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Ascend binary filters, as used in Ascend-Data-Filter and Ascend-Call-Filter attributes. The value
+// is 32 bytes long
+//    type: 1 byte. 1 for IP filters. Other types are not supported, and are represented as hex strings
+//    forward: 1 byte. 1 if forward, 0 if drop
+//    direction: 1 byte. 1 if in, 0 if out
+//    fill: 1 byte
+//    srcip: 4 bytes
+//    dstip: 4 bytes
+//    srcmask: 1 byte
+//    dstmask: 1 byte
+//    proto: 1 byte
+//    established: 1 byte
+//    srcport: 2 bytes
+//    dstport: 2 bytes
+//    srcPortComp: 1 byte
+//    dstPortComp: 1 byte
+//    fill: 10 bytes
+//
+// The textual representation is the one used by FreeRADIUS, such as
+// ip in forward srcip 10.0.0.0/8 dstip 192.168.1.1/32 tcp dstport = 80 est
+
+const abinaryFilterLen = 32
+const abinaryTypeIP = 1
+
+var abinaryProtocols = map[string]byte{
+	"icmp": 1,
+	"tcp":  6,
+	"udp":  17,
+	"ospf": 89,
+}
+
+// Comparison operators for the ports. 0 means no comparison
+var abinaryComparisons = []string{"", "<", "=", ">", "!="}
+
+// Generates the textual representation of an ascend binary filter. Filters not of type IP are
+// represented as an hex string prefixed by 0x
+func abinaryToString(filter []byte) string {
+	if len(filter) != abinaryFilterLen || filter[0] != abinaryTypeIP || filter[20] >= byte(len(abinaryComparisons)) || filter[21] >= byte(len(abinaryComparisons)) {
+		return "0x" + hex.EncodeToString(filter)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("ip")
+	if filter[2] == 1 {
+		sb.WriteString(" in")
+	} else {
+		sb.WriteString(" out")
+	}
+	if filter[1] == 1 {
+		sb.WriteString(" forward")
+	} else {
+		sb.WriteString(" drop")
+	}
+
+	if srcIP := net.IP(filter[4:8]); !srcIP.Equal(net.IPv4zero) {
+		sb.WriteString(fmt.Sprintf(" srcip %s/%d", srcIP, filter[12]))
+	}
+	if dstIP := net.IP(filter[8:12]); !dstIP.Equal(net.IPv4zero) {
+		sb.WriteString(fmt.Sprintf(" dstip %s/%d", dstIP, filter[13]))
+	}
+
+	protoName := strconv.Itoa(int(filter[14]))
+	for name, proto := range abinaryProtocols {
+		if proto == filter[14] {
+			protoName = name
+		}
+	}
+	sb.WriteString(" " + protoName)
+
+	if filter[20] != 0 {
+		sb.WriteString(fmt.Sprintf(" srcport %s %d", abinaryComparisons[filter[20]], binary.BigEndian.Uint16(filter[16:18])))
+	}
+	if filter[21] != 0 {
+		sb.WriteString(fmt.Sprintf(" dstport %s %d", abinaryComparisons[filter[21]], binary.BigEndian.Uint16(filter[18:20])))
+	}
+	if filter[15] != 0 {
+		sb.WriteString(" est")
+	}
+
+	return sb.String()
+}
+
+// Builds the binary representation of an ascend filter from its textual representation, or from
+// an hex string prefixed by 0x
+func abinaryFromString(text string) ([]byte, error) {
+	if strings.HasPrefix(text, "0x") {
+		return hex.DecodeString(text[2:])
+	}
+
+	words := strings.Fields(text)
+	if len(words) < 3 || words[0] != "ip" {
+		return nil, fmt.Errorf("unsupported ascend filter %s", text)
+	}
+
+	filter := make([]byte, abinaryFilterLen)
+	filter[0] = abinaryTypeIP
+
+	switch words[1] {
+	case "in":
+		filter[2] = 1
+	case "out":
+	default:
+		return nil, fmt.Errorf("bad direction in ascend filter %s", text)
+	}
+
+	switch words[2] {
+	case "forward":
+		filter[1] = 1
+	case "drop":
+	default:
+		return nil, fmt.Errorf("bad action in ascend filter %s", text)
+	}
+
+	for i := 3; i < len(words); i++ {
+		switch words[i] {
+		case "srcip", "dstip":
+			if i+1 >= len(words) {
+				return nil, fmt.Errorf("missing address in ascend filter %s", text)
+			}
+			ip, mask, err := parseABinaryAddress(words[i+1])
+			if err != nil {
+				return nil, fmt.Errorf("%s in ascend filter %s", err, text)
+			}
+			if words[i] == "srcip" {
+				copy(filter[4:8], ip)
+				filter[12] = mask
+			} else {
+				copy(filter[8:12], ip)
+				filter[13] = mask
+			}
+			i++
+
+		case "srcport", "dstport":
+			if i+2 >= len(words) {
+				return nil, fmt.Errorf("missing port in ascend filter %s", text)
+			}
+			comparison := 0
+			for c := 1; c < len(abinaryComparisons); c++ {
+				if abinaryComparisons[c] == words[i+1] {
+					comparison = c
+				}
+			}
+			port, err := strconv.ParseUint(words[i+2], 10, 16)
+			if comparison == 0 || err != nil {
+				return nil, fmt.Errorf("bad port in ascend filter %s", text)
+			}
+			if words[i] == "srcport" {
+				binary.BigEndian.PutUint16(filter[16:18], uint16(port))
+				filter[20] = byte(comparison)
+			} else {
+				binary.BigEndian.PutUint16(filter[18:20], uint16(port))
+				filter[21] = byte(comparison)
+			}
+			i += 2
+
+		case "est":
+			filter[15] = 1
+
+		default:
+			// Must be a protocol
+			if proto, found := abinaryProtocols[words[i]]; found {
+				filter[14] = proto
+			} else if proto, err := strconv.ParseUint(words[i], 10, 8); err == nil {
+				filter[14] = byte(proto)
+			} else {
+				return nil, fmt.Errorf("unknown keyword %s in ascend filter %s", words[i], text)
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+// Parses an address in the form a.b.c.d/mask. If not specified, the mask is 32
+func parseABinaryAddress(address string) (net.IP, byte, error) {
+	var mask uint64 = 32
+	addrMask := strings.Split(address, "/")
+	if len(addrMask) == 2 {
+		var err error
+		if mask, err = strconv.ParseUint(addrMask[1], 10, 8); err != nil || mask > 32 {
+			return nil, 0, fmt.Errorf("bad mask %s", address)
+		}
+	}
+	ip := net.ParseIP(addrMask[0]).To4()
+	if ip == nil {
+		return nil, 0, fmt.Errorf("bad address %s", address)
+	}
+	return ip, byte(mask), nil
+}
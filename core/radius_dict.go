@@ -1,8 +1,12 @@
 package core
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 )
 
 type RadiusAVPType int
@@ -18,22 +22,48 @@ const (
 	RadiusTypeIPv6Prefix  = 7
 	RadiusTypeInterfaceId = 8
 	RadiusTypeInteger64   = 9
+
+	// RFC 6929. The value of a TLV is a list of attributes. The other types are containers for the
+	// attributes in the Extended-Type, Long-Extended-Type and Extended-Vendor-Specific spaces
+	RadiusTypeTLV          = 10
+	RadiusTypeExtended     = 11
+	RadiusTypeLongExtended = 12
+	RadiusTypeEVS          = 13
+
+	// FreeRADIUS types. Byte and Short are unsigned integers of 1 and 2 bytes, and Signed a 32 bit
+	// signed integer. ComboIP is an IPv4 or IPv6 address, depending on the length, Ether a MAC address,
+	// and ABinary an Ascend binary filter
+	RadiusTypeByte       = 14
+	RadiusTypeShort      = 15
+	RadiusTypeSigned     = 16
+	RadiusTypeIPv4Prefix = 17
+	RadiusTypeEther      = 18
+	RadiusTypeComboIP    = 19
+	RadiusTypeABinary    = 20
+
+	// FreeRADIUS struct. The value is the list of members, encoded one after the other without headers.
+	// All the members have a fixed size, except maybe the last one, that takes the rest of the attribute
+	RadiusTypeStruct = 21
 )
 
+// Extended-Type of the Extended-Vendor-Specific attributes (RFC 6929)
+const EXTENDED_VENDOR_SPECIFIC_TYPE = 26
+
 var UnknownRadiusDictItem = RadiusAVPDictItem{
 	Name: "UNKNOWN",
 }
 
-// VendorId and code of AVP in a single attribute
+// VendorId and code of AVP in a single attribute. Also used for the sub-attributes
+// of TLV and extended attributes, where the VendorId is only used for Extended-Vendor-Specific ones
 type RadiusAVPCode struct {
 	VendorId uint32
-	Code     byte
+	Code     uint32
 }
 
 // Diameter Dictionary elements
 type RadiusAVPDictItem struct {
 	VendorId   uint32
-	Code       byte
+	Code       uint32
 	Name       string
 	RadiusType RadiusAVPType  // One of the constants above
 	EnumValues map[string]int // non nil only in enum type
@@ -43,6 +73,177 @@ type RadiusAVPDictItem struct {
 	Salted     bool
 	WithLen    bool
 	Concat     bool
+
+	// For attributes inside a TLV or in the extended spaces of RFC 6929, the attribute that contains it.
+	// nil for the rest
+	Parent *RadiusAVPDictItem
+
+	// For TLV, Extended, LongExtended and EVS, the attributes that may be contained in this one.
+	// For Struct, the members, with codes starting at 1 in the order in which they are encoded
+	SubAVPByCode map[RadiusAVPCode]*RadiusAVPDictItem
+
+	// For the Octets members of a Struct, the size of the value. Zero if the member takes the rest of the attribute
+	Size int
+}
+
+// Returns the dictionary item of the sub-attribute with the specified code. If not found, returns an
+// unknown item that has this one as parent, so that it can be encoded again in the same place
+func (di *RadiusAVPDictItem) getSubItem(code RadiusAVPCode) *RadiusAVPDictItem {
+	if subItem, found := di.SubAVPByCode[code]; found {
+		return subItem
+	}
+
+	vendorId := code.VendorId
+	if vendorId == 0 {
+		vendorId = di.VendorId
+	}
+	return &RadiusAVPDictItem{
+		VendorId: vendorId,
+		Code:     code.Code,
+		Name:     UnknownRadiusDictItem.Name,
+		Parent:   di,
+	}
+}
+
+// Returns the members of a struct, in the order in which they are encoded
+func (di *RadiusAVPDictItem) structMembers() []*RadiusAVPDictItem {
+	members := make([]*RadiusAVPDictItem, 0, len(di.SubAVPByCode))
+	for i := 1; i <= len(di.SubAVPByCode); i++ {
+		if member, found := di.SubAVPByCode[RadiusAVPCode{VendorId: 0, Code: uint32(i)}]; found {
+			members = append(members, member)
+		}
+	}
+	return members
+}
+
+// Returns the size of the value of a struct member, or zero if it takes the rest of the attribute
+func (di *RadiusAVPDictItem) structMemberSize() int {
+	switch di.RadiusType {
+	case RadiusTypeByte:
+		return 1
+	case RadiusTypeShort:
+		return 2
+	case RadiusTypeInteger, RadiusTypeSigned, RadiusTypeAddress, RadiusTypeTime:
+		return 4
+	case RadiusTypeEther:
+		return 6
+	case RadiusTypeInteger64, RadiusTypeInterfaceId:
+		return 8
+	case RadiusTypeIPv6Address:
+		return 16
+	default:
+		return di.Size
+	}
+}
+
+// Layout of the vendor specific attributes of a vendor, as specified with format=t,l[,c] in FreeRADIUS
+// dictionaries. TypeSize is the number of bytes of the vendor type (1, 2 or 4), LengthSize the number of
+// bytes of the length (0, 1 or 2), and Continuation is true if a continuation byte follows the length, as in WiMAX
+type RadiusVendorFormat struct {
+	TypeSize     int
+	LengthSize   int
+	Continuation bool
+}
+
+// Format of the vendors that follow the recommendations of RFC 2865
+var DefaultRadiusVendorFormat = RadiusVendorFormat{TypeSize: 1, LengthSize: 1}
+
+// Builds the vendor format from its specification, such as "2,1" or "1,1,c"
+func parseRadiusVendorFormat(spec string) (RadiusVendorFormat, error) {
+	parts := strings.Split(spec, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return RadiusVendorFormat{}, fmt.Errorf("bad vendor format %s", spec)
+	}
+	typeSize, err1 := strconv.Atoi(parts[0])
+	lengthSize, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || (typeSize != 1 && typeSize != 2 && typeSize != 4) || lengthSize < 0 || lengthSize > 2 {
+		return RadiusVendorFormat{}, fmt.Errorf("bad vendor format %s", spec)
+	}
+	format := RadiusVendorFormat{TypeSize: typeSize, LengthSize: lengthSize}
+	if len(parts) == 3 {
+		// Continuation is only allowed for the standard layout
+		if parts[2] != "c" || typeSize != 1 || lengthSize != 1 {
+			return RadiusVendorFormat{}, fmt.Errorf("bad vendor format %s", spec)
+		}
+		format.Continuation = true
+	}
+	return format, nil
+}
+
+// Size of the type, length and continuation
+func (vf RadiusVendorFormat) headerLen() int {
+	if vf.Continuation {
+		return vf.TypeSize + vf.LengthSize + 1
+	}
+	return vf.TypeSize + vf.LengthSize
+}
+
+// Maximum value of the vendor type
+func (vf RadiusVendorFormat) maxCode() uint32 {
+	if vf.TypeSize == 4 {
+		return math.MaxUint32
+	}
+	return 1<<(8*vf.TypeSize) - 1
+}
+
+// Parses the contents of a vendor specific attribute after the vendorId, setting the code and
+// returning the value and whether the continuation flag is set
+func (vf RadiusVendorFormat) decodeHeader(data []byte, code *uint32) ([]byte, bool, error) {
+	if len(data) < vf.headerLen() {
+		return nil, false, fmt.Errorf("bad avp coding. Vendor specific attribute too short")
+	}
+
+	switch vf.TypeSize {
+	case 1:
+		*code = uint32(data[0])
+	case 2:
+		*code = uint32(binary.BigEndian.Uint16(data[0:2]))
+	default:
+		*code = binary.BigEndian.Uint32(data[0:4])
+	}
+
+	// SanityCheck. The vendor length should be the length of the attribute minus 4 bytes for vendorId
+	var length int
+	switch vf.LengthSize {
+	case 0:
+		length = len(data)
+	case 1:
+		length = int(data[vf.TypeSize])
+	default:
+		length = int(binary.BigEndian.Uint16(data[vf.TypeSize : vf.TypeSize+2]))
+	}
+	if length != len(data) {
+		return nil, false, fmt.Errorf("bad avp coding. Expected length of vendor specific attribute does not match")
+	}
+
+	more := vf.Continuation && data[vf.TypeSize+vf.LengthSize]&0x80 != 0
+	return data[vf.headerLen():], more, nil
+}
+
+// Generates the header of the vendor specific attribute, that goes after the vendorId
+func (vf RadiusVendorFormat) encodeHeader(code uint32, valueLen int, more bool) []byte {
+	header := make([]byte, vf.headerLen())
+
+	switch vf.TypeSize {
+	case 1:
+		header[0] = byte(code)
+	case 2:
+		binary.BigEndian.PutUint16(header[0:2], uint16(code))
+	default:
+		binary.BigEndian.PutUint32(header[0:4], code)
+	}
+
+	switch vf.LengthSize {
+	case 1:
+		header[vf.TypeSize] = byte(vf.headerLen() + valueLen)
+	case 2:
+		binary.BigEndian.PutUint16(header[vf.TypeSize:vf.TypeSize+2], uint16(vf.headerLen()+valueLen))
+	}
+
+	if more {
+		header[vf.TypeSize+vf.LengthSize] = 0x80
+	}
+	return header
 }
 
 // Represents the full Radius Dictionary
@@ -53,10 +254,16 @@ type RadiusDict struct {
 	// Map of vendor name to vendor id
 	VendorByName map[string]uint32
 
+	// Map of vendor id to format of the vendor specific attributes. Only for the vendors
+	// that do not use the default format
+	VendorFormatById map[uint32]RadiusVendorFormat
+
 	// Map of avp code to name. Name is <vendorName>-<attributeName>
+	// Only for the attributes that are not contained in others
 	AVPByCode map[RadiusAVPCode]*RadiusAVPDictItem
 
-	// Map of avp name to code
+	// Map of avp name to code. The name of the attributes inside a TLV is
+	// <TLV name>.<attributeName>
 	AVPByName map[string]*RadiusAVPDictItem
 }
 
@@ -70,6 +277,14 @@ func (rd *RadiusDict) GetFromCode(code RadiusAVPCode) (*RadiusAVPDictItem, error
 	}
 }
 
+// Returns the format of the vendor specific attributes of the vendor
+func (rd *RadiusDict) GetVendorFormat(vendorId uint32) RadiusVendorFormat {
+	if format, found := rd.VendorFormatById[vendorId]; found {
+		return format
+	}
+	return DefaultRadiusVendorFormat
+}
+
 // Returns an empty dictionary item if the code is not found
 // The user may decide to go on with an UNKNOWN dictionary item when the error is returned
 func (rd *RadiusDict) GetFromName(name string) (*RadiusAVPDictItem, error) {
@@ -87,29 +302,88 @@ func newRadiusDictionaryFromJDict(jDict *jRadiusDict) *RadiusDict {
 	// Build the vendor maps
 	dict.VendorById = make(map[uint32]string)
 	dict.VendorByName = make(map[string]uint32)
+	dict.VendorFormatById = make(map[uint32]RadiusVendorFormat)
 	for _, v := range jDict.Vendors {
 		dict.VendorById[v.VendorId] = v.VendorName
 		dict.VendorByName[v.VendorName] = v.VendorId
+		if v.Format != "" {
+			format, err := parseRadiusVendorFormat(v.Format)
+			if err != nil {
+				panic(fmt.Sprintf("vendor %s: %s", v.VendorName, err))
+			}
+			if format != DefaultRadiusVendorFormat {
+				dict.VendorFormatById[v.VendorId] = format
+			}
+		}
 	}
 
 	// Build the AVP maps
 	dict.AVPByCode = make(map[RadiusAVPCode]*RadiusAVPDictItem)
 	dict.AVPByName = make(map[string]*RadiusAVPDictItem)
-	for _, vendorAVPs := range jDict.Avps {
-		vendorId := vendorAVPs.VendorId
-		vendorName := dict.VendorById[vendorId]
-
-		// Map all atttributtes from this vendor
-		for _, attr := range vendorAVPs.Attributes {
-			avpDictItem := attr.toAVPDictItem(vendorId, vendorName)
-			dict.AVPByCode[RadiusAVPCode{vendorId, attr.Code}] = &avpDictItem
-			dict.AVPByName[avpDictItem.Name] = &avpDictItem
+
+	// The items, by vendor and OID, to locate the parents of the nested attributes
+	itemsByOID := make(map[uint32]map[string]*RadiusAVPDictItem)
+
+	// The attributes in the Extended-Vendor-Specific spaces are processed in the second
+	// pass, once the attributes of vendor 0 that contain them are defined
+	for _, evsPass := range []bool{false, true} {
+		for _, vendorAVPs := range jDict.Avps {
+			if (vendorAVPs.Parent != "") != evsPass {
+				continue
+			}
+
+			vendorId := vendorAVPs.VendorId
+			vendorName := dict.VendorById[vendorId]
+
+			// The attributes without parent in the list are contained in the Extended-Vendor-Specific attribute,
+			// if specified. The OIDs are relative to it
+			var rootItem *RadiusAVPDictItem
+			var oids map[string]*RadiusAVPDictItem
+			if evsPass {
+				rootItem = itemsByOID[0][vendorAVPs.Parent]
+				if rootItem == nil || rootItem.RadiusType != RadiusTypeEVS {
+					panic(fmt.Sprintf("extended vendor specific attribute %s for vendor %s not found", vendorAVPs.Parent, vendorName))
+				}
+				oids = make(map[string]*RadiusAVPDictItem)
+			} else {
+				if itemsByOID[vendorId] == nil {
+					itemsByOID[vendorId] = make(map[string]*RadiusAVPDictItem)
+				}
+				oids = itemsByOID[vendorId]
+			}
+
+			// Map all atttributtes from this vendor
+			for _, attr := range vendorAVPs.Attributes {
+				parent := rootItem
+				if attr.Parent != "" {
+					if parent = oids[attr.Parent]; parent == nil {
+						panic(fmt.Sprintf("parent %s of radius attribute %s not found", attr.Parent, attr.Name))
+					}
+				}
+
+				avpDictItem := attr.toAVPDictItem(vendorId, vendorName, parent)
+				dict.addItem(&avpDictItem)
+				oids[attr.oid()] = &avpDictItem
+			}
 		}
 	}
 
 	return &dict
 }
 
+// Registers the item in the maps of the dictionary or in the parent
+func (rd *RadiusDict) addItem(item *RadiusAVPDictItem) {
+	switch {
+	case item.Parent == nil:
+		rd.AVPByCode[RadiusAVPCode{item.VendorId, item.Code}] = item
+	case item.Parent.RadiusType == RadiusTypeEVS:
+		item.Parent.SubAVPByCode[RadiusAVPCode{item.VendorId, item.Code}] = item
+	default:
+		item.Parent.SubAVPByCode[RadiusAVPCode{0, item.Code}] = item
+	}
+	rd.AVPByName[item.Name] = item
+}
+
 // Returns a Diameter Dictionary object from its serialized representation
 func NewRadiusDictionaryFromJSON(data []byte) *RadiusDict {
 
@@ -128,7 +402,7 @@ The following types are helpers for unserializing the JSON Radius Dictionary
 
 // To Unmarshall Dictionary from Json
 type jRadiusAVP struct {
-	Code       byte
+	Code       uint32
 	Name       string
 	Type       string
 	EnumValues map[string]int
@@ -137,16 +411,39 @@ type jRadiusAVP struct {
 	Salted     bool
 	WithLen    bool
 	Concat     bool
+
+	// Size of the Octets members of a Struct. Zero if variable
+	Size int
+
+	// OID of the attribute that contains this one, such as "241" or "26.1". Empty
+	// if not contained in other attribute
+	Parent string
+}
+
+// Returns the OID of the attribute, that is, the code prefixed by the OID of the parent
+func (javp jRadiusAVP) oid() string {
+	if javp.Parent == "" {
+		return strconv.Itoa(int(javp.Code))
+	}
+	return javp.Parent + "." + strconv.Itoa(int(javp.Code))
 }
 
 type jRadiusVendorAVPs struct {
 	VendorId   uint32
 	Attributes []jRadiusAVP
+
+	// If not empty, the attributes are in the Extended-Vendor-Specific space of the
+	// attribute of vendor 0 with this OID, such as "241.26"
+	Parent string
 }
 
 type jVendor struct {
 	VendorId   uint32
 	VendorName string
+
+	// Sizes of type and length of the vendor specific attributes, and "c" if there is
+	// a continuation byte, such as "2,1" or "1,1,c". Empty if standard
+	Format string
 }
 
 type jRadiusDict struct {
@@ -156,7 +453,7 @@ type jRadiusDict struct {
 }
 
 // Builds a cooked AVPDictItem from the raw Json representation
-func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) RadiusAVPDictItem {
+func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string, parent *RadiusAVPDictItem) RadiusAVPDictItem {
 
 	// Sanity check
 	var radiusType RadiusAVPType
@@ -181,6 +478,30 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) RadiusAVPDictItem {
 		radiusType = RadiusTypeInterfaceId
 	case "Integer64":
 		radiusType = RadiusTypeInteger64
+	case "TLV":
+		radiusType = RadiusTypeTLV
+	case "Extended":
+		radiusType = RadiusTypeExtended
+	case "LongExtended":
+		radiusType = RadiusTypeLongExtended
+	case "EVS":
+		radiusType = RadiusTypeEVS
+	case "Byte":
+		radiusType = RadiusTypeByte
+	case "Short":
+		radiusType = RadiusTypeShort
+	case "Signed":
+		radiusType = RadiusTypeSigned
+	case "IPv4Prefix":
+		radiusType = RadiusTypeIPv4Prefix
+	case "Ether":
+		radiusType = RadiusTypeEther
+	case "ComboIP":
+		radiusType = RadiusTypeComboIP
+	case "ABinary":
+		radiusType = RadiusTypeABinary
+	case "Struct":
+		radiusType = RadiusTypeStruct
 
 	default:
 		panic(javp.Type + " is not a valid RadiusType")
@@ -191,6 +512,39 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) RadiusAVPDictItem {
 		panic(javp.Name + " is concat but not of type Octets")
 	}
 
+	// Check the nesting
+	switch radiusType {
+	case RadiusTypeExtended, RadiusTypeLongExtended:
+		if parent != nil || v != 0 {
+			panic(javp.Name + " is extended but is not a standard attribute")
+		}
+	case RadiusTypeEVS:
+		if parent == nil || (parent.RadiusType != RadiusTypeExtended && parent.RadiusType != RadiusTypeLongExtended) {
+			panic(javp.Name + " is extended vendor specific but is not inside an extended attribute")
+		}
+	}
+	if parent != nil {
+		switch parent.RadiusType {
+		case RadiusTypeTLV, RadiusTypeExtended, RadiusTypeLongExtended, RadiusTypeEVS:
+		case RadiusTypeStruct:
+			switch radiusType {
+			case RadiusTypeByte, RadiusTypeShort, RadiusTypeInteger, RadiusTypeSigned, RadiusTypeInteger64, RadiusTypeAddress,
+				RadiusTypeIPv6Address, RadiusTypeTime, RadiusTypeEther, RadiusTypeInterfaceId, RadiusTypeOctets, RadiusTypeString:
+			default:
+				panic(javp.Name + " is not a valid member of struct " + parent.Name)
+			}
+		default:
+			panic(javp.Name + " is inside " + parent.Name + ", which cannot contain other attributes")
+		}
+	}
+
+	// Containers
+	var subAVPs map[RadiusAVPCode]*RadiusAVPDictItem
+	switch radiusType {
+	case RadiusTypeTLV, RadiusTypeExtended, RadiusTypeLongExtended, RadiusTypeEVS, RadiusTypeStruct:
+		subAVPs = make(map[RadiusAVPCode]*RadiusAVPDictItem)
+	}
+
 	// Build the map for enum values
 	var codes map[int]string
 	if javp.EnumValues != nil {
@@ -200,8 +554,11 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) RadiusAVPDictItem {
 		}
 	}
 
+	// Attributes inside a TLV and struct members are named after it
 	var namePrefix string
-	if vs != "" {
+	if parent != nil && (parent.RadiusType == RadiusTypeTLV || parent.RadiusType == RadiusTypeStruct) {
+		namePrefix = parent.Name + "."
+	} else if vs != "" {
 		namePrefix = vs + "-"
 	}
 
@@ -217,5 +574,9 @@ func (javp jRadiusAVP) toAVPDictItem(v uint32, vs string) RadiusAVPDictItem {
 		Salted:     javp.Salted,
 		WithLen:    javp.WithLen,
 		Concat:     javp.Concat,
+
+		Parent:       parent,
+		SubAVPByCode: subAVPs,
+		Size:         javp.Size,
 	}
 }
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"bytes"
+	"crypto/des"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/md4"
+)
+
+// MS-CHAP (RFC 2433) and MS-CHAPv2 (RFC 2759) authentication, with the
+// generation of MPPE keys as specified in RFC 3079 and RFC 2548
+
+// Magic constants of RFC 2759
+var mschap2Magic1 = []byte("Magic server to client signing constant")
+var mschap2Magic2 = []byte("Pad to make it do more than one iteration")
+
+// Magic constants of RFC 3079
+var mppeMasterKeyMagic = []byte("This is the MPPE Master Key")
+var mppeClientSendMagic = []byte("On the client side, this is the send key; on the server side, it is the receive key.")
+var mppeServerSendMagic = []byte("On the client side, this is the receive key; on the server side, it is the send key.")
+
+// Size of the MS-CHAP-Response and MS-CHAP2-Response attributes
+const mschapResponseLen = 50
+
+// Returns the NT-Hash of the password, that is, the MD4 of its UTF-16 little endian encoding
+func NTHash(password string) []byte {
+	encoded := utf16.Encode([]rune(password))
+	passwordBytes := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		passwordBytes[2*i] = byte(r)
+		passwordBytes[2*i+1] = byte(r >> 8)
+	}
+	hasher := md4.New()
+	hasher.Write(passwordBytes)
+	return hasher.Sum(nil)
+}
+
+// Returns the MD4 of the NT-Hash
+func ntHashHash(ntHash []byte) []byte {
+	hasher := md4.New()
+	hasher.Write(ntHash)
+	return hasher.Sum(nil)
+}
+
+// The 8 bytes challenge used in MS-CHAPv2, derived from both challenges and the user name
+func mschap2ChallengeHash(peerChallenge []byte, authenticatorChallenge []byte, userName string) []byte {
+	hasher := sha1.New()
+	hasher.Write(peerChallenge)
+	hasher.Write(authenticatorChallenge)
+	hasher.Write([]byte(userName))
+	return hasher.Sum(nil)[0:8]
+}
+
+// DES encrypts the challenge with the three 7 bytes keys taken from the zero padded NT-Hash
+func mschapChallengeResponse(challenge []byte, ntHash []byte) []byte {
+	zHash := make([]byte, 21)
+	copy(zHash, ntHash)
+
+	response := make([]byte, 24)
+	for i := 0; i < 3; i++ {
+		block, _ := des.NewCipher(desKey(zHash[7*i : 7*i+7]))
+		block.Encrypt(response[8*i:8*i+8], challenge)
+	}
+	return response
+}
+
+// Expands a 7 bytes key to the 8 bytes of DES, inserting the parity bits
+func desKey(key7 []byte) []byte {
+	key := make([]byte, 8)
+	key[0] = key7[0]
+	key[1] = key7[0]<<7 | key7[1]>>1
+	key[2] = key7[1]<<6 | key7[2]>>2
+	key[3] = key7[2]<<5 | key7[3]>>3
+	key[4] = key7[3]<<4 | key7[4]>>4
+	key[5] = key7[4]<<3 | key7[5]>>5
+	key[6] = key7[5]<<2 | key7[6]>>6
+	key[7] = key7[6] << 1
+	return key
+}
+
+// Generates the authenticator response, in the form S=<40 hex digits>, that proves to the peer that the server knows the password
+func mschap2AuthenticatorResponse(ntHash []byte, ntResponse []byte, peerChallenge []byte, authenticatorChallenge []byte, userName string) string {
+	hasher := sha1.New()
+	hasher.Write(ntHashHash(ntHash))
+	hasher.Write(ntResponse)
+	hasher.Write(mschap2Magic1)
+	digest := hasher.Sum(nil)
+
+	hasher = sha1.New()
+	hasher.Write(digest)
+	hasher.Write(mschap2ChallengeHash(peerChallenge, authenticatorChallenge, userName))
+	hasher.Write(mschap2Magic2)
+
+	return "S=" + strings.ToUpper(hex.EncodeToString(hasher.Sum(nil)))
+}
+
+// Generates the MPPE send and receive keys of the server, of 16 bytes, for MS-CHAPv2
+func mschap2MPPEKeys(ntHash []byte, ntResponse []byte) ([]byte, []byte) {
+	hasher := sha1.New()
+	hasher.Write(ntHashHash(ntHash))
+	hasher.Write(ntResponse)
+	hasher.Write(mppeMasterKeyMagic)
+	masterKey := hasher.Sum(nil)[0:16]
+
+	return mppeStartKey(masterKey, mppeServerSendMagic), mppeStartKey(masterKey, mppeClientSendMagic)
+}
+
+// GetAsymmetricStartKey of RFC 3079, for 128 bit keys
+func mppeStartKey(masterKey []byte, magic []byte) []byte {
+	hasher := sha1.New()
+	hasher.Write(masterKey)
+	hasher.Write(make([]byte, 40))
+	hasher.Write(magic)
+	hasher.Write(bytes.Repeat([]byte{0xF2}, 40))
+	return hasher.Sum(nil)[0:16]
+}
+
+// Verifies the MS-CHAP or MS-CHAPv2 attributes in the request against the NT-Hash of the password. If the
+// response packet is not nil, adds to it the attributes to be sent to the peer
+func (rp *RadiusPacket) mschapAuth(ntHash []byte, response *RadiusPacket) (bool, error) {
+
+	challenge := rp.GetOctetsAVP("Microsoft-CHAP-Challenge")
+
+	// MS-CHAPv2
+	if chapResponse := rp.GetOctetsAVP("Microsoft-CHAP2-Response"); chapResponse != nil {
+		if len(chapResponse) != mschapResponseLen || len(challenge) != 16 {
+			return false, fmt.Errorf("invalid MS-CHAP2-Response or MS-CHAP-Challenge in request")
+		}
+		ident := chapResponse[0]
+		peerChallenge := chapResponse[2:18]
+		ntResponse := chapResponse[26:50]
+
+		// The user name without the domain
+		userName := rp.GetStringAVP("User-Name")
+		if i := strings.LastIndex(userName, "\\"); i >= 0 {
+			userName = userName[i+1:]
+		}
+
+		expected := mschapChallengeResponse(mschap2ChallengeHash(peerChallenge, challenge, userName), ntHash)
+		if !bytes.Equal(expected, ntResponse) {
+			if response != nil {
+				response.Add("Microsoft-CHAP-Error", string([]byte{ident})+"E=691 R=0")
+			}
+			return false, nil
+		}
+
+		if response != nil {
+			authResponse := mschap2AuthenticatorResponse(ntHash, ntResponse, peerChallenge, challenge, userName)
+			response.Add("Microsoft-CHAP2-Success", append([]byte{ident}, authResponse...))
+			sendKey, recvKey := mschap2MPPEKeys(ntHash, ntResponse)
+			response.Add("Microsoft-MPPE-Send-Key", sendKey)
+			response.Add("Microsoft-MPPE-Recv-Key", recvKey)
+		}
+		return true, nil
+	}
+
+	// MS-CHAPv1
+	chapResponse := rp.GetOctetsAVP("Microsoft-CHAP-Response")
+	if len(chapResponse) != mschapResponseLen || len(challenge) != 8 {
+		return false, fmt.Errorf("invalid MS-CHAP-Response or MS-CHAP-Challenge in request")
+	}
+	ident := chapResponse[0]
+
+	// Only the NT response is supported
+	if chapResponse[1] != 1 {
+		return false, fmt.Errorf("LM response in MS-CHAP-Response is not supported")
+	}
+	if !bytes.Equal(mschapChallengeResponse(challenge, ntHash), chapResponse[26:50]) {
+		if response != nil {
+			response.Add("Microsoft-CHAP-Error", string([]byte{ident})+"E=691 R=0")
+		}
+		return false, nil
+	}
+
+	// The keys are the LM key, which is not supported and set to zero, and the NT-Hash hash
+	if response != nil {
+		response.Add("Microsoft-CHAP-MPPE-Keys", append(make([]byte, 8), ntHashHash(ntHash)...))
+	}
+	return true, nil
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/md5"
 	"encoding/binary"
 	"encoding/json"
@@ -18,9 +19,10 @@ type RadiusPacketType byte
 
 const (
 	// Success
-	ACCESS_REQUEST = 1
-	ACCESS_ACCEPT  = 2
-	ACCESS_REJECT  = 3
+	ACCESS_REQUEST   = 1
+	ACCESS_ACCEPT    = 2
+	ACCESS_REJECT    = 3
+	ACCESS_CHALLENGE = 11
 
 	ACCOUNTING_REQUEST  = 4
 	ACCOUNTING_RESPONSE = 5
@@ -32,6 +34,21 @@ const (
 	COA_REQUEST = 43
 	COA_ACK     = 44
 	COA_NAK     = 45
+
+	// RFC 5997. Answered with Access-Accept or Accounting-Response
+	STATUS_SERVER = 12
+)
+
+// Code of the Message-Authenticator attribute (RFC 3579)
+const MESSAGE_AUTHENTICATOR_CODE = 80
+
+// Policies for checking the Message-Authenticator in the received packets.
+// "require" applies only to Access-Request and the responses to it. For other codes,
+// it is treated as "validate-if-present"
+const (
+	MessageAuthenticatorValidateIfPresent = "validate-if-present"
+	MessageAuthenticatorRequire           = "require"
+	MessageAuthenticatorIgnore            = "ignore"
 )
 
 var Zero_authenticator = [16]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
@@ -121,7 +138,8 @@ func (rp *RadiusPacket) FromReader(reader io.Reader, secret string, ra [16]byte)
 		if nextAVP.DictItem.Concat && // Current has concat attribute
 			avpsLen > 0 && // There is a previous one
 			rp.AVPs[avpsLen-1].DictItem.Code == nextAVP.DictItem.Code && // Of the same Code
-			rp.AVPs[avpsLen-1].DictItem.VendorId == nextAVP.DictItem.VendorId { // And same vendor
+			rp.AVPs[avpsLen-1].DictItem.VendorId == nextAVP.DictItem.VendorId && // And same vendor
+			rp.AVPs[avpsLen-1].DictItem.Parent == nextAVP.DictItem.Parent { // And not inside an extended attribute
 
 			// Append the octets to the value
 			// It has been checked in the dictionary that concat must be octets
@@ -161,16 +179,26 @@ func (rp *RadiusPacket) FromReader(reader io.Reader, secret string, ra [16]byte)
 //	Authenticator is md5(Code+ID+Length+RequestAuth+Attributes+Secret)
 //
 // id is ignored in responses, where the id from the request and stored in the avp will be used
+//
+// The packet is not modified, so that it may be serialized concurrently. The authenticator
+// of a request, which is needed to validate the response, is in the bytes 4 to 20 of the output
 func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (int64, error) {
 
 	currentIndex := int64(0)
 	var err error
 
+	// The packet is not modified. The attributes to write, with the Message-Authenticator added
+	// if required, and the authenticator, are kept here
+	avps, maIndex := rp.prepareMessageAuthenticator()
+	var maOffset int64
+	var authenticator = rp.Authenticator
+
 	// If not an ACCESS_REQUEST, the authenticator is calculated based on a hash
-	// of the full packet, so it cannot be written beforehand
+	// of the full packet, so it cannot be written beforehand. The same happens with
+	// the Message-Authenticator, which is a hash of the full packet.
 	// Using this buffer as a temporary scratch pad
 	var scratchWriter io.Writer
-	if rp.Code == ACCESS_REQUEST {
+	if (rp.Code == ACCESS_REQUEST || rp.Code == STATUS_SERVER) && maIndex < 0 {
 		// Writer directly
 		scratchWriter = outWriter
 	} else {
@@ -179,22 +207,24 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 	}
 
 	// Normalize AVPs to fit in 256 bytes
-	// This mutates the RadiusPacket
 	// First, check that this is going to be needed, to avoid copying everything if not necessary
 	var doSplit = false
-	for i := range rp.AVPs {
-		if rp.AVPs[i].DictItem.Concat && rp.AVPs[i].Len() > 255 {
+	for i := range avps {
+		if avps[i].DictItem.Concat && avps[i].Len() > 255 {
 			doSplit = true
 			break
 		}
 	}
 	if doSplit {
 		newAVPs := make([]RadiusAVP, 0)
-		for i := range rp.AVPs {
-			if rp.AVPs[i].DictItem.Concat && rp.AVPs[i].Len() > 255 {
+		for i := range avps {
+			if i == maIndex {
+				maIndex = len(newAVPs)
+			}
+			if avps[i].DictItem.Concat && avps[i].Len() > 255 {
 				// Split into multiple attributes
 				valueIndex := 0
-				octetsValue := rp.AVPs[i].Value.([]byte)
+				octetsValue := avps[i].Value.([]byte)
 
 				for valueIndex < len(octetsValue) {
 					lastIndex := valueIndex + 240 // Play on the safe side
@@ -202,7 +232,7 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 						lastIndex = len(octetsValue)
 					}
 
-					splitAVP := rp.AVPs[i]
+					splitAVP := avps[i]
 					splitAVP.Value = octetsValue[valueIndex:lastIndex]
 					newAVPs = append(newAVPs, splitAVP)
 
@@ -210,11 +240,11 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 				}
 			} else {
 				// Normal path
-				newAVPs = append(newAVPs, rp.AVPs[i])
+				newAVPs = append(newAVPs, avps[i])
 			}
 		}
 
-		rp.AVPs = newAVPs
+		avps = newAVPs
 	}
 
 	// Write code
@@ -225,7 +255,7 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 
 	// Write identifier
 	var identifier byte
-	if rp.Code == ACCESS_REQUEST || rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST {
+	if rp.IsRequest() {
 		identifier = id
 	} else {
 		// The parameter is ignored. We use the one in the object
@@ -237,7 +267,7 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 	currentIndex += 1
 
 	// Write length
-	packetLen := rp.Len()
+	packetLen := radiusPacketLen(avps)
 	if err = binary.Write(scratchWriter, binary.BigEndian, packetLen); err != nil {
 		return 0, err
 	}
@@ -246,20 +276,23 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 	// Write authenticator
 	// If it is a response, authenticator will be set to the request authenticator.
 	// Otherwise, set to a new one or to zero
-	if rp.Code == ACCESS_REQUEST {
-		rp.Authenticator = BuildRandomAuthenticator()
+	if rp.Code == ACCESS_REQUEST || rp.Code == STATUS_SERVER {
+		authenticator = BuildRandomAuthenticator()
 	} else if rp.Code == ACCOUNTING_REQUEST || rp.Code == DISCONNECT_REQUEST || rp.Code == COA_REQUEST {
-		rp.Authenticator = Zero_authenticator
+		authenticator = Zero_authenticator
 	}
 	// else Do nothing. Authenticator will be set to the one in the request
-	if err = binary.Write(scratchWriter, binary.BigEndian, rp.Authenticator); err != nil {
+	if err = binary.Write(scratchWriter, binary.BigEndian, authenticator); err != nil {
 		return 0, err
 	}
 	currentIndex += 16
 
 	// Write all the AVP
-	for i := 0; i < len(rp.AVPs); i++ {
-		n, err := rp.AVPs[i].ToWriter(scratchWriter, rp.Authenticator, secret)
+	for i := 0; i < len(avps); i++ {
+		if i == maIndex {
+			maOffset = currentIndex
+		}
+		n, err := avps[i].ToWriter(scratchWriter, authenticator, secret)
 		if err != nil {
 			return 0, err
 		}
@@ -272,11 +305,29 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 		panic(panicString)
 	}
 
+	// Calculate the Message-Authenticator, which is the HMAC-MD5 of the packet with the
+	// Message-Authenticator set to zero, and write it in place
+	if maIndex >= 0 {
+		tmpPacketBytes := scratchWriter.(*bytes.Buffer).Bytes()
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(tmpPacketBytes)
+		messageAuthenticator := mac.Sum(nil)
+		copy(tmpPacketBytes[maOffset+2:maOffset+18], messageAuthenticator)
+	}
+
 	// Calculate final authenticator and write to stream
 	var writtenBytes int64
-	if rp.Code == ACCESS_REQUEST {
-		// Was already written directly to outwriter
-		writtenBytes = currentIndex
+	if rp.Code == ACCESS_REQUEST || rp.Code == STATUS_SERVER {
+		if maIndex < 0 {
+			// Was already written directly to outwriter
+			writtenBytes = currentIndex
+		} else {
+			n, err := outWriter.Write(scratchWriter.(*bytes.Buffer).Bytes())
+			if err != nil {
+				return int64(n), err
+			}
+			writtenBytes = int64(n)
+		}
 	} else {
 		// Authenticator is md5(code+identifier+(current authenticator in Authenticator field)+request_attributes+secret)
 		//                                      (wich is a generated one (auth request) zero (other requests) or the authenticator in the request (response))
@@ -297,12 +348,10 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 			return int64(n1), err
 		}
 		// Write authenticator
-		// And update the authenticator in the packet!
 		n2, err := outWriter.Write(auth)
 		if err != nil {
 			return int64(n1 + n2), err
 		}
-		rp.Authenticator = *(*[16]byte)(auth)
 
 		// Write AVPs
 		n3, err := outWriter.Write(tmpPacketBytes[20:])
@@ -321,6 +370,39 @@ func (rp *RadiusPacket) ToWriter(outWriter io.Writer, secret string, id byte) (i
 	return int64(packetLen), nil
 }
 
+// Returns the attributes to write, making sure that Access-Request, Status-Server and responses to Access-Request
+// include a Message-Authenticator, placed in the first position, with its value set to zero, as required before
+// calculating it. The packet is not modified: if the Message-Authenticator is added or zeroed, a copy of the
+// attributes is returned. Returns also the index of the Message-Authenticator attribute, or -1 if not present
+func (rp *RadiusPacket) prepareMessageAuthenticator() ([]RadiusAVP, int) {
+	maIndex := -1
+	for i := range rp.AVPs {
+		if rp.AVPs[i].Code == MESSAGE_AUTHENTICATOR_CODE && rp.AVPs[i].VendorId == 0 && rp.AVPs[i].DictItem.Parent == nil {
+			maIndex = i
+			break
+		}
+	}
+
+	if maIndex < 0 {
+		switch rp.Code {
+		case ACCESS_REQUEST, ACCESS_ACCEPT, ACCESS_REJECT, ACCESS_CHALLENGE, STATUS_SERVER:
+			avp, err := NewRadiusAVP("Message-Authenticator", make([]byte, 16))
+			if err != nil {
+				// Message-Authenticator not in the dictionary
+				return rp.AVPs, -1
+			}
+			avps := make([]RadiusAVP, 0, len(rp.AVPs)+1)
+			return append(append(avps, *avp), rp.AVPs...), 0
+		default:
+			return rp.AVPs, -1
+		}
+	}
+
+	avps := append([]RadiusAVP(nil), rp.AVPs...)
+	avps[maIndex].Value = make([]byte, 16)
+	return avps, maIndex
+}
+
 // Builds a Radius Packet from a Byte slice
 func NewRadiusPacketFromBytes(inputBytes []byte, secret string, ra [16]byte) (*RadiusPacket, error) {
 	reader := bytes.NewReader(inputBytes)
@@ -331,6 +413,30 @@ func NewRadiusPacketFromBytes(inputBytes []byte, secret string, ra [16]byte) (*R
 	return &radiusPacket, err
 }
 
+// Reads the bytes of a single radius packet from a stream, such as a RadSec connection, using
+// the length in the header to find the boundaries (RFC 6613). Packets with invalid length generate an
+// error, since the stream cannot be resynchronized
+func ReadRadiusPacketBytes(reader io.Reader) ([]byte, error) {
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+
+	packetLen := int(binary.BigEndian.Uint16(header[2:4]))
+	if packetLen < 20 || packetLen > 4096 {
+		return nil, fmt.Errorf("bad radius packet length %d", packetLen)
+	}
+
+	packetBytes := make([]byte, packetLen)
+	copy(packetBytes, header)
+	if _, err := io.ReadFull(reader, packetBytes[4:]); err != nil {
+		return nil, err
+	}
+
+	return packetBytes, nil
+}
+
 // Returns a byte slice with the contents of the AVP
 func (rp *RadiusPacket) ToBytes(secret string, id byte) (data []byte, err error) {
 
@@ -345,9 +451,14 @@ func (rp *RadiusPacket) ToBytes(secret string, id byte) (data []byte, err error)
 
 // Returns the size of the Radius packet
 func (rp *RadiusPacket) Len() uint16 {
+	return radiusPacketLen(rp.AVPs)
+}
+
+// Returns the size of a Radius packet with the specified attributes
+func radiusPacketLen(avps []RadiusAVP) uint16 {
 	var avpLen uint16 = 0
-	for i := range rp.AVPs {
-		avpLen += uint16(rp.AVPs[i].Len())
+	for i := range avps {
+		avpLen += uint16(avps[i].Len())
 	}
 
 	// Header always has 20 bytes
@@ -357,7 +468,7 @@ func (rp *RadiusPacket) Len() uint16 {
 // Returns true if any type of access request
 func (rp *RadiusPacket) IsRequest() bool {
 	switch rp.Code {
-	case ACCESS_REQUEST, ACCOUNTING_REQUEST, COA_REQUEST, DISCONNECT_REQUEST:
+	case ACCESS_REQUEST, ACCOUNTING_REQUEST, COA_REQUEST, DISCONNECT_REQUEST, STATUS_SERVER:
 		return true
 	default:
 		return false
@@ -578,21 +689,59 @@ func (rp *RadiusPacket) GetOctetsAVP(avpName string) []byte {
 // Password validation
 ///////////////////////////////////////////////////////////////
 
-// Performs the authentication using PAP or CHAP
+// Performs the authentication using PAP, CHAP, MS-CHAP or MS-CHAPv2, with the cleartext password
 func (rp *RadiusPacket) Auth(password string) (bool, error) {
+	return rp.auth(password, nil, nil)
+}
+
+// Performs the authentication using PAP, MS-CHAP or MS-CHAPv2, with the NT-Hash of the password. CHAP
+// requires the cleartext password
+func (rp *RadiusPacket) AuthNTHash(ntHash []byte) (bool, error) {
+	return rp.auth("", ntHash, nil)
+}
+
+// Same as Auth, adding to the response the attributes generated by the authentication method. For MS-CHAPv2,
+// the MS-CHAP2-Success and the MS-MPPE-Send-Key and MS-MPPE-Recv-Key, and for MS-CHAP the MS-CHAP-MPPE-Keys.
+// If MS-CHAP authentication fails, an MS-CHAP-Error is added
+func (rp *RadiusPacket) AuthWithResponse(password string, response *RadiusPacket) (bool, error) {
+	return rp.auth(password, nil, response)
+}
+
+// Same as AuthNTHash, adding to the response the attributes generated by the authentication method
+func (rp *RadiusPacket) AuthNTHashWithResponse(ntHash []byte, response *RadiusPacket) (bool, error) {
+	return rp.auth("", ntHash, response)
+}
+
+// Performs the authentication with the cleartext password or, if nil, the NT-Hash
+func (rp *RadiusPacket) auth(password string, ntHash []byte, response *RadiusPacket) (bool, error) {
 
 	// PAP
 	if p := rp.GetStringAVP("User-Password"); p != "" {
+		if ntHash != nil {
+			return bytes.Equal(NTHash(p), ntHash), nil
+		}
 		return password == p, nil
 	}
 
+	// MS-CHAP
+	if rp.GetOctetsAVP("Microsoft-CHAP-Challenge") != nil {
+		if ntHash == nil {
+			ntHash = NTHash(password)
+		}
+		return rp.mschapAuth(ntHash, response)
+	}
+
+	if ntHash != nil {
+		return false, fmt.Errorf("CHAP authentication requires the cleartext password")
+	}
+
 	// CHAP
 	chapPwd := rp.GetOctetsAVP("CHAP-Password")
 	if len(chapPwd) != 17 {
-		return false, fmt.Errorf("no User-Password or invalid/unexisting CHAP-Password in request")
+		return false, fmt.Errorf("no User-Password, MS-CHAP attributes or invalid/unexisting CHAP-Password in request")
 	}
 	id := chapPwd[0]
-	response := chapPwd[1:17]
+	chapResponse := chapPwd[1:17]
 
 	challenge := rp.GetOctetsAVP("CHAP-Challenge")
 	if len(challenge) == 0 {
@@ -606,7 +755,7 @@ func (rp *RadiusPacket) Auth(password string) (bool, error) {
 	hasher.Write(challenge)
 	expected := hasher.Sum(nil)
 
-	return bytes.Equal(expected, response), nil
+	return bytes.Equal(expected, chapResponse), nil
 }
 
 ///////////////////////////////////////////////////////////////
@@ -730,6 +879,73 @@ func ValidateRequestAuthenticator(packetBytes []byte, secret string) bool {
 	return true
 }
 
+// Checks the Message-Authenticator of the received packet, according to the specified policy,
+// which may be one of MessageAuthenticatorRequire, MessageAuthenticatorValidateIfPresent (the default
+// if empty) or MessageAuthenticatorIgnore. For responses, the authenticator of the request must be
+// specified, and is ignored otherwise.
+// The Message-Authenticator must be the HMAC-MD5 of the packet, with the value of the Message-Authenticator
+// set to zeroes and the authenticator replaced by the request authenticator for responses and zeroes for
+// requests other than Access-Request
+func ValidateMessageAuthenticator(packetBytes []byte, requestAuthenticator [16]byte, secret string, policy string) error {
+
+	if policy == MessageAuthenticatorIgnore {
+		return nil
+	}
+
+	if len(packetBytes) < 20 {
+		return fmt.Errorf("packet too short")
+	}
+
+	// Locate the Message-Authenticator
+	maOffset := -1
+	for i := 20; i+2 <= len(packetBytes); {
+		avpLen := int(packetBytes[i+1])
+		if avpLen < 2 || i+avpLen > len(packetBytes) {
+			return fmt.Errorf("bad attribute length")
+		}
+		if packetBytes[i] == MESSAGE_AUTHENTICATOR_CODE {
+			if avpLen != 18 {
+				return fmt.Errorf("bad Message-Authenticator length")
+			}
+			maOffset = i
+			break
+		}
+		i += avpLen
+	}
+
+	code := packetBytes[0]
+	if maOffset < 0 {
+		if policy == MessageAuthenticatorRequire {
+			switch code {
+			case ACCESS_REQUEST, ACCESS_ACCEPT, ACCESS_REJECT, ACCESS_CHALLENGE, STATUS_SERVER:
+				return fmt.Errorf("missing Message-Authenticator")
+			}
+		}
+		return nil
+	}
+
+	// Build the packet to calculate the hash
+	hashedBytes := make([]byte, len(packetBytes))
+	copy(hashedBytes, packetBytes)
+	switch code {
+	case ACCESS_REQUEST, STATUS_SERVER:
+		// Keep the authenticator
+	case ACCOUNTING_REQUEST, DISCONNECT_REQUEST, COA_REQUEST:
+		copy(hashedBytes[4:20], Zero_authenticator[:])
+	default:
+		copy(hashedBytes[4:20], requestAuthenticator[:])
+	}
+	copy(hashedBytes[maOffset+2:maOffset+18], Zero_authenticator[:])
+
+	mac := hmac.New(md5.New, []byte(secret))
+	mac.Write(hashedBytes)
+	if !hmac.Equal(mac.Sum(nil), packetBytes[maOffset+2:maOffset+18]) {
+		return fmt.Errorf("bad Message-Authenticator")
+	}
+
+	return nil
+}
+
 ///////////////////////////////////////////////////////////////
 // Serialization
 ///////////////////////////////////////////////////////////////
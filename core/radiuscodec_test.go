@@ -2,6 +2,9 @@ package core
 
 import (
 	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -472,6 +475,142 @@ func TestAccountingRequest(t *testing.T) {
 	}
 }
 
+func TestMessageAuthenticator(t *testing.T) {
+
+	// Access-Request gets a Message-Authenticator automatically, in the first position
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "MyUserName")
+	packetBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if packetBytes[20] != MESSAGE_AUTHENTICATOR_CODE || packetBytes[21] != 18 {
+		t.Fatalf("Message-Authenticator is not the first attribute")
+	}
+	if err := ValidateMessageAuthenticator(packetBytes, Zero_authenticator, secret, MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in request: %s", err)
+	}
+	if err := ValidateMessageAuthenticator(packetBytes, Zero_authenticator, "badsecret", MessageAuthenticatorValidateIfPresent); err == nil {
+		t.Fatalf("Message-Authenticator validated with bad secret")
+	}
+	if err := ValidateMessageAuthenticator(packetBytes, Zero_authenticator, "badsecret", MessageAuthenticatorIgnore); err != nil {
+		t.Fatalf("Message-Authenticator checked with ignore policy")
+	}
+
+	// Remove the Message-Authenticator
+	strippedBytes := append(append([]byte{}, packetBytes[0:20]...), packetBytes[38:]...)
+	binary.BigEndian.PutUint16(strippedBytes[2:4], uint16(len(strippedBytes)))
+	if err := ValidateMessageAuthenticator(strippedBytes, Zero_authenticator, secret, MessageAuthenticatorRequire); err == nil {
+		t.Fatalf("missing Message-Authenticator was accepted with require policy")
+	}
+	if err := ValidateMessageAuthenticator(strippedBytes, Zero_authenticator, secret, MessageAuthenticatorValidateIfPresent); err != nil {
+		t.Fatalf("missing Message-Authenticator was not accepted with validate-if-present policy")
+	}
+
+	// Tamper the packet
+	tamperedBytes := append([]byte{}, packetBytes...)
+	tamperedBytes[len(tamperedBytes)-1]++
+	if err := ValidateMessageAuthenticator(tamperedBytes, Zero_authenticator, secret, MessageAuthenticatorRequire); err == nil {
+		t.Fatalf("tampered packet was accepted")
+	}
+
+	// Decoded request keeps the attribute, and it is recalculated when sending again
+	recoveredPacket, err := NewRadiusPacketFromBytes(packetBytes, secret, Zero_authenticator)
+	if err != nil {
+		t.Fatalf("could not unserialize packet: %s", err)
+	}
+	if len(recoveredPacket.GetOctetsAVP("Message-Authenticator")) != 16 {
+		t.Fatalf("Message-Authenticator not decoded")
+	}
+	resentBytes, err := recoveredPacket.ToBytes("othersecret", 2)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if len(resentBytes) != len(packetBytes) {
+		t.Fatalf("Message-Authenticator was duplicated")
+	}
+	if err := ValidateMessageAuthenticator(resentBytes, Zero_authenticator, "othersecret", MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in resent request: %s", err)
+	}
+
+	// Response uses the request authenticator
+	response := NewRadiusResponse(request, false)
+	responseBytes, err := response.ToBytes(secret, 0)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if err := ValidateMessageAuthenticator(responseBytes, request.Authenticator, secret, MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in response: %s", err)
+	}
+	if !ValidateResponseAuthenticator(responseBytes, request.Authenticator, secret) {
+		t.Fatalf("response has invalid authenticator")
+	}
+
+	// Accounting-Request only if explicitly added, calculated with zero authenticator
+	accountingRequest := NewRadiusRequest(ACCOUNTING_REQUEST)
+	accountingRequest.Add("Class", "MyClass")
+	if _, err := accountingRequest.ToBytes(secret, 3); err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if len(accountingRequest.GetOctetsAVP("Message-Authenticator")) != 0 {
+		t.Fatalf("Message-Authenticator added to Accounting-Request")
+	}
+	accountingRequest.Add("Message-Authenticator", make([]byte, 16))
+	accountingBytes, _ := accountingRequest.ToBytes(secret, 3)
+	if err := ValidateMessageAuthenticator(accountingBytes, Zero_authenticator, secret, MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in accounting request: %s", err)
+	}
+	if !ValidateRequestAuthenticator(accountingBytes, secret) {
+		t.Fatalf("accounting request has invalid authenticator")
+	}
+}
+
+func TestSerializationDoesNotModifyPacket(t *testing.T) {
+
+	request := NewRadiusRequest(ACCESS_REQUEST)
+	request.Add("User-Name", "MyUserName")
+	request.Add("User-Password", "MyPassword")
+	request.Add("Class", make([]byte, 600))
+	original := request.Copy(nil, nil)
+
+	firstBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	secondBytes, err := request.ToBytes(secret, 1)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if !reflect.DeepEqual(request, original) {
+		t.Fatalf("packet was modified by serialization")
+	}
+
+	// Each serialization generates a new authenticator and the same attributes
+	if bytes.Equal(firstBytes[4:20], secondBytes[4:20]) {
+		t.Fatalf("authenticator was not generated")
+	}
+	if len(firstBytes) != len(secondBytes) {
+		t.Fatalf("serializations have different sizes")
+	}
+	recoveredPacket, err := NewRadiusPacketFromBytes(firstBytes, secret, Zero_authenticator)
+	if err != nil {
+		t.Fatalf("could not unserialize packet: %s", err)
+	}
+	if recoveredPacket.GetStringAVP("User-Password") != "MyPassword" {
+		t.Fatalf("bad User-Password %s", recoveredPacket.GetStringAVP("User-Password"))
+	}
+
+	// Response with a Message-Authenticator already present
+	response := NewRadiusResponse(recoveredPacket, true)
+	response.Add("Message-Authenticator", []byte("0123456789abcdef"))
+	if _, err := response.ToBytes(secret, 0); err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	if string(response.GetOctetsAVP("Message-Authenticator")) != "0123456789abcdef" {
+		t.Fatalf("Message-Authenticator was modified by serialization")
+	}
+}
+
 func TestJSONAVP(t *testing.T) {
 
 	var javp = `{
@@ -640,3 +779,661 @@ func TestAddIfNotPresent(t *testing.T) {
 		t.Errorf("added already present attribute")
 	}
 }
+
+func TestExtendedAVP(t *testing.T) {
+
+	// Create avp
+	avp, err := NewRadiusAVP("Frag-Status", "More-Data-Pending")
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+
+	// Serialize and check the headers
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if !reflect.DeepEqual(binaryAVP, []byte{241, 7, 1, 0, 0, 0, 2}) {
+		t.Fatalf("bad extended attribute encoding %v", binaryAVP)
+	}
+
+	// Unserialize
+	rebuiltAVP, n, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if n != 7 {
+		t.Errorf("bad number of bytes read %d", n)
+	}
+	if rebuiltAVP.Name != "Frag-Status" || rebuiltAVP.GetString() != "More-Data-Pending" {
+		t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP)
+	}
+}
+
+func TestLongExtendedAVP(t *testing.T) {
+
+	// Extended vendor specific attribute, in a long extended attribute, that needs three fragments
+	theValue := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6}, 100)
+
+	packet := NewRadiusRequest(ACCESS_REQUEST).
+		Add("User-Name", "theUserName").
+		Add("FreeRADIUS-802_1X-EAPoL-Key-Msg", theValue).
+		Add("Class", "theClass")
+
+	avp, err := packet.GetAVP("FreeRADIUS-802_1X-EAPoL-Key-Msg")
+	if err != nil {
+		t.Fatalf("error getting avp: %v", err)
+	}
+
+	// 600 bytes of value plus 5 of vendorId and code, with 4 bytes of header in each fragment
+	if avp.Len() != 617 {
+		t.Errorf("bad length of long extended attribute %d", avp.Len())
+	}
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if !reflect.DeepEqual(binaryAVP[0:9], []byte{245, 255, 26, 0x80, 0, 0, 0x2c, 0x50, 2}) {
+		t.Errorf("bad headers of first fragment %v", binaryAVP[0:9])
+	}
+	if !reflect.DeepEqual(binaryAVP[255:259], []byte{245, 255, 26, 0x80}) {
+		t.Errorf("bad headers of second fragment %v", binaryAVP[255:259])
+	}
+	if !reflect.DeepEqual(binaryAVP[510:514], []byte{245, 107, 26, 0}) {
+		t.Errorf("bad headers of last fragment %v", binaryAVP[510:514])
+	}
+
+	// Serialize and unserialize the full packet
+	packetBytes, err := packet.ToBytes(secret, 0)
+	if err != nil {
+		t.Fatalf("could not serialize packet: %s", err)
+	}
+	recoveredPacket, err := NewRadiusPacketFromBytes(packetBytes, secret, Zero_authenticator)
+	if err != nil {
+		t.Fatalf("could not unserialize packet: %s", err)
+	}
+	recoveredAVP, err := recoveredPacket.GetAVP("FreeRADIUS-802_1X-EAPoL-Key-Msg")
+	if err != nil {
+		t.Fatalf("long extended attribute not found: %s", err)
+	}
+	if !reflect.DeepEqual(recoveredAVP.GetOctets(), theValue) {
+		t.Errorf("bad recovered long extended attribute")
+	}
+	if recoveredPacket.GetStringAVP("Class") != "theClass" {
+		t.Errorf("bad attribute after long extended attribute")
+	}
+}
+
+func TestTLVAVP(t *testing.T) {
+
+	// Create avp
+	avp, err := NewRadiusAVP("IP-Port-Limit-Info", nil)
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+	avp.Add("IP-Port-Limit-Info.Type", 1).
+		Add("IP-Port-Limit-Info.Limit", 100).
+		Add("IP-Port-Limit-Info.Ext-IPv4-Addr", "1.2.3.4").
+		Add("IP-Port-Limit-Info.Alloc", "Allocation").
+		Add("Class", "not-in-the-tlv")
+	if len(avp.GetAllAVP("Class")) != 0 {
+		t.Errorf("attribute added to a tlv where it is not defined")
+	}
+
+	// Serialize and unserialize
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	// Extended header, plus three integers and an address, with 2 bytes of header each
+	if len(binaryAVP) != 3+4*6 {
+		t.Errorf("bad tlv length %d", len(binaryAVP))
+	}
+	rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if rebuiltAVP.Name != "IP-Port-Limit-Info" {
+		t.Errorf("bad name of rebuilt tlv %s", rebuiltAVP.Name)
+	}
+	limit, err := rebuiltAVP.GetAVP("IP-Port-Limit-Info.Limit")
+	if err != nil {
+		t.Fatalf("could not get attribute inside tlv: %v", err)
+	}
+	if limit.GetInt() != 100 {
+		t.Errorf("bad value inside tlv %d", limit.GetInt())
+	}
+	if rebuiltAVP.GetString() != "{IP-Port-Limit-Info.Type=1,IP-Port-Limit-Info.Limit=100,IP-Port-Limit-Info.Ext-IPv4-Addr=1.2.3.4,IP-Port-Limit-Info.Alloc=Allocation}" {
+		t.Errorf("bad string value of tlv %s", rebuiltAVP.GetString())
+	}
+
+	// JSON
+	jsonAVP, err := json.Marshal(&rebuiltAVP)
+	if err != nil {
+		t.Fatalf("could not marshal tlv: %v", err)
+	}
+	if string(jsonAVP) != `{"IP-Port-Limit-Info":[{"IP-Port-Limit-Info.Type":1},{"IP-Port-Limit-Info.Limit":100},{"IP-Port-Limit-Info.Ext-IPv4-Addr":"1.2.3.4"},{"IP-Port-Limit-Info.Alloc":"Allocation"}]}` {
+		t.Errorf("bad JSON representation of tlv %s", jsonAVP)
+	}
+	var unmarshalledAVP RadiusAVP
+	if err := json.Unmarshal(jsonAVP, &unmarshalledAVP); err != nil {
+		t.Fatalf("could not unmarshal tlv: %v", err)
+	}
+	unmarshalledBytes, _ := unmarshalledAVP.ToBytes(authenticator, secret)
+	if !reflect.DeepEqual(unmarshalledBytes, binaryAVP) {
+		t.Errorf("bad encoding of unmarshalled tlv %v", unmarshalledBytes)
+	}
+
+	// Attributes inside a tlv cannot be sent by themselves
+	if _, err := limit.ToBytes(authenticator, secret); err == nil {
+		t.Errorf("attribute inside tlv was serialized alone")
+	}
+}
+
+func TestStructAVP(t *testing.T) {
+
+	// Struct with fixed size members
+	avp, err := NewRadiusAVP("Nokia-SR-Acct-I-Inprof-Octets-64", nil)
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+	avp.Add("Nokia-SR-Acct-I-Inprof-Octets-64.Acct-I-Inprof-Octets-Selection", 0x80).
+		Add("Nokia-SR-Acct-I-Inprof-Octets-64.Acct-I-Inprof-Octets-Id", 2).
+		Add("Nokia-SR-Acct-I-Inprof-Octets-64.Acct-I-Inprof-Octets", 1<<40)
+
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	expected := []byte{26, 18, 0, 0, 0x19, 0x7f, 19, 12, 0x80, 2, 0, 0, 1, 0, 0, 0, 0, 0}
+	if !reflect.DeepEqual(binaryAVP, expected) {
+		t.Errorf("bad encoding of struct %v", binaryAVP)
+	}
+	rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	octets, err := rebuiltAVP.GetAVP("Nokia-SR-Acct-I-Inprof-Octets-64.Acct-I-Inprof-Octets")
+	if err != nil {
+		t.Fatalf("could not get struct member: %v", err)
+	}
+	if octets.GetInt() != 1<<40 {
+		t.Errorf("bad value of struct member %d", octets.GetInt())
+	}
+
+	// JSON
+	jsonAVP, err := json.Marshal(&rebuiltAVP)
+	if err != nil {
+		t.Fatalf("could not marshal struct: %v", err)
+	}
+	var unmarshalledAVP RadiusAVP
+	if err := json.Unmarshal(jsonAVP, &unmarshalledAVP); err != nil {
+		t.Fatalf("could not unmarshal struct: %v", err)
+	}
+	unmarshalledBytes, _ := unmarshalledAVP.ToBytes(authenticator, secret)
+	if !reflect.DeepEqual(unmarshalledBytes, binaryAVP) {
+		t.Errorf("bad encoding of unmarshalled struct %v", unmarshalledBytes)
+	}
+
+	// Missing member
+	incompleteAVP, _ := NewRadiusAVP("Nokia-SR-Acct-I-Inprof-Octets-64", nil)
+	incompleteAVP.Add("Nokia-SR-Acct-I-Inprof-Octets-64.Acct-I-Inprof-Octets-Id", 2)
+	if _, err := incompleteAVP.ToBytes(authenticator, secret); err == nil {
+		t.Errorf("struct with missing member was serialized")
+	}
+
+	// Bad size of member
+	if _, _, err := RadiusAVPFromBytes(expected[:len(expected)-1], authenticator, secret); err == nil {
+		t.Errorf("struct with bad size was unserialized")
+	}
+
+	// Last member with variable size, that may be absent
+	tzAVP, _ := NewRadiusAVP("3GPP-MS-TimeZone", nil)
+	tzAVP.Add("3GPP-MS-TimeZone.TZ", 0x40).Add("3GPP-MS-TimeZone.Daylight-Savings", []byte{1})
+	tzBytes, err := tzAVP.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if len(tzBytes) != 8+2 {
+		t.Errorf("bad struct length %d", len(tzBytes))
+	}
+	rebuiltTZAVP, _, err := RadiusAVPFromBytes(tzBytes, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if rebuiltTZAVP.GetString() != "{3GPP-MS-TimeZone.TZ=64,3GPP-MS-TimeZone.Daylight-Savings=01}" {
+		t.Errorf("bad string value of struct %s", rebuiltTZAVP.GetString())
+	}
+
+	tzAVP, _ = NewRadiusAVP("3GPP-MS-TimeZone", nil)
+	tzAVP.Add("3GPP-MS-TimeZone.TZ", 0x40)
+	if tzBytes, err = tzAVP.ToBytes(authenticator, secret); err != nil || len(tzBytes) != 8+1 {
+		t.Errorf("bad serialization of struct without last member %v %v", tzBytes, err)
+	}
+}
+
+func TestUnknownExtendedAVP(t *testing.T) {
+
+	// Extended vendor specific attribute of unknown vendor 12345, in Extended-Attribute-1
+	binaryAVP := []byte{241, 10, 26, 0, 0, 0x30, 0x39, 5, 'a', 'b'}
+
+	avp, n, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if n != 10 {
+		t.Errorf("bad number of bytes read %d", n)
+	}
+	if avp.Name != "UNKNOWN" || avp.VendorId != 12345 || avp.Code != 5 {
+		t.Errorf("bad unknown extended attribute %s %d %d", avp.Name, avp.VendorId, avp.Code)
+	}
+
+	// Serialized in the same place
+	rebuiltBytes, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if !reflect.DeepEqual(rebuiltBytes, binaryAVP) {
+		t.Errorf("bad encoding of unknown extended attribute %v", rebuiltBytes)
+	}
+}
+
+func TestSizedIntegerAVP(t *testing.T) {
+
+	var tests = []struct {
+		name     string
+		value    interface{}
+		expected int64
+		len      int
+	}{
+		{"Igor-ByteAttribute", "One", 1, 9},
+		{"Igor-ByteAttribute", 255, 255, 9},
+		{"Igor-ShortAttribute", 65535, 65535, 10},
+		{"Igor-SignedAttribute", -2, -2, 12},
+		{"Igor-IntegerAttribute", int64(4294967295), 4294967295, 12},
+	}
+
+	for _, test := range tests {
+		avp, err := NewRadiusAVP(test.name, test.value)
+		if err != nil {
+			t.Fatalf("error creating avp %s: %v", test.name, err)
+		}
+
+		binaryAVP, err := avp.ToBytes(authenticator, secret)
+		if err != nil {
+			t.Fatalf("error serializing avp %s: %v", test.name, err)
+		}
+		if len(binaryAVP) != test.len {
+			t.Errorf("bad length of %s: %d", test.name, len(binaryAVP))
+		}
+		rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+		if err != nil {
+			t.Fatalf("error unserializing avp %s: %v", test.name, err)
+		}
+		if rebuiltAVP.GetInt() != test.expected {
+			t.Errorf("value of %s does not match after unmarshalling. Got %d", test.name, rebuiltAVP.GetInt())
+		}
+	}
+
+	if _, err := NewRadiusAVP("Igor-ByteAttribute", 256); err == nil {
+		t.Errorf("out of range byte attribute was created")
+	}
+	if _, err := NewRadiusAVP("Igor-ShortAttribute", -1); err == nil {
+		t.Errorf("out of range short attribute was created")
+	}
+}
+
+func TestIPv4PrefixAVP(t *testing.T) {
+
+	_, ipNet, _ := net.ParseCIDR("10.1.0.0/16")
+	for _, value := range []interface{}{"10.1.0.0/16", ipNet, *ipNet} {
+		avp, err := NewRadiusAVP("Igor-IPv4PrefixAttribute", value)
+		if err != nil {
+			t.Fatalf("error creating avp: %v", err)
+		}
+		if avp.GetString() != "10.1.0.0/16" {
+			t.Errorf("bad value %s", avp.GetString())
+		}
+
+		binaryAVP, _ := avp.ToBytes(authenticator, secret)
+		if !reflect.DeepEqual(binaryAVP[8:], []byte{0, 16, 10, 1, 0, 0}) {
+			t.Errorf("bad ipv4prefix encoding %v", binaryAVP)
+		}
+		rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+		if err != nil {
+			t.Fatalf("error unserializing avp: %v", err)
+		}
+		if rebuiltAVP.GetString() != "10.1.0.0/16" {
+			t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP.GetString())
+		}
+	}
+
+	if _, err := NewRadiusAVP("Igor-IPv4PrefixAttribute", "bebe:cafe::0/64"); err == nil {
+		t.Errorf("ipv4prefix attribute created with ipv6 value")
+	}
+}
+
+func TestEtherAVP(t *testing.T) {
+
+	mac, _ := net.ParseMAC("00:11:22:aa:bb:cc")
+	for _, value := range []interface{}{"00:11:22:AA:BB:CC", mac, []byte(mac)} {
+		avp, err := NewRadiusAVP("Igor-EtherAttribute", value)
+		if err != nil {
+			t.Fatalf("error creating avp: %v", err)
+		}
+
+		binaryAVP, _ := avp.ToBytes(authenticator, secret)
+		if len(binaryAVP) != 14 {
+			t.Errorf("bad ether length %d", len(binaryAVP))
+		}
+		rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+		if err != nil {
+			t.Fatalf("error unserializing avp: %v", err)
+		}
+		if rebuiltAVP.GetString() != "00:11:22:aa:bb:cc" {
+			t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP.GetString())
+		}
+	}
+
+	if _, err := NewRadiusAVP("Igor-EtherAttribute", "00:11:22"); err == nil {
+		t.Errorf("ether attribute created with bad value")
+	}
+}
+
+func TestComboIPAVP(t *testing.T) {
+
+	for _, test := range []struct {
+		value string
+		len   int
+	}{{"10.1.1.1", 12}, {"bebe:cafe::1", 24}} {
+		avp, err := NewRadiusAVP("Igor-ComboIPAttribute", test.value)
+		if err != nil {
+			t.Fatalf("error creating avp: %v", err)
+		}
+
+		binaryAVP, _ := avp.ToBytes(authenticator, secret)
+		if len(binaryAVP) != test.len {
+			t.Errorf("bad combo-ip length %d for %s", len(binaryAVP), test.value)
+		}
+		rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+		if err != nil {
+			t.Fatalf("error unserializing avp: %v", err)
+		}
+		if rebuiltAVP.GetString() != test.value {
+			t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP.GetString())
+		}
+	}
+}
+
+func TestABinaryAVP(t *testing.T) {
+
+	var theFilter = "ip in forward srcip 10.0.0.0/8 dstip 192.168.1.1/32 tcp dstport = 80 est"
+
+	avp, err := NewRadiusAVP("Ascend-Data-Filter", theFilter)
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+
+	binaryAVP, _ := avp.ToBytes(authenticator, secret)
+	if len(binaryAVP) != 40 {
+		t.Errorf("bad abinary length %d", len(binaryAVP))
+	}
+	// Type, forward, direction, fill, srcip and dstip
+	if !reflect.DeepEqual(binaryAVP[8:20], []byte{1, 1, 1, 0, 10, 0, 0, 0, 192, 168, 1, 1}) {
+		t.Errorf("bad abinary encoding %v", binaryAVP)
+	}
+	rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if rebuiltAVP.GetString() != theFilter {
+		t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP.GetString())
+	}
+
+	// JSON
+	jsonAVP, _ := json.Marshal(&rebuiltAVP)
+	if string(jsonAVP) != `{"Ascend-Data-Filter":"`+theFilter+`"}` {
+		t.Errorf("bad JSON representation %s", jsonAVP)
+	}
+
+	// Filters that cannot be parsed are represented in hex
+	var genericFilter = "0x0200010000000000000000000000000000000000000000000000000000000000"
+	genericAVP, err := NewRadiusAVP("Ascend-Data-Filter", genericFilter)
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+	if genericAVP.GetString() != genericFilter {
+		t.Errorf("bad generic filter %s", genericAVP.GetString())
+	}
+
+	if _, err := NewRadiusAVP("Ascend-Data-Filter", "ip sideways forward"); err == nil {
+		t.Errorf("abinary attribute created with bad filter")
+	}
+}
+
+func TestVendorFormatAVP(t *testing.T) {
+
+	// Lucent uses 2 bytes for the type and 1 for the length
+	avp, err := NewRadiusAVP("Lucent-X25-X121-Source-Address", "theAddress")
+	if err != nil {
+		t.Fatalf("error creating avp: %v", err)
+	}
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if !reflect.DeepEqual(binaryAVP[:9], []byte{26, 19, 0, 0, 0x12, 0xEE, 0, 4, 13}) || len(binaryAVP) != avp.Len() {
+		t.Fatalf("bad lucent attribute encoding %v", binaryAVP)
+	}
+	rebuiltAVP, _, err := RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if err != nil {
+		t.Fatalf("error unserializing avp: %v", err)
+	}
+	if rebuiltAVP.Name != "Lucent-X25-X121-Source-Address" || rebuiltAVP.GetString() != "theAddress" {
+		t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP)
+	}
+
+	// Starent uses 2 bytes for the type and 2 for the length
+	avp, _ = NewRadiusAVP("Starent-VPN-Name", "theVPN")
+	binaryAVP, _ = avp.ToBytes(authenticator, secret)
+	if !reflect.DeepEqual(binaryAVP[:10], []byte{26, 16, 0, 0, 0x1F, 0xE4, 0, 2, 0, 10}) || len(binaryAVP) != avp.Len() {
+		t.Fatalf("bad starent attribute encoding %v", binaryAVP)
+	}
+	rebuiltAVP, _, _ = RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if rebuiltAVP.Name != "Starent-VPN-Name" || rebuiltAVP.GetString() != "theVPN" {
+		t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP)
+	}
+
+	// USR uses 4 bytes for the type and no length
+	avp, _ = NewRadiusAVP("USR-Last-Number-Dialed-Out", "12345")
+	binaryAVP, _ = avp.ToBytes(authenticator, secret)
+	if !reflect.DeepEqual(binaryAVP[:10], []byte{26, 15, 0, 0, 0x01, 0xAD, 0, 0, 0, 0x66}) || len(binaryAVP) != avp.Len() {
+		t.Fatalf("bad usr attribute encoding %v", binaryAVP)
+	}
+	rebuiltAVP, _, _ = RadiusAVPFromBytes(binaryAVP, authenticator, secret)
+	if rebuiltAVP.Name != "USR-Last-Number-Dialed-Out" || rebuiltAVP.GetString() != "12345" {
+		t.Errorf("value does not match after unmarshalling. Got %s", rebuiltAVP)
+	}
+}
+
+func TestVendorContinuationAVP(t *testing.T) {
+
+	// WiMAX attributes longer than 246 bytes are split, with the continuation flag set in all but the last fragment
+	theValue := bytes.Repeat([]byte{1, 2, 3, 4, 5, 6}, 50)
+
+	packet := NewRadiusRequest(ACCESS_REQUEST).
+		Add("User-Name", "theUserName").
+		Add("WiMAX-AAA-Session-Id", theValue).
+		Add("Class", "theClass")
+
+	avp, err := packet.GetAVP("WiMAX-AAA-Session-Id")
+	if err != nil {
+		t.Fatalf("error getting avp: %v", err)
+	}
+
+	// 300 bytes of value, with 9 bytes of header in each fragment
+	if avp.Len() != 300+2*9 {
+		t.Fatalf("bad continued attribute length %d", avp.Len())
+	}
+	binaryAVP, err := avp.ToBytes(authenticator, secret)
+	if err != nil {
+		t.Fatalf("error serializing avp: %v", err)
+	}
+	if len(binaryAVP) != avp.Len() || binaryAVP[1] != 255 || binaryAVP[8] != 0x80 || binaryAVP[255+8] != 0 {
+		t.Fatalf("bad continued attribute encoding %v", binaryAVP)
+	}
+
+	binaryPacket, err := packet.ToBytes(secret, 0)
+	if err != nil {
+		t.Fatalf("error serializing packet: %v", err)
+	}
+	rebuiltPacket, err := NewRadiusPacketFromBytes(binaryPacket, secret, Zero_authenticator)
+	if err != nil {
+		t.Fatalf("error unserializing packet: %v", err)
+	}
+	rebuiltAVP, err := rebuiltPacket.GetAVP("WiMAX-AAA-Session-Id")
+	if err != nil {
+		t.Fatalf("continued avp not found: %v", err)
+	}
+	if !reflect.DeepEqual(rebuiltAVP.GetOctets(), theValue) {
+		t.Errorf("continued attribute does not match after unmarshalling. Got %v", rebuiltAVP.GetOctets())
+	}
+	if rebuiltPacket.GetStringAVP("Class") != "theClass" {
+		t.Errorf("attribute after continued attribute not found")
+	}
+}
+
+func TestMSCHAPv2Vectors(t *testing.T) {
+
+	// Test vectors from RFC 2759 and RFC 3079
+	authenticatorChallenge, _ := hex.DecodeString("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255E262A28295F2B3A337C7E")
+	ntResponse, _ := hex.DecodeString("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+
+	ntHash := NTHash("clientPass")
+	if hex.EncodeToString(ntHash) != "44ebba8d5312b8d611474411f56989ae" {
+		t.Fatalf("bad NT-Hash %x", ntHash)
+	}
+	if challenge := mschap2ChallengeHash(peerChallenge, authenticatorChallenge, "User"); hex.EncodeToString(challenge) != "d02e4386bce91226" {
+		t.Fatalf("bad challenge hash %x", challenge)
+	}
+	if response := mschapChallengeResponse(mschap2ChallengeHash(peerChallenge, authenticatorChallenge, "User"), ntHash); !bytes.Equal(response, ntResponse) {
+		t.Fatalf("bad NT-Response %x", response)
+	}
+	if authResponse := mschap2AuthenticatorResponse(ntHash, ntResponse, peerChallenge, authenticatorChallenge, "User"); authResponse != "S=407A5589115FD0D6209F510FE9C04566932CDA56" {
+		t.Fatalf("bad authenticator response %s", authResponse)
+	}
+	if sendKey, _ := mschap2MPPEKeys(ntHash, ntResponse); hex.EncodeToString(sendKey) != "8b7cdc149b993a1ba118cb153f56dccb" {
+		t.Fatalf("bad MPPE send key %x", sendKey)
+	}
+}
+
+func TestMSCHAPv2Auth(t *testing.T) {
+
+	authenticatorChallenge, _ := hex.DecodeString("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255E262A28295F2B3A337C7E")
+	ntResponse, _ := hex.DecodeString("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+
+	// Ident, Flags, Peer-Challenge, Reserved and Response
+	chapResponse := append(append(append([]byte{7, 0}, peerChallenge...), make([]byte, 8)...), ntResponse...)
+	request := NewRadiusRequest(ACCESS_REQUEST).
+		Add("User-Name", "DOMAIN\\User").
+		Add("Microsoft-CHAP-Challenge", authenticatorChallenge).
+		Add("Microsoft-CHAP2-Response", chapResponse)
+
+	// With cleartext password
+	response := NewRadiusResponse(request, true)
+	if ok, err := request.AuthWithResponse("clientPass", response); !ok || err != nil {
+		t.Fatalf("MS-CHAPv2 authentication failed: %v", err)
+	}
+	if success := response.GetOctetsAVP("Microsoft-CHAP2-Success"); string(success) != "\x07S=407A5589115FD0D6209F510FE9C04566932CDA56" {
+		t.Fatalf("bad MS-CHAP2-Success %s", success)
+	}
+
+	// The keys are encrypted in the wire
+	responseBytes, err := response.ToBytes(secret, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(responseBytes, response.GetOctetsAVP("Microsoft-MPPE-Send-Key")) {
+		t.Fatal("MPPE key not encrypted")
+	}
+	rebuiltResponse, err := NewRadiusPacketFromBytes(responseBytes, secret, request.Authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(rebuiltResponse.GetOctetsAVP("Microsoft-MPPE-Send-Key")) != "8b7cdc149b993a1ba118cb153f56dccb" {
+		t.Fatalf("bad MPPE send key %x", rebuiltResponse.GetOctetsAVP("Microsoft-MPPE-Send-Key"))
+	}
+	if len(rebuiltResponse.GetOctetsAVP("Microsoft-MPPE-Recv-Key")) != 16 {
+		t.Fatalf("bad MPPE recv key %x", rebuiltResponse.GetOctetsAVP("Microsoft-MPPE-Recv-Key"))
+	}
+
+	// With NT-Hash
+	if ok, err := request.AuthNTHash(NTHash("clientPass")); !ok || err != nil {
+		t.Fatalf("MS-CHAPv2 authentication with NT-Hash failed: %v", err)
+	}
+
+	// Bad password
+	response = NewRadiusResponse(request, false)
+	if ok, _ := request.AuthWithResponse("badPass", response); ok {
+		t.Fatal("MS-CHAPv2 authentication with bad password succeeded")
+	}
+	if chapError := response.GetStringAVP("Microsoft-CHAP-Error"); chapError != "\x07E=691 R=0" {
+		t.Fatalf("bad MS-CHAP-Error %s", chapError)
+	}
+}
+
+func TestMSCHAPv1Auth(t *testing.T) {
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	ntResponse := mschapChallengeResponse(challenge, NTHash("thePassword"))
+
+	// Ident, Flags, LM-Response and NT-Response
+	chapResponse := append(append([]byte{3, 1}, make([]byte, 24)...), ntResponse...)
+	request := NewRadiusRequest(ACCESS_REQUEST).
+		Add("User-Name", "theUser").
+		Add("Microsoft-CHAP-Challenge", challenge).
+		Add("Microsoft-CHAP-Response", chapResponse)
+
+	response := NewRadiusResponse(request, true)
+	if ok, err := request.AuthWithResponse("thePassword", response); !ok || err != nil {
+		t.Fatalf("MS-CHAP authentication failed: %v", err)
+	}
+	if keys := response.GetOctetsAVP("Microsoft-CHAP-MPPE-Keys"); len(keys) != 24 || !bytes.Equal(keys[8:], ntHashHash(NTHash("thePassword"))) {
+		t.Fatalf("bad MS-CHAP-MPPE-Keys %x", keys)
+	}
+	if ok, _ := request.Auth("badPassword"); ok {
+		t.Fatal("MS-CHAP authentication with bad password succeeded")
+	}
+}
+
+func TestPAPAndCHAPAuth(t *testing.T) {
+
+	request := NewRadiusRequest(ACCESS_REQUEST).Add("User-Name", "theUser").Add("User-Password", "thePassword")
+	if ok, _ := request.Auth("thePassword"); !ok {
+		t.Fatal("PAP authentication failed")
+	}
+	if ok, _ := request.AuthNTHash(NTHash("thePassword")); !ok {
+		t.Fatal("PAP authentication with NT-Hash failed")
+	}
+	if ok, _ := request.Auth("badPassword"); ok {
+		t.Fatal("PAP authentication with bad password succeeded")
+	}
+
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	hasher := md5.New()
+	hasher.Write([]byte{1})
+	hasher.Write([]byte("thePassword"))
+	hasher.Write(challenge)
+	request = NewRadiusRequest(ACCESS_REQUEST).
+		Add("User-Name", "theUser").
+		Add("CHAP-Challenge", challenge).
+		Add("CHAP-Password", append([]byte{1}, hasher.Sum(nil)...))
+	if ok, _ := request.Auth("thePassword"); !ok {
+		t.Fatal("CHAP authentication failed")
+	}
+	if _, err := request.AuthNTHash(NTHash("thePassword")); err == nil {
+		t.Fatal("CHAP authentication with NT-Hash did not fail")
+	}
+}
@@ -100,6 +100,16 @@ func TestRadiusDict(t *testing.T) {
 			t.Errorf("Igor code 13 is not Tagged or Salted")
 		}
 	}
+
+	// FreeRADIUS types
+	avp = radiusDict.AVPByName["Igor-ByteAttribute"]
+	if avp.RadiusType != RadiusTypeByte || avp.EnumValues["One"] != 1 {
+		t.Errorf("Igor-ByteAttribute was not type Byte with enumerated values")
+	}
+	avp = radiusDict.AVPByName["Igor-EtherAttribute"]
+	if avp.RadiusType != RadiusTypeEther {
+		t.Errorf("Igor-EtherAttribute was not type Ether")
+	}
 }
 
 func TestUnknownRadiusAVP(t *testing.T) {
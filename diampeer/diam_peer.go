@@ -3,9 +3,11 @@ package diampeer
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,8 +27,24 @@ const (
 const (
 	EVENTLOOP_CAPACITY               = 100
 	MAX_UNANSWERED_WATCHDOG_REQUESTS = 2
+
+	// Messages waiting to be written to the socket. If the queue is full, the message is discarded
+	WRITER_QUEUE_SIZE = 1000
+
+	// Maximum number of messages written before flushing the socket
+	WRITER_MAX_BATCH = 100
+
+	// Size of the buffer for writing to the socket
+	WRITER_BUFFER_SIZE = 65536
+
+	// When terminating, maximum time to wait for the pending messages to be written
+	WRITER_DRAIN_TIMEOUT = 1 * time.Second
 )
 
+// Reported to the requests that cannot be sent, or that are cancelled, because the
+// peer is shutting down or its connection is closed
+var ErrPeerClosed = errors.New("diameter peer closed")
+
 //////////////////////////////////////////////////////////////////////////////
 // Router Control Channel Events
 //////////////////////////////////////////////////////////////////////////////
@@ -149,6 +167,17 @@ type WriteErrorMsg struct {
 type WatchdogMsg struct {
 }
 
+// Message to be written to the socket by the writeLoop
+type writerItem struct {
+	message *core.DiameterMessage
+
+	// For measuring the latency in the write queue
+	enqueued time.Time
+
+	// For the metrics. The peer configuration may change in the event loop
+	peerName string
+}
+
 /////////////////////////////////////////////
 
 // Context data for an in flight request
@@ -203,13 +232,19 @@ type DiameterPeer struct {
 	// Passed as parameter upon DiameterPeer creation. To report events back to the Router
 	routerControlChannel chan interface{}
 
+	// Messages to be written by the writeLoop. Created when the connection is
+	// established, and closed by the eventLoop when terminating
+	writerChannel chan writerItem
+
+	// Closed by the writeLoop when exiting, after having closed the connection
+	writeLoopDoneChannel chan bool
+
 	// The Status of the object (one of the const defined above)
 	status int
 
 	// Internal
 	connection net.Conn
 	connReader *bufio.Reader
-	connWriter *bufio.Writer
 
 	// Canceller of TCP connection with Peer
 	cancel context.CancelFunc
@@ -218,7 +253,7 @@ type DiameterPeer struct {
 	// Maps HopByHopIds to a channel where the response or a timeout will be sent
 	requestsMap map[uint32]RequestContext
 
-	// Registered Handler for incoming messages
+	// Registered Handler for incoming messages. Panics in it are recovered
 	handler core.DiameterMessageHandler
 
 	// Ticker for watchdog requests
@@ -230,6 +265,12 @@ type DiameterPeer struct {
 	// Wait group to be used on each goroutine launched, to be waited on Close(),
 	// to make sure that the eventloop channel is not used after being closed
 	wg sync.WaitGroup
+
+	// Set when Close() is invoked, after which DiameterExchange returns an error.
+	// Protected by closingMutex, so that wg.Add() in DiameterExchange is never
+	// executed after wg.Wait() in Close()
+	closing      bool
+	closingMutex sync.RWMutex
 }
 
 // Creates a new DiameterPeer when we are expected to establish the connection with the other side
@@ -243,7 +284,7 @@ func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peerC
 		routerControlChannel: rc,
 		peerConfig:           peerConf,
 		requestsMap:          make(map[uint32]RequestContext),
-		handler:              handler,
+		handler:              core.ChainDiameterHandler(handler, core.DiameterRecoveryMiddleware),
 	}
 
 	core.GetLogger().Debugf("creating active diameter peer for %s", peerConf.DiameterHost)
@@ -256,10 +297,16 @@ func NewActiveDiameterPeer(configInstanceName string, rc chan interface{}, peerC
 		timeoutMillis = 5000
 	}
 
+	// The configuration may not have been initialized if built programmatically
+	ipAddresses := peerConf.IPAddresses
+	if len(ipAddresses) == 0 {
+		ipAddresses = []string{peerConf.IPAddress}
+	}
+
 	// Do not close the Peer until the connecton thread finishes. Wait for this wg is in the Close() method
 	dp.wg.Add(1)
 	// This will eventually send a ConnectionEstablishedMsg or ConnectionErrorMsg to the event loop
-	go dp.connect(time.Duration(timeoutMillis)*time.Millisecond, peerConf.IPAddress, peerConf.Port)
+	go dp.connect(time.Duration(timeoutMillis)*time.Millisecond, ipAddresses, peerConf.Port)
 
 	// Start the event loop
 	go dp.eventLoop()
@@ -277,7 +324,7 @@ func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn
 		routerControlChannel: rc,
 		connection:           conn,
 		requestsMap:          make(map[uint32]RequestContext),
-		handler:              handler}
+		handler:              core.ChainDiameterHandler(handler, core.DiameterRecoveryMiddleware)}
 
 	core.GetLogger().Debugf("creating passive diameter peer for %s", conn.RemoteAddr().String())
 
@@ -285,11 +332,12 @@ func NewPassiveDiameterPeer(configInstanceName string, rc chan interface{}, conn
 	dp.status = StatusConnected
 
 	dp.connReader = bufio.NewReader(dp.connection)
-	dp.connWriter = bufio.NewWriter(dp.connection)
 
 	dp.readLoopDoneChannel = make(chan bool, 1)
 	go dp.readLoop(dp.readLoopDoneChannel)
 
+	dp.startWriteLoop()
+
 	// Start the event loop
 	go dp.eventLoop()
 
@@ -312,11 +360,21 @@ func (dp *DiameterPeer) Close() {
 
 	// TODO: Does make sense here to send a PeerSetDownCommandMsg, in order to avoid blocks and make the closing process easier for users?
 
+	// No more requests accepted
+	dp.closingMutex.Lock()
+	dp.closing = true
+	dp.closingMutex.Unlock()
+
 	// Wait for the readLoop to stop
 	if dp.readLoopDoneChannel != nil {
 		<-dp.readLoopDoneChannel
 	}
 
+	// Wait for the writeLoop to stop
+	if dp.writeLoopDoneChannel != nil {
+		<-dp.writeLoopDoneChannel
+	}
+
 	// Wait until all goroutines to exit, including timers in outstanding requests
 	core.GetLogger().Debugf("peer %s waiting for outstanding requests to be terminated", dp.peerConfig.DiameterHost)
 	dp.wg.Wait()
@@ -381,12 +439,14 @@ func (dp *DiameterPeer) eventLoop() {
 
 				dp.connection = v.connection
 				dp.connReader = bufio.NewReader(dp.connection)
-				dp.connWriter = bufio.NewWriter(dp.connection)
 
 				// Start the read loop
 				dp.readLoopDoneChannel = make(chan bool, 1)
 				go dp.readLoop(dp.readLoopDoneChannel)
 
+				// Start the write loop
+				dp.startWriteLoop()
+
 				dp.status = StatusConnected
 
 				// Active Peer. We'll send the CER
@@ -442,10 +502,12 @@ func (dp *DiameterPeer) eventLoop() {
 					dp.terminateActions(v.err)
 				}
 
-			// Same for writes
+			// writeLoop goroutine reports a write error
+			// the DiameterPeer will terminate the event loop, send the Down event
+			// and the Router must recycle it. The pending requests are cancelled
 			case WriteErrorMsg:
 
-				core.GetLogger().Errorf("%s write error %v with remote peer %s", dp.peerConfig.DiameterHost, v.err, dp.connection.RemoteAddr().String)
+				core.GetLogger().Errorf("%s write error %v with remote peer %s", dp.peerConfig.DiameterHost, v.err, dp.connection.RemoteAddr().String())
 
 				if dp.status < StatusTerminated {
 					dp.terminateActions(v.err)
@@ -483,7 +545,13 @@ func (dp *DiameterPeer) eventLoop() {
 				// If response, just send
 			case EgressDiameterMsg:
 
-				if (dp.status == StatusConnected && v.message.ApplicationId == 0) || dp.status == StatusEngaged {
+				if dp.writerChannel == nil && dp.status != StatusConnecting {
+					core.GetLogger().Errorf("message with application %s and command %s to %s was not sent because the connection is closed", v.message.ApplicationName, v.message.CommandName, dp.peerConfig.DiameterHost)
+					if v.rchan != nil {
+						v.rchan <- fmt.Errorf("message not sent to %s: %w", dp.peerConfig.DiameterHost, ErrPeerClosed)
+						close(v.rchan)
+					}
+				} else if (dp.status == StatusConnected && v.message.ApplicationId == 0) || dp.status == StatusEngaged {
 
 					// If message is a response to a disconnect peer, set to disconnect now
 					if !v.message.IsRequest && v.message.ApplicationId == 0 && v.message.CommandCode == 282 {
@@ -500,28 +568,18 @@ func (dp *DiameterPeer) eventLoop() {
 
 					core.GetLogger().Debugf("-> Sending Message %s\n", v.message)
 
-					// Send the message
-					if _, err := v.message.WriteTo(dp.connWriter); err != nil {
-						// There was an error writing. Will close the connection
-						dp.eventLoopChannel <- WriteErrorMsg{err}
-						dp.status = StatusTerminating
-
-						// Signal the error in the response channel for the input request
-						if v.message.IsRequest && v.rchan != nil {
-							v.rchan <- err
-							close(v.rchan)
-						}
+					// Get the labels before handing the message to the writeLoop
+					labels := core.LabelsFromDiameterMessage(dp.peerConfig.DiameterHost, v.message)
 
-						// No statistics, because the Peer will die
-					} else {
-						// Since it is a buffered writer, we must flush
-						dp.connWriter.Flush()
+					// Send the message. The writeLoop will report a WriteErrorMsg if unsuccessful
+					select {
+					case dp.writerChannel <- writerItem{message: v.message, enqueued: time.Now(), peerName: dp.peerConfig.DiameterHost}:
+						core.RecordPeerWriteQueueDepth(dp.peerConfig.DiameterHost, len(dp.writerChannel))
 
-						// All good.
 						// If it was a Request, store in the outstanding request map
 						// RChan may be nil if it is a base application message
 						if v.message.IsRequest {
-							core.RecordPeerDiameterRequestSent(dp.peerConfig.DiameterHost, v.message)
+							core.RecordPeerDiameterRequestSent(labels)
 							if v.rchan != nil {
 								// Set timer
 								dp.wg.Add(1)
@@ -535,11 +593,20 @@ func (dp *DiameterPeer) eventLoop() {
 								dp.requestsMap[v.message.HopByHopId] = RequestContext{
 									rchan:  v.rchan,
 									timer:  timer,
-									labels: core.LabelsFromDiameterMessage(dp.peerConfig.DiameterHost, v.message),
+									labels: labels,
 								}
 							}
 						} else {
-							core.RecordPeerDiameterAnswerSent(dp.peerConfig.DiameterHost, v.message)
+							core.RecordPeerDiameterAnswerSent(labels)
+						}
+
+					default:
+						// The peer is not accepting messages fast enough
+						core.GetLogger().Errorf("message with application %s and command %s to %s was not sent because the write queue is full", v.message.ApplicationName, v.message.CommandName, dp.peerConfig.DiameterHost)
+						core.RecordPeerWriteQueueDrop(labels)
+						if v.rchan != nil {
+							v.rchan <- fmt.Errorf("message not sent to %s. Write queue is full", dp.peerConfig.DiameterHost)
+							close(v.rchan)
 						}
 					}
 
@@ -732,22 +799,31 @@ func (dp *DiameterPeer) eventLoop() {
 // Establishes the connection with the peer
 // To be executed in a goroutine
 // Should not touch inner variables
-func (dp *DiameterPeer) connect(timeout time.Duration, ipAddress string, port int) {
+func (dp *DiameterPeer) connect(timeout time.Duration, ipAddresses []string, port int) {
 
-	// Create a cancellable deadline
-	context, cancel := context.WithDeadline(context.Background(), time.Now().Add(timeout))
+	// Create a cancellable context
+	ctx, cancel := context.WithCancel(context.Background())
 	dp.cancel = cancel
 
 	// dp.wg was added before calling this function
 	defer dp.wg.Done()
 
-	// Connect
+	// Connect. Try the addresses in order, each one with the specified timeout
 	var dialer net.Dialer
-	if conn, err := dialer.DialContext(context, "tcp4", fmt.Sprintf("%s:%d", ipAddress, port)); err != nil {
-		dp.eventLoopChannel <- ConnectionErrorMsg{err}
-	} else {
-		dp.eventLoopChannel <- ConnectionEstablishedMsg{conn}
+	var err error = fmt.Errorf("no ip address to connect to")
+	for _, ipAddress := range ipAddresses {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, timeout)
+		var conn net.Conn
+		conn, err = dialer.DialContext(attemptCtx, "tcp", net.JoinHostPort(ipAddress, strconv.Itoa(port)))
+		attemptCancel()
+		if err == nil {
+			dp.eventLoopChannel <- ConnectionEstablishedMsg{conn}
+			return
+		}
+		core.GetLogger().Debugf("could not connect to %s in %s: %s", dp.peerConfig.DiameterHost, ipAddress, err)
 	}
+
+	dp.eventLoopChannel <- ConnectionErrorMsg{err}
 }
 
 // Reader of peer messages
@@ -776,8 +852,80 @@ func (dp *DiameterPeer) readLoop(ch chan bool) {
 	close(ch)
 }
 
+// Creates the channels and starts the writeLoop for the current connection
+// To be executed in the eventLoop or before it is started
+func (dp *DiameterPeer) startWriteLoop() {
+	dp.writerChannel = make(chan writerItem, WRITER_QUEUE_SIZE)
+	dp.writeLoopDoneChannel = make(chan bool, 1)
+	go dp.writeLoop(dp.connection, dp.writerChannel, dp.writeLoopDoneChannel)
+}
+
+// Writer of peer messages
+// To be executed in a goroutine, so that a slow peer does not block the eventLoop.
+// The messages available in the channel are written together, up to WRITER_MAX_BATCH, and
+// flushed at once. After a write error, which is reported to the eventLoop, the rest of messages
+// are discarded. When the channel is closed, the connection is closed.
+// Should not touch inner variables
+func (dp *DiameterPeer) writeLoop(connection net.Conn, writerChannel chan writerItem, ch chan bool) {
+
+	connWriter := bufio.NewWriterSize(connection, WRITER_BUFFER_SIZE)
+	batch := make([]writerItem, 0, WRITER_MAX_BATCH)
+	var writeError error
+
+	for item := range writerChannel {
+
+		// Get all the messages available
+		batch = append(batch[:0], item)
+	coalesce:
+		for len(batch) < WRITER_MAX_BATCH {
+			select {
+			case next, ok := <-writerChannel:
+				if !ok {
+					break coalesce
+				}
+				batch = append(batch, next)
+			default:
+				break coalesce
+			}
+		}
+
+		// Discard if the connection is broken
+		if writeError != nil {
+			continue
+		}
+
+		for i := range batch {
+			if _, writeError = batch[i].message.WriteTo(connWriter); writeError != nil {
+				break
+			}
+		}
+		if writeError == nil {
+			writeError = connWriter.Flush()
+		}
+
+		if writeError != nil {
+			// Will close the connection. Only the first error is reported. The eventLoop keeps
+			// reading until Close(), which waits for this loop to finish, as with the readLoop
+			dp.eventLoopChannel <- WriteErrorMsg{writeError}
+			continue
+		}
+
+		now := time.Now()
+		for i := range batch {
+			core.RecordPeerWriteLatency(batch[i].peerName, now.Sub(batch[i].enqueued))
+		}
+		core.RecordPeerWriteQueueDepth(item.peerName, len(writerChannel))
+	}
+
+	connection.Close()
+
+	// Signal that we are finished
+	close(ch)
+}
+
 // Sends a Diameter request and gets the answer or error as a message to the specified channel.
-// The response channel is closed just after sending the reponse or error
+// The response channel is closed just after sending the reponse or error. If the peer is being
+// closed, the error is ErrPeerClosed
 func (dp *DiameterPeer) DiameterExchange(dm *core.DiameterMessage, timeout time.Duration, rchan chan interface{}) {
 
 	if cap(rchan) < 1 {
@@ -796,9 +944,19 @@ func (dp *DiameterPeer) DiameterExchange(dm *core.DiameterMessage, timeout time.
 		return
 	}
 
+	// The eventLoopChannel is closed after waiting for the wg
+	dp.closingMutex.RLock()
+	if dp.closing {
+		dp.closingMutex.RUnlock()
+		rchan <- fmt.Errorf("message not sent: %w", ErrPeerClosed)
+		close(rchan)
+		return
+	}
+	dp.wg.Add(1)
+	dp.closingMutex.RUnlock()
+
 	// Send myself the message
 	// Will close the response channel when processing EgressDiameterMessage. Singnal that we must call Done() with waited: true
-	dp.wg.Add(1)
 	dp.eventLoopChannel <- EgressDiameterMsg{message: dm, rchan: rchan, timeout: timeout, waited: true}
 }
 
@@ -857,8 +1015,8 @@ func (dp *DiameterPeer) handleCER(request *core.DiameterMessage) (string, error)
 func (dp *DiameterPeer) pushCEAttrubutes(cer *core.DiameterMessage) {
 	serverConf := dp.ci.DiameterServerConf()
 
-	if serverConf.BindAddress != "0.0.0.0" {
-		cer.Add("Host-IP-Address", serverConf.BindAddress)
+	for _, hostIPAddress := range serverConf.HostIPAddresses() {
+		cer.Add("Host-IP-Address", hostIPAddress)
 	}
 	cer.Add("Vendor-Id", serverConf.VendorId)
 	cer.Add("Product-Name", "igor")
@@ -889,8 +1047,8 @@ func (dp *DiameterPeer) pushCEAttrubutes(cer *core.DiameterMessage) {
 	}
 }
 
-// Cancels all Diameter requests. To be executed in the event loop
-func (dp *DiameterPeer) cancelAll() {
+// Cancels all Diameter requests, reporting the specified reason. To be executed in the event loop
+func (dp *DiameterPeer) cancelAll(reason error) {
 	// Cancellation of all outstanding requests
 	for hopId := range dp.requestsMap {
 		core.GetLogger().Debugf("cancelling request %d", hopId)
@@ -909,7 +1067,7 @@ func (dp *DiameterPeer) cancelAll() {
 			}
 		}
 		// Send the error
-		requestContext.rchan <- fmt.Errorf("request cancelled. Peer is shuting down")
+		requestContext.rchan <- fmt.Errorf("request cancelled: %w", reason)
 		close(requestContext.rchan)
 		delete(dp.requestsMap, hopId)
 	}
@@ -919,12 +1077,22 @@ func (dp *DiameterPeer) cancelAll() {
 func (dp *DiameterPeer) terminateActions(e error) {
 	dp.status = StatusTerminated
 
-	if dp.connection != nil {
+	if dp.writerChannel != nil {
+		// The writeLoop will close the connection after writing the pending messages,
+		// such as a Disconnect-Peer answer, but do not wait forever for a stuck peer
+		dp.connection.SetWriteDeadline(time.Now().Add(WRITER_DRAIN_TIMEOUT))
+		close(dp.writerChannel)
+		dp.writerChannel = nil
+	} else if dp.connection != nil {
 		dp.connection.Close()
 	}
 
-	// Cancels all outstanding requests
-	dp.cancelAll()
+	// Cancels all outstanding requests, with the cause of the termination, if any
+	if e != nil {
+		dp.cancelAll(fmt.Errorf("%w: %s", ErrPeerClosed, e))
+	} else {
+		dp.cancelAll(ErrPeerClosed)
+	}
 
 	// Tell the router that we are down
 	dp.routerControlChannel <- PeerDownEvent{Sender: dp, Error: e}
@@ -935,6 +1103,11 @@ func (dp *DiameterPeer) tstForceSocketError() {
 	dp.connection.Close()
 }
 
+// For testing purpuses only. Next writes to the socket will fail
+func (dp *DiameterPeer) tstForceWriteError() {
+	dp.connection.SetWriteDeadline(time.Now())
+}
+
 // Forces sending a disconnect message to the connected peer
 func (dp *DiameterPeer) tstSendDisconnectPeer() {
 	dpm, _ := core.NewDiameterRequest("Base", "Disconnect-Peer")
@@ -1,6 +1,7 @@
 package diampeer
 
 import (
+	"errors"
 	"net"
 	"os"
 	"strings"
@@ -114,6 +115,15 @@ func TestDiameterPeerOK(t *testing.T) {
 	if val != 1 {
 		t.Fatalf("number of diameter_request_timeouts messages was not 1")
 	}
+
+	// All messages are written by the writeLoop. At least the CER, the TestRequests and the answers to them
+	val, err = core.GetMetricWithLabels("diameter_peer_write_latency_seconds_count", `{peer="server.igorserver"}`)
+	if err != nil {
+		t.Fatalf("error getting diameter_peer_write_latency_seconds_count %s", err)
+	}
+	if val < 3 {
+		t.Fatalf("number of messages written was %d", val)
+	}
 	// t.Log(metrics)
 
 	// Disonnect peers
@@ -348,6 +358,17 @@ func TestRequestsCancellation(t *testing.T) {
 		t.Fatal("did not get an error message")
 	} else if !strings.Contains(r.Error(), "cancelled") {
 		t.Fatalf("wrong error message %s", r.Error())
+	} else if !errors.Is(r, ErrPeerClosed) {
+		t.Fatalf("cancellation error is not ErrPeerClosed: %s", r.Error())
+	}
+
+	// Requests to the closed peer are rejected
+	request3, _ := core.NewDiameterRequest("TestApplication", "TestRequest")
+	request3.AddOriginAVPs(core.GetPolicyConfigInstance("testClient"))
+	rc3 := make(chan interface{}, 1)
+	activePeer.DiameterExchange(request3, 300*time.Second, rc3)
+	if r, ok := (<-rc3).(error); !ok || !errors.Is(r, ErrPeerClosed) {
+		t.Fatalf("request to closed peer did not get ErrPeerClosed")
 	}
 
 	passivePeer.SetDown()
@@ -356,6 +377,13 @@ func TestRequestsCancellation(t *testing.T) {
 	// Close
 	activePeer.Close()
 	passivePeer.Close()
+
+	// Requests to a closed peer get an error
+	rc4 := make(chan interface{}, 1)
+	activePeer.DiameterExchange(request3, 300*time.Second, rc4)
+	if r, ok := (<-rc4).(error); !ok || !errors.Is(r, ErrPeerClosed) {
+		t.Fatalf("request after Close did not get ErrPeerClosed")
+	}
 }
 
 func TestSocketError(t *testing.T) {
@@ -379,6 +407,39 @@ func TestSocketError(t *testing.T) {
 	passivePeer.Close()
 }
 
+func TestWriteError(t *testing.T) {
+	activePeer, activeControlChannel, passivePeer, passiveControlChannel := setupSunnyDayDiameterPeers(t)
+
+	// Next write will fail
+	activePeer.tstForceWriteError()
+
+	request, _ := core.NewDiameterRequest("TestApplication", "TestRequest")
+	request.AddOriginAVPs(core.GetPolicyConfigInstance("testClient"))
+	rc := make(chan interface{}, 1)
+	activePeer.DiameterExchange(request, 300*time.Second, rc)
+
+	// The pending request is cancelled, without waiting for the timeout
+	select {
+	case resp := <-rc:
+		if r, ok := resp.(error); !ok || !errors.Is(r, ErrPeerClosed) {
+			t.Fatalf("pending request did not get ErrPeerClosed: %v", resp)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending request not cancelled after write error")
+	}
+
+	if _, ok := (<-activeControlChannel).(PeerDownEvent); !ok {
+		t.Fatal("received non PeerDownEvent in active peer")
+	}
+
+	passivePeer.SetDown()
+	<-passiveControlChannel
+
+	// Close
+	activePeer.Close()
+	passivePeer.Close()
+}
+
 func TestDisconnectMessage(t *testing.T) {
 
 	activePeer, activeControlChannel, passivePeer, passiveControlChannel := setupSunnyDayDiameterPeers(t)
@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+	"golang.org/x/crypto/bcrypt"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// User credentials store, with the passwords in cleartext or hashed, and
+// authentication of radius requests using the method required by them
+/////////////////////////////////////////////////////////////////////////////
+
+// Returned when the user is not in the store
+var ErrUserNotFound = errors.New("user not found")
+
+// Returned when the user is locked due to repeated authentication failures
+var ErrUserLocked = errors.New("user locked")
+
+// The credentials of a user. Different formats of the password may be specified, so that all the required
+// authentication methods are supported
+type UserCredentials struct {
+	// The password in cleartext. Required for CHAP, and valid for all the methods
+	Cleartext string
+
+	// The NT-Hash of the password, as 32 hex digits. Valid for PAP, MS-CHAP and MS-CHAPv2
+	NTHash string
+
+	// The password hashed with bcrypt ($2a$, $2b$ or $2y$) or SHA-512-crypt ($6$). Valid only for PAP
+	Crypt string
+}
+
+// Checks the cleartext password against the credentials, using the first format available
+func (c *UserCredentials) CheckPassword(password string) (bool, error) {
+	switch {
+	case c.Cleartext != "":
+		return subtle.ConstantTimeCompare([]byte(c.Cleartext), []byte(password)) == 1, nil
+
+	case c.Crypt != "":
+		return checkCryptPassword(password, c.Crypt)
+
+	case c.NTHash != "":
+		ntHash, err := hex.DecodeString(c.NTHash)
+		if err != nil {
+			return false, fmt.Errorf("bad NT-Hash: %w", err)
+		}
+		return subtle.ConstantTimeCompare(core.NTHash(password), ntHash) == 1, nil
+
+	default:
+		return false, errors.New("no password in credentials")
+	}
+}
+
+// Verifies the password against a hash in crypt format
+func checkCryptPassword(password string, hash string) (bool, error) {
+	switch {
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+
+	case strings.HasPrefix(hash, sha512CryptPrefix):
+		computed, err := sha512Crypt(password, hash)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hash)) == 1, nil
+
+	default:
+		return false, errors.New("unsupported crypt format")
+	}
+}
+
+// Source of user credentials
+type CredentialStore interface {
+	// Returns the credentials of the user, or ErrUserNotFound
+	GetCredentials(userName string) (*UserCredentials, error)
+}
+
+// Store with the credentials in a configuration object, which is a JSON map of user names to credentials.
+// {"user1": {"crypt": "$6$..."}, "user2": {"cleartext": "...", "ntHash": "..."}}
+type FileCredentialStore map[string]UserCredentials
+
+// Reads the credentials from the configuration object
+func NewFileCredentialStore(configObjectName string, ci *core.PolicyConfigurationManager) (FileCredentialStore, error) {
+
+	// If we pass nil as last parameter, use the default
+	var myCi *core.PolicyConfigurationManager
+	if ci == nil {
+		myCi = core.GetPolicyConfig()
+	} else {
+		myCi = ci
+	}
+
+	jBytes, err := myCi.CM.GetBytesConfigObject(configObjectName)
+	if err != nil {
+		return FileCredentialStore{}, err
+	}
+
+	store := FileCredentialStore{}
+	err = json.Unmarshal(jBytes, &store)
+
+	return store, err
+}
+
+// CredentialStore interface
+func (fs FileCredentialStore) GetCredentials(userName string) (*UserCredentials, error) {
+	if credentials, found := fs[userName]; found {
+		return &credentials, nil
+	}
+	return nil, ErrUserNotFound
+}
+
+// Default query for the SQL store
+const DefaultCredentialsQuery = "select Cleartext, NTHash, Crypt from Credentials where UserName = ?"
+
+// Store with the credentials in a database
+type SQLCredentialStore struct {
+	db    *sql.DB
+	query string
+}
+
+// Creates a store using the specified database handle. The query must have a single parameter, for the user
+// name, and return the cleartext password, the NT-Hash and the crypt hash, any of which may be null. If empty,
+// DefaultCredentialsQuery is used
+func NewSQLCredentialStore(db *sql.DB, query string) *SQLCredentialStore {
+	if query == "" {
+		query = DefaultCredentialsQuery
+	}
+	return &SQLCredentialStore{db: db, query: query}
+}
+
+// Creates a store using a MySQL database with the specified url, such as user:password@tcp(host:3306)/database
+func NewMySQLCredentialStore(url string, query string, maxOpenConns int) (*SQLCredentialStore, error) {
+	db, err := sql.Open("mysql", url)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+
+	return NewSQLCredentialStore(db, query), nil
+}
+
+// CredentialStore interface
+func (ss *SQLCredentialStore) GetCredentials(userName string) (*UserCredentials, error) {
+	var cleartext, ntHash, crypt sql.NullString
+	err := ss.db.QueryRow(ss.query, userName).Scan(&cleartext, &ntHash, &crypt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserCredentials{Cleartext: cleartext.String, NTHash: ntHash.String, Crypt: crypt.String}, nil
+}
+
+// Closes the database
+func (ss *SQLCredentialStore) Close() error {
+	return ss.db.Close()
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// Authenticator
+/////////////////////////////////////////////////////////////////////////////
+
+// Authentication failures of a user
+type authFailures struct {
+	count       int
+	lockedUntil time.Time
+}
+
+// Authenticates radius requests against the credentials in a store, locking the users after a number of
+// consecutive failures
+type RadiusAuthenticator struct {
+	store CredentialStore
+
+	// Number of consecutive failures that lock the user. If zero, users are never locked
+	maxFailures int
+
+	// Time during which the users are locked
+	lockoutTime time.Duration
+
+	// Failures by user name
+	failures map[string]*authFailures
+	mutex    sync.Mutex
+}
+
+// Creates an authenticator. If maxFailures is zero, users are never locked
+func NewRadiusAuthenticator(store CredentialStore, maxFailures int, lockoutTime time.Duration) *RadiusAuthenticator {
+	return &RadiusAuthenticator{
+		store:       store,
+		maxFailures: maxFailures,
+		lockoutTime: lockoutTime,
+		failures:    make(map[string]*authFailures),
+	}
+}
+
+// Authenticates the request, using PAP, CHAP, MS-CHAP or MS-CHAPv2 depending on the attributes present.
+// If response is not nil, the attributes generated by the authentication method, such as the MPPE keys,
+// are added to it. Returns ErrUserNotFound or ErrUserLocked if that is the case
+func (a *RadiusAuthenticator) Authenticate(request *core.RadiusPacket, response *core.RadiusPacket) (bool, error) {
+	userName := request.GetStringAVP("User-Name")
+
+	if a.isLocked(userName) {
+		return false, ErrUserLocked
+	}
+
+	credentials, err := a.store.GetCredentials(userName)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := a.check(request, response, credentials)
+	if err != nil {
+		return false, err
+	}
+	a.registerResult(userName, ok)
+
+	return ok, nil
+}
+
+// Verifies the request with the credentials
+func (a *RadiusAuthenticator) check(request *core.RadiusPacket, response *core.RadiusPacket, credentials *UserCredentials) (bool, error) {
+
+	// PAP
+	if password := request.GetStringAVP("User-Password"); password != "" {
+		return credentials.CheckPassword(password)
+	}
+
+	// CHAP and MS-CHAP with cleartext password
+	if credentials.Cleartext != "" {
+		return request.AuthWithResponse(credentials.Cleartext, response)
+	}
+
+	// MS-CHAP with NT-Hash
+	if request.GetOctetsAVP("Microsoft-CHAP-Challenge") != nil && credentials.NTHash != "" {
+		ntHash, err := hex.DecodeString(credentials.NTHash)
+		if err != nil {
+			return false, fmt.Errorf("bad NT-Hash: %w", err)
+		}
+		return request.AuthNTHashWithResponse(ntHash, response)
+	}
+
+	return false, errors.New("no suitable credentials for the authentication method")
+}
+
+// Checks whether the user is locked
+func (a *RadiusAuthenticator) isLocked(userName string) bool {
+	if a.maxFailures == 0 {
+		return false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	f, found := a.failures[userName]
+	if !found || f.count < a.maxFailures {
+		return false
+	}
+	if time.Now().Before(f.lockedUntil) {
+		return true
+	}
+
+	// Lockout expired
+	delete(a.failures, userName)
+	return false
+}
+
+// Updates the failure counter of the user
+func (a *RadiusAuthenticator) registerResult(userName string, ok bool) {
+	if a.maxFailures == 0 {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if ok {
+		delete(a.failures, userName)
+		return
+	}
+
+	f, found := a.failures[userName]
+	if !found {
+		f = &authFailures{}
+		a.failures[userName] = f
+	}
+	f.count++
+	if f.count >= a.maxFailures {
+		f.lockedUntil = time.Now().Add(a.lockoutTime)
+		core.GetLogger().Infof("user %s locked after %d authentication failures", userName, f.count)
+	}
+}
+
+// Returns the number of consecutive failures of the user
+func (a *RadiusAuthenticator) Failures(userName string) int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if f, found := a.failures[userName]; found {
+		return f.count
+	}
+	return 0
+}
+
+// Removes the lock and the failures of the user
+func (a *RadiusAuthenticator) Unlock(userName string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	delete(a.failures, userName)
+}
@@ -0,0 +1,220 @@
+package handler
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestSHA512Crypt(t *testing.T) {
+
+	// Vectors from the specification
+	vectors := [][3]string{
+		{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!", "$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=5000$toolongsaltstring", "This is just a test", "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, v := range vectors {
+		if hash, err := sha512Crypt(v[1], v[0]); err != nil || hash != v[2] {
+			t.Errorf("bad SHA-512-crypt for %s: %s %v", v[0], hash, err)
+		}
+	}
+}
+
+func TestCheckPassword(t *testing.T) {
+
+	store, err := NewFileCredentialStore("radiusCredentials.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userName := range []string{"cleartextUser", "bcryptUser", "sha512User", "ntHashUser"} {
+		credentials, err := store.GetCredentials(userName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := credentials.CheckPassword("thePassword"); !ok || err != nil {
+			t.Errorf("password of %s not verified: %v", userName, err)
+		}
+		if ok, _ := credentials.CheckPassword("badPassword"); ok {
+			t.Errorf("bad password of %s verified", userName)
+		}
+	}
+
+	if _, err := store.GetCredentials("unknownUser"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user found")
+	}
+}
+
+func TestRadiusAuthenticator(t *testing.T) {
+
+	store, err := NewFileCredentialStore("radiusCredentials.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := NewRadiusAuthenticator(store, 3, 100*time.Millisecond)
+
+	// PAP
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "sha512User").Add("User-Password", "thePassword")
+	if ok, err := authenticator.Authenticate(request, nil); !ok || err != nil {
+		t.Errorf("PAP not authenticated: %v", err)
+	}
+
+	// CHAP
+	request = chapRequest("cleartextUser", "thePassword")
+	if ok, err := authenticator.Authenticate(request, nil); !ok || err != nil {
+		t.Errorf("CHAP not authenticated: %v", err)
+	}
+	request = chapRequest("bcryptUser", "thePassword")
+	if _, err := authenticator.Authenticate(request, nil); err == nil {
+		t.Errorf("CHAP with hashed password did not fail")
+	}
+
+	// MS-CHAPv2 with NT-Hash, using the vectors of RFC 2759
+	authenticatorChallenge, _ := hex.DecodeString("5B5D7C7D7B3F2F3E3C2C602132262628")
+	peerChallenge, _ := hex.DecodeString("21402324255E262A28295F2B3A337C7E")
+	ntResponse, _ := hex.DecodeString("82309ECD8D708B5EA08FAA3981CD83544233114A3D85D6DF")
+	request = core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", "User").
+		Add("Microsoft-CHAP-Challenge", authenticatorChallenge).
+		Add("Microsoft-CHAP2-Response", append(append(append([]byte{1, 0}, peerChallenge...), make([]byte, 8)...), ntResponse...))
+	response := core.NewRadiusResponse(request, true)
+	if ok, err := authenticator.Authenticate(request, response); !ok || err != nil {
+		t.Errorf("MS-CHAPv2 not authenticated: %v", err)
+	}
+	if response.GetOctetsAVP("Microsoft-CHAP2-Success") == nil || response.GetOctetsAVP("Microsoft-MPPE-Send-Key") == nil {
+		t.Errorf("MS-CHAP2-Success or MPPE keys not generated")
+	}
+
+	// Lockout
+	badRequest := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "bcryptUser").Add("User-Password", "badPassword")
+	goodRequest := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "bcryptUser").Add("User-Password", "thePassword")
+	for i := 0; i < 3; i++ {
+		if ok, err := authenticator.Authenticate(badRequest, nil); ok || err != nil {
+			t.Fatalf("bad password authenticated or error %v", err)
+		}
+	}
+	if authenticator.Failures("bcryptUser") != 3 {
+		t.Errorf("bad number of failures %d", authenticator.Failures("bcryptUser"))
+	}
+	if _, err := authenticator.Authenticate(goodRequest, nil); !errors.Is(err, ErrUserLocked) {
+		t.Errorf("user not locked")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if ok, err := authenticator.Authenticate(goodRequest, nil); !ok || err != nil {
+		t.Errorf("user not unlocked after lockout time: %v", err)
+	}
+	if authenticator.Failures("bcryptUser") != 0 {
+		t.Errorf("failures not reset")
+	}
+}
+
+func TestSQLCredentialStore(t *testing.T) {
+
+	db, err := sql.Open("testCredentials", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewSQLCredentialStore(db, "")
+	defer store.Close()
+
+	credentials, err := store.GetCredentials("ntHashUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.NTHash != "c668fad627cec442e1371efc97c7cbf4" || credentials.Cleartext != "" {
+		t.Errorf("bad credentials %v", credentials)
+	}
+	if ok, _ := credentials.CheckPassword("thePassword"); !ok {
+		t.Errorf("password not verified")
+	}
+	if _, err := store.GetCredentials("unknownUser"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user found: %v", err)
+	}
+}
+
+// Helpers
+
+func chapRequest(userName string, password string) *core.RadiusPacket {
+	challenge := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	hasher := md5.New()
+	hasher.Write([]byte{1})
+	hasher.Write([]byte(password))
+	hasher.Write(challenge)
+	return core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", userName).
+		Add("CHAP-Challenge", challenge).
+		Add("CHAP-Password", append([]byte{1}, hasher.Sum(nil)...))
+}
+
+// Minimal database driver that returns the credentials of ntHashUser
+type testCredentialsDriver struct{}
+type testCredentialsConn struct{}
+type testCredentialsStmt struct{}
+type testCredentialsRows struct {
+	values []driver.Value
+}
+
+func init() {
+	sql.Register("testCredentials", testCredentialsDriver{})
+}
+
+func (d testCredentialsDriver) Open(name string) (driver.Conn, error) {
+	return testCredentialsConn{}, nil
+}
+
+func (c testCredentialsConn) Prepare(query string) (driver.Stmt, error) {
+	return testCredentialsStmt{}, nil
+}
+
+func (c testCredentialsConn) Close() error {
+	return nil
+}
+
+func (c testCredentialsConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s testCredentialsStmt) Close() error {
+	return nil
+}
+
+func (s testCredentialsStmt) NumInput() int {
+	return 1
+}
+
+func (s testCredentialsStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s testCredentialsStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if args[0] == "ntHashUser" {
+		return &testCredentialsRows{values: []driver.Value{nil, "c668fad627cec442e1371efc97c7cbf4", nil}}, nil
+	}
+	return &testCredentialsRows{}, nil
+}
+
+func (r *testCredentialsRows) Columns() []string {
+	return []string{"Cleartext", "NTHash", "Crypt"}
+}
+
+func (r *testCredentialsRows) Close() error {
+	return nil
+}
+
+func (r *testCredentialsRows) Next(dest []driver.Value) error {
+	if r.values == nil {
+		return io.EOF
+	}
+	copy(dest, r.values)
+	r.values = nil
+	return nil
+}
@@ -0,0 +1,475 @@
+package handler
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// EAP authentication (RFC 3748), transported in radius as specified in
+// RFC 3579. The EAPServer keeps track of the conversations using the State
+// attribute, and delegates the authentication to pluggable EAP methods
+/////////////////////////////////////////////////////////////////////////////
+
+// EAP Codes
+const (
+	EAP_REQUEST  = 1
+	EAP_RESPONSE = 2
+	EAP_SUCCESS  = 3
+	EAP_FAILURE  = 4
+)
+
+// EAP Types
+const (
+	EAP_TYPE_IDENTITY     = 1
+	EAP_TYPE_NOTIFICATION = 2
+	EAP_TYPE_NAK          = 3
+	EAP_TYPE_MD5          = 4
+	EAP_TYPE_TLS          = 13
+	EAP_TYPE_TTLS         = 21
+)
+
+// Maximum size of the value of a radius attribute
+const eapMessageMaxSize = 253
+
+// Default time to wait for the next message of a conversation
+const defaultEAPSessionTimeout = 30 * time.Second
+
+// Represents an EAP packet. Success and Failure packets have no Type nor Data
+type EAPPacket struct {
+	Code       byte
+	Identifier byte
+	Type       byte
+	Data       []byte
+}
+
+// Parses an EAP packet
+func NewEAPPacketFromBytes(packetBytes []byte) (*EAPPacket, error) {
+	if len(packetBytes) < 4 {
+		return nil, fmt.Errorf("eap packet too short")
+	}
+	length := int(binary.BigEndian.Uint16(packetBytes[2:4]))
+	if length < 4 || length > len(packetBytes) {
+		return nil, fmt.Errorf("bad eap packet length %d", length)
+	}
+
+	packet := EAPPacket{
+		Code:       packetBytes[0],
+		Identifier: packetBytes[1],
+	}
+	if packet.Code == EAP_REQUEST || packet.Code == EAP_RESPONSE {
+		if length < 5 {
+			return nil, fmt.Errorf("eap request or response without type")
+		}
+		packet.Type = packetBytes[4]
+		packet.Data = packetBytes[5:length]
+	}
+
+	return &packet, nil
+}
+
+// Serializes the EAP packet
+func (ep *EAPPacket) ToBytes() []byte {
+	var packetBytes []byte
+	if ep.Code == EAP_REQUEST || ep.Code == EAP_RESPONSE {
+		packetBytes = make([]byte, 5, 5+len(ep.Data))
+		packetBytes[4] = ep.Type
+		packetBytes = append(packetBytes, ep.Data...)
+	} else {
+		packetBytes = make([]byte, 4)
+	}
+	packetBytes[0] = ep.Code
+	packetBytes[1] = ep.Identifier
+	binary.BigEndian.PutUint16(packetBytes[2:4], uint16(len(packetBytes)))
+
+	return packetBytes
+}
+
+// Stringer interface
+func (ep EAPPacket) String() string {
+	return fmt.Sprintf("EAP Code: %d, Identifier: %d, Type: %d, Data length: %d", ep.Code, ep.Identifier, ep.Type, len(ep.Data))
+}
+
+// Gets the EAP packet in the radius packet, reassembling the contents of all the EAP-Message attributes
+func GetEAPPacket(rp *core.RadiusPacket) (*EAPPacket, error) {
+	var packetBytes []byte
+	for _, avp := range rp.GetAllAVP("EAP-Message") {
+		packetBytes = append(packetBytes, avp.GetOctets()...)
+	}
+	if len(packetBytes) == 0 {
+		return nil, fmt.Errorf("EAP-Message not found")
+	}
+
+	return NewEAPPacketFromBytes(packetBytes)
+}
+
+// Sets the EAP packet in the radius packet, replacing the existing one and splitting it in as many EAP-Message
+// attributes as needed
+func SetEAPPacket(rp *core.RadiusPacket, ep *EAPPacket) *core.RadiusPacket {
+	rp.DeleteAllAVP("EAP-Message")
+
+	packetBytes := ep.ToBytes()
+	for len(packetBytes) > eapMessageMaxSize {
+		rp.Add("EAP-Message", packetBytes[:eapMessageMaxSize])
+		packetBytes = packetBytes[eapMessageMaxSize:]
+	}
+	return rp.Add("EAP-Message", packetBytes)
+}
+
+/////////////////////////////////////////////////////////////////////////////
+// EAP Methods
+/////////////////////////////////////////////////////////////////////////////
+
+// The outcome of the processing of a response by an EAP method
+type EAPMethodResult int
+
+const (
+	// The method has generated a new request to send to the peer
+	EAPContinue EAPMethodResult = iota
+	// The peer has been authenticated
+	EAPAuthenticated
+	// The peer could not be authenticated
+	EAPRejected
+)
+
+// Implementation of an EAP method. An instance is created for each conversation, so that it may keep its own state.
+// Methods that hold resources may also implement io.Closer, that will be invoked when the conversation ends
+type EAPMethod interface {
+	// The EAP Type
+	Type() byte
+
+	// Returns the data of the first request of the method
+	Start(session *EAPSession) ([]byte, error)
+
+	// Processes the data of a response from the peer. If the result is EAPContinue, returns the data of the next request
+	Process(session *EAPSession, data []byte) (EAPMethodResult, []byte, error)
+}
+
+// Creates a new instance of an EAP method
+type EAPMethodFactory func() EAPMethod
+
+// Returns the cleartext password of a user, used by the methods that need to verify credentials
+type EAPPasswordFunc func(userName string) (string, error)
+
+/////////////////////////////////////////////////////////////////////////////
+// EAP Server
+/////////////////////////////////////////////////////////////////////////////
+
+// State of an EAP conversation
+type EAPSession struct {
+	// The identity reported by the peer in the EAP-Response/Identity
+	Identity string
+
+	// The identity used in the inner authentication of tunneled methods
+	InnerIdentity string
+
+	// The Master Session Key, generated by the methods that support key derivation
+	MSK []byte
+
+	// Identifier of the last request sent to the peer. While a method is invoked, the identifier of the request
+	// being generated
+	Identifier byte
+
+	server      *EAPServer
+	state       string
+	method      EAPMethod
+	lastRequest *EAPPacket
+	lastUsed    time.Time
+
+	// Serializes the processing of the requests of the conversation, and the closing of the method.
+	// ended is set, with the lock held, when the session is removed
+	mutex sync.Mutex
+	ended bool
+}
+
+// Returns the password of the user, as specified in the configuration of the server
+func (s *EAPSession) GetPassword(userName string) (string, error) {
+	if s.server.config.PasswordFunc == nil {
+		return "", errors.New("no password function configured")
+	}
+	return s.server.config.PasswordFunc(userName)
+}
+
+// Returns the configuration of the server
+func (s *EAPSession) Config() *EAPServerConfig {
+	return &s.server.config
+}
+
+// Configuration of the EAPServer
+type EAPServerConfig struct {
+	// Supported EAP methods, in order of preference
+	Methods []EAPMethodFactory
+
+	// To get the credentials of the users
+	PasswordFunc EAPPasswordFunc
+
+	// Time to wait for the next message of a conversation. Defaults to 30 seconds
+	SessionTimeout time.Duration
+
+	// Maximum size of the TLS data in each EAP request. Defaults to 1000 bytes
+	FragmentSize int
+}
+
+// Manages EAP conversations
+type EAPServer struct {
+	config EAPServerConfig
+
+	// Sessions by State
+	sessions map[string]*EAPSession
+
+	// Last time the expired sessions were removed
+	lastPurge time.Time
+
+	sync.Mutex
+}
+
+// Creates an EAP Server
+func NewEAPServer(config EAPServerConfig) *EAPServer {
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = defaultEAPSessionTimeout
+	}
+	if config.FragmentSize == 0 {
+		config.FragmentSize = defaultEAPTLSFragmentSize
+	}
+	return &EAPServer{
+		config:    config,
+		sessions:  make(map[string]*EAPSession),
+		lastPurge: time.Now(),
+	}
+}
+
+// Processes an Access-Request with an EAP-Message, generating an Access-Challenge, or an Access-Accept or Access-Reject
+// when the conversation finishes. The Access-Accept includes the MS-MPPE-Recv-Key and MS-MPPE-Send-Key attributes if
+// the method generates keys. The requests without Message-Authenticator are refused, as specified in RFC 3579.
+// The signature allows using it as a core.RadiusPacketHandler
+func (s *EAPServer) HandleRequest(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+
+	if _, err := request.GetAVP("Message-Authenticator"); err != nil {
+		return nil, errors.New("EAP-Message without Message-Authenticator")
+	}
+
+	eapResponse, err := GetEAPPacket(request)
+	if err != nil {
+		return nil, err
+	}
+	if eapResponse.Code != EAP_RESPONSE {
+		return nil, fmt.Errorf("unexpected EAP code %d", eapResponse.Code)
+	}
+
+	// The session is returned locked
+	session := s.getSession(request.GetOctetsAVP("State"))
+
+	// Start of the conversation
+	if session == nil {
+		if eapResponse.Type != EAP_TYPE_IDENTITY {
+			return s.reject(request, eapResponse.Identifier), nil
+		}
+		if len(s.config.Methods) == 0 {
+			return nil, errors.New("no EAP methods configured")
+		}
+		session = s.newSession(string(eapResponse.Data))
+		defer session.mutex.Unlock()
+		session.Identifier = eapResponse.Identifier
+		return s.startMethod(request, session, s.config.Methods[0]())
+	}
+	defer session.mutex.Unlock()
+
+	// Retransmission of the previous response
+	if session.lastRequest != nil && eapResponse.Identifier == session.lastRequest.Identifier-1 {
+		return s.challenge(request, session, session.lastRequest), nil
+	}
+	if eapResponse.Identifier != session.Identifier {
+		s.endSession(session)
+		return nil, fmt.Errorf("unexpected EAP identifier %d. Expected %d", eapResponse.Identifier, session.Identifier)
+	}
+
+	// The peer proposes another method
+	if eapResponse.Type == EAP_TYPE_NAK {
+		for _, factory := range s.config.Methods {
+			method := factory()
+			for _, desiredType := range eapResponse.Data {
+				if method.Type() == desiredType && desiredType != session.method.Type() {
+					closeEAPMethod(session.method)
+					return s.startMethod(request, session, method)
+				}
+			}
+			closeEAPMethod(method)
+		}
+		s.endSession(session)
+		return s.reject(request, eapResponse.Identifier), nil
+	}
+
+	if eapResponse.Type != session.method.Type() {
+		s.endSession(session)
+		return s.reject(request, eapResponse.Identifier), nil
+	}
+
+	session.Identifier++
+	result, data, err := session.method.Process(session, eapResponse.Data)
+	if err != nil {
+		core.GetLogger().Debugf("EAP method %d for %s error: %s", session.method.Type(), session.Identity, err)
+		result = EAPRejected
+	}
+
+	switch result {
+	case EAPContinue:
+		return s.challenge(request, session, s.newRequest(session, data)), nil
+
+	case EAPAuthenticated:
+		s.endSession(session)
+		response := core.NewRadiusResponse(request, true)
+		SetEAPPacket(response, &EAPPacket{Code: EAP_SUCCESS, Identifier: eapResponse.Identifier})
+		if len(session.MSK) >= 64 {
+			response.Add("Microsoft-MPPE-Recv-Key", session.MSK[0:32])
+			response.Add("Microsoft-MPPE-Send-Key", session.MSK[32:64])
+		}
+		return response, nil
+
+	default:
+		s.endSession(session)
+		return s.reject(request, eapResponse.Identifier), nil
+	}
+}
+
+// Starts a new method in the session, generating the challenge with its first request
+func (s *EAPServer) startMethod(request *core.RadiusPacket, session *EAPSession, method EAPMethod) (*core.RadiusPacket, error) {
+	session.method = method
+
+	session.Identifier++
+	data, err := method.Start(session)
+	if err != nil {
+		s.endSession(session)
+		return nil, err
+	}
+
+	return s.challenge(request, session, s.newRequest(session, data)), nil
+}
+
+// Builds the EAP request to send to the peer, and keeps it for retransmissions
+func (s *EAPServer) newRequest(session *EAPSession, data []byte) *EAPPacket {
+	session.lastRequest = &EAPPacket{Code: EAP_REQUEST, Identifier: session.Identifier, Type: session.method.Type(), Data: data}
+	return session.lastRequest
+}
+
+// Generates an Access-Challenge with the EAP request and the State of the session
+func (s *EAPServer) challenge(request *core.RadiusPacket, session *EAPSession, eapRequest *EAPPacket) *core.RadiusPacket {
+	response := core.NewRadiusResponse(request, true)
+	response.Code = core.ACCESS_CHALLENGE
+	SetEAPPacket(response, eapRequest)
+	response.Add("State", []byte(session.state))
+
+	return response
+}
+
+// Generates an Access-Reject with an EAP-Failure
+func (s *EAPServer) reject(request *core.RadiusPacket, identifier byte) *core.RadiusPacket {
+	return SetEAPPacket(core.NewRadiusResponse(request, false), &EAPPacket{Code: EAP_FAILURE, Identifier: identifier})
+}
+
+// Creates a new session, with a random State. The session is returned locked
+func (s *EAPServer) newSession(identity string) *EAPSession {
+	authenticator := core.BuildRandomAuthenticator()
+	session := EAPSession{
+		Identity: identity,
+		server:   s,
+		state:    string(authenticator[:]),
+		lastUsed: time.Now(),
+	}
+	session.mutex.Lock()
+
+	s.Lock()
+	defer s.Unlock()
+	s.sessions[session.state] = &session
+
+	return &session
+}
+
+// Returns the session with the specified state, locked, or nil if not found or expired. Takes the chance to purge
+// the expired sessions
+func (s *EAPServer) getSession(state []byte) *EAPSession {
+	var expired []*EAPSession
+
+	s.Lock()
+	now := time.Now()
+	if now.Sub(s.lastPurge) > s.config.SessionTimeout {
+		for key, session := range s.sessions {
+			if now.Sub(session.lastUsed) > s.config.SessionTimeout {
+				expired = append(expired, session)
+				delete(s.sessions, key)
+			}
+		}
+		s.lastPurge = now
+	}
+
+	session, found := s.sessions[string(state)]
+	if found && now.Sub(session.lastUsed) > s.config.SessionTimeout {
+		core.GetLogger().Debugf("EAP session with state %s expired", hex.EncodeToString(state))
+		expired = append(expired, session)
+		delete(s.sessions, session.state)
+		found = false
+	}
+	if found {
+		session.lastUsed = now
+	}
+	s.Unlock()
+
+	// The methods are closed without holding the lock of the server, since a request of the session may be
+	// in process and take it to end the session
+	for _, expiredSession := range expired {
+		expiredSession.mutex.Lock()
+		expiredSession.close()
+		expiredSession.mutex.Unlock()
+	}
+
+	if !found {
+		return nil
+	}
+
+	// Another request may have ended the session while waiting for the lock
+	session.mutex.Lock()
+	if session.ended {
+		session.mutex.Unlock()
+		return nil
+	}
+
+	return session
+}
+
+// Removes the session, freeing the resources of the method. Must be invoked with the lock of the session held
+func (s *EAPServer) endSession(session *EAPSession) {
+	s.Lock()
+	delete(s.sessions, session.state)
+	s.Unlock()
+
+	session.close()
+}
+
+// Returns the number of ongoing conversations
+func (s *EAPServer) SessionCount() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.sessions)
+}
+
+// Marks the session as ended and closes its method, if not done yet. Must be invoked with the lock of the session held
+func (s *EAPSession) close() {
+	if !s.ended {
+		s.ended = true
+		closeEAPMethod(s.method)
+	}
+}
+
+// Releases the resources of the method, if it holds any
+func closeEAPMethod(method EAPMethod) {
+	if closer, ok := method.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+
+	"github.com/francistor/igor/core"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// EAP-MD5 (RFC 3748). The response is the MD5 of the identifier, the
+// password and the challenge, as in CHAP. It does not generate keys
+/////////////////////////////////////////////////////////////////////////////
+
+// Implementation of EAP-MD5
+type EAPMD5Method struct {
+	identifier byte
+	challenge  []byte
+}
+
+// Creates an EAP-MD5 method. To be used in the Methods of the EAPServerConfig
+func NewEAPMD5Method() EAPMethod {
+	return &EAPMD5Method{}
+}
+
+// EAPMethod interface
+func (m *EAPMD5Method) Type() byte {
+	return EAP_TYPE_MD5
+}
+
+// Sends the challenge, preceded by its size
+func (m *EAPMD5Method) Start(session *EAPSession) ([]byte, error) {
+	challenge := core.BuildRandomAuthenticator()
+	m.identifier = session.Identifier
+	m.challenge = challenge[:]
+
+	return append([]byte{byte(len(challenge))}, challenge[:]...), nil
+}
+
+// Verifies the response
+func (m *EAPMD5Method) Process(session *EAPSession, data []byte) (EAPMethodResult, []byte, error) {
+	if len(data) < 1 || len(data) < int(data[0])+1 || data[0] != md5.Size {
+		return EAPRejected, nil, errors.New("bad EAP-MD5 response")
+	}
+
+	password, err := session.GetPassword(session.Identity)
+	if err != nil {
+		return EAPRejected, nil, err
+	}
+
+	hasher := md5.New()
+	hasher.Write([]byte{m.identifier})
+	hasher.Write([]byte(password))
+	hasher.Write(m.challenge)
+	if !bytes.Equal(hasher.Sum(nil), data[1:1+md5.Size]) {
+		return EAPRejected, nil, nil
+	}
+
+	return EAPAuthenticated, nil, nil
+}
@@ -0,0 +1,482 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestEAPPacket(t *testing.T) {
+
+	eapPacket := EAPPacket{Code: EAP_REQUEST, Identifier: 7, Type: EAP_TYPE_TLS, Data: bytes.Repeat([]byte{1, 2, 3}, 200)}
+
+	// Serialization
+	packetBytes := eapPacket.ToBytes()
+	if len(packetBytes) != 605 || binary.BigEndian.Uint16(packetBytes[2:4]) != 605 {
+		t.Fatalf("bad EAP packet length %d", len(packetBytes))
+	}
+	rebuilt, err := NewEAPPacketFromBytes(packetBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.Identifier != 7 || rebuilt.Type != EAP_TYPE_TLS || !bytes.Equal(rebuilt.Data, eapPacket.Data) {
+		t.Fatalf("bad rebuilt EAP packet %s", rebuilt)
+	}
+
+	// Success has no type
+	if successBytes := (&EAPPacket{Code: EAP_SUCCESS, Identifier: 8}).ToBytes(); !bytes.Equal(successBytes, []byte{3, 8, 0, 4}) {
+		t.Fatalf("bad EAP-Success %v", successBytes)
+	}
+
+	// Split in several EAP-Message attributes, also after going through the wire
+	rp := SetEAPPacket(core.NewRadiusRequest(core.ACCESS_REQUEST), &eapPacket)
+	if len(rp.GetAllAVP("EAP-Message")) != 3 {
+		t.Fatalf("EAP-Message not split in 3 attributes")
+	}
+	radiusBytes, err := rp.ToBytes("secret", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp, err = core.NewRadiusPacketFromBytes(radiusBytes, "secret", core.Zero_authenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rebuilt, err = GetEAPPacket(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Data, eapPacket.Data) {
+		t.Fatalf("bad EAP packet reassembled from radius")
+	}
+}
+
+func TestEAPMD5(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPMD5Method},
+		PasswordFunc: testEAPPasswords,
+	})
+
+	for _, password := range []string{"thePassword", "badPassword"} {
+		response := runEAPConversation(t, server, "theUser", func(eapRequest *EAPPacket) []byte {
+			return eapMD5Response(eapRequest, password)
+		})
+
+		if password == "thePassword" && response.Code != core.ACCESS_ACCEPT {
+			t.Errorf("EAP-MD5 not accepted")
+		}
+		if password == "badPassword" && response.Code != core.ACCESS_REJECT {
+			t.Errorf("EAP-MD5 with bad password not rejected")
+		}
+		if eapPacket, err := GetEAPPacket(response); err != nil || (eapPacket.Code != EAP_SUCCESS && eapPacket.Code != EAP_FAILURE) {
+			t.Errorf("EAP-Success or EAP-Failure not received: %v", err)
+		}
+	}
+
+	if server.SessionCount() != 0 {
+		t.Errorf("sessions not removed after finishing")
+	}
+}
+
+func TestEAPNak(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPTLSMethodFactory(testEAPTLSConfig(t)), NewEAPMD5Method},
+		PasswordFunc: testEAPPasswords,
+	})
+
+	// The peer only wants MD5
+	response := runEAPConversation(t, server, "theUser", func(eapRequest *EAPPacket) []byte {
+		if eapRequest.Type != EAP_TYPE_MD5 {
+			return nil
+		}
+		return eapMD5Response(eapRequest, "thePassword")
+	})
+	if response.Code != core.ACCESS_ACCEPT {
+		t.Errorf("EAP-MD5 after Nak not accepted")
+	}
+}
+
+func TestEAPSessionTimeout(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:        []EAPMethodFactory{NewEAPMD5Method},
+		PasswordFunc:   testEAPPasswords,
+		SessionTimeout: 50 * time.Millisecond,
+	})
+
+	response := runEAPConversation(t, server, "theUser", func(eapRequest *EAPPacket) []byte {
+		time.Sleep(100 * time.Millisecond)
+		return eapMD5Response(eapRequest, "thePassword")
+	})
+	if response.Code != core.ACCESS_REJECT {
+		t.Errorf("response after session timeout not rejected")
+	}
+}
+
+func TestEAPMessageAuthenticatorRequired(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPMD5Method},
+		PasswordFunc: testEAPPasswords,
+	})
+
+	eapResponse := &EAPPacket{Code: EAP_RESPONSE, Identifier: 0, Type: EAP_TYPE_IDENTITY, Data: []byte("theUser")}
+	request := SetEAPPacket(core.NewRadiusRequest(core.ACCESS_REQUEST), eapResponse)
+	if _, err := server.HandleRequest(request); err == nil {
+		t.Fatal("EAP request without Message-Authenticator accepted")
+	}
+	if server.SessionCount() != 0 {
+		t.Fatal("session created for EAP request without Message-Authenticator")
+	}
+}
+
+func TestEAPConcurrentRequests(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPMD5Method},
+		PasswordFunc: testEAPPasswords,
+	})
+
+	newRequest := func(eapResponse *EAPPacket, state []byte) *core.RadiusPacket {
+		request := SetEAPPacket(core.NewRadiusRequest(core.ACCESS_REQUEST), eapResponse)
+		request.Add("Message-Authenticator", make([]byte, 16))
+		if state != nil {
+			request.Add("State", state)
+		}
+		return request
+	}
+
+	challenge, err := server.HandleRequest(newRequest(&EAPPacket{Code: EAP_RESPONSE, Identifier: 0, Type: EAP_TYPE_IDENTITY, Data: []byte("theUser")}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapRequest, err := GetEAPPacket(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eapResponse := &EAPPacket{Code: EAP_RESPONSE, Identifier: eapRequest.Identifier, Type: eapRequest.Type, Data: eapMD5Response(eapRequest, "thePassword")}
+
+	// The same response is sent many times at once, as radius requests with different identifiers.
+	// Only one of them is processed by the method
+	const copies = 10
+	codes := make(chan core.RadiusPacketType, copies)
+	for i := 0; i < copies; i++ {
+		go func() {
+			response, err := server.HandleRequest(newRequest(eapResponse, challenge.GetOctetsAVP("State")))
+			if err != nil {
+				codes <- 0
+				return
+			}
+			codes <- response.Code
+		}()
+	}
+	var accepts int
+	for i := 0; i < copies; i++ {
+		if <-codes == core.ACCESS_ACCEPT {
+			accepts++
+		}
+	}
+	if accepts != 1 {
+		t.Errorf("got %d accepts for the same EAP response", accepts)
+	}
+	if server.SessionCount() != 0 {
+		t.Errorf("sessions not removed after finishing")
+	}
+}
+
+func TestEAPTLS(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPTLSMethodFactory(testEAPTLSConfig(t))},
+		FragmentSize: 200,
+	})
+
+	clientConfig := testEAPTLSConfig(t)
+	clientConfig.ServerName = "localhost"
+	peer := newTestEAPTLSPeer(clientConfig, nil)
+	defer peer.close()
+
+	response := runEAPConversation(t, server, "theUser", peer.respond)
+	if response.Code != core.ACCESS_ACCEPT {
+		t.Fatalf("EAP-TLS not accepted")
+	}
+
+	// Check the keys
+	state := peer.tlsConn.ConnectionState()
+	keyMaterial, err := state.ExportKeyingMaterial("client EAP encryption", nil, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(response.GetOctetsAVP("Microsoft-MPPE-Recv-Key"), keyMaterial[0:32]) || !bytes.Equal(response.GetOctetsAVP("Microsoft-MPPE-Send-Key"), keyMaterial[32:64]) {
+		t.Errorf("bad MPPE keys")
+	}
+
+	// Peer without certificate
+	clientConfig.Certificates = nil
+	peer = newTestEAPTLSPeer(clientConfig, nil)
+	defer peer.close()
+	if response := runEAPConversation(t, server, "theUser", peer.respond); response.Code != core.ACCESS_REJECT {
+		t.Errorf("EAP-TLS without client certificate not rejected")
+	}
+
+	if server.SessionCount() != 0 {
+		t.Errorf("sessions not removed after finishing")
+	}
+}
+
+func TestEAPTTLS(t *testing.T) {
+
+	server := NewEAPServer(EAPServerConfig{
+		Methods:      []EAPMethodFactory{NewEAPTTLSMethodFactory(testEAPTLSConfig(t))},
+		PasswordFunc: testEAPPasswords,
+	})
+
+	for _, password := range []string{"thePassword", "badPassword"} {
+		clientConfig := testEAPTLSConfig(t)
+		clientConfig.ServerName = "localhost"
+		clientConfig.Certificates = nil
+		peer := newTestEAPTLSPeer(clientConfig, append(ttlsAVP(ttlsUserNameCode, []byte("theUser")), ttlsAVP(ttlsUserPasswordCode, []byte(password))...))
+		defer peer.close()
+
+		response := runEAPConversation(t, server, "anonymous", peer.respond)
+		if password == "badPassword" {
+			if response.Code != core.ACCESS_REJECT {
+				t.Errorf("EAP-TTLS with bad password not rejected")
+			}
+			continue
+		}
+		if response.Code != core.ACCESS_ACCEPT {
+			t.Fatalf("EAP-TTLS not accepted")
+		}
+
+		state := peer.tlsConn.ConnectionState()
+		keyMaterial, err := state.ExportKeyingMaterial("ttls keying material", nil, 128)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(response.GetOctetsAVP("Microsoft-MPPE-Recv-Key"), keyMaterial[0:32]) || !bytes.Equal(response.GetOctetsAVP("Microsoft-MPPE-Send-Key"), keyMaterial[32:64]) {
+			t.Errorf("bad MPPE keys")
+		}
+	}
+}
+
+// Helpers
+
+func testEAPPasswords(userName string) (string, error) {
+	if userName == "theUser" {
+		return "thePassword", nil
+	}
+	return "", errors.New("user not found")
+}
+
+// Generates the EAP-MD5 response to a request
+func eapMD5Response(eapRequest *EAPPacket, password string) []byte {
+	hasher := md5.New()
+	hasher.Write([]byte{eapRequest.Identifier})
+	hasher.Write([]byte(password))
+	hasher.Write(eapRequest.Data[1:])
+	return append([]byte{md5.Size}, hasher.Sum(nil)...)
+}
+
+// Executes an EAP conversation, passing all the packets through the wire. The respond function gets the EAP
+// request and returns the data of the response, or nil to send a Nak proposing MD5
+func runEAPConversation(t *testing.T, server *EAPServer, identity string, respond func(*EAPPacket) []byte) *core.RadiusPacket {
+	eapResponse := &EAPPacket{Code: EAP_RESPONSE, Identifier: 0, Type: EAP_TYPE_IDENTITY, Data: []byte(identity)}
+	var state []byte
+
+	for i := 0; i < 100; i++ {
+		request := SetEAPPacket(core.NewRadiusRequest(core.ACCESS_REQUEST), eapResponse)
+		if state != nil {
+			request.Add("State", state)
+		}
+		requestBytes, err := request.ToBytes("secret", byte(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		request, err = core.NewRadiusPacketFromBytes(requestBytes, "secret", core.Zero_authenticator)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := server.HandleRequest(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		responseBytes, err := response.ToBytes("secret", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err = core.NewRadiusPacketFromBytes(responseBytes, "secret", request.Authenticator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.Code != core.ACCESS_CHALLENGE {
+			return response
+		}
+
+		eapRequest, err := GetEAPPacket(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state = response.GetOctetsAVP("State")
+		if data := respond(eapRequest); data != nil {
+			eapResponse = &EAPPacket{Code: EAP_RESPONSE, Identifier: eapRequest.Identifier, Type: eapRequest.Type, Data: data}
+		} else {
+			eapResponse = &EAPPacket{Code: EAP_RESPONSE, Identifier: eapRequest.Identifier, Type: EAP_TYPE_NAK, Data: []byte{EAP_TYPE_MD5}}
+		}
+	}
+
+	t.Fatal("EAP conversation did not finish")
+	return nil
+}
+
+// TLS peer for EAP-TLS and EAP-TTLS, that sends the specified application data after the handshake
+type testEAPTLSPeer struct {
+	config   *tls.Config
+	appData  []byte
+	conn     *eapTLSConn
+	tlsConn  *tls.Conn
+	done     chan error
+	incoming []byte
+	pending  []byte
+}
+
+func newTestEAPTLSPeer(config *tls.Config, appData []byte) *testEAPTLSPeer {
+	return &testEAPTLSPeer{
+		config:  config,
+		appData: appData,
+		conn:    &eapTLSConn{inChan: make(chan []byte), blocked: make(chan struct{})},
+		done:    make(chan error, 1),
+	}
+}
+
+func (p *testEAPTLSPeer) respond(eapRequest *EAPPacket) []byte {
+	flags := eapRequest.Data[0]
+	data := eapRequest.Data[1:]
+
+	if flags&eapTLSFlagStart != 0 {
+		p.tlsConn = tls.Client(p.conn, p.config)
+		go func() {
+			if err := p.tlsConn.Handshake(); err != nil {
+				p.done <- err
+				return
+			}
+			if p.appData != nil {
+				p.tlsConn.Write(p.appData)
+			}
+			_, err := p.tlsConn.Read(make([]byte, 1))
+			p.done <- err
+		}()
+		return p.wait()
+	}
+
+	if flags&eapTLSFlagLength != 0 {
+		data = data[4:]
+	}
+	if len(data) == 0 {
+		return p.nextFragment()
+	}
+	p.incoming = append(p.incoming, data...)
+	if flags&eapTLSFlagMore != 0 {
+		return []byte{0}
+	}
+
+	p.conn.inChan <- p.incoming
+	p.incoming = nil
+	return p.wait()
+}
+
+// Waits until the TLS client needs more data, and returns its output
+func (p *testEAPTLSPeer) wait() []byte {
+	select {
+	case <-p.conn.blocked:
+	case <-p.done:
+	}
+	p.pending = append([]byte(nil), p.conn.out.Bytes()...)
+	p.conn.out.Reset()
+	return p.nextFragment()
+}
+
+// Sends the output in fragments of 300 bytes
+func (p *testEAPTLSPeer) nextFragment() []byte {
+	if len(p.pending) > 300 {
+		fragment := p.pending[:300]
+		p.pending = p.pending[300:]
+		return append([]byte{eapTLSFlagMore}, fragment...)
+	}
+	fragment := p.pending
+	p.pending = nil
+	return append([]byte{0}, fragment...)
+}
+
+func (p *testEAPTLSPeer) close() {
+	close(p.conn.inChan)
+}
+
+// Builds an attribute to send inside the TTLS tunnel
+func ttlsAVP(code uint32, value []byte) []byte {
+	avp := make([]byte, 8, 8+len(value)+3)
+	binary.BigEndian.PutUint32(avp[0:4], code)
+	binary.BigEndian.PutUint32(avp[4:8], uint32(8+len(value)))
+	avp[4] = 0x40
+	avp = append(avp, value...)
+	for len(avp)%4 != 0 {
+		avp = append(avp, 0)
+	}
+	return avp
+}
+
+// TLS configuration with a certificate signed by a CA that is trusted both as root and for clients
+var testEAPTLS *tls.Config
+
+func testEAPTLSConfig(t *testing.T) *tls.Config {
+	if testEAPTLS != nil {
+		return testEAPTLS.Clone()
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(certBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	testEAPTLS = &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certBytes}, PrivateKey: key, Leaf: cert}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+	}
+	return testEAPTLS.Clone()
+}
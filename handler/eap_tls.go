@@ -0,0 +1,367 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// EAP-TLS (RFC 5216) and EAP-TTLS (RFC 5281) with PAP as inner method.
+// The TLS handshake is performed by crypto/tls on top of a connection
+// whose records are carried in EAP messages. TLS is limited to version 1.2,
+// which is the one for which the keys derivation is defined in those RFC
+/////////////////////////////////////////////////////////////////////////////
+
+// Default maximum size of the TLS data in an EAP message
+const defaultEAPTLSFragmentSize = 1000
+
+// Flags of the EAP-TLS and EAP-TTLS data. The version of TTLS, in the lower bits, is always 0
+const (
+	eapTLSFlagLength = 0x80
+	eapTLSFlagMore   = 0x40
+	eapTLSFlagStart  = 0x20
+)
+
+// Labels for the derivation of the keys
+const (
+	eapTLSKeyLabel  = "client EAP encryption"
+	eapTTLSKeyLabel = "ttls keying material"
+)
+
+// Codes of the diameter-like attributes carried inside the TTLS tunnel
+const (
+	ttlsUserNameCode     = 1
+	ttlsUserPasswordCode = 2
+)
+
+// Implements net.Conn, on top of the data exchanged in EAP messages. The TLS library runs in its own goroutine,
+// reading from the data received from the peer and writing to a buffer. When it needs more data, it signals
+// that it is blocked, so that the buffered output may be sent to the peer
+type eapTLSConn struct {
+	in      []byte
+	inChan  chan []byte
+	blocked chan struct{}
+	out     bytes.Buffer
+}
+
+// net.Conn interface
+func (c *eapTLSConn) Read(b []byte) (int, error) {
+	if len(c.in) == 0 {
+		c.blocked <- struct{}{}
+		data, ok := <-c.inChan
+		if !ok {
+			return 0, io.EOF
+		}
+		c.in = data
+	}
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+// net.Conn interface
+func (c *eapTLSConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// net.Conn interface. Closing is done in the method
+func (c *eapTLSConn) Close() error {
+	return nil
+}
+
+// net.Conn interface
+func (c *eapTLSConn) LocalAddr() net.Addr {
+	return &net.IPAddr{}
+}
+
+// net.Conn interface
+func (c *eapTLSConn) RemoteAddr() net.Addr {
+	return &net.IPAddr{}
+}
+
+// net.Conn interface. Not used
+func (c *eapTLSConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// net.Conn interface. Not used
+func (c *eapTLSConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// net.Conn interface. Not used
+func (c *eapTLSConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Implementation of EAP-TLS and EAP-TTLS
+type EAPTLSMethod struct {
+	eapType   byte
+	tlsConfig *tls.Config
+
+	conn    *eapTLSConn
+	tlsConn *tls.Conn
+
+	// Result of the TLS goroutine
+	done chan error
+
+	// Set by the TLS goroutine
+	handshakeDone bool
+	appData       []byte
+
+	// Fragments received from the peer
+	incoming []byte
+
+	// Data not yet sent to the peer
+	pending      []byte
+	pendingFirst bool
+	fragmentSize int
+
+	closeOnce sync.Once
+}
+
+// Returns a factory of EAP-TLS methods with the specified TLS configuration, which must include the server certificate.
+// A client certificate is always required
+func NewEAPTLSMethodFactory(tlsConfig *tls.Config) EAPMethodFactory {
+	config := tlsConfig.Clone()
+	config.MaxVersion = tls.VersionTLS12
+	if config.ClientAuth < tls.RequireAnyClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return func() EAPMethod {
+		return &EAPTLSMethod{eapType: EAP_TYPE_TLS, tlsConfig: config}
+	}
+}
+
+// Returns a factory of EAP-TTLS methods with the specified TLS configuration, which must include the server certificate.
+// The inner authentication must be PAP
+func NewEAPTTLSMethodFactory(tlsConfig *tls.Config) EAPMethodFactory {
+	config := tlsConfig.Clone()
+	config.MaxVersion = tls.VersionTLS12
+	return func() EAPMethod {
+		return &EAPTLSMethod{eapType: EAP_TYPE_TTLS, tlsConfig: config}
+	}
+}
+
+// EAPMethod interface
+func (m *EAPTLSMethod) Type() byte {
+	return m.eapType
+}
+
+// Starts the TLS server and sends the Start flag
+func (m *EAPTLSMethod) Start(session *EAPSession) ([]byte, error) {
+	m.fragmentSize = session.Config().FragmentSize
+	m.conn = &eapTLSConn{
+		inChan:  make(chan []byte),
+		blocked: make(chan struct{}),
+	}
+	m.tlsConn = tls.Server(m.conn, m.tlsConfig)
+	m.done = make(chan error, 1)
+
+	go func() {
+		if err := m.tlsConn.Handshake(); err != nil {
+			m.done <- err
+			return
+		}
+		m.handshakeDone = true
+
+		buffer := make([]byte, 4096)
+		for {
+			n, err := m.tlsConn.Read(buffer)
+			if err != nil {
+				m.done <- err
+				return
+			}
+			m.appData = append(m.appData, buffer[:n]...)
+		}
+	}()
+
+	// Wait until the server is waiting for the ClientHello
+	select {
+	case <-m.conn.blocked:
+	case err := <-m.done:
+		return nil, err
+	}
+
+	return []byte{eapTLSFlagStart}, nil
+}
+
+// Processes the TLS data received from the peer
+func (m *EAPTLSMethod) Process(session *EAPSession, data []byte) (EAPMethodResult, []byte, error) {
+	if len(data) < 1 {
+		return EAPRejected, nil, errors.New("missing TLS flags")
+	}
+	flags := data[0]
+	data = data[1:]
+	if flags&eapTLSFlagLength != 0 {
+		if len(data) < 4 {
+			return EAPRejected, nil, errors.New("missing TLS message length")
+		}
+		data = data[4:]
+	}
+
+	// Acknowledge of a fragment
+	if len(data) == 0 && flags&eapTLSFlagMore == 0 {
+		if len(m.pending) > 0 {
+			return EAPContinue, m.nextFragment(), nil
+		}
+		if m.handshakeDone && m.eapType == EAP_TYPE_TLS {
+			return m.authenticated(session, eapTLSKeyLabel)
+		}
+		return EAPRejected, nil, errors.New("unexpected empty TLS message")
+	}
+
+	// Reassemble the fragments, sending an acknowledge if more are to come
+	m.incoming = append(m.incoming, data...)
+	if flags&eapTLSFlagMore != 0 {
+		return EAPContinue, []byte{0}, nil
+	}
+	input := m.incoming
+	m.incoming = nil
+
+	// Deliver to the TLS server, and wait until it needs more data
+	m.conn.inChan <- input
+	select {
+	case <-m.conn.blocked:
+	case err := <-m.done:
+		return EAPRejected, nil, fmt.Errorf("TLS error: %w", err)
+	}
+
+	// Tunneled data
+	if m.eapType == EAP_TYPE_TTLS && len(m.appData) > 0 {
+		if m.verifyTTLSCredentials(session) {
+			return m.authenticated(session, eapTTLSKeyLabel)
+		}
+		return EAPRejected, nil, nil
+	}
+
+	// Send the response of the TLS server
+	if m.conn.out.Len() > 0 {
+		m.pending = append([]byte(nil), m.conn.out.Bytes()...)
+		m.pendingFirst = true
+		m.conn.out.Reset()
+		return EAPContinue, m.nextFragment(), nil
+	}
+
+	// Nothing to send. This happens if the peer sends the last message of a resumed handshake
+	if m.handshakeDone {
+		if m.eapType == EAP_TYPE_TLS {
+			return m.authenticated(session, eapTLSKeyLabel)
+		}
+		return EAPContinue, []byte{0}, nil
+	}
+
+	return EAPRejected, nil, errors.New("TLS server generated no data")
+}
+
+// Stops the TLS goroutine. The EAPServer invokes it with the lock of the session held, so that it
+// is not executed while Process is delivering data to the TLS server
+func (m *EAPTLSMethod) Close() error {
+	m.closeOnce.Do(func() {
+		if m.conn != nil {
+			close(m.conn.inChan)
+		}
+	})
+	return nil
+}
+
+// Generates the data of the next request with the pending data, fragmented if necessary
+func (m *EAPTLSMethod) nextFragment() []byte {
+	var flags byte
+	var fragment []byte
+	if len(m.pending) > m.fragmentSize {
+		flags |= eapTLSFlagMore
+		fragment = m.pending[:m.fragmentSize]
+		m.pending = m.pending[m.fragmentSize:]
+	} else {
+		fragment = m.pending
+		m.pending = nil
+	}
+
+	// The first fragment of a fragmented message carries the total length
+	if m.pendingFirst && flags&eapTLSFlagMore != 0 {
+		m.pendingFirst = false
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(fragment)+len(m.pending)))
+		return append(append([]byte{flags | eapTLSFlagLength}, length[:]...), fragment...)
+	}
+	m.pendingFirst = false
+
+	return append([]byte{flags}, fragment...)
+}
+
+// Derives the keys of the session and signals success
+func (m *EAPTLSMethod) authenticated(session *EAPSession, label string) (EAPMethodResult, []byte, error) {
+	state := m.tlsConn.ConnectionState()
+	keyMaterial, err := state.ExportKeyingMaterial(label, nil, 128)
+	if err != nil {
+		return EAPRejected, nil, err
+	}
+	session.MSK = keyMaterial[0:64]
+
+	return EAPAuthenticated, nil, nil
+}
+
+// Checks the User-Name and User-Password sent in the TTLS tunnel
+func (m *EAPTLSMethod) verifyTTLSCredentials(session *EAPSession) bool {
+	avps, err := parseTTLSAVPs(m.appData)
+	if err != nil {
+		return false
+	}
+	userName, found := avps[ttlsUserNameCode]
+	if !found {
+		return false
+	}
+	userPassword, found := avps[ttlsUserPasswordCode]
+	if !found {
+		return false
+	}
+
+	password, err := session.GetPassword(string(userName))
+	if err != nil || password != string(bytes.TrimRight(userPassword, "\x00")) {
+		return false
+	}
+	session.InnerIdentity = string(userName)
+
+	return true
+}
+
+// Parses the attributes sent in the TTLS tunnel, which use the diameter encoding. Only non vendor
+// specific attributes are returned, by code
+func parseTTLSAVPs(data []byte) (map[uint32][]byte, error) {
+	avps := make(map[uint32][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("TTLS attribute too short")
+		}
+		code := binary.BigEndian.Uint32(data[0:4])
+		flags := data[4]
+		length := int(binary.BigEndian.Uint32(data[4:8]) & 0x00FFFFFF)
+		headerLen := 8
+		if flags&0x80 != 0 {
+			headerLen = 12
+		}
+		if length < headerLen || length > len(data) {
+			return nil, fmt.Errorf("bad TTLS attribute length %d", length)
+		}
+		if headerLen == 8 {
+			avps[code] = data[headerLen:length]
+		}
+
+		// Attributes are padded to 4 bytes
+		paddedLength := (length + 3) &^ 3
+		if paddedLength > len(data) {
+			paddedLength = len(data)
+		}
+		data = data[paddedLength:]
+	}
+
+	return avps, nil
+}
@@ -241,3 +241,104 @@ func TestTemplatedConfigObject(t *testing.T) {
 	fmt.Printf("%#v\n", o.Get())
 
 }
+
+func TestRadiusUsersFile(t *testing.T) {
+
+	usersFile, err := NewRadiusUsersFile("users", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usersFile) != 6 {
+		t.Fatalf("bad number of entries %d", len(usersFile))
+	}
+
+	bob := usersFile[0]
+	if bob.Key != "bob" || bob.ConfigItems["Cleartext-Password"] != "hello" || bob.CheckItems["NAS-IP-Address"] != "127.0.0.1" || !bob.FallThrough {
+		t.Errorf("bad entry %v", bob)
+	}
+	if len(bob.ReplyItems) != 3 || bob.ReplyItems[2].GetString() != "Hello, bob" || bob.ReplyOperators[0] != "=" {
+		t.Errorf("bad reply items %v", bob.ReplyItems)
+	}
+
+	// Only the first entry for each key
+	if ruf := usersFile.RadiusUserFile(); len(ruf) != 2 || ruf["bob"].ConfigItems["Cleartext-Password"] != "hello" {
+		t.Errorf("bad user file %v", ruf)
+	}
+
+	// Errors
+	for _, contents := range []string{
+		"bob Cleartext-Password \"hello\"",
+		"bob Cleartext-Password := \"hello",
+		"bob\n\tService-Type == Framed-User",
+		"bob\n\tService-Type = Framed-User\n\tClass = \"a\"",
+		"bob\n\tUnknown-Attribute = 1",
+		"bob Calling-Station-Id =~ \"(\"",
+		"\tClass = \"a\"",
+		"$INCLUDE users.other",
+	} {
+		if _, err := ParseRadiusUsersFile(contents); err == nil {
+			t.Errorf("bad users file accepted: %s", contents)
+		}
+	}
+}
+
+func TestRadiusUsersFileMatch(t *testing.T) {
+
+	usersFile, err := NewRadiusUsersFile("users", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// First entry of bob, and then the DEFAULT ones
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", "bob").
+		Add("NAS-IP-Address", "127.0.0.1").
+		Add("Calling-Station-Id", "34600000000").
+		Add("Service-Type", "Framed-User").
+		Add("NAS-Port", 20)
+	configItems, replyItems, matched := usersFile.Match(request)
+	if !matched || configItems["Cleartext-Password"] != "hello" {
+		t.Fatalf("bad config items %v", configItems)
+	}
+	if classes := findAttributes(replyItems, "Class"); len(classes) != 2 || classes[0].GetString() != "spain" || classes[1].GetString() != "framed" {
+		t.Errorf("bad Class %v", classes)
+	}
+	if timeouts := findAttributes(replyItems, "Session-Timeout"); len(timeouts) != 1 || timeouts[0].GetInt() != 7200 {
+		t.Errorf("bad Session-Timeout %v", timeouts)
+	}
+	if _, found := configItems["Auth-Type"]; found {
+		t.Errorf("entry after one without Fall-Through applied")
+	}
+
+	// Second entry of bob, without Fall-Through
+	request = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "bob").Add("NAS-IP-Address", "127.0.0.2")
+	configItems, replyItems, _ = usersFile.Match(request)
+	if configItems["Cleartext-Password"] != "other" || len(replyItems) != 1 || replyItems[0].GetString() != "Other NAS" {
+		t.Errorf("bad result %v %v", configItems, replyItems)
+	}
+
+	// Unknown user from abroad
+	request = core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", "alice").
+		Add("Calling-Station-Id", "44600000000").
+		Add("Framed-Protocol", "PPP")
+	configItems, replyItems, _ = usersFile.Match(request)
+	if configItems["Auth-Type"] != "Reject" {
+		t.Errorf("bad config items %v", configItems)
+	}
+	if classes := findAttributes(replyItems, "Class"); len(classes) != 1 || classes[0].GetString() != "abroad" {
+		t.Errorf("bad Class %v", classes)
+	}
+
+	// The check items of each entry
+	entry := RadiusUserFileEntry{CheckOperations: []RadiusUserFileItem{
+		{Name: "Service-Type", Operator: "!=", Value: "Login-User"},
+		{Name: "User-Name", Operator: "=~", Value: "^a"},
+	}}
+	if !entry.MatchCheckItems(request.Add("Service-Type", "Framed-User")) {
+		t.Errorf("check items not matched")
+	}
+	if entry.MatchCheckItems(core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "alice")) {
+		t.Errorf("!= matched with missing attribute")
+	}
+}
@@ -0,0 +1,557 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/francistor/igor/core"
+	"github.com/go-ldap/ldap/v3"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// LDAP module for the authentication of users with a bind, either directly
+// with a DN built from the user name or after searching for it, and for the
+// retrieval of their attributes and groups, which are mapped to radius
+// attributes. Connections are pooled, and the servers are tried in order,
+// skipping for some time those that fail
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	LDAP_MODULE_DEFAULT_MAX_IDLE_CONNS      = 5
+	LDAP_MODULE_DEFAULT_TIMEOUT_MILLIS      = 2000
+	LDAP_MODULE_DEFAULT_SERVER_DOWN_SECONDS = 30
+	LDAP_MODULE_DEFAULT_GROUP_ATTRIBUTE     = "cn"
+)
+
+// Placeholders in the DN and filters of the configuration
+const (
+	ldapUserNamePlaceholder = "{userName}"
+	ldapUserDNPlaceholder   = "{userDN}"
+)
+
+// Returned when the password of the user is not correct
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Returned when no LDAP server could be reached
+var ErrLDAPUnavailable = errors.New("no LDAP server available")
+
+// Configuration of the LDAP module
+type LDAPModuleConfig struct {
+	// Servers, such as ldap://host:389 or ldaps://host:636, in order of preference
+	URLs []string
+
+	// Credentials used for searching. If empty, searches are anonymous
+	BindDN       string
+	BindPassword string
+
+	// DN of the users, with {userName} to be replaced by the name of the user, for binding
+	// without searching. Used if UserFilter is not specified
+	UserDN string
+
+	// Base and filter for searching the users, with {userName} to be replaced by the name of the
+	// user, such as (uid={userName})
+	BaseDN     string
+	UserFilter string
+
+	// Base and filter for searching the groups of the user, with {userDN} to be replaced by the
+	// DN of the user and {userName} by its name, such as (&(objectClass=groupOfNames)(member={userDN})).
+	// If not specified, groups are not retrieved
+	GroupBaseDN string
+	GroupFilter string
+
+	// Attribute of the groups that contains its name. Defaults to cn
+	GroupNameAttribute string
+
+	// LDAP attribute names to radius attribute names, to generate the reply items from the
+	// attributes of the user
+	AttributeMap map[string]string
+
+	// Reply items for the members of the groups, by group name
+	GroupReplyItems map[string]AVPItems
+
+	// Number of idle connections kept for each server
+	MaxIdleConns int
+
+	// Timeout for connecting and for each operation
+	TimeoutMillis int
+
+	// Time during which a server that failed is not tried
+	ServerDownSeconds int
+}
+
+// User found in the directory
+type LDAPUser struct {
+	DN         string
+	Attributes map[string][]string
+	Groups     []string
+}
+
+// Returns whether the user is member of the group
+func (u *LDAPUser) IsMember(group string) bool {
+	for _, g := range u.Groups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+	return false
+}
+
+// A server with its pool of connections
+type ldapServer struct {
+	url       string
+	pool      chan *ldap.Conn
+	downUntil time.Time
+}
+
+// LDAP module
+type LDAPModule struct {
+	config  LDAPModuleConfig
+	servers []*ldapServer
+	timeout time.Duration
+
+	// Protects the status of the servers
+	mutex sync.Mutex
+}
+
+// Creates the module with the configuration in the specified object
+func NewLDAPModule(configObjectName string, ci *core.PolicyConfigurationManager) (*LDAPModule, error) {
+
+	// If we pass nil as last parameter, use the default
+	var myCi *core.PolicyConfigurationManager
+	if ci == nil {
+		myCi = core.GetPolicyConfig()
+	} else {
+		myCi = ci
+	}
+
+	jBytes, err := myCi.CM.GetBytesConfigObject(configObjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	var config LDAPModuleConfig
+	if err := json.Unmarshal(jBytes, &config); err != nil {
+		return nil, err
+	}
+
+	return NewLDAPModuleWithConfig(config)
+}
+
+// Creates the module with the specified configuration
+func NewLDAPModuleWithConfig(config LDAPModuleConfig) (*LDAPModule, error) {
+
+	if len(config.URLs) == 0 {
+		return nil, errors.New("no LDAP servers specified")
+	}
+	if config.UserFilter == "" && config.UserDN == "" {
+		return nil, errors.New("either UserFilter or UserDN must be specified")
+	}
+	if config.MaxIdleConns == 0 {
+		config.MaxIdleConns = LDAP_MODULE_DEFAULT_MAX_IDLE_CONNS
+	}
+	if config.TimeoutMillis == 0 {
+		config.TimeoutMillis = LDAP_MODULE_DEFAULT_TIMEOUT_MILLIS
+	}
+	if config.ServerDownSeconds == 0 {
+		config.ServerDownSeconds = LDAP_MODULE_DEFAULT_SERVER_DOWN_SECONDS
+	}
+	if config.GroupNameAttribute == "" {
+		config.GroupNameAttribute = LDAP_MODULE_DEFAULT_GROUP_ATTRIBUTE
+	}
+
+	m := LDAPModule{
+		config:  config,
+		timeout: time.Duration(config.TimeoutMillis) * time.Millisecond,
+	}
+	for _, url := range config.URLs {
+		m.servers = append(m.servers, &ldapServer{url: url, pool: make(chan *ldap.Conn, config.MaxIdleConns)})
+	}
+
+	return &m, nil
+}
+
+// Closes the idle connections
+func (m *LDAPModule) Close() {
+	for _, server := range m.servers {
+	drain:
+		for {
+			select {
+			case conn := <-server.pool:
+				conn.Close()
+			default:
+				break drain
+			}
+		}
+	}
+}
+
+// Authenticates the PAP request, and returns the reply items for the user if successful. Returns
+// ErrUserNotFound if that is the case
+func (m *LDAPModule) Authenticate(request *core.RadiusPacket) (bool, AVPItems, error) {
+	password := request.GetStringAVP("User-Password")
+	if password == "" {
+		return false, nil, errors.New("no User-Password in request")
+	}
+
+	user, err := m.Bind(request.GetStringAVP("User-Name"), password)
+	if errors.Is(err, ErrInvalidCredentials) {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+
+	replyItems, err := m.ReplyItems(user)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, replyItems, nil
+}
+
+// Verifies the password binding as the user, and returns the user with its attributes and groups.
+// Returns ErrInvalidCredentials if the password is not correct, and ErrUserNotFound if the user
+// was searched for and not found
+func (m *LDAPModule) Bind(userName string, password string) (*LDAPUser, error) {
+
+	// Empty passwords would be accepted as anonymous binds
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	var user *LDAPUser
+	err := m.withConn(func(conn *ldap.Conn) error {
+		var err error
+		user, err = m.bindAndRead(conn, userName, password)
+
+		// Back to the service account, for the groups and for reuse of the connection,
+		// also if the bind failed
+		if serviceErr := m.bindService(conn); serviceErr != nil {
+			conn.Close()
+			if err == nil {
+				return serviceErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		user.Groups, err = m.searchGroups(conn, userName, user.DN)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Binds as the user and gets its entry, searching for it before the bind or reading it after
+func (m *LDAPModule) bindAndRead(conn *ldap.Conn, userName string, password string) (*LDAPUser, error) {
+	if m.config.UserFilter != "" {
+		user, err := m.searchUser(conn, userName)
+		if err != nil {
+			return nil, err
+		}
+		return user, m.bindUser(conn, user.DN, password)
+	}
+
+	dn := strings.ReplaceAll(m.config.UserDN, ldapUserNamePlaceholder, escapeDNValue(userName))
+	if err := m.bindUser(conn, dn, password); err != nil {
+		return nil, err
+	}
+	return m.readUser(conn, dn)
+}
+
+// Returns the user with its attributes and groups, without authentication. Returns ErrUserNotFound
+// if it does not exist
+func (m *LDAPModule) GetUser(userName string) (*LDAPUser, error) {
+
+	var user *LDAPUser
+	err := m.withConn(func(conn *ldap.Conn) error {
+		var err error
+		if m.config.UserFilter != "" {
+			user, err = m.searchUser(conn, userName)
+		} else {
+			user, err = m.readUser(conn, strings.ReplaceAll(m.config.UserDN, ldapUserNamePlaceholder, escapeDNValue(userName)))
+		}
+		if err != nil {
+			return err
+		}
+
+		user.Groups, err = m.searchGroups(conn, userName, user.DN)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Generates the reply items for the user, from its attributes as specified in the AttributeMap and
+// from its groups as specified in the GroupReplyItems
+func (m *LDAPModule) ReplyItems(user *LDAPUser) (AVPItems, error) {
+	items := AVPItems{}
+
+	// Sorted, so that the order of the items is always the same
+	ldapNames := make([]string, 0, len(m.config.AttributeMap))
+	for ldapName := range m.config.AttributeMap {
+		ldapNames = append(ldapNames, ldapName)
+	}
+	sort.Strings(ldapNames)
+
+	for _, ldapName := range ldapNames {
+		radiusName := m.config.AttributeMap[ldapName]
+		for attrName, values := range user.Attributes {
+			if !strings.EqualFold(attrName, ldapName) {
+				continue
+			}
+			for _, value := range values {
+				avp, err := core.NewRadiusAVP(radiusName, value)
+				if err != nil {
+					return nil, fmt.Errorf("could not map %s to %s: %w", ldapName, radiusName, err)
+				}
+				items = append(items, *avp)
+			}
+		}
+	}
+
+	for _, group := range user.Groups {
+		for groupName, groupItems := range m.config.GroupReplyItems {
+			if strings.EqualFold(groupName, group) {
+				items = items.Add(groupItems)
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// Executes the function with a connection to the first server available, trying the next ones if
+// there are network errors
+func (m *LDAPModule) withConn(f func(conn *ldap.Conn) error) error {
+	for _, server := range m.servers {
+		if !m.isAvailable(server) {
+			continue
+		}
+
+		conn, pooled, err := m.getConn(server)
+		if err != nil {
+			core.GetLogger().Errorf("could not connect to LDAP server %s: %s", server.url, err)
+			m.setDown(server)
+			continue
+		}
+
+		// The connection is closed if the server went away. The result of the authentication
+		// is kept even if the connection could not be bound again to the service account
+		err = f(conn)
+
+		// An idle connection may have been closed by the server. Try once with a new one before
+		// marking the server as down
+		if pooled && isLDAPConnError(conn, err) {
+			core.GetLogger().Debugf("LDAP server %s error in pooled connection: %s", server.url, err)
+			conn.Close()
+			if conn, err = m.dialConn(server); err != nil {
+				core.GetLogger().Errorf("could not connect to LDAP server %s: %s", server.url, err)
+				m.setDown(server)
+				continue
+			}
+			err = f(conn)
+		}
+
+		if isLDAPConnError(conn, err) {
+			core.GetLogger().Errorf("LDAP server %s error: %s", server.url, err)
+			conn.Close()
+			m.setDown(server)
+			continue
+		}
+
+		m.putConn(server, conn)
+		return err
+	}
+
+	return ErrLDAPUnavailable
+}
+
+// Returns whether the error is due to a failure of the connection
+func isLDAPConnError(conn *ldap.Conn, err error) bool {
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || errors.Is(err, ErrUserNotFound) {
+		return false
+	}
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || conn.IsClosing()
+}
+
+// Returns whether the server is not marked as down
+func (m *LDAPModule) isAvailable(server *ldapServer) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return time.Now().After(server.downUntil)
+}
+
+// Marks the server as down, and closes its idle connections
+func (m *LDAPModule) setDown(server *ldapServer) {
+	m.mutex.Lock()
+	server.downUntil = time.Now().Add(time.Duration(m.config.ServerDownSeconds) * time.Second)
+	m.mutex.Unlock()
+
+	for {
+		select {
+		case conn := <-server.pool:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Takes an idle connection from the pool, or creates a new one bound with the service account.
+// Returns also whether the connection was taken from the pool
+func (m *LDAPModule) getConn(server *ldapServer) (*ldap.Conn, bool, error) {
+	for {
+		select {
+		case conn := <-server.pool:
+			if !conn.IsClosing() {
+				return conn, true, nil
+			}
+		default:
+			conn, err := m.dialConn(server)
+			return conn, false, err
+		}
+	}
+}
+
+// Creates a new connection to the server, bound with the service account
+func (m *LDAPModule) dialConn(server *ldapServer) (*ldap.Conn, error) {
+	conn, err := ldap.DialURL(server.url, ldap.DialWithDialer(&net.Dialer{Timeout: m.timeout}))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(m.timeout)
+	if err := m.bindService(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Returns the connection to the pool, or closes it if the pool is full
+func (m *LDAPModule) putConn(server *ldapServer, conn *ldap.Conn) {
+	if conn.IsClosing() {
+		return
+	}
+	select {
+	case server.pool <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// Binds with the service account, or anonymously if not configured
+func (m *LDAPModule) bindService(conn *ldap.Conn) error {
+	if m.config.BindDN == "" {
+		return conn.UnauthenticatedBind("")
+	}
+	return conn.Bind(m.config.BindDN, m.config.BindPassword)
+}
+
+// Binds as the user, translating the error for a bad password
+func (m *LDAPModule) bindUser(conn *ldap.Conn, dn string, password string) error {
+	err := conn.Bind(dn, password)
+	if ldap.IsErrorAnyOf(err, ldap.LDAPResultInvalidCredentials, ldap.LDAPResultNoSuchObject) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// Searches for the user with the UserFilter
+func (m *LDAPModule) searchUser(conn *ldap.Conn, userName string) (*LDAPUser, error) {
+	filter := strings.ReplaceAll(m.config.UserFilter, ldapUserNamePlaceholder, ldap.EscapeFilter(userName))
+	result, err := conn.Search(ldap.NewSearchRequest(m.config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, m.config.TimeoutMillis/1000, false, filter, nil, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, ErrUserNotFound
+	case 1:
+		return newLDAPUser(result.Entries[0]), nil
+	default:
+		return nil, fmt.Errorf("more than one entry found for %s", userName)
+	}
+}
+
+// Reads the entry of the user with the specified DN
+func (m *LDAPModule) readUser(conn *ldap.Conn, dn string) (*LDAPUser, error) {
+	result, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+		1, m.config.TimeoutMillis/1000, false, "(objectClass=*)", nil, nil))
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Entries) == 0 {
+		return nil, ErrUserNotFound
+	}
+
+	return newLDAPUser(result.Entries[0]), nil
+}
+
+// Returns the names of the groups of the user
+func (m *LDAPModule) searchGroups(conn *ldap.Conn, userName string, userDN string) ([]string, error) {
+	if m.config.GroupFilter == "" {
+		return nil, nil
+	}
+
+	filter := strings.ReplaceAll(m.config.GroupFilter, ldapUserNamePlaceholder, ldap.EscapeFilter(userName))
+	filter = strings.ReplaceAll(filter, ldapUserDNPlaceholder, ldap.EscapeFilter(userDN))
+	result, err := conn.Search(ldap.NewSearchRequest(m.config.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		0, m.config.TimeoutMillis/1000, false, filter, []string{m.config.GroupNameAttribute}, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.GetEqualFoldAttributeValues(m.config.GroupNameAttribute)...)
+	}
+	return groups, nil
+}
+
+// Builds the user from the LDAP entry
+func newLDAPUser(entry *ldap.Entry) *LDAPUser {
+	user := LDAPUser{DN: entry.DN, Attributes: make(map[string][]string)}
+	for _, attr := range entry.Attributes {
+		user.Attributes[attr.Name] = attr.Values
+	}
+	return &user
+}
+
+// Escapes the special characters of a value to be used in a DN, as specified in RFC 4514
+func escapeDNValue(value string) string {
+	var sb strings.Builder
+	for i, c := range value {
+		switch {
+		case strings.ContainsRune(",+\"\\<>;=", c):
+			sb.WriteRune('\\')
+			sb.WriteRune(c)
+		case (c == ' ' || c == '#') && i == 0, c == ' ' && i == len(value)-1:
+			sb.WriteRune('\\')
+			sb.WriteRune(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		default:
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,427 @@
+package handler
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/francistor/igor/core"
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestLDAPSearchAndBind(t *testing.T) {
+
+	stub := newTestLDAPServer(t, "127.0.0.1:13389")
+	defer stub.close()
+
+	module, err := NewLDAPModule("radiusLDAPModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	user, err := module.Bind("alice", "alicePassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.DN != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("bad DN %s", user.DN)
+	}
+	if !user.IsMember("apnAdmins") || !user.IsMember("apnUsers") || len(user.Groups) != 2 {
+		t.Errorf("bad groups %v", user.Groups)
+	}
+
+	// Bad password, and then a search in the same pooled connection, that must be bound again
+	if _, err := module.Bind("alice", "badPassword"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad password accepted: %v", err)
+	}
+	if _, err := module.Bind("alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password accepted: %v", err)
+	}
+	if _, err := module.Bind("unknown", "password"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user found: %v", err)
+	}
+	if user, err := module.GetUser("bob"); err != nil || user.IsMember("apnAdmins") || !user.IsMember("apnUsers") {
+		t.Errorf("bad user %v %v", user, err)
+	}
+
+	// Special characters in the user name are escaped
+	if _, err := module.Bind("*", "alicePassword"); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("wildcard user name not escaped: %v", err)
+	}
+
+	// Connections are reused
+	if stub.getConnections() != 1 {
+		t.Errorf("connections not reused: %d", stub.getConnections())
+	}
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+
+	stub := newTestLDAPServer(t, "127.0.0.1:13389")
+	defer stub.close()
+
+	module, err := NewLDAPModule("radiusLDAPModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "alice").Add("User-Password", "alicePassword")
+	ok, replyItems, err := module.Authenticate(request)
+	if !ok || err != nil {
+		t.Fatalf("not authenticated: %v", err)
+	}
+	if len(replyItems) != 3 {
+		t.Fatalf("bad reply items %v", replyItems)
+	}
+	if replyItems[0].Name != "Class" || replyItems[0].GetString() != "gold" {
+		t.Errorf("bad Class %v", replyItems[0])
+	}
+	if replyItems[1].Name != "Session-Timeout" || replyItems[1].GetInt() != 3600 {
+		t.Errorf("bad Session-Timeout %v", replyItems[1])
+	}
+	if replyItems[2].Name != "Filter-Id" || replyItems[2].GetString() != "admin-filter" {
+		t.Errorf("bad group item %v", replyItems[2])
+	}
+
+	request = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "alice").Add("User-Password", "badPassword")
+	if ok, _, err := module.Authenticate(request); ok || err != nil {
+		t.Errorf("bad password authenticated or error %v", err)
+	}
+}
+
+func TestLDAPDirectBind(t *testing.T) {
+
+	stub := newTestLDAPServer(t, "127.0.0.1:13391")
+	defer stub.close()
+
+	module, err := NewLDAPModuleWithConfig(LDAPModuleConfig{
+		URLs:   []string{"ldap://127.0.0.1:13391"},
+		BindDN: "cn=igor,dc=example,dc=com", BindPassword: "servicePassword",
+		UserDN: "uid={userName},ou=people,dc=example,dc=com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	user, err := module.Bind("bob", "bobPassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Attributes["sessionTimeout"][0] != "7200" || len(user.Groups) != 0 {
+		t.Errorf("bad user %v", user)
+	}
+	if _, err := module.Bind("bob", "badPassword"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("bad password accepted: %v", err)
+	}
+	if _, err := module.Bind("nobody", "password"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("unknown user accepted: %v", err)
+	}
+}
+
+func TestLDAPFailover(t *testing.T) {
+
+	primary := newTestLDAPServer(t, "127.0.0.1:13389")
+	secondary := newTestLDAPServer(t, "127.0.0.1:13390")
+	defer secondary.close()
+
+	module, err := NewLDAPModule("radiusLDAPModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	if _, err := module.Bind("alice", "alicePassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The pooled connection to the primary fails, and the secondary is used
+	primary.close()
+	if _, err := module.Bind("alice", "alicePassword"); err != nil {
+		t.Fatal(err)
+	}
+	if secondary.getConnections() != 1 {
+		t.Errorf("secondary not used")
+	}
+
+	// The primary is not tried again
+	if _, err := module.Bind("bob", "bobPassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	// No servers
+	secondary.close()
+	if _, err := module.Bind("alice", "alicePassword"); !errors.Is(err, ErrLDAPUnavailable) {
+		t.Errorf("bad error with no servers %v", err)
+	}
+}
+
+func TestLDAPStaleConnection(t *testing.T) {
+
+	primary := newTestLDAPServer(t, "127.0.0.1:13389")
+	defer primary.close()
+
+	module, err := NewLDAPModule("radiusLDAPModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	if _, err := module.Bind("alice", "alicePassword"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server closes the idle connection, but is still up
+	primary.closeConnections()
+	if _, err := module.Bind("alice", "alicePassword"); err != nil {
+		t.Fatal(err)
+	}
+	if primary.getConnections() != 2 {
+		t.Errorf("new connection to primary not used")
+	}
+
+	// The primary was not marked as down
+	if _, err := module.Bind("bob", "bobPassword"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Helpers
+
+// Entries of the directory of the stub server
+var testLDAPEntries = map[string]map[string][]string{
+	"cn=igor,dc=example,dc=com": {
+		"objectClass":  {"applicationProcess"},
+		"userPassword": {"servicePassword"},
+	},
+	"uid=alice,ou=people,dc=example,dc=com": {
+		"objectClass":    {"person"},
+		"uid":            {"alice"},
+		"userPassword":   {"alicePassword"},
+		"radiusClass":    {"gold"},
+		"sessionTimeout": {"3600"},
+	},
+	"uid=bob,ou=people,dc=example,dc=com": {
+		"objectClass":    {"person"},
+		"uid":            {"bob"},
+		"userPassword":   {"bobPassword"},
+		"sessionTimeout": {"7200"},
+	},
+	"cn=apnAdmins,ou=groups,dc=example,dc=com": {
+		"objectClass": {"groupOfNames"},
+		"cn":          {"apnAdmins"},
+		"member":      {"uid=alice,ou=people,dc=example,dc=com"},
+	},
+	"cn=apnUsers,ou=groups,dc=example,dc=com": {
+		"objectClass": {"groupOfNames"},
+		"cn":          {"apnUsers"},
+		"member":      {"uid=alice,ou=people,dc=example,dc=com", "uid=bob,ou=people,dc=example,dc=com"},
+	},
+}
+
+// In-process LDAP server supporting simple binds and searches with and, or, not, equality and
+// presence filters. Anonymous searches are not allowed
+type testLDAPServer struct {
+	listener    net.Listener
+	mutex       sync.Mutex
+	conns       []net.Conn
+	connections int
+	wg          sync.WaitGroup
+}
+
+func newTestLDAPServer(t *testing.T, address string) *testLDAPServer {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAPServer{listener: listener}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mutex.Lock()
+			s.conns = append(s.conns, conn)
+			s.connections++
+			s.mutex.Unlock()
+
+			s.wg.Add(1)
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// Closes the listener and all the connections
+func (s *testLDAPServer) close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+}
+
+// Closes the connections accepted, but keeps listening
+func (s *testLDAPServer) closeConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Number of connections accepted
+func (s *testLDAPServer) getConnections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.connections
+}
+
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+
+	var boundDN string
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		messageID := packet.Children[0].Value
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			password := op.Children[2].Data.String()
+			var code uint16 = ldap.LDAPResultSuccess
+			if password == "" {
+				boundDN = ""
+			} else if entry, found := testLDAPEntries[dn]; !found || entry["userPassword"][0] != password {
+				boundDN = ""
+				code = ldap.LDAPResultInvalidCredentials
+			} else {
+				boundDN = dn
+			}
+			conn.Write(testLDAPMessage(messageID, ldap.ApplicationBindResponse, testLDAPResult(code)...).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			if boundDN == "" {
+				conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultDone, testLDAPResult(ldap.LDAPResultInsufficientAccessRights)...).Bytes())
+				continue
+			}
+			baseDN := op.Children[0].Value.(string)
+			scope := op.Children[1].Value.(int64)
+			if _, found := testLDAPEntries[baseDN]; scope == ldap.ScopeBaseObject && !found {
+				conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultDone, testLDAPResult(ldap.LDAPResultNoSuchObject)...).Bytes())
+				continue
+			}
+			for dn, attributes := range testLDAPEntries {
+				if scope == ldap.ScopeBaseObject && dn != baseDN || !strings.HasSuffix(dn, baseDN) {
+					continue
+				}
+				if !testLDAPMatch(op.Children[6], attributes) {
+					continue
+				}
+				attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+				for name, values := range attributes {
+					attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+					attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+					set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+					for _, value := range values {
+						set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+					}
+					attr.AppendChild(set)
+					attrs.AppendChild(attr)
+				}
+				conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultEntry,
+					ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""), attrs).Bytes())
+			}
+			conn.Write(testLDAPMessage(messageID, ldap.ApplicationSearchResultDone, testLDAPResult(ldap.LDAPResultSuccess)...).Bytes())
+
+		default:
+			return
+		}
+	}
+}
+
+// Evaluates the filter for the attributes of an entry
+func testLDAPMatch(filter *ber.Packet, attributes map[string][]string) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !testLDAPMatch(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if testLDAPMatch(child, attributes) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return !testLDAPMatch(filter.Children[0], attributes)
+	case ldap.FilterEqualityMatch:
+		name := filter.Children[0].Data.String()
+		value := filter.Children[1].Data.String()
+		for attrName, values := range attributes {
+			if strings.EqualFold(attrName, name) {
+				for _, v := range values {
+					if strings.EqualFold(v, value) {
+						return true
+					}
+				}
+			}
+		}
+		return false
+	case ldap.FilterPresent:
+		name := filter.Data.String()
+		for attrName := range attributes {
+			if strings.EqualFold(attrName, name) {
+				return true
+			}
+		}
+		return strings.EqualFold(name, "objectClass")
+	default:
+		return false
+	}
+}
+
+// Builds an LDAP message
+func testLDAPMessage(messageID interface{}, tag ber.Tag, children ...*ber.Packet) *ber.Packet {
+	envelope := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	envelope.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, ""))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	for _, child := range children {
+		op.AppendChild(child)
+	}
+	envelope.AppendChild(op)
+	return envelope
+}
+
+// Builds the components of an LDAP result
+func testLDAPResult(code uint16) []*ber.Packet {
+	return []*ber.Packet{
+		ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+		ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""),
+	}
+}
@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"crypto/sha512"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// SHA-512-crypt, as specified in https://www.akkadia.org/drepper/SHA-crypt.txt
+// Hashes have the form $6$[rounds=<n>$]<salt>$<hash>
+/////////////////////////////////////////////////////////////////////////////
+
+const sha512CryptPrefix = "$6$"
+const sha512CryptRoundsPrefix = "rounds="
+const sha512CryptDefaultRounds = 5000
+const sha512CryptMaxSaltLen = 16
+
+// Alphabet for the encoding of the hash
+const cryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Order in which the bytes of the hash are encoded, in groups of three
+var sha512CryptPermutation = [][3]int{
+	{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+	{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+	{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+}
+
+// Generates the SHA-512-crypt hash of the password, taking the salt and rounds from the setting, which
+// may be a full hash
+func sha512Crypt(password string, setting string) (string, error) {
+	if !strings.HasPrefix(setting, sha512CryptPrefix) {
+		return "", errors.New("not a SHA-512-crypt hash")
+	}
+	spec := setting[len(sha512CryptPrefix):]
+
+	// Rounds
+	rounds := sha512CryptDefaultRounds
+	customRounds := false
+	if strings.HasPrefix(spec, sha512CryptRoundsPrefix) {
+		end := strings.Index(spec, "$")
+		if end < 0 {
+			return "", errors.New("bad rounds in SHA-512-crypt hash")
+		}
+		r, err := strconv.Atoi(spec[len(sha512CryptRoundsPrefix):end])
+		if err != nil {
+			return "", errors.New("bad rounds in SHA-512-crypt hash")
+		}
+		if r < 1000 {
+			r = 1000
+		} else if r > 999999999 {
+			r = 999999999
+		}
+		rounds = r
+		customRounds = true
+		spec = spec[end+1:]
+	}
+
+	// Salt
+	salt := spec
+	if end := strings.Index(spec, "$"); end >= 0 {
+		salt = spec[:end]
+	}
+	if len(salt) > sha512CryptMaxSaltLen {
+		salt = salt[:sha512CryptMaxSaltLen]
+	}
+
+	p := []byte(password)
+	s := []byte(salt)
+
+	// Digest B
+	hasher := sha512.New()
+	hasher.Write(p)
+	hasher.Write(s)
+	hasher.Write(p)
+	digestB := hasher.Sum(nil)
+
+	// Digest A
+	hasher = sha512.New()
+	hasher.Write(p)
+	hasher.Write(s)
+	for i := len(p); i > 0; i -= 64 {
+		if i > 64 {
+			hasher.Write(digestB)
+		} else {
+			hasher.Write(digestB[:i])
+		}
+	}
+	for i := len(p); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			hasher.Write(digestB)
+		} else {
+			hasher.Write(p)
+		}
+	}
+	digestA := hasher.Sum(nil)
+
+	// Sequence P
+	hasher = sha512.New()
+	for i := 0; i < len(p); i++ {
+		hasher.Write(p)
+	}
+	seqP := repeatToLen(hasher.Sum(nil), len(p))
+
+	// Sequence S
+	hasher = sha512.New()
+	for i := 0; i < 16+int(digestA[0]); i++ {
+		hasher.Write(s)
+	}
+	seqS := repeatToLen(hasher.Sum(nil), len(s))
+
+	// Rounds
+	digestC := digestA
+	for i := 0; i < rounds; i++ {
+		hasher = sha512.New()
+		if i&1 != 0 {
+			hasher.Write(seqP)
+		} else {
+			hasher.Write(digestC)
+		}
+		if i%3 != 0 {
+			hasher.Write(seqS)
+		}
+		if i%7 != 0 {
+			hasher.Write(seqP)
+		}
+		if i&1 != 0 {
+			hasher.Write(digestC)
+		} else {
+			hasher.Write(seqP)
+		}
+		digestC = hasher.Sum(nil)
+	}
+
+	// Encode
+	var sb strings.Builder
+	sb.WriteString(sha512CryptPrefix)
+	if customRounds {
+		sb.WriteString(sha512CryptRoundsPrefix + strconv.Itoa(rounds) + "$")
+	}
+	sb.WriteString(salt)
+	sb.WriteString("$")
+	for _, group := range sha512CryptPermutation {
+		cryptEncode(&sb, uint(digestC[group[0]])<<16|uint(digestC[group[1]])<<8|uint(digestC[group[2]]), 4)
+	}
+	cryptEncode(&sb, uint(digestC[63]), 2)
+
+	return sb.String(), nil
+}
+
+// Builds a sequence of the specified length repeating the bytes
+func repeatToLen(b []byte, length int) []byte {
+	seq := make([]byte, 0, length)
+	for len(seq) < length {
+		if length-len(seq) > len(b) {
+			seq = append(seq, b...)
+		} else {
+			seq = append(seq, b[:length-len(seq)]...)
+		}
+	}
+	return seq
+}
+
+// Writes n characters of the encoding of the value, 6 bits each, starting with the least significant
+func cryptEncode(sb *strings.Builder, value uint, n int) {
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptItoa64[value&0x3f])
+		value >>= 6
+	}
+}
@@ -0,0 +1,579 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// SQL module for authorization, post-auth logging and accounting, with
+// queries generated from templates using the values in the radius packets.
+// The values are always passed as query parameters, not inserted in the
+// query text. Writes that fail are saved to a backup file and replayed later
+/////////////////////////////////////////////////////////////////////////////
+
+const (
+	SQL_MODULE_DEFAULT_MAX_OPEN_CONNS       = 10
+	SQL_MODULE_DEFAULT_QUERY_TIMEOUT_MILLIS = 1000
+	SQL_MODULE_BACKUP_CHECK_TIME_SECONDS    = 60
+)
+
+// Values of Acct-Status-Type
+const (
+	acctStatusStart   = 1
+	acctStatusStop    = 2
+	acctStatusInterim = 3
+)
+
+// Configuration of the SQL module. The queries are go templates with ${ and } as delimiters, so that they are
+// not processed when reading the configuration object, executed with the radius packet as data. The functions
+// avp "<name>" and intAVP "<name>" insert a parameter placeholder bound to the value of the attribute in the
+// packet, as a string or as an integer, and now inserts one bound to the current time.
+// For instance: select Attribute, Value from radcheck where UserName = ${avp "User-Name"}
+// The authorize queries must return the attribute name and value in each row. Queries left empty are not executed
+type SQLModuleConfig struct {
+	// Name of the database/sql driver. If empty, mysql is used
+	Driver string
+
+	// Data source name, such as user:password@tcp(host:3306)/database
+	URL string
+
+	// Size of the connection pool
+	MaxOpenConns int
+	MaxIdleConns int
+
+	// Timeout of each query
+	QueryTimeoutMillis int
+
+	// Time during which the results of the authorize queries are cached. If zero, they are not cached
+	CacheTTLSeconds int
+
+	// Query returning the check items of the user
+	AuthorizeCheckQuery string
+
+	// Query returning the reply items of the user
+	AuthorizeReplyQuery string
+
+	// Statement executed after the authentication, with the request or the response as data
+	PostAuthQuery string
+
+	// Statements executed for accounting requests, depending on the Acct-Status-Type
+	AccountingStartQuery   string
+	AccountingInterimQuery string
+	AccountingStopQuery    string
+
+	// File where the statements that could not be executed are written, to be replayed later. If empty,
+	// the errors are returned to the caller
+	BackupFileName string
+
+	// Period for checking whether there are backup files to replay. Defaults to SQL_MODULE_BACKUP_CHECK_TIME_SECONDS
+	BackupCheckSeconds int
+}
+
+// Statement saved in the backup file
+type sqlBackupEntry struct {
+	Query string        `json:"query"`
+	Args  []interface{} `json:"args"`
+}
+
+// Cached result of the authorize queries
+type sqlAuthorizeEntry struct {
+	checkItems Properties
+	replyItems AVPItems
+	expiration time.Time
+}
+
+// Generates a query with its parameters from a template
+type sqlTemplate struct {
+	tmpl *template.Template
+}
+
+// Delimiters of the templates of the queries
+const (
+	sqlTemplateLeftDelim  = "${"
+	sqlTemplateRightDelim = "}"
+)
+
+// The functions are replaced on each execution, to collect the parameters
+var sqlTemplateFuncs = template.FuncMap{
+	"avp":    func(string) string { return "?" },
+	"intAVP": func(string) string { return "?" },
+	"now":    func() string { return "?" },
+}
+
+// Parses the template of a query. Returns nil if the query is empty
+func newSQLTemplate(name string, query string) (*sqlTemplate, error) {
+	if query == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(name).Delims(sqlTemplateLeftDelim, sqlTemplateRightDelim).Funcs(sqlTemplateFuncs).Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %w", name, err)
+	}
+	return &sqlTemplate{tmpl: tmpl}, nil
+}
+
+// Generates the query text and the parameters, taking the values from the packet
+func (st *sqlTemplate) render(packet *core.RadiusPacket) (string, []interface{}, error) {
+	var args []interface{}
+	bind := func(value interface{}) string {
+		args = append(args, value)
+		return "?"
+	}
+
+	tmpl, err := st.tmpl.Clone()
+	if err != nil {
+		return "", nil, err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"avp":    func(name string) string { return bind(packet.GetStringAVP(name)) },
+		"intAVP": func(name string) string { return bind(packet.GetIntAVP(name)) },
+		"now":    func() string { return bind(time.Now().Format("2006-01-02 15:04:05")) },
+	})
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, packet); err != nil {
+		return "", nil, err
+	}
+	return buffer.String(), args, nil
+}
+
+// SQL module, implementing the authorize, post-auth and accounting functions of a radius server
+type SQLModule struct {
+	config SQLModuleConfig
+	db     *sql.DB
+
+	authorizeCheck    *sqlTemplate
+	authorizeReply    *sqlTemplate
+	postAuth          *sqlTemplate
+	accountingStart   *sqlTemplate
+	accountingInterim *sqlTemplate
+	accountingStop    *sqlTemplate
+
+	queryTimeout time.Duration
+	cacheTTL     time.Duration
+
+	// Results of the authorize queries, by query text and parameters
+	cache      map[string]sqlAuthorizeEntry
+	cacheMutex sync.Mutex
+
+	// Whether there are statements in the backup file
+	hasBackup   bool
+	backupMutex sync.Mutex
+
+	// To stop the processing of backup files
+	doneChan chan struct{}
+	wg       sync.WaitGroup
+}
+
+// Creates the module with the configuration in the specified object
+func NewSQLModule(configObjectName string, ci *core.PolicyConfigurationManager) (*SQLModule, error) {
+
+	// If we pass nil as last parameter, use the default
+	var myCi *core.PolicyConfigurationManager
+	if ci == nil {
+		myCi = core.GetPolicyConfig()
+	} else {
+		myCi = ci
+	}
+
+	jBytes, err := myCi.CM.GetBytesConfigObject(configObjectName)
+	if err != nil {
+		return nil, err
+	}
+
+	var config SQLModuleConfig
+	if err := json.Unmarshal(jBytes, &config); err != nil {
+		return nil, err
+	}
+
+	return NewSQLModuleWithConfig(config)
+}
+
+// Creates the module with the specified configuration
+func NewSQLModuleWithConfig(config SQLModuleConfig) (*SQLModule, error) {
+
+	if config.Driver == "" {
+		config.Driver = "mysql"
+	}
+	if config.MaxOpenConns == 0 {
+		config.MaxOpenConns = SQL_MODULE_DEFAULT_MAX_OPEN_CONNS
+	}
+	if config.QueryTimeoutMillis == 0 {
+		config.QueryTimeoutMillis = SQL_MODULE_DEFAULT_QUERY_TIMEOUT_MILLIS
+	}
+	if config.BackupCheckSeconds == 0 {
+		config.BackupCheckSeconds = SQL_MODULE_BACKUP_CHECK_TIME_SECONDS
+	}
+
+	m := SQLModule{
+		config:       config,
+		queryTimeout: time.Duration(config.QueryTimeoutMillis) * time.Millisecond,
+		cacheTTL:     time.Duration(config.CacheTTLSeconds) * time.Second,
+		cache:        make(map[string]sqlAuthorizeEntry),
+		doneChan:     make(chan struct{}),
+	}
+
+	// Parse the queries
+	var err error
+	templates := []struct {
+		target **sqlTemplate
+		name   string
+		query  string
+	}{
+		{&m.authorizeCheck, "authorizeCheckQuery", config.AuthorizeCheckQuery},
+		{&m.authorizeReply, "authorizeReplyQuery", config.AuthorizeReplyQuery},
+		{&m.postAuth, "postAuthQuery", config.PostAuthQuery},
+		{&m.accountingStart, "accountingStartQuery", config.AccountingStartQuery},
+		{&m.accountingInterim, "accountingInterimQuery", config.AccountingInterimQuery},
+		{&m.accountingStop, "accountingStopQuery", config.AccountingStopQuery},
+	}
+	for _, t := range templates {
+		if *t.target, err = newSQLTemplate(t.name, t.query); err != nil {
+			return nil, err
+		}
+	}
+
+	// The pool of connections
+	m.db, err = sql.Open(config.Driver, config.URL)
+	if err != nil {
+		return nil, err
+	}
+	m.db.SetMaxOpenConns(config.MaxOpenConns)
+	if config.MaxIdleConns != 0 {
+		m.db.SetMaxIdleConns(config.MaxIdleConns)
+	}
+
+	if config.BackupFileName != "" {
+		// Rename a backup file left by a previous execution, so that it is processed
+		if _, err := os.Stat(config.BackupFileName); err == nil {
+			os.Rename(config.BackupFileName, fmt.Sprintf("%s.%d.w", config.BackupFileName, time.Now().UnixMilli()))
+		}
+
+		m.wg.Add(1)
+		go m.processBackupFiles()
+	}
+
+	return &m, nil
+}
+
+// Stops the processing of backup files and closes the database
+func (m *SQLModule) Close() error {
+	close(m.doneChan)
+	m.wg.Wait()
+	return m.db.Close()
+}
+
+// Returns the check items and the reply items of the user in the request. If nothing is found,
+// returns ErrUserNotFound
+func (m *SQLModule) Authorize(request *core.RadiusPacket) (Properties, AVPItems, error) {
+
+	var checkQuery, replyQuery string
+	var checkArgs, replyArgs []interface{}
+	var err error
+	if m.authorizeCheck != nil {
+		if checkQuery, checkArgs, err = m.authorizeCheck.render(request); err != nil {
+			return nil, nil, err
+		}
+	}
+	if m.authorizeReply != nil {
+		if replyQuery, replyArgs, err = m.authorizeReply.render(request); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Look in the cache
+	cacheKey, err := sqlAuthorizeCacheKey(checkQuery, checkArgs, replyQuery, replyArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.cacheTTL > 0 {
+		if entry, found := m.getCached(cacheKey); found {
+			return entry.checkItems.copy(), append(AVPItems{}, entry.replyItems...), nil
+		}
+	}
+
+	checkItems := Properties{}
+	replyItems := AVPItems{}
+	if checkQuery != "" {
+		if err := m.queryItems(checkQuery, checkArgs, func(name string, value string) error {
+			checkItems[name] = value
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+	if replyQuery != "" {
+		if err := m.queryItems(replyQuery, replyArgs, func(name string, value string) error {
+			avp, err := core.NewRadiusAVP(name, value)
+			if err != nil {
+				return err
+			}
+			replyItems = append(replyItems, *avp)
+			return nil
+		}); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if m.cacheTTL > 0 {
+		m.setCached(cacheKey, sqlAuthorizeEntry{checkItems: checkItems.copy(), replyItems: append(AVPItems{}, replyItems...)})
+	}
+
+	if len(checkItems) == 0 && len(replyItems) == 0 {
+		return nil, nil, ErrUserNotFound
+	}
+	return checkItems, replyItems, nil
+}
+
+// Executes the post-auth statement, with the values of the packet, which may be the request or the response
+func (m *SQLModule) PostAuth(packet *core.RadiusPacket) error {
+	return m.execTemplate(m.postAuth, packet)
+}
+
+// Executes the accounting statement corresponding to the Acct-Status-Type. Other types of
+// accounting requests are ignored
+func (m *SQLModule) Accounting(request *core.RadiusPacket) error {
+	switch request.GetIntAVP("Acct-Status-Type") {
+	case acctStatusStart:
+		return m.execTemplate(m.accountingStart, request)
+	case acctStatusInterim:
+		return m.execTemplate(m.accountingInterim, request)
+	case acctStatusStop:
+		return m.execTemplate(m.accountingStop, request)
+	default:
+		return nil
+	}
+}
+
+// Removes all the entries from the cache
+func (m *SQLModule) FlushCache() {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	m.cache = make(map[string]sqlAuthorizeEntry)
+}
+
+// Executes a query returning attribute names and values, invoking the function for each row
+func (m *SQLModule) queryItems(query string, args []interface{}, f func(name string, value string) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout)
+	defer cancel()
+
+	rows, err := m.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		if err := f(name, value); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// Generates and executes the statement. If it fails and there is a backup file, the statement is written to it
+func (m *SQLModule) execTemplate(st *sqlTemplate, packet *core.RadiusPacket) error {
+	if st == nil {
+		return nil
+	}
+	query, args, err := st.render(packet)
+	if err != nil {
+		return err
+	}
+
+	err = m.exec(query, args)
+	if err == nil {
+		// Move backup file so that it is processed, if just recovered from an error
+		m.backupMutex.Lock()
+		if m.hasBackup {
+			os.Rename(m.config.BackupFileName, fmt.Sprintf("%s.%d.w", m.config.BackupFileName, time.Now().UnixMilli()))
+			m.hasBackup = false
+		}
+		m.backupMutex.Unlock()
+		return nil
+	}
+
+	if m.config.BackupFileName == "" {
+		return err
+	}
+
+	core.GetLogger().Errorf("sql module error: %s. Backing up statement", err)
+	return m.writeBackup(query, args)
+}
+
+// Executes a statement
+func (m *SQLModule) exec(query string, args []interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.queryTimeout)
+	defer cancel()
+
+	_, err := m.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// Appends the statement to the backup file
+func (m *SQLModule) writeBackup(query string, args []interface{}) error {
+	line, err := json.Marshal(sqlBackupEntry{Query: query, Args: args})
+	if err != nil {
+		return err
+	}
+
+	m.backupMutex.Lock()
+	defer m.backupMutex.Unlock()
+
+	file, err := os.OpenFile(m.config.BackupFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0770)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", m.config.BackupFileName, err)
+	}
+	defer file.Close()
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("could not write to %s: %w", m.config.BackupFileName, err)
+	}
+	m.hasBackup = true
+
+	return nil
+}
+
+// Processes periodically the backup files (the ones with names terminating in ".w")
+func (m *SQLModule) processBackupFiles() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(time.Duration(m.config.BackupCheckSeconds) * time.Second)
+	defer ticker.Stop()
+
+	dir := filepath.Dir(m.config.BackupFileName)
+	prefix := filepath.Base(m.config.BackupFileName) + "."
+
+	for {
+		select {
+		case <-m.doneChan:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			core.GetLogger().Errorf("could not list files in %s", dir)
+			continue
+		}
+
+		for _, file := range files {
+			if strings.HasPrefix(file.Name(), prefix) && strings.HasSuffix(file.Name(), ".w") {
+				m.processBackupFile(filepath.Join(dir, file.Name()))
+			}
+		}
+	}
+}
+
+// Replays the statements in a backup file. Deletes it if successful, or leaves in it the
+// statements not executed otherwise
+func (m *SQLModule) processBackupFile(fileName string) error {
+
+	core.GetLogger().Debugf("processing backup file %s", fileName)
+
+	file, err := os.Open(fileName)
+	if err != nil {
+		core.GetLogger().Errorf("could not open %s", fileName)
+		return err
+	}
+
+	var lines []string
+	fileScanner := bufio.NewScanner(file)
+	fileScanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for fileScanner.Scan() {
+		if line := fileScanner.Text(); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	file.Close()
+	if err := fileScanner.Err(); err != nil {
+		core.GetLogger().Errorf("could not read %s: %s", fileName, err)
+		return err
+	}
+
+	for i, line := range lines {
+		var entry sqlBackupEntry
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&entry); err != nil {
+			core.GetLogger().Errorf("discarding bad line in %s: %s", fileName, err)
+			continue
+		}
+		for j := range entry.Args {
+			if number, ok := entry.Args[j].(json.Number); ok {
+				if intValue, err := number.Int64(); err == nil {
+					entry.Args[j] = intValue
+				}
+			}
+		}
+
+		if err := m.exec(entry.Query, entry.Args); err != nil {
+			core.GetLogger().Errorf("error replaying %s: %s", fileName, err)
+			// Keep the remaining statements
+			return os.WriteFile(fileName, []byte(strings.Join(lines[i:], "\n")+"\n"), 0770)
+		}
+	}
+
+	return os.Remove(fileName)
+}
+
+// Builds the key of the cache of Authorize results, which identifies unambiguously the queries and their parameters
+func sqlAuthorizeCacheKey(checkQuery string, checkArgs []interface{}, replyQuery string, replyArgs []interface{}) (string, error) {
+	key, err := json.Marshal([]interface{}{checkQuery, checkArgs, replyQuery, replyArgs})
+	if err != nil {
+		return "", fmt.Errorf("could not build cache key: %w", err)
+	}
+	return string(key), nil
+}
+
+// Returns the cached entry, if not expired
+func (m *SQLModule) getCached(key string) (sqlAuthorizeEntry, bool) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	entry, found := m.cache[key]
+	if !found {
+		return entry, false
+	}
+	if time.Now().After(entry.expiration) {
+		delete(m.cache, key)
+		return entry, false
+	}
+	return entry, true
+}
+
+// Stores an entry in the cache, removing the expired ones if the cache has grown
+func (m *SQLModule) setCached(key string, entry sqlAuthorizeEntry) {
+	m.cacheMutex.Lock()
+	defer m.cacheMutex.Unlock()
+
+	now := time.Now()
+	entry.expiration = now.Add(m.cacheTTL)
+	m.cache[key] = entry
+
+	if len(m.cache)%1000 == 0 {
+		for k, v := range m.cache {
+			if now.After(v.expiration) {
+				delete(m.cache, k)
+			}
+		}
+	}
+}
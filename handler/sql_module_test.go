@@ -0,0 +1,337 @@
+package handler
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+func TestSQLModuleAuthorize(t *testing.T) {
+
+	module, err := NewSQLModule("radiusSQLModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	testSQLDB.reset()
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "sqlUser")
+	checkItems, replyItems, err := module.Authorize(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkItems["Cleartext-Password"] != "thePassword" {
+		t.Errorf("bad check items %v", checkItems)
+	}
+	if len(replyItems) != 2 || replyItems[0].Name != "Class" || replyItems[0].GetString() != "theClass" || replyItems[1].GetInt() != 3600 {
+		t.Errorf("bad reply items %v", replyItems)
+	}
+
+	// The parameters are bound, not inserted in the query
+	if queries := testSQLDB.getQueries(); len(queries) != 2 || !strings.HasSuffix(queries[0], "UserName = ? [sqlUser]") {
+		t.Errorf("bad queries %v", queries)
+	}
+
+	// Second time is taken from the cache
+	checkItems["Cleartext-Password"] = "modified"
+	checkItems, _, _ = module.Authorize(request)
+	if len(testSQLDB.getQueries()) != 2 {
+		t.Errorf("authorize result not cached")
+	}
+	if checkItems["Cleartext-Password"] != "thePassword" {
+		t.Errorf("cached entry was modified")
+	}
+	module.FlushCache()
+	module.Authorize(request)
+	if len(testSQLDB.getQueries()) != 4 {
+		t.Errorf("cache not flushed")
+	}
+
+	// Unknown user
+	if _, _, err := module.Authorize(core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "unknownUser")); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("unknown user found: %v", err)
+	}
+}
+
+func TestSQLAuthorizeCacheKey(t *testing.T) {
+
+	// Would be the same if the parameters were just formatted
+	key1, err := sqlAuthorizeCacheKey("q ?", []interface{}{"a b"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := sqlAuthorizeCacheKey("q ?", []interface{}{"a", "b"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key3, err := sqlAuthorizeCacheKey("q ?", []interface{}{int64(1)}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key4, err := sqlAuthorizeCacheKey("q ?", []interface{}{"1"}, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key1 == key2 || key3 == key4 {
+		t.Errorf("ambiguous cache keys %s %s %s %s", key1, key2, key3, key4)
+	}
+}
+
+func TestSQLModuleAccounting(t *testing.T) {
+
+	module, err := NewSQLModule("radiusSQLModule.json", core.GetPolicyConfigInstance("testConfig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	testSQLDB.reset()
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "sqlUser")
+	if err := module.PostAuth(core.NewRadiusResponse(request, true)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, statusType := range []string{"Start", "Interim-Update", "Stop", "Accounting-On"} {
+		acct := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+			Add("User-Name", "sqlUser").
+			Add("Acct-Session-Id", "session-1").
+			Add("NAS-IP-Address", "127.0.0.1").
+			Add("Acct-Session-Time", 60).
+			Add("Acct-Status-Type", statusType)
+		if err := module.Accounting(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	statements := testSQLDB.getStatements()
+	if len(statements) != 4 {
+		t.Fatalf("bad number of statements %d: %v", len(statements), statements)
+	}
+	if !strings.Contains(statements[0], "'Access-Accept'") || !strings.HasPrefix(statements[0], "insert into radpostauth") {
+		t.Errorf("bad post-auth statement %s", statements[0])
+	}
+	if !strings.HasSuffix(statements[1], "[session-1 sqlUser 127.0.0.1]") {
+		t.Errorf("bad start statement %s", statements[1])
+	}
+	if !strings.HasSuffix(statements[2], "[60 session-1]") {
+		t.Errorf("bad interim statement %s", statements[2])
+	}
+	if !strings.HasPrefix(statements[3], "update radacct set AcctSessionTime = ?, AcctStopTime = ?") {
+		t.Errorf("bad stop statement %s", statements[3])
+	}
+}
+
+func TestSQLModuleBackup(t *testing.T) {
+
+	backupFileName := filepath.Join(t.TempDir(), "sql.backup")
+	module, err := NewSQLModuleWithConfig(SQLModuleConfig{
+		Driver:               "testSQLModule",
+		AccountingStartQuery: `insert into radacct (AcctSessionId, AcctSessionTime) values (${avp "Acct-Session-Id"}, ${intAVP "Acct-Session-Time"})`,
+		BackupFileName:       backupFileName,
+		BackupCheckSeconds:   1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer module.Close()
+
+	testSQLDB.reset()
+	testSQLDB.setFailing(true)
+
+	acct := core.NewRadiusRequest(core.ACCOUNTING_REQUEST).
+		Add("Acct-Session-Id", "session-1").
+		Add("Acct-Session-Time", 60).
+		Add("Acct-Status-Type", "Start")
+
+	// Written to the backup file, without error
+	for i := 0; i < 2; i++ {
+		if err := module.Accounting(acct); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(backupFileName); err != nil {
+		t.Fatalf("backup file not written: %s", err)
+	}
+
+	// After recovery, the backup file is renamed and replayed
+	testSQLDB.setFailing(false)
+	if err := module.Accounting(acct); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backupFileName); !os.IsNotExist(err) {
+		t.Errorf("backup file not renamed")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+
+	statements := testSQLDB.getStatements()
+	if len(statements) != 3 {
+		t.Fatalf("bad number of statements %d: %v", len(statements), statements)
+	}
+	for _, statement := range statements {
+		if !strings.HasSuffix(statement, "[session-1 60]") {
+			t.Errorf("bad statement %s", statement)
+		}
+	}
+	if files, _ := filepath.Glob(backupFileName + ".*.w"); len(files) != 0 {
+		t.Errorf("backup files not removed: %v", files)
+	}
+}
+
+func TestSQLModuleBadTemplate(t *testing.T) {
+	if _, err := NewSQLModuleWithConfig(SQLModuleConfig{Driver: "testSQLModule", PostAuthQuery: "insert ${avp"}); err == nil {
+		t.Errorf("bad template accepted")
+	}
+}
+
+// Helpers
+
+// In memory database that records the queries and statements, as text followed by the parameters,
+// and answers the radcheck and radreply queries for sqlUser
+type testSQLDatabase struct {
+	sync.Mutex
+	queries    []string
+	statements []string
+	failing    bool
+}
+
+var testSQLDB = &testSQLDatabase{}
+
+func (db *testSQLDatabase) reset() {
+	db.Lock()
+	defer db.Unlock()
+
+	db.queries = nil
+	db.statements = nil
+	db.failing = false
+}
+
+func (db *testSQLDatabase) setFailing(failing bool) {
+	db.Lock()
+	defer db.Unlock()
+
+	db.failing = failing
+}
+
+func (db *testSQLDatabase) getQueries() []string {
+	db.Lock()
+	defer db.Unlock()
+
+	return append([]string(nil), db.queries...)
+}
+
+func (db *testSQLDatabase) getStatements() []string {
+	db.Lock()
+	defer db.Unlock()
+
+	return append([]string(nil), db.statements...)
+}
+
+type testSQLDriver struct{}
+type testSQLConn struct{}
+type testSQLStmt struct {
+	query string
+}
+type testSQLRows struct {
+	values [][]driver.Value
+}
+type testSQLResult struct{}
+
+func init() {
+	sql.Register("testSQLModule", testSQLDriver{})
+}
+
+func (d testSQLDriver) Open(name string) (driver.Conn, error) {
+	return testSQLConn{}, nil
+}
+
+func (c testSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return testSQLStmt{query: query}, nil
+}
+
+func (c testSQLConn) Close() error {
+	return nil
+}
+
+func (c testSQLConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s testSQLStmt) Close() error {
+	return nil
+}
+
+func (s testSQLStmt) NumInput() int {
+	return -1
+}
+
+func (s testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	testSQLDB.Lock()
+	defer testSQLDB.Unlock()
+
+	if testSQLDB.failing {
+		return nil, errors.New("database unavailable")
+	}
+	testSQLDB.statements = append(testSQLDB.statements, s.query+" "+testSQLArgs(args))
+	return testSQLResult{}, nil
+}
+
+func (s testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	testSQLDB.Lock()
+	defer testSQLDB.Unlock()
+
+	if testSQLDB.failing {
+		return nil, errors.New("database unavailable")
+	}
+	testSQLDB.queries = append(testSQLDB.queries, s.query+" "+testSQLArgs(args))
+
+	if len(args) == 0 || args[0] != "sqlUser" {
+		return &testSQLRows{}, nil
+	}
+	if strings.Contains(s.query, "radcheck") {
+		return &testSQLRows{values: [][]driver.Value{{"Cleartext-Password", "thePassword"}}}, nil
+	}
+	return &testSQLRows{values: [][]driver.Value{{"Class", "theClass"}, {"Session-Timeout", "3600"}}}, nil
+}
+
+func (r *testSQLRows) Columns() []string {
+	return []string{"Attribute", "Value"}
+}
+
+func (r *testSQLRows) Close() error {
+	return nil
+}
+
+func (r *testSQLRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+func (r testSQLResult) LastInsertId() (int64, error) {
+	return 0, nil
+}
+
+func (r testSQLResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+// Formats the arguments as a list
+func testSQLArgs(args []driver.Value) string {
+	return fmt.Sprint(args)
+}
@@ -42,6 +42,15 @@ func (p Properties) String() string {
 	return sb.String()
 }
 
+// Returns a copy of the properties
+func (p Properties) copy() Properties {
+	c := make(Properties, len(p))
+	for k, v := range p {
+		c[k] = v
+	}
+	return c
+}
+
 type AVPItems []core.RadiusAVP
 
 // Merges Radius Items. The new with higher priority.
@@ -83,6 +92,17 @@ type RadiusUserFileEntry struct {
 	ReplyItems               AVPItems
 	NonOverridableReplyItems AVPItems
 	OOBReplyItems            AVPItems
+
+	// Check items with their operators, for entries parsed from FreeRADIUS users files. Those with
+	// comparison operators are evaluated against the request, and those with assignment operators
+	// are also in ConfigItems, as the control items of FreeRADIUS
+	CheckOperations []RadiusUserFileItem `json:",omitempty"`
+
+	// Operators of the ReplyItems, in the same order, for entries parsed from FreeRADIUS users files
+	ReplyOperators []string `json:",omitempty"`
+
+	// Whether the following matching entries are also processed
+	FallThrough bool `json:",omitempty"`
 }
 
 type RadiusUserFile map[string]RadiusUserFileEntry
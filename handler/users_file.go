@@ -0,0 +1,447 @@
+package handler
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/francistor/igor/core"
+)
+
+/////////////////////////////////////////////////////////////////////////////
+// FreeRADIUS users files, with entries of the form
+//
+// key	Check-Item == "value", Config-Item := value
+//		Reply-Item = value,
+//		Reply-Item += value,
+//		Fall-Through = Yes
+//
+// where key is a user name or DEFAULT. Entries are evaluated in order
+/////////////////////////////////////////////////////////////////////////////
+
+// Key of the entries that apply to all users
+const DefaultUsersFileKey = "DEFAULT"
+
+// Name of the pseudo-attribute that specifies that the next entries are also evaluated
+const fallThroughAttribute = "Fall-Through"
+
+// Operators, with the longer ones first for parsing
+var usersFileOperators = []string{":=", "==", "!=", "+=", "=~", "!~", ">=", "<=", "=*", "!*", "=", ">", "<"}
+
+// Operators that assign values, instead of comparing
+var usersFileAssignOperators = map[string]bool{"=": true, ":=": true, "+=": true}
+
+// Item of an entry, with its operator
+type RadiusUserFileItem struct {
+	Name     string
+	Operator string
+	Value    string
+
+	// For regular expression operators
+	regex *regexp.Regexp
+}
+
+// Entries of a FreeRADIUS users file, in order
+type RadiusUsersFile []RadiusUserFileEntry
+
+// Reads a FreeRADIUS users file from the configuration object
+func NewRadiusUsersFile(configObjectName string, ci *core.PolicyConfigurationManager) (RadiusUsersFile, error) {
+
+	// If we pass nil as last parameter, use the default
+	var myCi *core.PolicyConfigurationManager
+	if ci == nil {
+		myCi = core.GetPolicyConfig()
+	} else {
+		myCi = ci
+	}
+
+	contents, err := myCi.CM.GetBytesConfigObject(configObjectName)
+	if err != nil {
+		return RadiusUsersFile{}, err
+	}
+
+	return ParseRadiusUsersFile(string(contents))
+}
+
+// Parses the contents of a FreeRADIUS users file. Check items with assignment operators are also placed
+// in the ConfigItems, and those with == in the CheckItems. Reply items are parsed as radius attributes,
+// so they must be in the dictionary
+func ParseRadiusUsersFile(contents string) (RadiusUsersFile, error) {
+
+	usersFile := RadiusUsersFile{}
+
+	var entry *RadiusUserFileEntry
+	inReply := false
+
+	scanner := bufio.NewScanner(strings.NewReader(contents))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+
+		// Remove comments and skip empty lines
+		trimmed := strings.TrimSpace(stripUsersFileComment(line))
+		if trimmed == "" {
+			continue
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			// Start of an entry
+			if strings.HasPrefix(trimmed, "$") {
+				return nil, fmt.Errorf("line %d: directive %s not supported", lineNumber, strings.Fields(trimmed)[0])
+			}
+			if entry != nil {
+				usersFile = append(usersFile, *entry)
+			}
+
+			key, rest, err := parseUsersFileValue(trimmed)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry = &RadiusUserFileEntry{Key: key, CheckItems: Properties{}, ConfigItems: Properties{}}
+
+			items, err := parseUsersFileItems(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			for _, item := range items {
+				entry.CheckOperations = append(entry.CheckOperations, item)
+				if usersFileAssignOperators[item.Operator] {
+					if _, found := entry.ConfigItems[item.Name]; !found || item.Operator == ":=" {
+						entry.ConfigItems[item.Name] = item.Value
+					}
+				} else if item.Operator == "==" {
+					entry.CheckItems[item.Name] = item.Value
+				}
+			}
+			inReply = true
+			continue
+		}
+
+		// Reply items
+		if entry == nil {
+			return nil, fmt.Errorf("line %d: reply items without entry", lineNumber)
+		}
+		if !inReply {
+			return nil, fmt.Errorf("line %d: missing comma in previous line", lineNumber)
+		}
+		items, err := parseUsersFileItems(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		for _, item := range items {
+			if !usersFileAssignOperators[item.Operator] {
+				return nil, fmt.Errorf("line %d: operator %s not valid in reply item %s", lineNumber, item.Operator, item.Name)
+			}
+			if item.Name == fallThroughAttribute {
+				entry.FallThrough = strings.EqualFold(item.Value, "yes")
+				continue
+			}
+			avp, err := core.NewRadiusAVP(item.Name, usersFileAVPValue(item.Name, item.Value))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			entry.ReplyItems = append(entry.ReplyItems, *avp)
+			entry.ReplyOperators = append(entry.ReplyOperators, item.Operator)
+		}
+
+		// The reply items continue if the line ends with a comma
+		inReply = strings.HasSuffix(trimmed, ",")
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		usersFile = append(usersFile, *entry)
+	}
+
+	return usersFile, nil
+}
+
+// Returns the entries as a RadiusUserFile, keeping only the first entry for each key
+func (uf RadiusUsersFile) RadiusUserFile() RadiusUserFile {
+	ruf := RadiusUserFile{}
+	for _, entry := range uf {
+		if _, found := ruf[entry.Key]; !found {
+			ruf[entry.Key] = entry
+		}
+	}
+	return ruf
+}
+
+// Evaluates the entries against the request as FreeRADIUS does. The entries with the key equal to the
+// User-Name or DEFAULT, and whose check items match, are applied in order, until one is found without
+// Fall-Through. Returns the resulting config items and reply items, and whether any entry matched
+func (uf RadiusUsersFile) Match(request *core.RadiusPacket) (Properties, AVPItems, bool) {
+	userName := request.GetStringAVP("User-Name")
+
+	configItems := Properties{}
+	replyItems := AVPItems{}
+	matched := false
+
+	for i := range uf {
+		entry := &uf[i]
+		if entry.Key != DefaultUsersFileKey && entry.Key != userName {
+			continue
+		}
+		if !entry.MatchCheckItems(request) {
+			continue
+		}
+		matched = true
+
+		for _, item := range entry.CheckOperations {
+			switch item.Operator {
+			case ":=":
+				configItems[item.Name] = item.Value
+			case "=", "+=":
+				// Properties have a single value, so the first one is kept
+				if _, found := configItems[item.Name]; !found {
+					configItems[item.Name] = item.Value
+				}
+			}
+		}
+		for j, avp := range entry.ReplyItems {
+			replyItems = applyUsersFileOperator(replyItems, avp, entry.replyOperator(j))
+		}
+
+		if !entry.FallThrough {
+			break
+		}
+	}
+
+	return configItems, replyItems, matched
+}
+
+// Evaluates the check items with comparison operators against the request, as FreeRADIUS does.
+// The comparison is true if any of the instances of the attribute in the request satisfies it
+// and, except for !*, false if the attribute is not present
+func (e *RadiusUserFileEntry) MatchCheckItems(request *core.RadiusPacket) bool {
+	for _, item := range e.CheckOperations {
+		if usersFileAssignOperators[item.Operator] {
+			continue
+		}
+
+		avps := request.GetAllAVP(item.Name)
+		switch item.Operator {
+		case "=*":
+			if len(avps) == 0 {
+				return false
+			}
+			continue
+		case "!*":
+			if len(avps) > 0 {
+				return false
+			}
+			continue
+		}
+
+		found := false
+		for i := range avps {
+			if item.compare(&avps[i]) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Returns the operator of the reply item, which is = if not specified
+func (e *RadiusUserFileEntry) replyOperator(i int) string {
+	if i < len(e.ReplyOperators) {
+		return e.ReplyOperators[i]
+	}
+	return "="
+}
+
+// Compares the value of the attribute of the request with the item
+func (item *RadiusUserFileItem) compare(avp *core.RadiusAVP) bool {
+	if item.Operator == "=~" || item.Operator == "!~" {
+		// Not compiled if the item was not parsed from a file
+		regex := item.regex
+		if regex == nil {
+			var err error
+			if regex, err = regexp.Compile(item.Value); err != nil {
+				return false
+			}
+		}
+		return regex.MatchString(avp.GetString()) == (item.Operator == "=~")
+	}
+
+	// Integers are compared as numbers, converting the names of the values if needed
+	var cmp int
+	switch avp.DictItem.RadiusType {
+	case core.RadiusTypeInteger, core.RadiusTypeInteger64, core.RadiusTypeByte, core.RadiusTypeShort, core.RadiusTypeSigned:
+		checkAVP, err := core.NewRadiusAVP(item.Name, item.Value)
+		if err != nil {
+			return false
+		}
+		a, b := avp.GetInt(), checkAVP.GetInt()
+		switch {
+		case a < b:
+			cmp = -1
+		case a > b:
+			cmp = 1
+		}
+	default:
+		cmp = strings.Compare(avp.GetString(), usersFileAVPValue(item.Name, item.Value))
+	}
+
+	switch item.Operator {
+	case "==":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return false
+}
+
+// Adds the attribute to the list as specified by the operator: = adds it if not present, := replaces
+// the existing ones and += always adds it
+func applyUsersFileOperator(items AVPItems, avp core.RadiusAVP, operator string) AVPItems {
+	switch operator {
+	case ":=":
+		filtered := items[:0]
+		for _, item := range items {
+			if item.Name != avp.Name {
+				filtered = append(filtered, item)
+			}
+		}
+		return append(filtered, avp)
+	case "+=":
+		return append(items, avp)
+	default:
+		for _, item := range items {
+			if item.Name == avp.Name {
+				return items
+			}
+		}
+		return append(items, avp)
+	}
+}
+
+// Parses a comma separated list of items. A trailing comma is allowed
+func parseUsersFileItems(text string) ([]RadiusUserFileItem, error) {
+	var items []RadiusUserFileItem
+
+	rest := strings.TrimSpace(text)
+	for rest != "" {
+		// Name
+		end := strings.IndexAny(rest, " \t=!:+<>~*")
+		if end <= 0 {
+			return nil, fmt.Errorf("bad item %q", rest)
+		}
+		item := RadiusUserFileItem{Name: rest[:end]}
+		rest = strings.TrimLeft(rest[end:], " \t")
+
+		// Operator
+		for _, op := range usersFileOperators {
+			if strings.HasPrefix(rest, op) {
+				item.Operator = op
+				break
+			}
+		}
+		if item.Operator == "" {
+			return nil, fmt.Errorf("missing operator for %s", item.Name)
+		}
+		rest = strings.TrimLeft(rest[len(item.Operator):], " \t")
+
+		// Value
+		var err error
+		if item.Value, rest, err = parseUsersFileValue(rest); err != nil {
+			return nil, fmt.Errorf("bad value for %s: %w", item.Name, err)
+		}
+		if item.Operator == "=~" || item.Operator == "!~" {
+			if item.regex, err = regexp.Compile(item.Value); err != nil {
+				return nil, fmt.Errorf("bad regular expression for %s: %w", item.Name, err)
+			}
+		}
+		items = append(items, item)
+
+		// Separator
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+		if rest[0] != ',' {
+			return nil, fmt.Errorf("missing comma after %s", item.Name)
+		}
+		rest = strings.TrimLeft(rest[1:], " \t")
+	}
+
+	return items, nil
+}
+
+// Parses a value, which may be quoted with double quotes, or delimited with slashes for regular
+// expressions. Returns the value and the rest of the text
+func parseUsersFileValue(text string) (string, string, error) {
+	if text == "" {
+		return "", "", fmt.Errorf("missing value")
+	}
+
+	if text[0] == '"' || text[0] == '/' {
+		delimiter := text[0]
+		var sb strings.Builder
+		for i := 1; i < len(text); i++ {
+			switch {
+			case text[i] == '\\' && i+1 < len(text):
+				i++
+				if delimiter == '/' && text[i] != '/' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteByte(text[i])
+			case text[i] == delimiter:
+				return sb.String(), text[i+1:], nil
+			default:
+				sb.WriteByte(text[i])
+			}
+		}
+		return "", "", fmt.Errorf("unterminated value %s", text)
+	}
+
+	end := strings.IndexAny(text, " \t,")
+	if end < 0 {
+		return text, "", nil
+	}
+	return text[:end], text[end:], nil
+}
+
+// Removes the comment from the line, if the # is not inside a quoted value
+func stripUsersFileComment(line string) string {
+	inQuotes := false
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuotes = !inQuotes
+		case '#':
+			if !inQuotes {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// FreeRADIUS writes octets as 0x<hex>, while igor does not use the prefix
+func usersFileAVPValue(name string, value string) string {
+	if di, err := core.GetRDict().GetFromName(name); err == nil && di.RadiusType == core.RadiusTypeOctets {
+		return strings.TrimPrefix(strings.TrimPrefix(value, "0x"), "0X")
+	}
+	return value
+}
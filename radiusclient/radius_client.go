@@ -1,7 +1,10 @@
 package radiusclient
 
 import (
+	"crypto/tls"
 	"fmt"
+	"net"
+	"strconv"
 	"sync"
 	"time"
 
@@ -29,6 +32,9 @@ type ClientRadiusRequestMsg struct {
 	// Where to send the message to
 	endpoint string
 
+	// Origin address. Empty if unspecified
+	originAddress string
+
 	// Origin port. 0 if unspecified
 	originPort int
 
@@ -47,6 +53,12 @@ type ClientRadiusRequestMsg struct {
 	// The secret shared with the endpoint
 	secret string
 
+	// Check to perform on the Message-Authenticator of the response
+	messageAuthenticatorPolicy string
+
+	// "udp", "tcp" or "radsec". Empty is treated as "udp"
+	transport string
+
 	// The channel on which the response to this request must be sent
 	rchan chan interface{}
 }
@@ -55,7 +67,9 @@ type ClientRadiusRequestMsg struct {
 //
 // Presents a method for sending requests to upstreams servers
 // Maintains a set of RadiusClientSockets that own the UDP socket and actually send the requests and receive the answers
-// The RadiusClientSockets are created on demand. It is the RadiusRouter which is in control of the origin port used
+// The RadiusClientSockets are created on demand. It is the RadiusRouter which is in control of the origin address and port used
+// For TCP and RadSec, maintains a set of RadiusClientConnections, one per transport and destination endpoint, also
+// created on demand
 type RadiusClient struct {
 
 	// Receives events from the RadiusClientSockets and from the external world
@@ -67,8 +81,18 @@ type RadiusClient struct {
 	// To signal termination
 	doneChannel chan interface{}
 
-	// Map of created RadiusClientSockets by origin port
-	clientSockets map[int]*RadiusClientSocket
+	// Map of created RadiusClientSockets by origin address and port
+	clientSockets map[string]*RadiusClientSocket
+
+	// Map of created RadiusClientConnections by transport and endpoint
+	clientConnections map[string]*RadiusClientConnection
+
+	// Configuration instance whose radius server configuration holds the certificates for RadSec.
+	// If nil, the default instance is used
+	ci *core.PolicyConfigurationManager
+
+	// For RadSec connections. Created when first needed
+	tlsConfig *tls.Config
 
 	// Status may be StatusTerminated
 	status int32
@@ -78,14 +102,23 @@ type RadiusClient struct {
 	wg sync.WaitGroup
 }
 
-// Creates a new instance of the Radius Client
+// Creates a new instance of the Radius Client, using the default configuration instance
 func NewRadiusClient() *RadiusClient {
+	return NewRadiusClientWithConfig(nil)
+}
+
+// Creates a new instance of the Radius Client, taking the RadSec certificates from the radius
+// server configuration of the specified configuration instance
+func NewRadiusClientWithConfig(ci *core.PolicyConfigurationManager) *RadiusClient {
 
 	rc := RadiusClient{
+		ci:              ci,
 		controlChannel:  make(chan interface{}, CONTROL_QUEUE_SIZE),
 		requestsChannel: make(chan interface{}, REQUESTS_QUEUE_SIZE),
 		doneChannel:     make(chan interface{}, 1),
-		clientSockets:   make(map[int]*RadiusClientSocket),
+		clientSockets:   make(map[string]*RadiusClientSocket),
+
+		clientConnections: make(map[string]*RadiusClientConnection),
 	}
 
 	go rc.eventLoop()
@@ -131,30 +164,53 @@ func (r *RadiusClient) eventLoop() {
 			case SocketDownEvent:
 				// Close and delete from map
 				rcs := v.Sender
-				delete(r.clientSockets, rcs.port)
+				key := socketKey(rcs.bindAddress, rcs.port)
+				if r.clientSockets[key] == rcs {
+					delete(r.clientSockets, key)
+				}
 
 				// While the socket is closed, another one may be created and assigned to the map
 				go v.Sender.Close()
 
 				// Check if we are completely finished
-				if r.status == StatusTerminated && len(r.clientSockets) == 0 {
+				if r.status == StatusTerminated && len(r.clientSockets) == 0 && len(r.clientConnections) == 0 {
 					core.GetLogger().Info("last socket -> radius client closed")
 					close(r.doneChannel)
 				}
 
+			// RadiusClientConnection reported it is down
+			case ConnectionDownEvent:
+				// Close and delete from map
+				rcc := v.Sender
+				key := connectionKey(rcc.transport, rcc.endpoint)
+				if r.clientConnections[key] == rcc {
+					delete(r.clientConnections, key)
+				}
+
+				go rcc.Close()
+
+				// Check if we are completely finished
+				if r.status == StatusTerminated && len(r.clientSockets) == 0 && len(r.clientConnections) == 0 {
+					core.GetLogger().Info("last connection -> radius client closed")
+					close(r.doneChannel)
+				}
+
 			case SetDownCommandMsg:
 				// Signal that we are done and no more requests will be processed
 				r.status = StatusTerminated
 
 				// If no clients, we are done
-				if len(r.clientSockets) == 0 {
+				if len(r.clientSockets) == 0 && len(r.clientConnections) == 0 {
 					core.GetLogger().Info("no sockets -> radius client closed")
 					close(r.doneChannel)
 				} else {
-					// Terminate all radius client sockets. Will terminate when all sockets are down
+					// Terminate all radius client sockets and connections. Will terminate when all are down
 					for i := range r.clientSockets {
 						r.clientSockets[i].SetDown()
 					}
+					for i := range r.clientConnections {
+						r.clientConnections[i].SetDown()
+					}
 				}
 
 			default:
@@ -176,16 +232,66 @@ func (r *RadiusClient) eventLoop() {
 					continue
 				}
 
-				// Check if there is a RadiusClientSocket and create it otherwise
-				var rcs *RadiusClientSocket
-				var found bool
-				if rcs, found = r.clientSockets[v.originPort]; !found {
-					rcs = NewRadiusClientSocket(r.controlChannel, core.GetPolicyConfig().RadiusServerConf().BindAddress, v.originPort)
-					r.clientSockets[v.originPort] = rcs
-				}
+				switch v.transport {
+				case "", core.RadiusTransportUDP:
+					// Check if there is a RadiusClientSocket and create it otherwise
+					var rcs *RadiusClientSocket
+					var found bool
+					key := socketKey(v.originAddress, v.originPort)
+					if rcs, found = r.clientSockets[key]; !found {
+						rcs = NewRadiusClientSocket(r.controlChannel, v.originAddress, v.originPort)
+						r.clientSockets[key] = rcs
+					}
 
-				// Invoke the operation
-				rcs.SendRadiusRequest(v)
+					// Invoke the operation
+					rcs.SendRadiusRequest(v)
+
+				case core.RadiusTransportTCP:
+					// Check if there is a RadiusClientConnection and create it otherwise
+					key := connectionKey(v.transport, v.endpoint)
+					var rcc *RadiusClientConnection
+					var found bool
+					if rcc, found = r.clientConnections[key]; !found {
+						rcc = NewRadiusTCPClientConnection(r.controlChannel, v.endpoint)
+						r.clientConnections[key] = rcc
+					}
+
+					// Invoke the operation
+					rcc.SendRadiusRequest(v)
+
+				case core.RadiusTransportRadSec:
+					// Check if there is a RadiusClientConnection and create it otherwise
+					key := connectionKey(v.transport, v.endpoint)
+					var rcc *RadiusClientConnection
+					var found bool
+					if rcc, found = r.clientConnections[key]; !found {
+						if r.tlsConfig == nil {
+							ci := r.ci
+							if ci == nil {
+								ci = core.GetPolicyConfig()
+							}
+							conf := ci.RadiusServerConf()
+							tlsConfig, err := core.NewRadSecTLSConfig(conf.RadSecCertFile, conf.RadSecKeyFile, conf.RadSecCAFile, false)
+							if err != nil {
+								core.GetLogger().Errorf("could not build RadSec configuration: %s", err)
+								v.rchan <- err
+								close(v.rchan)
+								r.wg.Done()
+								continue
+							}
+							r.tlsConfig = tlsConfig
+						}
+						rcc = NewRadSecClientConnection(r.controlChannel, v.endpoint, r.tlsConfig)
+						r.clientConnections[key] = rcc
+					}
+
+					// Invoke the operation
+					rcc.SendRadiusRequest(v)
+
+				default:
+					v.rchan <- fmt.Errorf("unknown radius transport %s", v.transport)
+					close(v.rchan)
+				}
 
 				// Corresponding to the Add(1) in RadiusExchange
 				r.wg.Done()
@@ -194,20 +300,68 @@ func (r *RadiusClient) eventLoop() {
 	}
 }
 
+// Parameters for sending a radius request
+type RadiusExchangeOptions struct {
+	// The source IP address to use, IPv4 or IPv6. If empty, the socket is bound to all addresses.
+	// Ignored for TCP and RadSec
+	OriginAddress string
+
+	// The source port to use. Ignored for TCP and RadSec
+	OriginPort int
+
+	// Time to wait for the response to each try
+	Timeout time.Duration
+
+	// Number of times the request is sent
+	ServerTries int
+
+	// The secret shared with the endpoint. Ignored for RadSec
+	Secret string
+
+	// The check to perform on the Message-Authenticator of the response. May be one of
+	// core.MessageAuthenticatorRequire, core.MessageAuthenticatorValidateIfPresent (if empty)
+	// or core.MessageAuthenticatorIgnore
+	MessageAuthenticatorPolicy string
+
+	// May be core.RadiusTransportUDP (if empty), core.RadiusTransportTCP or core.RadiusTransportRadSec
+	Transport string
+}
+
 // Send the radius packet to the target socket and receive the answer or error in the specified channel
+// The packet is sent over UDP, and the Message-Authenticator of the response is validated if present
 func (r *RadiusClient) RadiusExchange(endpoint string, originPort int, packet *core.RadiusPacket, timeout time.Duration, serverTries int, secret string, rchan chan interface{}) {
+	r.RadiusExchangeWithOptions(endpoint, packet, RadiusExchangeOptions{OriginPort: originPort, Timeout: timeout, ServerTries: serverTries, Secret: secret}, rchan)
+}
+
+// Send the radius packet to the target socket and receive the answer or error in the specified channel,
+// using the specified options
+func (r *RadiusClient) RadiusExchangeWithOptions(endpoint string, packet *core.RadiusPacket, options RadiusExchangeOptions, rchan chan interface{}) {
 
 	// Will be Done() after processing the message
 	r.wg.Add(1)
 
 	// Send myself the message
 	r.requestsChannel <- ClientRadiusRequestMsg{
-		endpoint:    endpoint,
-		originPort:  originPort,
-		packet:      packet,
-		timeout:     timeout,
-		serverTries: serverTries,
-		secret:      secret,
-		rchan:       rchan,
+		endpoint:      endpoint,
+		originAddress: options.OriginAddress,
+		originPort:    options.OriginPort,
+		packet:        packet,
+		timeout:       options.Timeout,
+		serverTries:   options.ServerTries,
+		secret:        options.Secret,
+		rchan:         rchan,
+
+		messageAuthenticatorPolicy: options.MessageAuthenticatorPolicy,
+		transport:                  options.Transport,
 	}
 }
+
+// Key of the RadiusClientSockets map
+func socketKey(originAddress string, originPort int) string {
+	return net.JoinHostPort(originAddress, strconv.Itoa(originPort))
+}
+
+// Key of the RadiusClientConnections map
+func connectionKey(transport string, endpoint string) string {
+	return transport + "/" + endpoint
+}
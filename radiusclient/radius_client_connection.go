@@ -0,0 +1,493 @@
+package radiusclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Maximum time to wait for a connection to be established
+const CONNECTION_TIMEOUT = 5 * time.Second
+
+// Packets waiting to be written to the connection. If the queue is full, the request fails
+const WRITER_QUEUE_SIZE = 1000
+
+// Sent to the parent RadiusClient when the connection and the eventloop are terminated, due
+// to a request or an error. The RadiusClient can then invoke the Close() command
+type ConnectionDownEvent struct {
+	// Myself
+	Sender *RadiusClientConnection
+
+	// Will be nil if the reason is not an error
+	Error error
+}
+
+//////////////////////////////////////////////////////////////////////////////
+// Eventloop messages
+//////////////////////////////////////////////////////////////////////////////
+
+// Sent to the eventLoop when the connection has been established
+type ConnectionEstablishedMsg struct {
+	connection net.Conn
+}
+
+// Sent to the eventLoop when the connection could not be established
+type ConnectionErrorMsg struct {
+	Error error
+}
+
+// The readLoop sends this message to the eventLoop when a packet has been received
+type ConnectionResponseMsg struct {
+	packetBytes []byte
+}
+
+// The writeLoop sends this message to the eventLoop when a packet could not be written
+type WriteErrorMsg struct {
+	Error error
+}
+
+// Packet to be written to the connection by the writeLoop
+type writerItem struct {
+	packetBytes []byte
+
+	// Maximum time to wait for the packet to be written
+	timeout time.Duration
+}
+
+//////////////////////////////////////////////////////////////////////////////////
+
+// RadiusClientConnection
+// Manages a single connection to an upstream server using a stream transport, that is, TCP (RFC 6613) or RadSec (RFC 6614)
+// The connection is established when created, and kept open until an error occurs or the RadiusClient is
+// set down. Requests received while connecting are queued.
+// There are no retransmissions in stream transports. The request is cancelled if not answered after the
+// timeout multiplied by the number of serverTries.
+type RadiusClientConnection struct {
+
+	// <ipaddress>:<port> of the upstream server
+	endpoint string
+
+	// core.RadiusTransportTCP or core.RadiusTransportRadSec
+	transport string
+
+	// Outstanding requests, indexed by radius identifier
+	requestsMap map[byte]RequestContext
+
+	// Last assigned radius id. Used as a hint for optimization when finding a new id to use
+	lastRadiusId byte
+
+	// Requests received before the connection is established
+	pendingRequests []ClientRadiusRequestMsg
+
+	// The connection. nil until established
+	connection net.Conn
+
+	// Created iternally. This is for the Actor model loop
+	eventLoopChannel chan interface{}
+
+	// Created internaly, for synchronizing the event and read loops
+	readLoopDoneChannel chan bool
+
+	// Packets to be written by the writeLoop. Created when the connection is established,
+	// and closed by the eventLoop when terminating
+	writerChannel chan writerItem
+
+	// Closed by the writeLoop when exiting
+	writeLoopDoneChannel chan bool
+
+	// Passed as parameter. To report events back to the RadiusClient
+	controlChannel chan interface{}
+
+	// Wait group to be used on each goroutine launched, to make sure that
+	// the eventloop channel is not used after being closed
+	wg sync.WaitGroup
+
+	// StatusTerminated if we should close gracefully
+	status int32
+}
+
+// Creation function. Starts connecting to the endpoint using TCP
+func NewRadiusTCPClientConnection(controlChannel chan interface{}, endpoint string) *RadiusClientConnection {
+	return newRadiusClientConnection(controlChannel, endpoint, core.RadiusTransportTCP, &net.Dialer{Timeout: CONNECTION_TIMEOUT})
+}
+
+// Creation function. Starts connecting to the endpoint using TLS
+func NewRadSecClientConnection(controlChannel chan interface{}, endpoint string, tlsConfig *tls.Config) *RadiusClientConnection {
+	dialer := tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: CONNECTION_TIMEOUT},
+		Config:    tlsConfig,
+	}
+	return newRadiusClientConnection(controlChannel, endpoint, core.RadiusTransportRadSec, &dialer)
+}
+
+// Helper for the creation functions, which specify the dialer to use
+func newRadiusClientConnection(controlChannel chan interface{}, endpoint string, transport string, dialer interface {
+	Dial(network string, address string) (net.Conn, error)
+}) *RadiusClientConnection {
+
+	rcc := RadiusClientConnection{
+		endpoint:             endpoint,
+		transport:            transport,
+		requestsMap:          make(map[byte]RequestContext),
+		eventLoopChannel:     make(chan interface{}, EVENTLOOP_CAPACITY),
+		readLoopDoneChannel:  make(chan bool, 1),
+		writeLoopDoneChannel: make(chan bool, 1),
+		controlChannel:       controlChannel,
+	}
+
+	go rcc.eventLoop()
+
+	rcc.wg.Add(1)
+	go func() {
+		defer rcc.wg.Done()
+
+		connection, err := dialer.Dial("tcp", endpoint)
+		if err != nil {
+			rcc.eventLoopChannel <- ConnectionErrorMsg{err}
+		} else {
+			rcc.eventLoopChannel <- ConnectionEstablishedMsg{connection}
+		}
+	}()
+
+	return &rcc
+}
+
+// Starts the closing process
+func (rcc *RadiusClientConnection) SetDown() {
+	core.GetLogger().Debugf("client connection to %s terminating", rcc.endpoint)
+
+	rcc.eventLoopChannel <- SetDownCommandMsg{}
+}
+
+// Closes the event loop channel
+// Use this method only after a ConnectionDownEvent has been received
+func (rcc *RadiusClientConnection) Close() {
+
+	// Wait until the connection attempt and all outstanding requests finish
+	rcc.wg.Wait()
+
+	// Wait for the readLoop and writeLoop to stop. The channels are closed without starting
+	// the loops if the connection was not established
+	<-rcc.readLoopDoneChannel
+	<-rcc.writeLoopDoneChannel
+
+	// Terminate the event loop
+	rcc.eventLoopChannel <- ClientCloseCommand{}
+
+	close(rcc.eventLoopChannel)
+
+	core.GetLogger().Debugf("RadiusClientConnection closed")
+}
+
+// Actor model event loop. All interaction with RadiusClientConnection takes place by
+// sending messages which are processed here
+func (rcc *RadiusClientConnection) eventLoop() {
+
+	// Whether the ConnectionDownEvent has already been sent
+	isDown := false
+
+	// Finishes all the requests, closes the connection and reports to the RadiusClient
+	setDown := func(err error) {
+		if isDown {
+			return
+		}
+		isDown = true
+
+		atomic.StoreInt32(&rcc.status, StatusTerminated)
+
+		if rcc.connection != nil {
+			// The pending packets are discarded, since the requests are cancelled below
+			rcc.connection.Close()
+			close(rcc.writerChannel)
+		} else {
+			close(rcc.readLoopDoneChannel)
+			close(rcc.writeLoopDoneChannel)
+		}
+
+		// Terminate the outsanding requests
+		rcc.cancelAll()
+
+		// Tell the radiusclient we are down
+		rcc.controlChannel <- ConnectionDownEvent{Sender: rcc, Error: err}
+	}
+
+	for {
+
+		in := <-rcc.eventLoopChannel
+
+		switch v := in.(type) {
+
+		case ClientCloseCommand:
+
+			// Terminate the event loop
+			return
+
+		case ConnectionEstablishedMsg:
+
+			if isDown {
+				// Set down while connecting
+				v.connection.Close()
+				continue
+			}
+
+			core.GetLogger().Debugf("connected to %s", rcc.endpoint)
+
+			rcc.connection = v.connection
+			rcc.writerChannel = make(chan writerItem, WRITER_QUEUE_SIZE)
+			go rcc.readLoop(rcc.connection, rcc.readLoopDoneChannel)
+			go rcc.writeLoop(rcc.connection, rcc.writerChannel, rcc.writeLoopDoneChannel)
+
+			// Send the queued requests
+			for _, request := range rcc.pendingRequests {
+				rcc.sendRequest(request)
+			}
+			rcc.pendingRequests = nil
+
+		case ConnectionErrorMsg:
+
+			core.GetLogger().Errorf("could not connect to %s: %s", rcc.endpoint, v.Error)
+			setDown(v.Error)
+
+		case ReadErrorMsg:
+
+			setDown(v.Error)
+
+		case WriteErrorMsg:
+
+			core.GetLogger().Errorf("error writing packet to %s: %s", rcc.endpoint, v.Error)
+			setDown(v.Error)
+
+		case SetDownCommandMsg:
+
+			setDown(nil)
+
+			// Received message in the connection. Sent by the readLoop
+		case ConnectionResponseMsg:
+
+			radiusId := v.packetBytes[1]
+			if requestContext, ok := rcc.requestsMap[radiusId]; !ok {
+				core.RecordRadiusClientResponseStalled(rcc.endpoint, strconv.Itoa(int(v.packetBytes[0])))
+				core.GetLogger().Debugf("unsolicited or stalled response from endpoint %s and id %d", rcc.endpoint, radiusId)
+				continue
+			} else {
+
+				// Cancel timer
+				if requestContext.timer.Stop() {
+					// The after func has not been called
+					rcc.wg.Done()
+				}
+
+				// Remove from outstanding requests
+				delete(rcc.requestsMap, radiusId)
+
+				// Send the answer or error to the requester
+				requestContext.rchan <- decodeResponse(rcc.endpoint, v.packetBytes, requestContext)
+				close(requestContext.rchan)
+			}
+
+		case ClientRadiusRequestMsg:
+
+			if isDown {
+				v.rchan <- fmt.Errorf("connection to %s is down", rcc.endpoint)
+				close(v.rchan)
+			} else if rcc.connection == nil {
+				rcc.pendingRequests = append(rcc.pendingRequests, v)
+			} else {
+				rcc.sendRequest(v)
+			}
+
+			// Corresponding to the Add(1) in SendRadiusRequest
+			rcc.wg.Done()
+
+		case CancelRequestMsg:
+
+			if reqCtx, found := rcc.requestsMap[v.radiusId]; !found {
+				core.GetLogger().Debugf("tried to cancel not existing request %s:%d", rcc.endpoint, v.radiusId)
+				continue
+			} else {
+				reqCtx.rchan <- v.reason
+				close(reqCtx.rchan)
+				delete(rcc.requestsMap, v.radiusId)
+			}
+		}
+	}
+}
+
+// Queues the request to be written to the connection and registers it in the requests map.
+// To be executed in the event loop, with the connection established
+func (rcc *RadiusClientConnection) sendRequest(request ClientRadiusRequestMsg) {
+
+	radiusId, err := rcc.getNextRadiusId()
+	if err != nil {
+		core.GetLogger().Errorf("could not get an id: %s", err)
+		request.rchan <- err
+		close(request.rchan)
+		return
+	}
+
+	// For RadSec, the secret is fixed
+	secret := request.secret
+	if rcc.transport == core.RadiusTransportRadSec {
+		secret = core.RADSEC_SECRET
+	}
+
+	packetBytes, err := request.packet.ToBytes(secret, radiusId)
+	if err != nil {
+		core.GetLogger().Errorf("error marshaling packet: %s", err)
+		request.rchan <- err
+		close(request.rchan)
+		return
+	}
+
+	// The writeLoop will report a WriteErrorMsg if unsuccessful
+	select {
+	case rcc.writerChannel <- writerItem{packetBytes: packetBytes, timeout: request.timeout}:
+	default:
+		core.GetLogger().Errorf("write queue to %s is full", rcc.endpoint)
+		request.rchan <- fmt.Errorf("write queue to %s is full", rcc.endpoint)
+		close(request.rchan)
+		return
+	}
+
+	// No retransmissions. Wait for all the serverTries
+	serverTries := request.serverTries
+	if serverTries < 1 {
+		serverTries = 1
+	}
+
+	// For the timer to be created below
+	rcc.wg.Add(1)
+
+	rcc.requestsMap[radiusId] = RequestContext{
+		rchan: request.rchan,
+		timer: time.AfterFunc(request.timeout*time.Duration(serverTries), func() {
+			// This will be called if the timer expires
+			defer rcc.wg.Done()
+			rcc.eventLoopChannel <- CancelRequestMsg{endpoint: rcc.endpoint, radiusId: radiusId, reason: fmt.Errorf("timeout")}
+			core.RecordRadiusClientTimeout(rcc.endpoint, strconv.Itoa(int(request.packet.Code)))
+		}),
+		secret: secret,
+		// The authenticator generated by ToBytes, in the header of the packet
+		authenticator:              *(*[16]byte)(packetBytes[4:20]),
+		messageAuthenticatorPolicy: request.messageAuthenticatorPolicy,
+	}
+
+	core.RecordRadiusClientRequest(rcc.endpoint, strconv.Itoa(int(request.packet.Code)))
+	core.GetLogger().Debugf("-> Client sent RadiusPacket with Identifier %d - %s\n", radiusId, request.packet)
+}
+
+// Loop for receiving answer messages
+func (rcc *RadiusClientConnection) readLoop(connection net.Conn, ch chan bool) {
+
+	for {
+		packetBytes, err := core.ReadRadiusPacketBytes(connection)
+		if err != nil {
+			if atomic.LoadInt32(&rcc.status) != StatusTerminated {
+				// Unexpected error
+				rcc.eventLoopChannel <- ReadErrorMsg{err}
+			}
+			break
+		}
+
+		rcc.eventLoopChannel <- ConnectionResponseMsg{packetBytes: packetBytes}
+	}
+
+	// Signal that we are finished
+	close(ch)
+}
+
+// Writer of the packets
+// To be executed in a goroutine, so that a slow server does not block the eventLoop.
+// After a write error, which is reported to the eventLoop, the rest of packets are discarded.
+// Should not touch inner variables
+func (rcc *RadiusClientConnection) writeLoop(connection net.Conn, writerChannel chan writerItem, ch chan bool) {
+
+	var writeError error
+	for item := range writerChannel {
+
+		// Discard if the connection is broken
+		if writeError != nil {
+			continue
+		}
+
+		connection.SetWriteDeadline(time.Now().Add(item.timeout))
+		if _, writeError = connection.Write(item.packetBytes); writeError != nil {
+			if atomic.LoadInt32(&rcc.status) != StatusTerminated {
+				// Unexpected error
+				rcc.eventLoopChannel <- WriteErrorMsg{writeError}
+			}
+		}
+	}
+
+	// Signal that we are finished
+	close(ch)
+}
+
+// Sends a Radius request and gets the answer or error as a message to the specified channel.
+// The response channel is closed just after sending the reponse or error
+func (rcc *RadiusClientConnection) SendRadiusRequest(request ClientRadiusRequestMsg) {
+	if cap(request.rchan) < 1 {
+		panic("using an unbuffered response channel")
+	}
+
+	code := request.packet.Code
+	if !request.packet.IsRequest() {
+		request.rchan <- fmt.Errorf("code is not for request, but %d", code)
+		close(request.rchan)
+		return
+	}
+
+	// Make sure the message is processed
+	rcc.wg.Add(1)
+	// Send myself the message
+	rcc.eventLoopChannel <- request
+}
+
+// Gets the next radiusid to use, or error if all are busy
+// Id 0 is never allocated
+func (rcc *RadiusClientConnection) getNextRadiusId() (byte, error) {
+
+	nextId := rcc.lastRadiusId
+	for i := 0; i < 255; i++ {
+		if nextId == 255 {
+			nextId = 1
+		} else {
+			nextId = nextId + 1
+		}
+		if _, ok := rcc.requestsMap[nextId]; !ok {
+			rcc.lastRadiusId = nextId
+			return nextId, nil
+		}
+	}
+
+	return 0, fmt.Errorf("exhausted ids for endpoint %s", rcc.endpoint)
+}
+
+// Cancells all outstanding and pending requests
+func (rcc *RadiusClientConnection) cancelAll() {
+	for rid, requestContext := range rcc.requestsMap {
+
+		// Cancel timer
+		if requestContext.timer.Stop() {
+			// The after func has not been called
+			rcc.wg.Done()
+		}
+
+		// Send the error
+		requestContext.rchan <- fmt.Errorf("request cancelled due to connection down")
+		close(requestContext.rchan)
+		delete(rcc.requestsMap, rid)
+	}
+
+	for _, request := range rcc.pendingRequests {
+		request.rchan <- fmt.Errorf("request cancelled due to connection down")
+		close(request.rchan)
+	}
+	rcc.pendingRequests = nil
+}
@@ -73,6 +73,9 @@ type RequestContext struct {
 
 	// Authenticator
 	authenticator [16]byte
+
+	// Check to perform on the Message-Authenticator of the response
+	messageAuthenticatorPolicy string
 }
 
 // RadiusClientSocket
@@ -82,8 +85,9 @@ type RequestContext struct {
 // authenticator and timer, in order to match requests with answers.
 type RadiusClientSocket struct {
 
-	// The port used
-	port int
+	// The address and port used. The address may be empty, meaning all the local addresses
+	bindAddress string
+	port        int
 
 	// Outstanding requests
 	// Nested map. First keyed by destination endpoint (ipaddress:port) and then by radius identifier
@@ -117,15 +121,17 @@ type RadiusClientSocket struct {
 }
 
 // Creation function
+// The bindAddress may be IPv4 or IPv6. If empty, the socket is bound to all the IPv4 and IPv6 addresses
 func NewRadiusClientSocket(controlChannel chan interface{}, bindAddress string, originPort int) *RadiusClientSocket {
 
 	// Bind socket
-	socket, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", bindAddress, originPort))
+	socket, err := net.ListenPacket("udp", net.JoinHostPort(bindAddress, strconv.Itoa(originPort)))
 	if err != nil {
 		panic(fmt.Sprintf("could not bind client socket to %s:%d: %s", bindAddress, originPort, err))
 	}
 
 	rcs := RadiusClientSocket{
+		bindAddress:         bindAddress,
 		port:                originPort,
 		requestsMap:         make(map[string]map[byte]RequestContext),
 		lastRadiusIdMap:     make(map[string]byte),
@@ -244,35 +250,9 @@ func (rcs *RadiusClientSocket) eventLoop() {
 				// Remove from outstanding requests
 				delete(epReqMap, radiusId)
 
-				// Check authenticator
-				if !core.ValidateResponseAuthenticator(v.packetBytes, requestContext.authenticator, requestContext.secret) {
-					core.RecordRadiusClientResponseDrop(endpoint, code)
-					core.GetLogger().Warnf("bad authenticator from %s", endpoint)
-
-					// Send the answer to the requester
-					requestContext.rchan <- fmt.Errorf("bad authenticator")
-					close(requestContext.rchan)
-					continue
-				}
-
-				// Decode the packet
-				radiusPacket, err := core.NewRadiusPacketFromBytes(v.packetBytes, requestContext.secret, requestContext.authenticator)
-				if err != nil {
-					core.RecordRadiusClientResponseDrop(endpoint, code)
-					core.GetLogger().Errorf("error decoding packet from %s %s", endpoint, err)
-					// Send the answer to the requester
-					requestContext.rchan <- fmt.Errorf("could not decode packet")
-					close(requestContext.rchan)
-					continue
-				}
-
-				core.RecordRadiusClientResponse(endpoint, strconv.Itoa(int(radiusPacket.Code)))
-				core.GetLogger().Debugf("<- Client received RadiusPacket %s\n", radiusPacket)
-
-				// Send the answer to the requester
-				requestContext.rchan <- radiusPacket
+				// Send the answer or error to the requester
+				requestContext.rchan <- decodeResponse(endpoint, v.packetBytes, requestContext)
 				close(requestContext.rchan)
-
 			}
 
 		case ClientRadiusRequestMsg:
@@ -340,8 +320,9 @@ func (rcs *RadiusClientSocket) eventLoop() {
 
 				}),
 				secret: v.secret,
-				// The authenticator is generated after ToBytes is called!
-				authenticator: v.packet.Authenticator,
+				// The authenticator generated by ToBytes, in the header of the packet
+				authenticator:              *(*[16]byte)(packetBytes[4:20]),
+				messageAuthenticatorPolicy: v.messageAuthenticatorPolicy,
 			}
 
 			core.RecordRadiusClientRequest(v.endpoint, strconv.Itoa(int(v.packet.Code)))
@@ -406,7 +387,7 @@ func (rcs *RadiusClientSocket) SendRadiusRequest(request ClientRadiusRequestMsg)
 	}
 
 	code := request.packet.Code
-	if code != core.ACCESS_REQUEST && code != core.ACCOUNTING_REQUEST && code != core.COA_REQUEST && code != core.DISCONNECT_REQUEST {
+	if !request.packet.IsRequest() {
 		request.rchan <- fmt.Errorf("code is not for request, but %d", code)
 		close(request.rchan)
 		return
@@ -462,6 +443,41 @@ func (rcs *RadiusClientSocket) getNextRadiusId(endpoint string, currentRadiusId
 	return 0, fmt.Errorf("exhausted ids for endpoint %s", endpoint)
 }
 
+// Validates the response to the request with the specified context, and decodes it.
+// Returns the radius packet or an error, to be sent to the requester
+func decodeResponse(endpoint string, packetBytes []byte, requestContext RequestContext) interface{} {
+
+	code := strconv.Itoa(int(packetBytes[0]))
+
+	// Check authenticator
+	if !core.ValidateResponseAuthenticator(packetBytes, requestContext.authenticator, requestContext.secret) {
+		core.RecordRadiusClientResponseDrop(endpoint, code)
+		core.GetLogger().Warnf("bad authenticator from %s", endpoint)
+		return fmt.Errorf("bad authenticator")
+	}
+
+	// Check Message-Authenticator
+	if err := core.ValidateMessageAuthenticator(packetBytes, requestContext.authenticator, requestContext.secret, requestContext.messageAuthenticatorPolicy); err != nil {
+		core.RecordRadiusMessageAuthenticatorDrop(endpoint, code)
+		core.RecordRadiusClientResponseDrop(endpoint, code)
+		core.GetLogger().Warnf("invalid response from %s: %s", endpoint, err)
+		return err
+	}
+
+	// Decode the packet
+	radiusPacket, err := core.NewRadiusPacketFromBytes(packetBytes, requestContext.secret, requestContext.authenticator)
+	if err != nil {
+		core.RecordRadiusClientResponseDrop(endpoint, code)
+		core.GetLogger().Errorf("error decoding packet from %s %s", endpoint, err)
+		return fmt.Errorf("could not decode packet")
+	}
+
+	core.RecordRadiusClientResponse(endpoint, strconv.Itoa(int(radiusPacket.Code)))
+	core.GetLogger().Debugf("<- Client received RadiusPacket %s\n", radiusPacket)
+
+	return radiusPacket
+}
+
 // Cancells all outstanding requests
 func (rcs *RadiusClientSocket) cancelAll() {
 	// TODO: Map is being modified while being iterated
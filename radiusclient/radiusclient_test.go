@@ -2,6 +2,7 @@ package radiusclient
 
 import (
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -29,6 +30,7 @@ func TestMain(m *testing.M) {
 
 	// Initialize the Config Objects
 	core.InitPolicyConfigInstance("resources/searchRules.json", "testServer", nil, true)
+	core.InitPolicyConfigInstance("resources/searchRules.json", "testSuperServer", nil, false)
 
 	// Execute the tests and exit
 	os.Exit(m.Run())
@@ -40,7 +42,7 @@ func TestRadiusClientSocket(t *testing.T) {
 	serverConf := pci.RadiusServerConf()
 
 	// Instantiate a radius server
-	rs := radiusserver.NewRadiusServer(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, echoHandler)
+	rs := radiusserver.NewRadiusServerWithOptions(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, radiusserver.RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
 
 	// Wait fo the server to be created
 	time.Sleep(100 * time.Millisecond)
@@ -151,7 +153,7 @@ func TestRadiusClientOnly(t *testing.T) {
 	serverConf := pci.RadiusServerConf()
 
 	// Instantiate a radius server
-	rs := radiusserver.NewRadiusServer(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, echoHandler)
+	rs := radiusserver.NewRadiusServerWithOptions(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, radiusserver.RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
 
 	// Wait fo the server to be created
 	time.Sleep(100 * time.Millisecond)
@@ -166,7 +168,7 @@ func TestRadiusClientOnly(t *testing.T) {
 	// Create channel for the request
 	rchan1 := make(chan interface{}, 1)
 
-	rc.RadiusExchange("127.0.0.1:1812", 2000, request, 100*time.Millisecond, 1, "secret", rchan1)
+	rc.RadiusExchangeWithOptions("127.0.0.1:1812", request, RadiusExchangeOptions{OriginAddress: "127.0.0.1", OriginPort: 2000, Timeout: 100 * time.Millisecond, ServerTries: 1, Secret: "secret"}, rchan1)
 
 	// Verify answer
 	response1 := <-rchan1
@@ -214,3 +216,101 @@ func TestRadiusClientOnly(t *testing.T) {
 
 	rs.Close()
 }
+
+func TestRadSecClient(t *testing.T) {
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// A CA is mandatory
+	if _, err := core.NewRadSecTLSConfig("", "", "", true); err == nil {
+		t.Fatal("RadSec configuration without CA did not generate an error")
+	}
+
+	// Instantiate a RadSec server
+	tlsConfig, err := core.NewRadSecTLSConfig("", "", serverConf.RadSecCAFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := radiusserver.NewRadSecServer(pci.RadiusClients(), serverConf.BindAddress, serverConf.RadSecPort, tlsConfig, core.RadiusServerLimits{}, echoHandler)
+
+	// Wait fo the server to be created
+	time.Sleep(100 * time.Millisecond)
+
+	// Create the radius client
+	rc := NewRadiusClient()
+
+	// Create a request radius packet
+	request := core.NewRadiusRequest(1)
+	request.Add("User-Name", "myUserName")
+
+	// Send two requests at the same time, while the connection is established
+	rchan1 := make(chan interface{}, 1)
+	rchan2 := make(chan interface{}, 1)
+	rc.RadiusExchangeWithOptions("127.0.0.1:2083", request, RadiusExchangeOptions{Timeout: 1 * time.Second, ServerTries: 1, Transport: core.RadiusTransportRadSec}, rchan1)
+	rc.RadiusExchangeWithOptions("127.0.0.1:2083", request, RadiusExchangeOptions{Timeout: 1 * time.Second, ServerTries: 1, Transport: core.RadiusTransportRadSec}, rchan2)
+
+	// Verify answers
+	for _, rchan := range []chan interface{}{rchan1, rchan2} {
+		response := <-rchan
+		switch v := response.(type) {
+		case error:
+			t.Fatalf("received error response: %s", v)
+		case *core.RadiusPacket:
+			if v.GetStringAVP("User-Name") != "myUserName" {
+				t.Fatal("User-Name attribute not found in response")
+			}
+		default:
+			t.Fatalf("got %v", v)
+		}
+	}
+
+	// Force a timeout
+	slowRequest := core.NewRadiusRequest(1)
+	slowRequest.Add("Session-Timeout", 1)
+	rchan3 := make(chan interface{}, 1)
+	rc.RadiusExchangeWithOptions("127.0.0.1:2083", slowRequest, RadiusExchangeOptions{Timeout: 500 * time.Millisecond, ServerTries: 1, Transport: core.RadiusTransportRadSec}, rchan3)
+	response3 := <-rchan3
+	switch v := response3.(type) {
+	case error:
+	case *core.RadiusPacket:
+		t.Fatalf("did not get a timeout")
+	default:
+		t.Fatalf("got %v", v)
+	}
+
+	// Send to a non existing server
+	rchan4 := make(chan interface{}, 1)
+	rc.RadiusExchangeWithOptions("127.0.0.1:2888", request, RadiusExchangeOptions{Timeout: 1 * time.Second, ServerTries: 1, Transport: core.RadiusTransportRadSec}, rchan4)
+	response4 := <-rchan4
+	switch v := response4.(type) {
+	case error:
+	case *core.RadiusPacket:
+		t.Fatalf("got response from non existing server")
+	default:
+		t.Fatalf("got %v", v)
+	}
+
+	val, err := core.GetMetricWithLabels("radius_client_requests", `{.*endpoint="127.0.0.1:2083".*}`)
+	if err != nil {
+		t.Fatalf("error getting radius_client_requests %s", err)
+	}
+	if val != 3 {
+		t.Fatalf("number of radius_client_requests was %d", val)
+	}
+
+	rc.SetDown()
+	rc.Close()
+
+	// The certificates are taken from the configuration instance of the client. There is no CA in testSuperServer
+	otherClient := NewRadiusClientWithConfig(core.GetPolicyConfigInstance("testSuperServer"))
+	rchan5 := make(chan interface{}, 1)
+	otherClient.RadiusExchangeWithOptions("127.0.0.1:2083", request, RadiusExchangeOptions{Timeout: 1 * time.Second, ServerTries: 1, Transport: core.RadiusTransportRadSec}, rchan5)
+	if r, ok := (<-rchan5).(error); !ok || !strings.Contains(r.Error(), "CA") {
+		t.Fatalf("RadSec configuration of the client instance was not used: %v", r)
+	}
+	otherClient.SetDown()
+	otherClient.Close()
+
+	rs.Close()
+}
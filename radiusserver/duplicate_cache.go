@@ -0,0 +1,156 @@
+package radiusserver
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Default time during which a request is remembered, to detect retransmissions
+const DEFAULT_DUPLICATE_CACHE_LIFETIME = 5 * time.Second
+
+// Identifies a radius request, as per RFC 5080 section 2.2.2
+type duplicateCacheKey struct {
+	// Client IP address and source port
+	clientAddr string
+
+	// Radius Identifier
+	identifier byte
+
+	// Request authenticator
+	authenticator [16]byte
+}
+
+// Status of a request received
+type duplicateCacheEntry struct {
+	// nil while the request is being processed
+	response []byte
+
+	// The entry may be removed after this time
+	expires time.Time
+}
+
+// Used to keep the order of expiration of the entries
+type duplicateCacheExpiration struct {
+	key     duplicateCacheKey
+	expires time.Time
+}
+
+// Keeps track of the requests received recently, to avoid processing twice the
+// retransmissions by the clients. Requests being processed are marked as such until
+// the response is available, which is then stored to be sent again if the request is retransmitted.
+// A nil duplicateCache does nothing.
+type duplicateCache struct {
+	sync.Mutex
+
+	// Time during which the entries are kept
+	lifetime time.Duration
+
+	// The requests
+	entries map[duplicateCacheKey]*duplicateCacheEntry
+
+	// Keys in the order in which they should expire. Since the lifetime is the
+	// same for all entries, the order is that of insertion. There may be more than one
+	// item for the same key, if the expiration has been refreshed
+	expirations []duplicateCacheExpiration
+
+	// Position of the first item in expirations not yet processed
+	head int
+}
+
+// Creates a duplicate cache. Returns nil, which means no detection of duplicates, if
+// the lifetime is not positive
+func newDuplicateCache(lifetime time.Duration) *duplicateCache {
+	if lifetime <= 0 {
+		return nil
+	}
+
+	return &duplicateCache{
+		lifetime: lifetime,
+		entries:  make(map[duplicateCacheKey]*duplicateCacheEntry),
+	}
+}
+
+// Builds the key for the request in the specified buffer, sent from the specified address
+func newDuplicateCacheKey(clientAddr net.Addr, packetBytes []byte) duplicateCacheKey {
+	return duplicateCacheKey{
+		clientAddr:    clientAddr.String(),
+		identifier:    packetBytes[1],
+		authenticator: *(*[16]byte)(packetBytes[4:20]),
+	}
+}
+
+// Looks for the request in the cache. If found, returns true and the response, which will be nil
+// if the request is still being processed. If not found, the request is registered as being in progress
+func (dc *duplicateCache) lookup(key duplicateCacheKey) (bool, []byte) {
+	if dc == nil {
+		return false, nil
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	now := time.Now()
+	dc.expire(now)
+
+	if entry, found := dc.entries[key]; found {
+		return true, entry.response
+	}
+
+	expires := now.Add(dc.lifetime)
+	dc.entries[key] = &duplicateCacheEntry{expires: expires}
+	dc.expirations = append(dc.expirations, duplicateCacheExpiration{key: key, expires: expires})
+
+	return false, nil
+}
+
+// Stores the response to the request, to be sent if the request is retransmitted.
+// The lifetime of the entry is counted from now on
+func (dc *duplicateCache) complete(key duplicateCacheKey, response []byte) {
+	if dc == nil {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	if entry, found := dc.entries[key]; found {
+		entry.response = response
+		entry.expires = time.Now().Add(dc.lifetime)
+		dc.expirations = append(dc.expirations, duplicateCacheExpiration{key: key, expires: entry.expires})
+	}
+}
+
+// Forgets the request, so that a retransmission is processed again. To be used when there was
+// no response
+func (dc *duplicateCache) remove(key duplicateCacheKey) {
+	if dc == nil {
+		return
+	}
+
+	dc.Lock()
+	defer dc.Unlock()
+
+	delete(dc.entries, key)
+}
+
+// Removes the entries already expired. Must be called with the lock held
+func (dc *duplicateCache) expire(now time.Time) {
+	for dc.head < len(dc.expirations) {
+		expiration := dc.expirations[dc.head]
+		if expiration.expires.After(now) {
+			break
+		}
+		// The entry may have been refreshed, and then there will be another item later
+		if entry, found := dc.entries[expiration.key]; found && !entry.expires.After(now) {
+			delete(dc.entries, expiration.key)
+		}
+		dc.head++
+	}
+
+	// Reclaim the space of the items already processed
+	if dc.head > len(dc.expirations)/2 {
+		dc.expirations = append(dc.expirations[:0], dc.expirations[dc.head:]...)
+		dc.head = 0
+	}
+}
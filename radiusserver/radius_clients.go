@@ -0,0 +1,24 @@
+package radiusserver
+
+import (
+	"sync/atomic"
+
+	"github.com/francistor/igor/core"
+)
+
+// Holds the radius clients used by a server, which may be replaced while the server is
+// running. Each packet is validated against the set of clients current at the time of reception,
+// so that the packets being processed when the clients are updated are not affected
+type radiusClientsSnapshot struct {
+	value atomic.Value
+}
+
+// Returns the current radius clients
+func (s *radiusClientsSnapshot) get() core.RadiusClients {
+	return s.value.Load().(core.RadiusClients)
+}
+
+// Replaces the radius clients. The map must not be modified afterwards
+func (s *radiusClientsSnapshot) set(radiusClients core.RadiusClients) {
+	s.value.Store(radiusClients)
+}
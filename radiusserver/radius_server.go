@@ -5,6 +5,7 @@ import (
 	"net"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/francistor/igor/core"
 )
@@ -18,11 +19,13 @@ const (
 // Implements a radius server socket
 // Validates incoming messages, sends them to the router for processing and replies back
 // with the responses
-// TODO: Being able to update the radius clients
+// The radius clients may be updated without restarting the server
+// The requests are processed by a pool of workers, with limits to the requests queued and
+// in progress for each client. Access-Request are processed before any other request
 type RadiusServer struct {
 
 	// Radius Clients
-	radiusClients core.RadiusClients
+	radiusClients radiusClientsSnapshot
 
 	// Handler function for incoming packets
 	// handler RadiusPacketHandler
@@ -31,15 +34,45 @@ type RadiusServer struct {
 	// The UDP socket
 	socket net.PacketConn
 
+	// Requests recently received, to detect retransmissions
+	duplicates *duplicateCache
+
+	// Code of the response to Status-Server. If 0, Status-Server is not answered
+	statusServerResponseCode core.RadiusPacketType
+
+	// Processes the requests
+	workers *workerPool
+
 	// Status. Initially 0 and 1 (StatusTerminated) if we are shutting down
 	status int32
 }
 
-// Creates a Radius Server
+// Parameters of the processing of the requests received by a radius server
+type RadiusServerOptions struct {
+	// Requests are remembered during this time, so that retransmissions are not processed again.
+	// If not positive, duplicate detection is disabled. Not used in the stream servers
+	DuplicateCacheLifetime time.Duration
+
+	// Status-Server (RFC 5997) is answered without invoking the handler, with a packet with this code,
+	// which should be core.ACCESS_ACCEPT for authentication ports and core.ACCOUNTING_RESPONSE for accounting ports.
+	// If 0, Status-Server is discarded
+	StatusServerResponseCode core.RadiusPacketType
+
+	// The requests exceeding these limits are dropped
+	Limits core.RadiusServerLimits
+}
+
+// Creates a Radius Server with the default options: no duplicate detection, Status-Server discarded
+// and the default limits
 func NewRadiusServer(radiusClients core.RadiusClients, bindAddress string, bindPort int, handler core.RadiusPacketHandler) *RadiusServer {
+	return NewRadiusServerWithOptions(radiusClients, bindAddress, bindPort, RadiusServerOptions{}, handler)
+}
+
+// Creates a Radius Server with the specified options
+func NewRadiusServerWithOptions(radiusClients core.RadiusClients, bindAddress string, bindPort int, options RadiusServerOptions, handler core.RadiusPacketHandler) *RadiusServer {
 
 	// Create the server socket
-	socket, err := net.ListenPacket("udp", fmt.Sprintf("%s:%d", bindAddress, bindPort))
+	socket, err := net.ListenPacket(core.ListenNetwork("udp", bindAddress), net.JoinHostPort(bindAddress, strconv.Itoa(bindPort)))
 	if err != nil {
 		panic(fmt.Sprintf("could not create listen socket in %s:%d : %s", bindAddress, bindPort, err))
 	} else {
@@ -47,10 +80,14 @@ func NewRadiusServer(radiusClients core.RadiusClients, bindAddress string, bindP
 	}
 
 	radiusServer := RadiusServer{
-		radiusClients: radiusClients,
-		handler:       handler,
-		socket:        socket,
+		handler:    core.RadiusRecoveryMiddleware(handler),
+		socket:     socket,
+		duplicates: newDuplicateCache(options.DuplicateCacheLifetime),
+		workers:    newWorkerPool(options.Limits),
+
+		statusServerResponseCode: options.StatusServerResponseCode,
 	}
+	radiusServer.radiusClients.set(radiusClients)
 
 	// Start receiving packets
 	go radiusServer.readLoop(socket)
@@ -58,6 +95,11 @@ func NewRadiusServer(radiusClients core.RadiusClients, bindAddress string, bindP
 	return &radiusServer
 }
 
+// Replaces the radius clients. The packets received from now on are validated against the new ones
+func (rs *RadiusServer) UpdateRadiusClients(radiusClients core.RadiusClients) {
+	rs.radiusClients.set(radiusClients)
+}
+
 // Frees the server socket. No need to call any SetDown() here
 func (rs *RadiusServer) Close() {
 	// Set the status
@@ -80,6 +122,7 @@ func (rs *RadiusServer) readLoop(socket net.PacketConn) {
 			if atomic.LoadInt32(&rs.status) == StatusTerminated {
 				// The socket was closed gracefully
 				core.GetLogger().Infof("closed radius server socket %s", socket.LocalAddr().String())
+				rs.workers.close()
 				return
 			} else {
 				// Some other error
@@ -89,35 +132,54 @@ func (rs *RadiusServer) readLoop(socket net.PacketConn) {
 
 		clientIP := clientAddr.(*net.UDPAddr).IP
 		clientIPAddr := clientIP.String()
-		radiusClient, err := rs.radiusClients.FindRadiusClient(clientIP)
+		radiusClient, err := rs.radiusClients.get().FindRadiusClient(clientIP)
 		if err != nil {
 			core.RecordRadiusServerDrop(clientIPAddr, "0")
 			core.GetLogger().Warnf("message from unknown client %s", clientIPAddr)
 			continue
 		}
 
-		// Decode the packet
-		core.GetLogger().Debugf("received packet: %v", reqBuf[:packetSize])
-		radiusPacket, err := core.NewRadiusPacketFromBytes((reqBuf[:packetSize]), radiusClient.Secret, core.Zero_authenticator)
+		radiusPacket, err := decodeRequest(reqBuf[:packetSize], clientIPAddr, radiusClient.Secret, radiusClient.MessageAuthenticator)
 		if err != nil {
-			core.GetLogger().Errorf("error decoding packet %s\n", err)
 			continue
 		}
 
-		// Validate the packet
-		if radiusPacket.Code != core.ACCESS_REQUEST {
-			if !core.ValidateRequestAuthenticator(reqBuf[:packetSize], radiusClient.Secret) {
-				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
-				core.GetLogger().Warnf("invalid request packet %s\n", radiusPacket)
+		// Status-Server is answered here
+		if radiusPacket.Code == core.STATUS_SERVER {
+			if respBuf, err := answerStatusServer(radiusPacket, clientIPAddr, radiusClient.Secret, rs.statusServerResponseCode); err == nil {
+				if _, err = socket.WriteTo(respBuf, clientAddr); err != nil {
+					core.GetLogger().Errorf("error sending packet to %s: %s", clientAddr.String(), err)
+				}
+			}
+			continue
+		}
+
+		// Check if this is a retransmission
+		duplicateKey := newDuplicateCacheKey(clientAddr, reqBuf[:packetSize])
+		if rs.duplicates != nil {
+			if found, cachedResponse := rs.duplicates.lookup(duplicateKey); found {
+				core.RecordRadiusServerDuplicateCacheHit(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
+				if cachedResponse == nil {
+					// Still being processed
+					core.GetLogger().Debugf("dropping duplicate request in progress from %s with identifier %d", clientAddr.String(), radiusPacket.Identifier)
+				} else {
+					core.GetLogger().Debugf("sending cached response to %s with identifier %d", clientAddr.String(), radiusPacket.Identifier)
+					if _, err = socket.WriteTo(cachedResponse, clientAddr); err != nil {
+						core.GetLogger().Errorf("error sending cached packet to %s: %s", clientAddr.String(), err)
+					}
+				}
 				continue
 			}
+			core.RecordRadiusServerDuplicateCacheMiss(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
 		}
 
 		core.RecordRadiusServerRequest(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
 		core.GetLogger().Debugf("<- Server received RadiusPacket %s\n", radiusPacket)
 
-		// Wait for response
-		go func(radiusPacket *core.RadiusPacket, secret string, addr net.Addr) {
+		// Process in a worker, unless overloaded
+		secret := radiusClient.Secret
+		addr := clientAddr
+		reason := rs.workers.submit(clientIPAddr, radiusPacket.Code == core.ACCESS_REQUEST, func() {
 
 			code := radiusPacket.Code
 
@@ -126,6 +188,7 @@ func (rs *RadiusServer) readLoop(socket net.PacketConn) {
 			if err != nil {
 				core.GetLogger().Errorf("discarding packet for %s with code %d: %s", addr.String(), radiusPacket.Code, err)
 				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
+				rs.duplicates.remove(duplicateKey)
 				return
 			}
 
@@ -134,8 +197,13 @@ func (rs *RadiusServer) readLoop(socket net.PacketConn) {
 			if err != nil {
 				core.GetLogger().Errorf("error serializing packet for %s with code %d: %s", addr.String(), code, err)
 				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
+				rs.duplicates.remove(duplicateKey)
 				return
 			}
+
+			// Keep for retransmissions
+			rs.duplicates.complete(duplicateKey, respBuf)
+
 			if _, err = socket.WriteTo(respBuf, addr); err != nil {
 				core.GetLogger().Errorf("error sending packet to %s with code %d: %s", addr.String(), code, err)
 				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
@@ -144,7 +212,86 @@ func (rs *RadiusServer) readLoop(socket net.PacketConn) {
 
 			core.RecordRadiusServerResponse(clientIPAddr, strconv.Itoa(int(code)))
 			core.GetLogger().Debugf("-> Server sent RadiusPacket %s\n", response)
+		})
 
-		}(radiusPacket, radiusClient.Secret, clientAddr)
+		if reason != "" {
+			core.GetLogger().Warnf("dropping packet from %s with code %d: %s", clientAddr.String(), radiusPacket.Code, reason)
+			core.RecordRadiusServerOverloadDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)), reason)
+			core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
+
+			// The retransmissions will be processed
+			rs.duplicates.remove(duplicateKey)
+		}
 	}
 }
+
+// Checks the Message-Authenticator and the authenticator of the request received from the specified client,
+// and decodes it. Invalid requests are recorded as dropped, and an error is returned
+func decodeRequest(packetBytes []byte, clientIPAddr string, secret string, messageAuthenticatorPolicy string) (*core.RadiusPacket, error) {
+
+	// Datagrams may have any size. Check that there is a header before looking into it
+	if len(packetBytes) < 20 {
+		core.RecordRadiusServerDrop(clientIPAddr, "0")
+		core.GetLogger().Warnf("packet from %s is too short: %d bytes", clientIPAddr, len(packetBytes))
+		return nil, fmt.Errorf("packet too short")
+	}
+
+	// Status-Server must always include a Message-Authenticator
+	if packetBytes[0] == core.STATUS_SERVER {
+		messageAuthenticatorPolicy = core.MessageAuthenticatorRequire
+	}
+
+	// Check the Message-Authenticator
+	if err := core.ValidateMessageAuthenticator(packetBytes, core.Zero_authenticator, secret, messageAuthenticatorPolicy); err != nil {
+		core.RecordRadiusMessageAuthenticatorDrop(clientIPAddr, strconv.Itoa(int(packetBytes[0])))
+		core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(packetBytes[0])))
+		core.GetLogger().Warnf("invalid request packet from %s: %s", clientIPAddr, err)
+		return nil, err
+	}
+
+	// Decode the packet
+	core.GetLogger().Debugf("received packet: %v", packetBytes)
+	radiusPacket, err := core.NewRadiusPacketFromBytes(packetBytes, secret, core.Zero_authenticator)
+	if err != nil {
+		core.GetLogger().Errorf("error decoding packet %s\n", err)
+		return nil, err
+	}
+
+	// Validate the packet
+	if radiusPacket.Code != core.ACCESS_REQUEST && radiusPacket.Code != core.STATUS_SERVER {
+		if !core.ValidateRequestAuthenticator(packetBytes, secret) {
+			core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
+			core.GetLogger().Warnf("invalid request packet %s\n", radiusPacket)
+			return nil, fmt.Errorf("invalid request authenticator")
+		}
+	}
+
+	return radiusPacket, nil
+}
+
+// Builds the response to a Status-Server request, with the specified code. If the code is 0, the
+// request is dropped and an error is returned
+func answerStatusServer(request *core.RadiusPacket, clientIPAddr string, secret string, responseCode core.RadiusPacketType) ([]byte, error) {
+
+	core.RecordRadiusServerRequest(clientIPAddr, strconv.Itoa(core.STATUS_SERVER))
+
+	if responseCode == 0 {
+		core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(core.STATUS_SERVER))
+		core.GetLogger().Debugf("discarding Status-Server from %s", clientIPAddr)
+		return nil, fmt.Errorf("Status-Server not supported")
+	}
+
+	response := core.NewRadiusResponse(request, true)
+	response.Code = responseCode
+	respBuf, err := response.ToBytes(secret, request.Identifier)
+	if err != nil {
+		core.GetLogger().Errorf("error serializing Status-Server response for %s: %s", clientIPAddr, err)
+		core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(core.STATUS_SERVER))
+		return nil, err
+	}
+
+	core.RecordRadiusServerResponse(clientIPAddr, strconv.Itoa(core.STATUS_SERVER))
+	core.GetLogger().Debugf("-> Server sent Status-Server response %s\n", response)
+
+	return respBuf, nil
+}
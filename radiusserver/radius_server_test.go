@@ -1,8 +1,10 @@
 package radiusserver
 
 import (
+	"bytes"
 	"net"
 	"os"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -38,7 +40,7 @@ func TestRadiusServer(t *testing.T) {
 	serverConf := pci.RadiusServerConf()
 
 	// Instantiate a radius server
-	rs := NewRadiusServer(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, echoHandler)
+	rs := NewRadiusServerWithOptions(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
 
 	// Wait fo the socket to be created
 	time.Sleep(100 * time.Millisecond)
@@ -78,3 +80,605 @@ func TestRadiusServer(t *testing.T) {
 
 	rs.Close()
 }
+
+func TestRadiusServerIPv6(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Instantiate two radius servers in the same port, one for IPv4 and another one for IPv6
+	rs4 := NewRadiusServerWithOptions(pci.RadiusClients(), "127.0.0.1", serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
+	defer rs4.Close()
+	rs6 := NewRadiusServerWithOptions(pci.RadiusClients(), "::1", serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
+	defer rs6.Close()
+
+	// Wait fo the sockets to be created
+	time.Sleep(100 * time.Millisecond)
+
+	for _, address := range []string{"127.0.0.1", "::1"} {
+		clientSocket, err := net.ListenPacket("udp", net.JoinHostPort(address, "0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer clientSocket.Close()
+
+		request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+		request.Add("User-Name", address)
+		requestBytes, err := request.ToBytes("secret", 103)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(address, "1812"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientSocket.WriteTo(requestBytes, addr)
+
+		responseBuffer := make([]byte, 4096)
+		clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+		if _, _, err = clientSocket.ReadFrom(responseBuffer); err != nil {
+			t.Fatalf("no response from %s: %s", address, err)
+		}
+		receivedPacket, err := core.NewRadiusPacketFromBytes(responseBuffer, "secret", core.Zero_authenticator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if receivedPacket.GetStringAVP("User-Name") != address {
+			t.Errorf("unexpected User-Name attribute in response <%s>", receivedPacket.GetStringAVP("User-Name"))
+		}
+	}
+}
+
+func TestRadiusServerMessageAuthenticator(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Instantiate a radius server
+	rs := NewRadiusServerWithOptions(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	// This client requires Message-Authenticator
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.2:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, err := request.ToBytes("secret", 101)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Remove the Message-Authenticator, which is added automatically in the first position
+	strippedBytes := append(append([]byte{}, requestBytes[0:20]...), requestBytes[38:]...)
+	strippedBytes[3] = byte(len(strippedBytes))
+	clientSocket.WriteTo(strippedBytes, addr)
+
+	// Should be dropped
+	responseBuffer := make([]byte, 4096)
+	clientSocket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err = clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Fatal("got response to request without Message-Authenticator")
+	}
+	val, err := core.GetMetricWithLabels("radius_message_authenticator_drops", `{code="1",endpoint="127.0.0.2"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_message_authenticator_drops: %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_message_authenticator_drops is %d", val)
+	}
+
+	// The full request is answered
+	clientSocket.WriteTo(requestBytes, addr)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	packetSize, _, err := clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The authenticator of the request is the one generated when serializing it
+	requestAuthenticator := *(*[16]byte)(requestBytes[4:20])
+	if err := core.ValidateMessageAuthenticator(responseBuffer[:packetSize], requestAuthenticator, "secret", core.MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in response: %s", err)
+	}
+}
+
+func TestRadiusServerShortPackets(t *testing.T) {
+
+	// Packets without a full header, or with a bad length, are rejected
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, err := request.ToBytes("secret", 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badLength := append([]byte{}, requestBytes...)
+	badLength[3] = byte(len(badLength) + 10)
+	for _, packetBytes := range [][]byte{{}, {core.ACCESS_REQUEST}, requestBytes[:19], requestBytes[:20], badLength} {
+		if _, err := decodeRequest(packetBytes, "127.0.0.1", "secret", core.MessageAuthenticatorIgnore); err == nil {
+			t.Errorf("short packet %v was decoded", packetBytes)
+		}
+	}
+
+	// And the server goes on processing requests
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+	rs := NewRadiusServer(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, echoHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSocket.WriteTo([]byte{}, addr)
+	clientSocket.WriteTo(requestBytes[:10], addr)
+	clientSocket.WriteTo(requestBytes, addr)
+
+	responseBuffer := make([]byte, 4096)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	if _, _, err = clientSocket.ReadFrom(responseBuffer); err != nil {
+		t.Fatalf("no response after short packets: %s", err)
+	}
+}
+
+func TestRadiusServerStatusServer(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// The handler must not be invoked
+	var handled int32
+	countingHandler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		atomic.AddInt32(&handled, 1)
+		return echoHandler(request)
+	}
+
+	// Instantiate a radius server
+	rs := NewRadiusServerWithOptions(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, countingHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Message-Authenticator is added automatically
+	request := core.NewRadiusRequest(core.STATUS_SERVER)
+	requestBytes, err := request.ToBytes("secret", 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without Message-Authenticator, should be dropped
+	strippedBytes := append([]byte{}, requestBytes[0:20]...)
+	strippedBytes[3] = byte(len(strippedBytes))
+	clientSocket.WriteTo(strippedBytes, addr)
+	responseBuffer := make([]byte, 4096)
+	clientSocket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err = clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Fatal("got response to Status-Server without Message-Authenticator")
+	}
+
+	// The full request is answered with Access-Accept
+	clientSocket.WriteTo(requestBytes, addr)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	packetSize, _, err := clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The authenticator of the request is the one generated when serializing it
+	requestAuthenticator := *(*[16]byte)(requestBytes[4:20])
+	if !core.ValidateResponseAuthenticator(responseBuffer[:packetSize], requestAuthenticator, "secret") {
+		t.Fatal("bad authenticator in Status-Server response")
+	}
+	if err := core.ValidateMessageAuthenticator(responseBuffer[:packetSize], requestAuthenticator, "secret", core.MessageAuthenticatorRequire); err != nil {
+		t.Fatalf("bad Message-Authenticator in Status-Server response: %s", err)
+	}
+	response, err := core.NewRadiusPacketFromBytes(responseBuffer[:packetSize], "secret", requestAuthenticator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.Code != core.ACCESS_ACCEPT {
+		t.Fatalf("Status-Server response code is %d", response.Code)
+	}
+	if atomic.LoadInt32(&handled) != 0 {
+		t.Fatal("Status-Server was passed to the handler")
+	}
+}
+
+func TestRadiusServerUpdateClients(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Start without the client in 127.0.0.1
+	radiusClients := pci.RadiusClients()
+	reducedClients := make(core.RadiusClients)
+	for key, radiusClient := range radiusClients {
+		if key != "127.0.0.1" {
+			reducedClients[key] = radiusClient
+		}
+	}
+
+	// Instantiate a radius server
+	rs := NewRadiusServerWithOptions(reducedClients, serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+	request.Add("User-Name", "myUserName")
+	requestBytes, err := request.ToBytes("secret", 103)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown client. Should be dropped
+	clientSocket.WriteTo(requestBytes, addr)
+	responseBuffer := make([]byte, 4096)
+	clientSocket.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err = clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Fatal("got response from unknown client")
+	}
+
+	// Now the client is known, without restarting the server
+	rs.UpdateRadiusClients(radiusClients)
+
+	clientSocket.WriteTo(requestBytes, addr)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	packetSize, _, err := clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := core.NewRadiusPacketFromBytes(responseBuffer[:packetSize], "secret", *(*[16]byte)(requestBytes[4:20]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.GetStringAVP("User-Name") != "myUserName" {
+		t.Fatalf("unexpected User-Name in response <%s>", response.GetStringAVP("User-Name"))
+	}
+}
+
+func TestRadiusServerOverload(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Handler that waits for the gate to be opened and records the order of the requests
+	gate := make(chan struct{})
+	processed := make(chan byte, 10)
+	blockingHandler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		<-gate
+		processed <- request.Identifier
+		return echoHandler(request)
+	}
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(code core.RadiusPacketType, id byte) {
+		request := core.NewRadiusRequest(code)
+		request.Add("User-Name", "myUserName")
+		requestBytes, err := request.ToBytes("secret", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientSocket.WriteTo(requestBytes, addr)
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// One worker, and queues with one place
+	rs := NewRadiusServerWithOptions(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT, Limits: core.RadiusServerLimits{Workers: 1, QueueSize: 1}}, blockingHandler)
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	// Taken by the worker
+	send(core.ACCOUNTING_REQUEST, 1)
+	// Queued
+	send(core.ACCOUNTING_REQUEST, 2)
+	// Dropped
+	send(core.ACCOUNTING_REQUEST, 3)
+	// Queued with priority
+	send(core.ACCESS_REQUEST, 4)
+
+	close(gate)
+	var order []byte
+	for i := 0; i < 3; i++ {
+		select {
+		case id := <-processed:
+			order = append(order, id)
+		case <-time.After(1 * time.Second):
+			t.Fatalf("only %d requests processed", len(order))
+		}
+	}
+	if !bytes.Equal(order, []byte{1, 4, 2}) {
+		t.Fatalf("requests processed in order %v", order)
+	}
+
+	val, err := core.GetMetricWithLabels("radius_server_overload_drops", `{code="4",endpoint="127.0.0.1",reason="queue_full"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_server_overload_drops: %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_server_overload_drops is %d", val)
+	}
+
+	rs.Close()
+
+	// Now with a goroutine per request, but only one request in flight per client
+	gate = make(chan struct{})
+	rs = NewRadiusServerWithOptions(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT, Limits: core.RadiusServerLimits{Workers: -1, MaxInFlightPerClient: 1}}, blockingHandler)
+	defer rs.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	send(core.ACCESS_REQUEST, 5)
+	send(core.ACCESS_REQUEST, 6)
+	close(gate)
+	if id := <-processed; id != 5 {
+		t.Fatalf("processed request %d", id)
+	}
+
+	// The slot is free again
+	time.Sleep(50 * time.Millisecond)
+	send(core.ACCESS_REQUEST, 7)
+	if id := <-processed; id != 7 {
+		t.Fatalf("processed request %d", id)
+	}
+
+	val, err = core.GetMetricWithLabels("radius_server_overload_drops", `{code="1",endpoint="127.0.0.1",reason="client_limit"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_server_overload_drops: %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_server_overload_drops is %d", val)
+	}
+}
+
+func TestRadiusServerDuplicates(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Slow handler that counts the invocations
+	var invocations int32
+	slowHandler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		atomic.AddInt32(&invocations, 1)
+		time.Sleep(200 * time.Millisecond)
+		return echoHandler(request)
+	}
+
+	// Instantiate a radius server
+	rs := NewRadiusServerWithOptions(core.GetPolicyConfigInstance("testServer").RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{DuplicateCacheLifetime: DEFAULT_DUPLICATE_CACHE_LIFETIME, StatusServerResponseCode: core.ACCESS_ACCEPT}, slowHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	clientSocket, err := net.ListenPacket("udp", "127.0.0.1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientSocket.Close()
+	addr, err := net.ResolveUDPAddr("udp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+	request.Add("User-Name", "duplicatedUserName")
+	requestBytes, err := request.ToBytes("secret", 102)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Send twice. The second one is dropped, because the first is still being processed
+	clientSocket.WriteTo(requestBytes, addr)
+	time.Sleep(50 * time.Millisecond)
+	clientSocket.WriteTo(requestBytes, addr)
+
+	responseBuffer := make([]byte, 4096)
+	clientSocket.SetReadDeadline(time.Now().Add(1 * time.Second))
+	packetSize, _, err := clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstResponse := append([]byte{}, responseBuffer[:packetSize]...)
+
+	clientSocket.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, _, err = clientSocket.ReadFrom(responseBuffer); err == nil {
+		t.Fatal("got response to duplicate request in progress")
+	}
+
+	// Retransmission after the answer is sent. Gets the cached response
+	clientSocket.WriteTo(requestBytes, addr)
+	clientSocket.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	packetSize, _, err = clientSocket.ReadFrom(responseBuffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(firstResponse, responseBuffer[:packetSize]) {
+		t.Fatal("cached response is different from the original one")
+	}
+
+	if atomic.LoadInt32(&invocations) != 1 {
+		t.Fatalf("handler invoked %d times", invocations)
+	}
+	val, err := core.GetMetricWithLabels("radius_server_duplicate_cache_hits", `{code="1",endpoint="127.0.0.1"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_server_duplicate_cache_hits: %s", err)
+	}
+	if val != 2 {
+		t.Fatalf("radius_server_duplicate_cache_hits is %d", val)
+	}
+}
+
+func TestRadiusTCPServer(t *testing.T) {
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Instantiate a radius server
+	rs := NewRadiusTCPServerWithOptions(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT}, echoHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	connection, err := net.Dial("tcp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	// Send two requests in the same write
+	var requestBytes []byte
+	for i, userName := range []string{"firstUserName", "secondUserName"} {
+		request := core.NewRadiusRequest(core.ACCESS_REQUEST)
+		request.Add("User-Name", userName)
+		packetBytes, err := request.ToBytes("secret", byte(110+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		requestBytes = append(requestBytes, packetBytes...)
+	}
+	if _, err := connection.Write(requestBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get the two responses, in any order
+	connection.SetReadDeadline(time.Now().Add(1 * time.Second))
+	userNames := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		packetBytes, err := core.ReadRadiusPacketBytes(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, err := core.NewRadiusPacketFromBytes(packetBytes, "secret", core.Zero_authenticator)
+		if err != nil {
+			t.Fatal(err)
+		}
+		userNames[response.GetStringAVP("User-Name")] = true
+	}
+	if !userNames["firstUserName"] || !userNames["secondUserName"] {
+		t.Fatalf("unexpected responses %v", userNames)
+	}
+}
+
+func TestRadiusTCPServerOverload(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	// Get the configuration
+	pci := core.GetPolicyConfigInstance("testServer")
+	serverConf := pci.RadiusServerConf()
+
+	// Handler that waits for the gate to be opened
+	gate := make(chan struct{})
+	blockingHandler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		<-gate
+		return echoHandler(request)
+	}
+
+	// One worker, and queues with one place
+	rs := NewRadiusTCPServerWithOptions(pci.RadiusClients(), serverConf.BindAddress, serverConf.AuthPort, RadiusServerOptions{StatusServerResponseCode: core.ACCESS_ACCEPT, Limits: core.RadiusServerLimits{Workers: 1, QueueSize: 1}}, blockingHandler)
+	defer rs.Close()
+
+	// Wait fo the socket to be created
+	time.Sleep(100 * time.Millisecond)
+
+	connection, err := net.Dial("tcp", "127.0.0.1:1812")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connection.Close()
+
+	// Taken by the worker, queued and dropped
+	for i := 0; i < 3; i++ {
+		request := core.NewRadiusRequest(core.ACCOUNTING_REQUEST)
+		request.Add("User-Name", "myUserName")
+		packetBytes, err := request.ToBytes("secret", byte(120+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := connection.Write(packetBytes); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	close(gate)
+
+	// Only the first two are answered
+	connection.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		packetBytes, err := core.ReadRadiusPacketBytes(connection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if packetBytes[1] != byte(120+i) {
+			t.Fatalf("unexpected response with identifier %d", packetBytes[1])
+		}
+	}
+	if _, err := core.ReadRadiusPacketBytes(connection); err == nil {
+		t.Fatal("dropped request was answered")
+	}
+
+	val, err := core.GetMetricWithLabels("radius_server_overload_drops", `{code="4",endpoint="127.0.0.1",reason="queue_full"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_server_overload_drops: %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_server_overload_drops is %d", val)
+	}
+}
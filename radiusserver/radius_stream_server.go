@@ -0,0 +1,282 @@
+package radiusserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/francistor/igor/core"
+)
+
+// Maximum time to wait for the TLS handshake to complete
+const TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// Implements a radius server over a stream transport, that is, TCP (RFC 6613) or RadSec (RFC 6614)
+// Accepts connections from the radius clients, validates the requests received in them,
+// sends them to the router for processing and replies back with the responses through the same
+// connection. Packets are delimited using the length field in the header.
+// RadSec clients are identified by the name in the certificate they present, or by their IP address
+// if no radius client is configured with that name. The shared secret is always "radsec"
+// The requests of all the connections are processed by a pool of workers, with the same limits as
+// in the UDP RadiusServer
+type RadiusStreamServer struct {
+
+	// Radius Clients
+	radiusClients radiusClientsSnapshot
+
+	// Handler function for incoming packets
+	handler core.RadiusPacketHandler
+
+	// The listening socket
+	listener net.Listener
+
+	// If not empty, used instead of the secret of the radius client
+	fixedSecret string
+
+	// Code of the response to Status-Server. If 0, Status-Server is not answered
+	statusServerResponseCode core.RadiusPacketType
+
+	// Processes the requests
+	workers *workerPool
+
+	// The connections currently open, to be closed when the server is closed
+	connMutex   sync.Mutex
+	connections map[net.Conn]struct{}
+
+	// Status. Initially 0 and 1 (StatusTerminated) if we are shutting down
+	status int32
+}
+
+// Creates a Radius Server over TCP with the default options, as NewRadiusServer
+func NewRadiusTCPServer(radiusClients core.RadiusClients, bindAddress string, bindPort int, handler core.RadiusPacketHandler) *RadiusStreamServer {
+	return NewRadiusTCPServerWithOptions(radiusClients, bindAddress, bindPort, RadiusServerOptions{}, handler)
+}
+
+// Creates a Radius Server over TCP with the specified options
+// Status-Server is answered and the limits are applied as in the UDP RadiusServer
+func NewRadiusTCPServerWithOptions(radiusClients core.RadiusClients, bindAddress string, bindPort int, options RadiusServerOptions, handler core.RadiusPacketHandler) *RadiusStreamServer {
+
+	listener, err := net.Listen(core.ListenNetwork("tcp", bindAddress), net.JoinHostPort(bindAddress, strconv.Itoa(bindPort)))
+	if err != nil {
+		panic(fmt.Sprintf("could not create TCP listen socket in %s:%d : %s", bindAddress, bindPort, err))
+	} else {
+		core.GetLogger().Infof("RADIUS TCP server listening in %s:%d", bindAddress, bindPort)
+	}
+
+	return newRadiusStreamServer(radiusClients, listener, "", options.StatusServerResponseCode, options.Limits, handler)
+}
+
+// Creates a RadSec Server, using the specified TLS configuration, which should
+// require a certificate from the clients. Status-Server is answered with Access-Accept
+// The requests exceeding the specified limits are dropped
+func NewRadSecServer(radiusClients core.RadiusClients, bindAddress string, bindPort int, tlsConfig *tls.Config, limits core.RadiusServerLimits, handler core.RadiusPacketHandler) *RadiusStreamServer {
+
+	listener, err := tls.Listen(core.ListenNetwork("tcp", bindAddress), net.JoinHostPort(bindAddress, strconv.Itoa(bindPort)), tlsConfig)
+	if err != nil {
+		panic(fmt.Sprintf("could not create RadSec listen socket in %s:%d : %s", bindAddress, bindPort, err))
+	} else {
+		core.GetLogger().Infof("RadSec server listening in %s:%d", bindAddress, bindPort)
+	}
+
+	return newRadiusStreamServer(radiusClients, listener, core.RADSEC_SECRET, core.ACCESS_ACCEPT, limits, handler)
+}
+
+// Helper to create the server with the listener already created
+func newRadiusStreamServer(radiusClients core.RadiusClients, listener net.Listener, fixedSecret string, statusServerResponseCode core.RadiusPacketType, limits core.RadiusServerLimits, handler core.RadiusPacketHandler) *RadiusStreamServer {
+
+	radiusServer := RadiusStreamServer{
+		handler:     core.RadiusRecoveryMiddleware(handler),
+		listener:    listener,
+		fixedSecret: fixedSecret,
+		workers:     newWorkerPool(limits),
+		connections: make(map[net.Conn]struct{}),
+
+		statusServerResponseCode: statusServerResponseCode,
+	}
+	radiusServer.radiusClients.set(radiusClients)
+
+	// Start accepting connections
+	go radiusServer.acceptLoop()
+
+	return &radiusServer
+}
+
+// Closes the listener and all the connections
+func (rs *RadiusStreamServer) Close() {
+	// Set the status
+	atomic.StoreInt32(&rs.status, StatusTerminated)
+
+	// Will generate an error in the accept loop, which will return
+	rs.listener.Close()
+
+	// Will generate an error in the connection loops
+	rs.connMutex.Lock()
+	defer rs.connMutex.Unlock()
+	for connection := range rs.connections {
+		connection.Close()
+	}
+}
+
+// Replaces the radius clients. The connections already established keep the radius client
+// with which they were identified
+func (rs *RadiusStreamServer) UpdateRadiusClients(radiusClients core.RadiusClients) {
+	rs.radiusClients.set(radiusClients)
+}
+
+// Waits for connections and starts a connection loop for each one
+func (rs *RadiusStreamServer) acceptLoop() {
+	for {
+		connection, err := rs.listener.Accept()
+		if err != nil {
+			if atomic.LoadInt32(&rs.status) == StatusTerminated {
+				// The socket was closed gracefully
+				core.GetLogger().Infof("closed radius server listener %s", rs.listener.Addr().String())
+				rs.workers.close()
+				return
+			} else {
+				// Some other error
+				panic(err)
+			}
+		}
+
+		// Register the connection, unless we are terminating
+		rs.connMutex.Lock()
+		if atomic.LoadInt32(&rs.status) == StatusTerminated {
+			rs.connMutex.Unlock()
+			connection.Close()
+			return
+		}
+		rs.connections[connection] = struct{}{}
+		rs.connMutex.Unlock()
+
+		go rs.connectionLoop(connection)
+	}
+}
+
+// Identifies the radius client, and then reads the requests and writes the responses
+func (rs *RadiusStreamServer) connectionLoop(connection net.Conn) {
+
+	defer func() {
+		rs.connMutex.Lock()
+		delete(rs.connections, connection)
+		rs.connMutex.Unlock()
+		connection.Close()
+	}()
+
+	clientIP := connection.RemoteAddr().(*net.TCPAddr).IP
+	clientIPAddr := clientIP.String()
+
+	radiusClient, err := rs.identifyClient(connection, clientIP)
+	if err != nil {
+		core.RecordRadiusServerDrop(clientIPAddr, "0")
+		core.GetLogger().Warnf("connection from unknown client %s: %s", clientIPAddr, err)
+		return
+	}
+	core.GetLogger().Debugf("accepted connection from %s as radius client %s", clientIPAddr, radiusClient.Name)
+
+	// For RadSec, the secret is fixed
+	secret := radiusClient.Secret
+	if rs.fixedSecret != "" {
+		secret = rs.fixedSecret
+	}
+
+	// Responses are written from different goroutines
+	var writeMutex sync.Mutex
+
+	for {
+		packetBytes, err := core.ReadRadiusPacketBytes(connection)
+		if err != nil {
+			if atomic.LoadInt32(&rs.status) != StatusTerminated {
+				core.GetLogger().Infof("closing connection from %s: %s", clientIPAddr, err)
+			}
+			return
+		}
+
+		radiusPacket, err := decodeRequest(packetBytes, clientIPAddr, secret, radiusClient.MessageAuthenticator)
+		if err != nil {
+			continue
+		}
+
+		// Status-Server is answered here
+		if radiusPacket.Code == core.STATUS_SERVER {
+			if respBuf, err := answerStatusServer(radiusPacket, clientIPAddr, secret, rs.statusServerResponseCode); err == nil {
+				writeMutex.Lock()
+				_, err = connection.Write(respBuf)
+				writeMutex.Unlock()
+				if err != nil {
+					core.GetLogger().Errorf("error sending packet to %s: %s", clientIPAddr, err)
+				}
+			}
+			continue
+		}
+
+		core.RecordRadiusServerRequest(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
+		core.GetLogger().Debugf("<- Server received RadiusPacket %s\n", radiusPacket)
+
+		// Process in a worker, unless overloaded
+		reason := rs.workers.submit(clientIPAddr, radiusPacket.Code == core.ACCESS_REQUEST, func() {
+
+			code := radiusPacket.Code
+
+			response, err := rs.handler(radiusPacket)
+			if err != nil {
+				core.GetLogger().Errorf("discarding packet for %s with code %d: %s", clientIPAddr, code, err)
+				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
+				return
+			}
+
+			// Build the response
+			respBuf, err := response.ToBytes(secret, radiusPacket.Identifier)
+			if err != nil {
+				core.GetLogger().Errorf("error serializing packet for %s with code %d: %s", clientIPAddr, code, err)
+				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
+				return
+			}
+
+			writeMutex.Lock()
+			_, err = connection.Write(respBuf)
+			writeMutex.Unlock()
+			if err != nil {
+				core.GetLogger().Errorf("error sending packet to %s with code %d: %s", clientIPAddr, code, err)
+				core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(code)))
+				return
+			}
+
+			core.RecordRadiusServerResponse(clientIPAddr, strconv.Itoa(int(code)))
+			core.GetLogger().Debugf("-> Server sent RadiusPacket %s\n", response)
+		})
+
+		if reason != "" {
+			core.GetLogger().Warnf("dropping packet from %s with code %d: %s", clientIPAddr, radiusPacket.Code, reason)
+			core.RecordRadiusServerOverloadDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)), reason)
+			core.RecordRadiusServerDrop(clientIPAddr, strconv.Itoa(int(radiusPacket.Code)))
+		}
+	}
+}
+
+// Finds the radius client for the connection. For TLS, the client is looked for by
+// the name in the certificate and, if not found, by the IP address
+func (rs *RadiusStreamServer) identifyClient(connection net.Conn, clientIP net.IP) (core.RadiusClient, error) {
+
+	if tlsConnection, ok := connection.(*tls.Conn); ok {
+		tlsConnection.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+		if err := tlsConnection.Handshake(); err != nil {
+			return core.RadiusClient{}, err
+		}
+		tlsConnection.SetDeadline(time.Time{})
+
+		// Only certificates verified against the configured CA are used
+		verifiedChains := tlsConnection.ConnectionState().VerifiedChains
+		if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			if radiusClient, err := rs.radiusClients.get().FindRadiusClientByCertificate(verifiedChains[0][0]); err == nil {
+				return radiusClient, nil
+			}
+		}
+	}
+
+	return rs.radiusClients.get().FindRadiusClient(clientIP)
+}
@@ -0,0 +1,145 @@
+package radiusserver
+
+import (
+	"sync"
+
+	"github.com/francistor/igor/core"
+)
+
+// Default number of goroutines processing the requests
+const DEFAULT_WORKERS = 200
+
+// Default number of requests waiting for a worker, for each priority
+const DEFAULT_QUEUE_SIZE = 1000
+
+// Reasons for dropping requests due to overload, used as label in the metrics
+const (
+	DropReasonQueueFull   = "queue_full"
+	DropReasonClientLimit = "client_limit"
+)
+
+// Executes the processing of the requests received by a RadiusServer, enforcing the configured limits.
+// There are two queues. The jobs in the high priority queue are always taken first by the workers.
+// If the number of workers configured is negative, a goroutine is started for each job, and only the
+// limit per client is enforced
+type workerPool struct {
+
+	// Configuration
+	limits core.RadiusServerLimits
+
+	// Jobs waiting for a worker
+	highPriorityQueue chan func()
+	lowPriorityQueue  chan func()
+
+	// Closed to signal the workers that they must finish
+	doneChan chan struct{}
+
+	// Number of jobs being processed or waiting, per client
+	inFlightMutex sync.Mutex
+	inFlight      map[string]int
+}
+
+// Creates the worker pool and starts the workers
+func newWorkerPool(limits core.RadiusServerLimits) *workerPool {
+
+	if limits.Workers == 0 {
+		limits.Workers = DEFAULT_WORKERS
+	}
+	if limits.QueueSize == 0 {
+		limits.QueueSize = DEFAULT_QUEUE_SIZE
+	}
+
+	wp := workerPool{
+		limits:   limits,
+		doneChan: make(chan struct{}),
+		inFlight: make(map[string]int),
+	}
+
+	if limits.Workers > 0 {
+		wp.highPriorityQueue = make(chan func(), limits.QueueSize)
+		wp.lowPriorityQueue = make(chan func(), limits.QueueSize)
+		for i := 0; i < limits.Workers; i++ {
+			go wp.worker()
+		}
+	}
+
+	return &wp
+}
+
+// Queues the job for execution. If it cannot be accepted, returns the reason, that will be
+// one of the DropReason constants. Otherwise, returns an empty string
+func (wp *workerPool) submit(clientIPAddr string, highPriority bool, job func()) string {
+
+	// Check the limit for the client
+	wp.inFlightMutex.Lock()
+	if wp.limits.MaxInFlightPerClient > 0 && wp.inFlight[clientIPAddr] >= wp.limits.MaxInFlightPerClient {
+		wp.inFlightMutex.Unlock()
+		return DropReasonClientLimit
+	}
+	wp.inFlight[clientIPAddr]++
+	wp.inFlightMutex.Unlock()
+
+	// The job releases its slot when finished
+	trackedJob := func() {
+		defer wp.release(clientIPAddr)
+		job()
+	}
+
+	// No workers. Just launch
+	if wp.limits.Workers < 0 {
+		go trackedJob()
+		return ""
+	}
+
+	queue := wp.lowPriorityQueue
+	if highPriority {
+		queue = wp.highPriorityQueue
+	}
+
+	select {
+	case queue <- trackedJob:
+		return ""
+	default:
+		wp.release(clientIPAddr)
+		return DropReasonQueueFull
+	}
+}
+
+// Signals that a job for the client has finished
+func (wp *workerPool) release(clientIPAddr string) {
+	wp.inFlightMutex.Lock()
+	defer wp.inFlightMutex.Unlock()
+
+	if wp.inFlight[clientIPAddr] <= 1 {
+		delete(wp.inFlight, clientIPAddr)
+	} else {
+		wp.inFlight[clientIPAddr]--
+	}
+}
+
+// Makes the workers finish. The jobs still in the queues are not executed
+func (wp *workerPool) close() {
+	close(wp.doneChan)
+}
+
+// Takes jobs from the queues, giving priority to the high priority one
+func (wp *workerPool) worker() {
+	for {
+		// Try first the high priority queue
+		select {
+		case job := <-wp.highPriorityQueue:
+			job()
+			continue
+		default:
+		}
+
+		select {
+		case <-wp.doneChan:
+			return
+		case job := <-wp.highPriorityQueue:
+			job()
+		case job := <-wp.lowPriorityQueue:
+			job()
+		}
+	}
+}
@@ -6,7 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
-	"sync"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -32,10 +32,21 @@ type DiameterPeerWithStatus struct {
 	lastError        error
 }
 
+// Immutable view of the engaged peers, used to route the requests in the goroutine of the
+// caller, without going through the event loop.
+// A new one is built and published by the event loop each time the peers table changes.
+// The routing rules are not part of it, since they may be updated without any change in
+// the peers, and are read from the configuration for each request
+type diameterRoutingSnapshot struct {
+	// Engaged peers, by Diameter-Host
+	peers map[string]*diampeer.DiameterPeer
+}
+
 // The Router handles the lifecycle of Peers and routes Diameter requests
 // to the appropriate destinations.
-// It follows the Actor model. All actions take place in the event loop and interaction is done through
-// channels
+// The lifecycle of the Peers follows the Actor model. Those actions take place in the event loop and
+// interaction is done through channels. The routing of requests takes place in the goroutine of the caller,
+// using the last snapshot of the peers table and routing rules published by the event loop
 type DiameterRouter struct {
 
 	// Configuration instance
@@ -47,8 +58,8 @@ type DiameterRouter struct {
 	// Stauts of the Router. May be StatusOperational or StatusClosed
 	status int32
 
-	// Accepter of incoming connections
-	listener net.Listener
+	// Accepters of incoming connections, one per bind address
+	listeners []net.Listener
 
 	// Holds the Peers Table.
 	// One entry for each configured peer or for peers now not configured but still not received
@@ -62,8 +73,9 @@ type DiameterRouter struct {
 	// Passed to the DiameterPeers to receive back lifecycle events
 	peerControlChannel chan interface{}
 
-	// Used to retreive Diameter Requests
-	diameterRequestsChan chan RoutableDiameterRequest
+	// Engaged peers. Holds a *diameterRoutingSnapshot that is replaced,
+	// never modified, by the event loop
+	routingSnapshot atomic.Value
 
 	// To receive commands to this Router
 	routerControlChannel chan interface{}
@@ -73,27 +85,28 @@ type DiameterRouter struct {
 	routerDoneChannel chan struct{}
 
 	// To make sure there are no outstanding requests pending
-	wg sync.WaitGroup
+	wg shardedWaitGroup
 
 	// HTTP2 client for sending requests to http handlers
 	http2Client http.Client
 
-	// Handler for requests to be treated locally
+	// Handler for requests to be treated locally, wrapped in the middlewares
 	localHandler core.DiameterMessageHandler
 }
 
 // Creates and runs a Router
-func NewDiameterRouter(instanceName string, handler core.DiameterMessageHandler) *DiameterRouter {
+// The handler is wrapped in the specified middlewares, the first one being the outermost, and
+// panics in any of them are always recovered and treated as errors
+func NewDiameterRouter(instanceName string, handler core.DiameterMessageHandler, middlewares ...core.DiameterMiddleware) *DiameterRouter {
 
 	router := DiameterRouter{
 		configInstanceName:   instanceName,
 		ci:                   core.GetPolicyConfigInstance(instanceName),
 		diameterPeersTable:   make(map[string]DiameterPeerWithStatus),
 		peerControlChannel:   make(chan interface{}, CONTROL_QUEUE_SIZE),
-		diameterRequestsChan: make(chan RoutableDiameterRequest, DIAMETER_REQUESTS_QUEUE_SIZE),
 		routerControlChannel: make(chan interface{}, CONTROL_QUEUE_SIZE),
 		routerDoneChannel:    make(chan struct{}, 1),
-		localHandler:         handler,
+		localHandler:         core.ChainDiameterHandler(handler, append([]core.DiameterMiddleware{core.DiameterRecoveryMiddleware}, middlewares...)...),
 	}
 
 	// Create an http client with timeout and http2 transport
@@ -104,6 +117,11 @@ func NewDiameterRouter(instanceName string, handler core.DiameterMessageHandler)
 		},
 	}
 
+	// Nothing to route to until started
+	router.routingSnapshot.Store(&diameterRoutingSnapshot{
+		peers: make(map[string]*diampeer.DiameterPeer),
+	})
+
 	return &router
 }
 
@@ -134,7 +152,6 @@ func (router *DiameterRouter) Close() {
 	router.routerControlChannel <- RouterCloseCommand{}
 
 	close(router.routerControlChannel)
-	close(router.diameterRequestsChan)
 	close(router.peerControlChannel)
 }
 
@@ -142,63 +159,27 @@ func (router *DiameterRouter) Close() {
 func (router *DiameterRouter) startAndAccept() {
 	logger := core.GetLogger()
 
-	// Server socket
+	// Server sockets
 	serverConf := router.ci.DiameterServerConf()
-	listenAddrAndPort := fmt.Sprintf("%s:%d", serverConf.BindAddress, serverConf.BindPort)
-	listener, err := net.Listen("tcp4", listenAddrAndPort)
-	if err != nil {
-		panic(err)
-	}
-	// Assign to instance variable
-	router.listener = listener
+	for _, bindAddress := range serverConf.BindAddresses {
+		listenAddrAndPort := net.JoinHostPort(bindAddress, strconv.Itoa(serverConf.BindPort))
+		listener, err := net.Listen(core.ListenNetwork("tcp", bindAddress), listenAddrAndPort)
+		if err != nil {
+			panic(err)
+		}
+		// Assign to instance variable
+		router.listeners = append(router.listeners, listener)
 
-	logger.Infof("Diameter server listening in %s", listenAddrAndPort)
+		logger.Infof("Diameter server listening in %s", listenAddrAndPort)
+	}
 
 	// First pass
 	router.updatePeersTable()
 
-	// Accepter loop
-	go func() {
-		for {
-			connection, err := router.listener.Accept()
-			if err != nil {
-				// Use atomic to avoid races, because this is executed out of the eventLoop (goroutine)
-				if atomic.LoadInt32(&router.status) != StatusTerminated {
-					logger.Info("error accepting connection", err)
-					panic(err)
-				}
-				// We are closing business. Finish acceptor loop
-				return
-			}
-
-			remoteAddr, _, _ := net.SplitHostPort(connection.RemoteAddr().String())
-			logger.Infof("accepted connection from %s", remoteAddr)
-			remoteIPAddr, _ := net.ResolveIPAddr("", remoteAddr)
-
-			// Check that the incoming IP address is on the list of originCIDR for declared Peers
-			peersConf := router.ci.DiameterPeers()
-			if !peersConf.ValidateIncomingAddress("", remoteIPAddr.IP) {
-				logger.Infof("received incoming connection from invalid peer %s\n", remoteIPAddr)
-				connection.Close()
-				continue
-			}
-
-			// Create peer for the accepted connection and start it
-			// The addition to the peers table will be done later,
-			// after the PeerUp event is received and checking that there is not a duplicate.
-			// Declares, as handler for the Peer, a function that injects here a message to be routed
-			logger.Info("Spawning passive DiameterPeer")
-			diampeer.NewPassiveDiameterPeer(
-				router.configInstanceName,
-				router.peerControlChannel,
-				connection,
-				// The specified handler will inject me the message
-				func(request *core.DiameterMessage) (*core.DiameterMessage, error) {
-					return router.RouteDiameterRequest(request, DEFAULT_REQUEST_TIMEOUT_SECONDS*time.Second)
-				},
-			)
-		}
-	}()
+	// Accepter loops
+	for _, listener := range router.listeners {
+		go router.acceptLoop(listener)
+	}
 
 	// Start ticker
 	peerCheckInterval := serverConf.PeerCheckTimeSeconds
@@ -208,6 +189,52 @@ func (router *DiameterRouter) startAndAccept() {
 	router.peerTableTicker = time.NewTicker(time.Duration(peerCheckInterval) * time.Second)
 }
 
+// Accepts incoming connections in the specified listener and creates the passive peers for them.
+// To be executed in a goroutine
+func (router *DiameterRouter) acceptLoop(listener net.Listener) {
+	logger := core.GetLogger()
+
+	for {
+		connection, err := listener.Accept()
+		if err != nil {
+			// Use atomic to avoid races, because this is executed out of the eventLoop (goroutine)
+			if atomic.LoadInt32(&router.status) != StatusTerminated {
+				logger.Info("error accepting connection", err)
+				panic(err)
+			}
+			// We are closing business. Finish acceptor loop
+			return
+		}
+
+		remoteAddr, _, _ := net.SplitHostPort(connection.RemoteAddr().String())
+		logger.Infof("accepted connection from %s", remoteAddr)
+		remoteIPAddr, _ := net.ResolveIPAddr("", remoteAddr)
+
+		// Check that the incoming IP address is on the list of originCIDR for declared Peers
+		peersConf := router.ci.DiameterPeers()
+		if !peersConf.ValidateIncomingAddress("", remoteIPAddr.IP) {
+			logger.Infof("received incoming connection from invalid peer %s\n", remoteIPAddr)
+			connection.Close()
+			continue
+		}
+
+		// Create peer for the accepted connection and start it
+		// The addition to the peers table will be done later,
+		// after the PeerUp event is received and checking that there is not a duplicate.
+		// Declares, as handler for the Peer, a function that injects here a message to be routed
+		logger.Info("Spawning passive DiameterPeer")
+		diampeer.NewPassiveDiameterPeer(
+			router.configInstanceName,
+			router.peerControlChannel,
+			connection,
+			// The specified handler will inject me the message
+			func(request *core.DiameterMessage) (*core.DiameterMessage, error) {
+				return router.RouteDiameterRequest(request, DEFAULT_REQUEST_TIMEOUT_SECONDS*time.Second)
+			},
+		)
+	}
+}
+
 // Actor model event loop
 func (router *DiameterRouter) eventLoop() {
 
@@ -232,8 +259,10 @@ func (router *DiameterRouter) eventLoop() {
 				// Stop the ticker
 				router.peerTableTicker.Stop()
 
-				// Close the tcp listener. The acceptor loop will exit
-				router.listener.Close()
+				// Close the tcp listeners. The acceptor loops will exit
+				for _, listener := range router.listeners {
+					listener.Close()
+				}
 
 				// Signal down all Peers that are up
 				for peer := range router.diameterPeersTable {
@@ -305,14 +334,13 @@ func (router *DiameterRouter) eventLoop() {
 					v.Sender.SetDown()
 				}
 
+				// Make the changes visible for routing
+				router.publishRoutingSnapshot()
+
 				// Update the PeersTable for instrumentation
 				core.PushDiameterPeersStatus(router.configInstanceName, router.buildPeersStatusTable())
 
 			case diampeer.PeerDownEvent:
-				// Closing may take time. Do it in the background
-				logger.Infof("closing %s", v.Sender.GetPeerConfig().DiameterHost)
-				go v.Sender.Close()
-
 				// Update the status in the peers table
 				// Look for peer based on pointer identity, not OriginHost identity.
 				// Mark as disengaged. Ignore if not found (might be unconfigured
@@ -335,6 +363,14 @@ func (router *DiameterRouter) eventLoop() {
 					delete(router.diameterPeersTable, peer.DiameterHost)
 				}
 
+				// Make the changes visible for routing
+				router.publishRoutingSnapshot()
+
+				// Closing may take time. Do it in the background, once the peer is not in the routing
+				// snapshot any more. Requests dispatched with a previous snapshot will get an error
+				logger.Infof("closing %s", v.Sender.GetPeerConfig().DiameterHost)
+				go v.Sender.Close()
+
 				// Update the PeersTable for instrumentation
 				core.PushDiameterPeersStatus(router.configInstanceName, router.buildPeersStatusTable())
 
@@ -352,111 +388,6 @@ func (router *DiameterRouter) eventLoop() {
 					close(router.routerDoneChannel)
 				}
 			}
-
-			// Diameter Request message to be routed
-		case rdr := <-router.diameterRequestsChan:
-
-			var route core.DiameterRoutingRule
-			var err error
-
-			if router.status == StatusTerminated {
-				rdr.RChan <- fmt.Errorf("diameter router is terminated")
-				close(rdr.RChan)
-			} else if route, err = router.ci.DiameterRoutingRules().FindDiameterRoutingRule(
-				rdr.Message.GetStringAVP("Destination-Realm"),
-				rdr.Message.ApplicationName,
-				false); err != nil {
-				core.RecordRouterRouteNotFound("", rdr.Message)
-				rdr.RChan <- fmt.Errorf("request not sent: no route found")
-				close(rdr.RChan)
-			} else {
-				// Route found
-				logger.Debugf("Found matching rule %v", route)
-				if len(route.Peers) > 0 {
-					// Route to destination peer
-					// If policy is "random", shuffle the destination-hosts
-					var peers []string
-					peers = append(peers, route.Peers...)
-					if route.Policy == "random" {
-						rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
-					}
-
-					var engagedPeerFound = false
-					for _, destinationHost := range peers {
-						targetPeer := router.diameterPeersTable[destinationHost]
-						if targetPeer.isEngaged {
-							// Route found. Send request asyncronously. Answer will be sent to the response channel
-							engagedPeerFound = true
-							logger.Debugf("Selected Peer: %s", destinationHost)
-							go func(r RoutableDiameterRequest) {
-								targetPeer.peer.DiameterExchange(r.Message, r.Timeout, r.RChan)
-							}(rdr)
-						}
-					}
-
-					if !engagedPeerFound {
-						core.RecordRouterNoAvailablePeer("", rdr.Message)
-						rdr.RChan <- fmt.Errorf("resquest not sent: no engaged peer")
-						close(rdr.RChan)
-					}
-
-				} else if len(route.Handlers) > 0 {
-					// Use http handlers
-
-					// For handlers there is not such a thing as fixed policy
-					var destinationURLs []string
-					destinationURLs = append(destinationURLs, route.Handlers...)
-					// TODO: Uncomment for true randomness
-					//rand.Seed(time.Now().UnixNano())
-					rand.Shuffle(len(destinationURLs), func(i, j int) { destinationURLs[i], destinationURLs[j] = destinationURLs[j], destinationURLs[i] })
-
-					// Send to the handler asynchronously
-					logger.Debugf("Selected Handler: %s", destinationURLs[0])
-					go func(rchan chan interface{}, diameterRequest *core.DiameterMessage, url string) {
-
-						// Make sure the response channel is closed
-						defer close(rchan)
-
-						if answer, err := HttpDiameterRequest(router.http2Client, url, diameterRequest); err != nil {
-							logger.Errorf("http handler %s returned error: %s", url, err.Error())
-							core.RecordRouterHandlerError("", diameterRequest)
-							rchan <- err
-						} else {
-							// Add the Origin-Host and Origin-Realm, that are not set by the handler
-							// because it lacks that configuration
-							answer.AddOriginAVPs(router.ci)
-							rchan <- answer
-						}
-
-					}(rdr.RChan, rdr.Message, destinationURLs[0])
-
-				} else {
-					// Handle locally
-					go func(rchan chan interface{}, diameterRequest *core.DiameterMessage) {
-
-						// Make sure the response channel is closed
-						defer func() {
-							close(rchan)
-						}()
-
-						answer, err := router.localHandler(diameterRequest)
-						if err != nil {
-							logger.Errorf("local handler returned error: %s", err.Error())
-							core.RecordRouterHandlerError("", diameterRequest)
-							rchan <- err
-						} else {
-							// Add the Origin-Host and Origin-Realm, that are not set by the handler
-							// because it lacks that configuration
-							answer.AddOriginAVPs(router.ci)
-							rchan <- answer
-						}
-
-					}(rdr.RChan, rdr.Message)
-				}
-			}
-
-			// Corresponding to RouteDiameterRequest
-			router.wg.Done()
 		}
 	}
 }
@@ -465,16 +396,11 @@ func (router *DiameterRouter) eventLoop() {
 func (router *DiameterRouter) RouteDiameterRequest(request *core.DiameterMessage, timeout time.Duration) (*core.DiameterMessage, error) {
 	responseChannel := make(chan interface{}, 1)
 
-	routableRequest := RoutableDiameterRequest{
+	router.dispatchDiameterRequest(RoutableDiameterRequest{
 		Message: request,
 		RChan:   responseChannel,
 		Timeout: timeout,
-	}
-
-	// Will be Done() after processing the message
-	router.wg.Add(1)
-
-	router.diameterRequestsChan <- routableRequest
+	})
 
 	r := <-responseChannel
 	switch v := r.(type) {
@@ -491,16 +417,11 @@ func (router *DiameterRouter) RouteDiameterRequest(request *core.DiameterMessage
 func (router *DiameterRouter) RouteDiameterRequestAsync(request *core.DiameterMessage, timeout time.Duration, handler func(*core.DiameterMessage, error)) {
 	rchan := make(chan interface{}, 1)
 
-	routableRequest := RoutableDiameterRequest{
+	router.dispatchDiameterRequest(RoutableDiameterRequest{
 		Message: request,
 		RChan:   rchan,
 		Timeout: timeout,
-	}
-
-	// Will be Done() after processing the message
-	router.wg.Add(1)
-
-	router.diameterRequestsChan <- routableRequest
+	})
 
 	go func(rc chan interface{}) {
 		r := <-rc
@@ -516,6 +437,109 @@ func (router *DiameterRouter) RouteDiameterRequestAsync(request *core.DiameterMe
 	}(rchan)
 }
 
+// Finds the destination of the request and sends it. The answer or error will be sent to the
+// response channel of the request, which will then be closed.
+// Executed in the goroutine of the caller, using the current routing rules and the last published
+// snapshot of the engaged peers, so that requests are not serialized through the event loop
+func (router *DiameterRouter) dispatchDiameterRequest(rdr RoutableDiameterRequest) {
+
+	logger := core.GetLogger()
+
+	// Make sure that the Router is not closed before the request is dispatched
+	wg := router.wg.Add(rdr.Message.HopByHopId)
+	defer wg.Done()
+
+	if atomic.LoadInt32(&router.status) == StatusTerminated {
+		rdr.RChan <- fmt.Errorf("diameter router is terminated")
+		close(rdr.RChan)
+		return
+	}
+
+	snapshot := router.routingSnapshot.Load().(*diameterRoutingSnapshot)
+
+	route, err := router.ci.DiameterRoutingRules().FindDiameterRoutingRule(rdr.Message.GetStringAVP("Destination-Realm"), rdr.Message.ApplicationName, false)
+	if err != nil {
+		core.RecordRouterRouteNotFound("", rdr.Message)
+		rdr.RChan <- fmt.Errorf("request not sent: no route found")
+		close(rdr.RChan)
+		return
+	}
+
+	// Route found
+	logger.Debugf("Found matching rule %v", route)
+	if len(route.Peers) > 0 {
+		// Route to destination peer
+		// If policy is "random", start looking for an engaged peer in a random position
+		var offset = 0
+		if route.Policy == "random" {
+			offset = rand.Intn(len(route.Peers))
+		}
+
+		for i := range route.Peers {
+			destinationHost := route.Peers[(i+offset)%len(route.Peers)]
+			if targetPeer, found := snapshot.peers[destinationHost]; found {
+				// Route found. Send request asyncronously. Answer will be sent to the response channel
+				logger.Debugf("Selected Peer: %s", destinationHost)
+				targetPeer.DiameterExchange(rdr.Message, rdr.Timeout, rdr.RChan)
+				return
+			}
+		}
+
+		core.RecordRouterNoAvailablePeer("", rdr.Message)
+		rdr.RChan <- fmt.Errorf("resquest not sent: no engaged peer")
+		close(rdr.RChan)
+
+	} else if len(route.Handlers) > 0 {
+		// Use http handlers
+
+		// For handlers there is not such a thing as fixed policy
+		destinationURL := route.Handlers[rand.Intn(len(route.Handlers))]
+
+		// Send to the handler asynchronously
+		logger.Debugf("Selected Handler: %s", destinationURL)
+		go func(rchan chan interface{}, diameterRequest *core.DiameterMessage, url string) {
+
+			// Make sure the response channel is closed
+			defer close(rchan)
+
+			if answer, err := HttpDiameterRequest(router.http2Client, url, diameterRequest); err != nil {
+				logger.Errorf("http handler %s returned error: %s", url, err.Error())
+				core.RecordRouterHandlerError("", diameterRequest)
+				rchan <- err
+			} else {
+				// Add the Origin-Host and Origin-Realm, that are not set by the handler
+				// because it lacks that configuration
+				answer.AddOriginAVPs(router.ci)
+				rchan <- answer
+			}
+
+		}(rdr.RChan, rdr.Message, destinationURL)
+
+	} else {
+		// Handle locally
+		go func(rchan chan interface{}, diameterRequest *core.DiameterMessage) {
+
+			// Make sure the response channel is closed
+			defer func() {
+				close(rchan)
+			}()
+
+			answer, err := router.localHandler(diameterRequest)
+			if err != nil {
+				logger.Errorf("local handler returned error: %s", err.Error())
+				core.RecordRouterHandlerError("", diameterRequest)
+				rchan <- err
+			} else {
+				// Add the Origin-Host and Origin-Realm, that are not set by the handler
+				// because it lacks that configuration
+				answer.AddOriginAVPs(router.ci)
+				rchan <- answer
+			}
+
+		}(rdr.RChan, rdr.Message)
+	}
+}
+
 // Takes the current map of DiameterPeers and generates a new one based on the current configuration
 // There is an entry per configured peer, either active or passive. Entries unconfigured for which the
 // PeerDown command has not yet been received will still be present in the table, to be removed later.
@@ -561,10 +585,28 @@ func (router *DiameterRouter) updatePeersTable() {
 		}
 	}
 
+	// Make the changes visible for routing
+	router.publishRoutingSnapshot()
+
 	// Update for instrumentation
 	core.PushDiameterPeersStatus(router.configInstanceName, router.buildPeersStatusTable())
 }
 
+// Builds a new routing snapshot with the engaged peers, and makes it available for the routing of requests.
+// To be executed in the event loop
+func (router *DiameterRouter) publishRoutingSnapshot() {
+	peers := make(map[string]*diampeer.DiameterPeer)
+	for diameterHost, peerStatus := range router.diameterPeersTable {
+		if peerStatus.isEngaged && peerStatus.peer != nil {
+			peers[diameterHost] = peerStatus.peer
+		}
+	}
+
+	router.routingSnapshot.Store(&diameterRoutingSnapshot{
+		peers: peers,
+	})
+}
+
 // Generates the DiameterPeersTableEntry for instrumetation purposes, using the current
 // internal table and shuffling the fields as necessary to adjust the contents
 func (router *DiameterRouter) buildPeersStatusTable() core.DiameterPeersTable {
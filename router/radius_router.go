@@ -1,16 +1,21 @@
 package router
 
 import (
+	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
 	"github.com/francistor/igor/radiusclient"
 	"github.com/francistor/igor/radiusserver"
 
@@ -34,15 +39,30 @@ type RadiusServerWithStatus struct {
 
 	// Quarantined time. If in the past, the server is not quarantined
 	unavailableUntil time.Time
+
+	// Status-Server probes answered in a row while unavailable
+	probeSuccesses int
+
+	// Time and round trip time of the last probe answered
+	lastProbeTime time.Time
+	lastProbeRTT  time.Duration
+
+	// Timer for the next probe. nil if not waiting to probe
+	probeTimer *time.Timer
 }
 
 // Encapsulates the data passed to the RadiusClient, once the routing has been
 // performed
 type RadiusRequestParamsSet struct {
-	endpoint   string
-	originPort int
-	secret     string
-	serverName string
+	endpoint      string
+	originAddress string
+	originPort    int
+	secret        string
+	serverName    string
+	// Check to perform on the Message-Authenticator of the response
+	messageAuthenticatorPolicy string
+	// "udp", "tcp" or "radsec"
+	transport string
 	// For optimization. Store here if the server has numErrors > 0, because if this is the case,
 	// and the requests successd, it should be reset to zero.
 	hasErrors bool
@@ -62,6 +82,25 @@ type RadiusRequestResult struct {
 	ok         bool
 }
 
+// Sent when it is time to probe an unavailable server with Status-Server
+type ProbeRadiusServer struct {
+	serverName string
+}
+
+// To signal the result of a Status-Server probe
+type RadiusProbeResult struct {
+	serverName string
+	ok         bool
+	rtt        time.Duration
+}
+
+// Routing rules for the received requests, with the attribute filters they use, which are
+// verified to exist when built
+type radiusRouting struct {
+	rules   core.RadiusRoutingRules
+	filters handler.RadiusAVPFilters
+}
+
 // Receives radius packets and decides how to treat them
 // Radius packets may be received through one of the UDP dockets in the spun up RadiusServers, or
 // programatically, encapsulated in RoutableRadiusPacket messages, which contain a radius packet
@@ -74,7 +113,8 @@ type RadiusRequestResult struct {
 // and sends the packet to the appropriate RadiusClient. It also manages the request-level retries.
 //
 // The status of the radius servers is kept on a table. Radius Server are marked as "down" when the number of timeouts in a row
-// exceeds the configured value.
+// exceeds the configured value. If so configured, unavailable servers are probed with Status-Server, and are not used again
+// until the probes are answered.
 //
 // Requests may be sent to configured radius groups or to stand-alone servers using just destination IP address and secret. The
 // status of those is not tracked.
@@ -103,14 +143,19 @@ type RadiusRouter struct {
 	// Radius Client
 	radiusClient *radiusclient.RadiusClient
 
-	// RadiusServers
-	authServer *radiusserver.RadiusServer
-	acctServer *radiusserver.RadiusServer
-	coaServer  *radiusserver.RadiusServer
+	// UDP RadiusServers, for all the services and bind addresses
+	udpServers []*radiusserver.RadiusServer
+
+	// TCP and RadSec servers
+	streamServers []*radiusserver.RadiusStreamServer
 
-	// Function to handle messages not sent to http handlers
+	// Function to handle messages not sent to http handlers, wrapped in the middlewares
 	localHandler core.RadiusPacketHandler
 
+	// Routing rules for the received requests and attribute filters for the proxied requests and responses,
+	// as a *radiusRouting. Replaced when the configuration is updated
+	radiusRouting atomic.Value
+
 	// Status of this Router
 	status int32
 
@@ -122,17 +167,20 @@ type RadiusRouter struct {
 }
 
 // Creates and runs a Router
-func NewRadiusRouter(instanceName string, localHandler core.RadiusPacketHandler) *RadiusRouter {
+// The localHandler is wrapped in the specified middlewares, the first one being the outermost, and
+// panics in any of them are always recovered and treated as errors
+func NewRadiusRouter(instanceName string, localHandler core.RadiusPacketHandler, middlewares ...core.RadiusMiddleware) *RadiusRouter {
 
+	ci := core.GetPolicyConfigInstance(instanceName)
 	router := RadiusRouter{
 		instanceName:       instanceName,
-		ci:                 core.GetPolicyConfigInstance(instanceName),
+		ci:                 ci,
 		radiusServersTable: make(map[string]*RadiusServerWithStatus),
 		radiusRequestsChan: make(chan RoutableRadiusRequest, RADIUS_REQUESTS_QUEUE_SIZE),
 		routerControlChan:  make(chan interface{}, CONTROL_QUEUE_SIZE),
 		doneChan:           make(chan interface{}, 1),
-		radiusClient:       radiusclient.NewRadiusClient(),
-		localHandler:       localHandler,
+		radiusClient:       radiusclient.NewRadiusClientWithConfig(ci),
+		localHandler:       core.ChainRadiusHandler(localHandler, append([]core.RadiusMiddleware{core.RadiusRecoveryMiddleware}, middlewares...)...),
 	}
 
 	// Create an http client with timeout and http2 transport
@@ -147,6 +195,10 @@ func NewRadiusRouter(instanceName string, localHandler core.RadiusPacketHandler)
 		},
 	}
 
+	if err := router.updateRadiusRouting(); err != nil {
+		panic("could not build radius routing configuration: " + err.Error())
+	}
+
 	// First pass for building the radius server table and signal that we must send it to instrumentation.
 	// Sending must be done within the event loop in order to ensure that the table is in a consistent state.
 	router.buildRadiusServersTable()
@@ -163,21 +215,54 @@ func (router *RadiusRouter) Start() *RadiusRouter {
 	radiusServerConf := router.ci.RadiusServerConf()
 
 	// Function to be used for the RadiusServers.
-	// This handler function sends the request to this router, signalling that it must not be sent to
-	// an upstream server (destination = ""). This forces to be handled locally.
-	handler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
-		return router.RouteRadiusRequest(request /* destination */, "", 0, 0, 0 /* secret */, "")
+	// This handler function sends the request to this router, to be proxied or handled locally
+	// as specified in the radius routing rules
+	handler := router.routeReceivedRadiusRequest
+
+	// Retransmissions are detected during this time
+	duplicateCacheLifetime := radiusserver.DEFAULT_DUPLICATE_CACHE_LIFETIME
+	if radiusServerConf.DuplicateCacheSeconds < 0 {
+		duplicateCacheLifetime = 0
+	} else if radiusServerConf.DuplicateCacheSeconds > 0 {
+		duplicateCacheLifetime = time.Duration(radiusServerConf.DuplicateCacheSeconds) * time.Second
 	}
 
-	// Start the servers
-	if radiusServerConf.AuthPort != 0 {
-		router.authServer = radiusserver.NewRadiusServer(router.ci.RadiusClients(), radiusServerConf.BindAddress, radiusServerConf.AuthPort, handler)
+	// The services to start, with the addresses, port and code of the response to Status-Server for each one
+	services := []struct {
+		bindAddresses            []string
+		port                     int
+		statusServerResponseCode core.RadiusPacketType
+	}{
+		{radiusServerConf.AuthBindAddresses, radiusServerConf.AuthPort, core.ACCESS_ACCEPT},
+		{radiusServerConf.AcctBindAddresses, radiusServerConf.AcctPort, core.ACCOUNTING_RESPONSE},
+		{radiusServerConf.CoABindAddresses, radiusServerConf.CoAPort, 0},
 	}
-	if radiusServerConf.AcctPort != 0 {
-		router.acctServer = radiusserver.NewRadiusServer(router.ci.RadiusClients(), radiusServerConf.BindAddress, radiusServerConf.AcctPort, handler)
+
+	// Start the servers, one for each address of each service
+	for _, service := range services {
+		if service.port == 0 {
+			continue
+		}
+		options := radiusserver.RadiusServerOptions{
+			DuplicateCacheLifetime:   duplicateCacheLifetime,
+			StatusServerResponseCode: service.statusServerResponseCode,
+			Limits:                   radiusServerConf.RadiusServerLimits,
+		}
+		for _, bindAddress := range service.bindAddresses {
+			router.udpServers = append(router.udpServers, radiusserver.NewRadiusServerWithOptions(router.ci.RadiusClients(), bindAddress, service.port, options, handler))
+			if radiusServerConf.EnableTCP {
+				router.streamServers = append(router.streamServers, radiusserver.NewRadiusTCPServerWithOptions(router.ci.RadiusClients(), bindAddress, service.port, options, handler))
+			}
+		}
 	}
-	if radiusServerConf.CoAPort != 0 {
-		router.coaServer = radiusserver.NewRadiusServer(router.ci.RadiusClients(), radiusServerConf.BindAddress, radiusServerConf.CoAPort, handler)
+	if radiusServerConf.RadSecPort != 0 {
+		tlsConfig, err := core.NewRadSecTLSConfig(radiusServerConf.RadSecCertFile, radiusServerConf.RadSecKeyFile, radiusServerConf.RadSecCAFile, true)
+		if err != nil {
+			panic("could not build RadSec configuration: " + err.Error())
+		}
+		for _, bindAddress := range radiusServerConf.BindAddresses {
+			router.streamServers = append(router.streamServers, radiusserver.NewRadSecServer(router.ci.RadiusClients(), bindAddress, radiusServerConf.RadSecPort, tlsConfig, radiusServerConf.RadiusServerLimits, handler))
+		}
 	}
 
 	// Start the event loop
@@ -202,14 +287,11 @@ func (router *RadiusRouter) Close() {
 	<-router.doneChan
 
 	// Servers
-	if router.authServer != nil {
-		router.authServer.Close()
-	}
-	if router.acctServer != nil {
-		router.acctServer.Close()
+	for _, udpServer := range router.udpServers {
+		udpServer.Close()
 	}
-	if router.coaServer != nil {
-		router.coaServer.Close()
+	for _, streamServer := range router.streamServers {
+		streamServer.Close()
 	}
 
 	// close the client
@@ -226,11 +308,74 @@ func (router *RadiusRouter) Close() {
 	close(router.routerControlChan)
 }
 
-// Reload upstream radius servers configuration
+// Reload the radius clients and routing rules, and rebuild the upstream radius servers table.
+// The radius clients are read again from the configured origin and the running radius
+// servers use them for the packets received from now on. If the radius clients or the routing
+// rules cannot be read, the previous ones are kept
 func (router *RadiusRouter) UpdateConfiguration() {
+	if err := router.ci.UpdateRadiusClients(); err != nil {
+		core.GetLogger().Errorf("could not update radius clients: %s", err)
+	} else {
+		router.updateRadiusClients(router.ci.RadiusClients())
+	}
+	if err := router.ci.UpdateRadiusRoutingRules(); err != nil && !errors.Is(err, core.ErrObjectNotFound) {
+		core.GetLogger().Errorf("could not update radius routing rules: %s", err)
+	}
+	if err := router.updateRadiusRouting(); err != nil {
+		core.GetLogger().Errorf("could not update radius routing configuration: %s", err)
+	}
+
 	router.routerControlChan <- UpdateRadiusTable{}
 }
 
+// Builds the radius routing configuration from the current radius routing rules and the attribute filters,
+// which are read again, checking that all the filters referenced in the rules exist. If there is an error,
+// the previous configuration is kept. The attribute filters configuration object is optional
+func (router *RadiusRouter) updateRadiusRouting() error {
+	filters, err := handler.NewAVPFilters(RADIUS_FILTERS_CONFIG_OBJECT, router.ci)
+	if err != nil {
+		if !errors.Is(err, core.ErrObjectNotFound) {
+			return fmt.Errorf("could not read radius filters: %w", err)
+		}
+		filters = handler.RadiusAVPFilters{}
+	}
+
+	routing, err := newRadiusRouting(router.ci.RadiusRoutingRules(), filters)
+	if err != nil {
+		return err
+	}
+
+	router.radiusRouting.Store(routing)
+	return nil
+}
+
+// Builds the radius routing configuration, checking that all the filters referenced in the rules exist
+func newRadiusRouting(rules core.RadiusRoutingRules, filters handler.RadiusAVPFilters) (*radiusRouting, error) {
+	for _, rule := range rules {
+		for _, filterName := range []string{rule.RequestFilter, rule.ResponseFilter} {
+			if _, found := filters[filterName]; filterName != "" && !found {
+				return nil, fmt.Errorf("radius filter %s in routing rule for realm %s not found", filterName, rule.Realm)
+			}
+		}
+	}
+
+	return &radiusRouting{rules: rules, filters: filters}, nil
+}
+
+// Sets the radius clients in all the running radius servers
+func (router *RadiusRouter) updateRadiusClients(radiusClients core.RadiusClients) {
+	if !router.isStarted {
+		return
+	}
+
+	for _, udpServer := range router.udpServers {
+		udpServer.UpdateRadiusClients(radiusClients)
+	}
+	for _, streamServer := range router.streamServers {
+		streamServer.UpdateRadiusClients(radiusClients)
+	}
+}
+
 // Event loop for implementing the Actor model
 func (router *RadiusRouter) eventLoop() {
 	for {
@@ -248,6 +393,9 @@ func (router *RadiusRouter) eventLoop() {
 
 				router.status = StatusTerminated
 
+				// No more probes
+				router.stopProbes()
+
 				// Close the radius client. This will cancel all requests
 				router.radiusClient.SetDown()
 
@@ -281,6 +429,12 @@ func (router *RadiusRouter) eventLoop() {
 								now := time.Now()
 								rsws.unavailableUntil = now.Add(time.Duration(rsws.conf.QuarantineTimeSeconds) * time.Second)
 								router.routerControlChan <- SendRadiusTable{}
+
+								// Start probing, if so configured
+								if rsws.conf.ProbeIntervalSeconds > 0 && router.status != StatusTerminated {
+									rsws.probeSuccesses = 0
+									router.scheduleProbe(v.serverName, rsws)
+								}
 							}
 						} else {
 							// Reset the counter when a success comes
@@ -293,6 +447,35 @@ func (router *RadiusRouter) eventLoop() {
 
 				}
 				// Server will not be found if has not got a name (not declared in configuration as part of server group)
+
+			case ProbeRadiusServer:
+
+				// The server may have been made available or the table rebuilt in the meanwhile
+				if rsws, found := router.radiusServersTable[v.serverName]; found && !rsws.isAvailable && router.status != StatusTerminated {
+					rsws.probeTimer = nil
+					router.sendProbe(v.serverName, rsws)
+				}
+
+			case RadiusProbeResult:
+
+				if rsws, found := router.radiusServersTable[v.serverName]; found && !rsws.isAvailable && router.status != StatusTerminated {
+					if v.ok {
+						rsws.probeSuccesses++
+						rsws.lastProbeTime = time.Now()
+						rsws.lastProbeRTT = v.rtt
+					} else {
+						rsws.probeSuccesses = 0
+					}
+
+					// Back to available only if the quarantine has elapsed and the server has answered
+					if rsws.probeSuccesses >= rsws.conf.ProbeSuccesses && rsws.unavailableUntil.Before(time.Now()) {
+						rsws.isAvailable = true
+						rsws.numErrors = 0
+					} else {
+						router.scheduleProbe(v.serverName, rsws)
+					}
+					router.routerControlChan <- SendRadiusTable{}
+				}
 			}
 
 		case rrr := <-router.radiusRequestsChan:
@@ -324,14 +507,15 @@ func (router *RadiusRouter) eventLoop() {
 						for _, requestParamsSet := range rps {
 							// Channel to get the answer
 							ch := make(chan interface{}, 1)
-							router.radiusClient.RadiusExchange(
-								requestParamsSet.endpoint,
-								requestParamsSet.originPort,
-								req.Packet,
-								req.PerRequestTimeout,
-								req.ServerTries,
-								requestParamsSet.secret,
-								ch)
+							router.radiusClient.RadiusExchangeWithOptions(requestParamsSet.endpoint, req.Packet, radiusclient.RadiusExchangeOptions{
+								OriginAddress:              requestParamsSet.originAddress,
+								OriginPort:                 requestParamsSet.originPort,
+								Timeout:                    req.PerRequestTimeout,
+								ServerTries:                req.ServerTries,
+								Secret:                     requestParamsSet.secret,
+								MessageAuthenticatorPolicy: requestParamsSet.messageAuthenticatorPolicy,
+								Transport:                  requestParamsSet.transport,
+							}, ch)
 
 							// Block here until response or error
 							response := <-ch
@@ -462,6 +646,116 @@ func (router *RadiusRouter) RouteRadiusRequest(packet *core.RadiusPacket, destin
 	panic("got an answer that was not error or pointer to radius packet")
 }
 
+// Treats a request received by the radius servers of this router, as specified in the radius routing
+// rules. If a rule for the realm of the User-Name specifies a server group for the code of the request,
+// the request is proxied to that group with the filters of the rule. Otherwise, the request is handled
+// locally. In both cases, the realm is removed from the User-Name if so specified in the rule
+func (router *RadiusRouter) routeReceivedRadiusRequest(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+
+	routing := router.radiusRouting.Load().(*radiusRouting)
+
+	userName := request.GetStringAVP("User-Name")
+	rule, routedUserName, err := routing.rules.FindRadiusRoutingRule(userName)
+	if err != nil {
+		// No rule. Handle locally
+		return router.RouteRadiusRequest(request, "", 0, 0, 0, "")
+	}
+
+	if routedUserName != userName {
+		request.Replace("User-Name", routedUserName)
+	}
+
+	serverGroup := rule.ServerGroupFor(request.Code)
+	if serverGroup == "" {
+		return router.RouteRadiusRequest(request, "", 0, 0, 0, "")
+	}
+
+	// The filters were checked to exist when the configuration was loaded
+	var requestFilter, responseFilter *handler.RadiusAVPFilter
+	if rule.RequestFilter != "" {
+		requestFilter = routing.filters[rule.RequestFilter]
+	}
+	if rule.ResponseFilter != "" {
+		responseFilter = routing.filters[rule.ResponseFilter]
+	}
+
+	perRequestTimeout := DEFAULT_REQUEST_TIMEOUT_SECONDS * time.Second
+	if rule.PerRequestTimeoutMillis > 0 {
+		perRequestTimeout = time.Duration(rule.PerRequestTimeoutMillis) * time.Millisecond
+	}
+	tries := 1
+	if rule.Tries > 0 {
+		tries = rule.Tries
+	}
+	serverTries := 1
+	if rule.ServerTries > 0 {
+		serverTries = rule.ServerTries
+	}
+
+	return router.ProxyRadiusRequest(request, serverGroup, perRequestTimeout, tries, serverTries, "", requestFilter, responseFilter)
+}
+
+// Proxies a request received from a radius client to the specified destination, which is treated as in
+// RouteRadiusRequest, and returns the response to send to that client.
+// The request sent is a copy of the received one, with the requestFilter applied if not nil and a Proxy-State
+// appended, which is removed from the response. The encrypted attributes are decrypted when received and
+// encrypted again with the secret of the destination, and the same happens with the ones in the response.
+// CHAP-Password depends on the authenticator of the request, so that a CHAP-Challenge with the original
+// authenticator is added if the request does not include one.
+// The response keeps the code sent by the upstream server, so that rejects are relayed as such, and is copied
+// with the responseFilter applied, if not nil, and the identifier and authenticator of the received request
+func (router *RadiusRouter) ProxyRadiusRequest(request *core.RadiusPacket, destination string,
+	perRequestTimeout time.Duration, tries int, serverTries int, secret string,
+	requestFilter *handler.RadiusAVPFilter, responseFilter *handler.RadiusAVPFilter) (*core.RadiusPacket, error) {
+
+	// The request will be modified when sent, so that a copy is proxied
+	var proxyRequest *core.RadiusPacket
+	if requestFilter != nil {
+		proxyRequest = requestFilter.FilteredPacket(request)
+	} else {
+		proxyRequest = request.Copy(nil, nil)
+	}
+
+	// Keep the challenge of the CHAP-Password
+	if _, err := proxyRequest.GetAVP("CHAP-Password"); err == nil {
+		if _, err := proxyRequest.GetAVP("CHAP-Challenge"); err != nil {
+			if challenge, err := request.GetAVP("CHAP-Challenge"); err == nil {
+				proxyRequest.AddAVP(&challenge)
+			} else {
+				proxyRequest.Add("CHAP-Challenge", request.Authenticator[:])
+			}
+		}
+	}
+
+	// Our own Proxy-State, after the ones already in the request
+	proxyState := core.BuildRandomAuthenticator()
+	proxyRequest.Add("Proxy-State", proxyState[:])
+
+	response, err := router.RouteRadiusRequest(proxyRequest, destination, perRequestTimeout, tries, serverTries, secret)
+	if err != nil {
+		return response, err
+	}
+
+	// Remove our Proxy-State, which should be the last one
+	proxyStateFound := false
+	for i := len(response.AVPs) - 1; i >= 0; i-- {
+		if response.AVPs[i].Name == "Proxy-State" && bytes.Equal(response.AVPs[i].GetOctets(), proxyState[:]) {
+			response.AVPs = append(response.AVPs[:i], response.AVPs[i+1:]...)
+			proxyStateFound = true
+			break
+		}
+	}
+	if !proxyStateFound {
+		core.GetLogger().Warnf("Proxy-State not received in response from %s", destination)
+	}
+
+	if responseFilter != nil {
+		response = responseFilter.FilteredPacket(response)
+	}
+
+	return response.MakeResponseTo(request), nil
+}
+
 // Same as RouteRadiusRequests, but does not block: executes the specified handler
 func (router *RadiusRouter) RouteRadiusRequestAsync(destination string, packet *core.RadiusPacket,
 	perRequestTimeout time.Duration, tries int, serverTries int, secret string, handler func(*core.RadiusPacket, error)) {
@@ -511,7 +805,8 @@ func (router *RadiusRouter) getRouteParams(req RoutableRadiusRequest) []RadiusRe
 		originPorts := router.ci.RadiusServerConf().OriginPorts
 		routeParam := RadiusRequestParamsSet{
 			// Get ip if a name was specified as destination
-			endpoint: normalizeEndpoint(req.Destination),
+			endpoint:      normalizeEndpoint(req.Destination),
+			originAddress: router.ci.RadiusServerConf().OriginAddress,
 			// Choose one of the origin ports at random
 			originPort: originPorts[rand.Intn(len(originPorts))],
 			secret:     req.Secret,
@@ -531,8 +826,8 @@ func (router *RadiusRouter) getRouteParams(req RoutableRadiusRequest) []RadiusRe
 				if server.isAvailable {
 					availableServerNames = append(availableServerNames, serverName)
 				} else {
-					// Still could be available
-					if server.unavailableUntil.Before(time.Now()) {
+					// Still could be available. If probed, only the probes make it available again
+					if server.conf.ProbeIntervalSeconds == 0 && server.unavailableUntil.Before(time.Now()) {
 						server.isAvailable = true
 						availableServerNames = append(availableServerNames, serverName)
 						router.routerControlChan <- SendRadiusTable{}
@@ -556,14 +851,7 @@ func (router *RadiusRouter) getRouteParams(req RoutableRadiusRequest) []RadiusRe
 				server := router.radiusServersTable[serverName]
 
 				// Select one client port randomly.
-				// Origin ports may be specified per destination server or globally in the server
-				var originPorts []int
-				if len(server.conf.OriginPorts) == 0 {
-					originPorts = append(originPorts, router.ci.RadiusServerConf().OriginPorts...)
-				} else {
-					originPorts = append(originPorts, server.conf.OriginPorts...)
-				}
-				clientPort := originPorts[rand.Intn(len(originPorts))]
+				clientPort := router.getOriginPort(server)
 
 				// Determine destination port
 				var destPort int
@@ -579,11 +867,15 @@ func (router *RadiusRouter) getRouteParams(req RoutableRadiusRequest) []RadiusRe
 				// Build route param
 				sName := normalizeIPAddress(server.conf.IPAddress)
 				routeParam := RadiusRequestParamsSet{
-					endpoint:   fmt.Sprintf("%s:%d", sName, destPort),
-					originPort: clientPort,
-					serverName: serverName,
-					secret:     server.conf.Secret,
-					hasErrors:  server.numErrors > 0,
+					endpoint:      net.JoinHostPort(sName, strconv.Itoa(destPort)),
+					originAddress: router.getOriginAddress(serverGroup),
+					originPort:    clientPort,
+					serverName:    serverName,
+					secret:        server.conf.Secret,
+					hasErrors:     server.numErrors > 0,
+
+					messageAuthenticatorPolicy: server.conf.MessageAuthenticator,
+					transport:                  server.conf.Transport,
 				}
 				params = append(params, routeParam)
 			}
@@ -595,10 +887,116 @@ func (router *RadiusRouter) getRouteParams(req RoutableRadiusRequest) []RadiusRe
 	return params
 }
 
+// Origin ports may be specified per destination server or globally in the server.
+// Returns one of them randomly
+func (router *RadiusRouter) getOriginPort(server *RadiusServerWithStatus) int {
+	var originPorts []int
+	if len(server.conf.OriginPorts) == 0 {
+		originPorts = append(originPorts, router.ci.RadiusServerConf().OriginPorts...)
+	} else {
+		originPorts = append(originPorts, server.conf.OriginPorts...)
+	}
+	return originPorts[rand.Intn(len(originPorts))]
+}
+
+// The origin address may be specified per server group or globally in the server
+func (router *RadiusRouter) getOriginAddress(serverGroup core.RadiusServerGroup) string {
+	if serverGroup.OriginAddress != "" {
+		return serverGroup.OriginAddress
+	}
+	return router.ci.RadiusServerConf().OriginAddress
+}
+
+// Sets the timer to probe the server after the configured interval.
+// To be executed in the event loop
+func (router *RadiusRouter) scheduleProbe(serverName string, rsws *RadiusServerWithStatus) {
+
+	// Will be Done() when the timer is executed or stopped
+	router.wg.Add(1)
+	rsws.probeTimer = time.AfterFunc(time.Duration(rsws.conf.ProbeIntervalSeconds)*time.Second, func() {
+		defer router.wg.Done()
+		router.routerControlChan <- ProbeRadiusServer{serverName: serverName}
+	})
+}
+
+// Stops the timers of the probes not yet sent.
+// To be executed in the event loop
+func (router *RadiusRouter) stopProbes() {
+	for _, rsws := range router.radiusServersTable {
+		if rsws.probeTimer != nil {
+			if rsws.probeTimer.Stop() {
+				// The after func has not been called
+				router.wg.Done()
+			}
+			rsws.probeTimer = nil
+		}
+	}
+}
+
+// Sends a Status-Server to the authentication port of the server (the accounting port if not defined), and
+// reports the result to the event loop.
+// To be executed in the event loop
+func (router *RadiusRouter) sendProbe(serverName string, rsws *RadiusServerWithStatus) {
+
+	destPort := rsws.conf.AuthPort
+	if destPort == 0 {
+		destPort = rsws.conf.AcctPort
+	}
+	endpoint := net.JoinHostPort(normalizeIPAddress(rsws.conf.IPAddress), strconv.Itoa(destPort))
+	originPort := router.getOriginPort(rsws)
+
+	// Use the origin address of the first group with this server that specifies one
+	originAddress := router.ci.RadiusServerConf().OriginAddress
+groupLoop:
+	for _, serverGroup := range router.ci.RadiusServers().ServerGroups {
+		if serverGroup.OriginAddress == "" {
+			continue
+		}
+		for _, groupServerName := range serverGroup.Servers {
+			if groupServerName == serverName {
+				originAddress = serverGroup.OriginAddress
+				break groupLoop
+			}
+		}
+	}
+
+	router.wg.Add(1)
+	go func(conf core.RadiusServer) {
+		defer router.wg.Done()
+
+		startTime := time.Now()
+		ch := make(chan interface{}, 1)
+		router.radiusClient.RadiusExchangeWithOptions(endpoint, core.NewRadiusRequest(core.STATUS_SERVER), radiusclient.RadiusExchangeOptions{
+			OriginAddress:              originAddress,
+			OriginPort:                 originPort,
+			Timeout:                    STATUS_SERVER_PROBE_TIMEOUT,
+			ServerTries:                1,
+			Secret:                     conf.Secret,
+			MessageAuthenticatorPolicy: conf.MessageAuthenticator,
+			Transport:                  conf.Transport,
+		}, ch)
+
+		// Block here until response or error
+		response := <-ch
+
+		result := RadiusProbeResult{serverName: serverName, rtt: time.Since(startTime)}
+		switch v := response.(type) {
+		case *core.RadiusPacket:
+			result.ok = true
+		case error:
+			core.GetLogger().Debugf("Status-Server to %s %s not answered: %s", serverName, endpoint, v.Error())
+		}
+		router.routerControlChan <- result
+	}(rsws.conf)
+}
+
 // Builds the RadiusServerTable. Any previous information such as server status
 // will be lost
 func (router *RadiusRouter) buildRadiusServersTable() {
 
+	// The probes of the old table are not needed anymore
+	router.stopProbes()
+
 	// The table being built
 	table := make(map[string]*RadiusServerWithStatus)
 
@@ -620,9 +1018,12 @@ func (router *RadiusRouter) parseRadiusServersTable() core.RadiusServersTable {
 
 	for serverName, rsws := range router.radiusServersTable {
 		entry := core.RadiusServerTableEntry{
-			ServerName:       serverName,
-			IsAvailable:      rsws.isAvailable,
-			UnavailableUntil: rsws.unavailableUntil,
+			ServerName:         serverName,
+			IsAvailable:        rsws.isAvailable,
+			UnavailableUntil:   rsws.unavailableUntil,
+			ProbeSuccesses:     rsws.probeSuccesses,
+			LastProbeTime:      rsws.lastProbeTime,
+			LastProbeRTTMillis: float64(rsws.lastProbeRTT.Microseconds()) / 1000,
 		}
 		radiusServersTable = append(radiusServersTable, entry)
 	}
@@ -633,16 +1034,16 @@ func (router *RadiusRouter) parseRadiusServersTable() core.RadiusServersTable {
 // If endopoint contains a name instead of an IP address, turn it into an IP
 // address
 func normalizeEndpoint(endpoint string) string {
-	addrPort := strings.Split(endpoint, ":")
-	if len(addrPort) != 2 {
+	host, port, err := net.SplitHostPort(endpoint)
+	if err != nil {
 		panic("bad endpoint format " + endpoint)
 	}
 
-	IPPtr, err := net.ResolveIPAddr("", addrPort[0])
+	IPPtr, err := net.ResolveIPAddr("", host)
 	if err != nil {
 		panic("bad endpoint format " + endpoint)
 	}
-	return IPPtr.String() + ":" + addrPort[1]
+	return net.JoinHostPort(IPPtr.String(), port)
 }
 
 // If ip address contains a name, get the IP address
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/francistor/igor/constants"
@@ -24,9 +25,9 @@ const (
 // Allow some buffering. TODO: Evaluate if 64 is a good number
 const RADIUS_REQUESTS_QUEUE_SIZE = 64
 
-// Size of the channel for getting messages to route
-// Allow some buffering. TODO: Evaluate if 64 is a good number
-const DIAMETER_REQUESTS_QUEUE_SIZE = 64
+// Number of shards of the counter of requests being dispatched. Spreading the updates
+// avoids contention between cores when many goroutines are routing requests
+const IN_FLIGHT_SHARDS = 32
 
 // Size of the channel for getting peer control messages
 // Allow some buffering. TODO: Evaluate if 16 is a good number
@@ -38,10 +39,16 @@ const HTTP_TIMEOUT_SECONDS = 10
 // Ticker for Diameter Peer checking
 const DEFAULT_PEER_CHECK_INTERVAL_SECONDS = 120
 
+// Timeout for the Status-Server probes sent to unavailable radius servers
+const STATUS_SERVER_PROBE_TIMEOUT = 1 * time.Second
+
 // Default timeout for requests, when not specified in the origin of the request
 // (e.g. diameter request that is routed to another peer instead of being handled)
 const DEFAULT_REQUEST_TIMEOUT_SECONDS = 6
 
+// Name of the configuration object with the attribute filters referenced in the radius routing rules
+const RADIUS_FILTERS_CONFIG_OBJECT = "radiusFilters.json"
+
 // Represents a Diameter Message to be routed, either to a Handler
 // or to another Diameter Peer
 type RoutableDiameterRequest struct {
@@ -161,6 +168,34 @@ type RouterSetDownCommand struct {
 type RouterCloseCommand struct {
 }
 
+// A WaitGroup padded to fill its own cache lines
+type paddedWaitGroup struct {
+	sync.WaitGroup
+	_ [64]byte
+}
+
+// WaitGroup split in shards, to be used when Add() and Done() are called very frequently
+// from many goroutines
+type shardedWaitGroup struct {
+	shards [IN_FLIGHT_SHARDS]paddedWaitGroup
+}
+
+// Adds one to the shard selected by the hint, which is returned. Done() must be called on the returned WaitGroup.
+// The hint should be different for concurrent callers, such as the HopByHopId of the request, so that they
+// use different shards without sharing any other state
+func (swg *shardedWaitGroup) Add(hint uint32) *sync.WaitGroup {
+	wg := &swg.shards[hint%IN_FLIGHT_SHARDS].WaitGroup
+	wg.Add(1)
+	return wg
+}
+
+// Waits for all the shards
+func (swg *shardedWaitGroup) Wait() {
+	for i := range swg.shards {
+		swg.shards[i].Wait()
+	}
+}
+
 // Helper function to serialize, send request, get response and unserialize Diameter Request
 func HttpDiameterRequest(client http.Client, endpoint string, diameterRequest *core.DiameterMessage) (*core.DiameterMessage, error) {
 
@@ -2,14 +2,21 @@ package router
 
 import (
 	"bytes"
+	"crypto/md5"
 	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/francistor/igor/core"
+	"github.com/francistor/igor/handler"
 	"github.com/francistor/igor/httphandler"
+	"github.com/francistor/igor/radiusclient"
 )
 
 // This message handler parses the Igor1-Command, which may specify
@@ -297,6 +304,98 @@ func TestDiameterRouteMessagetoLocal(t *testing.T) {
 
 }
 
+func TestDiameterRoutingRulesUpdate(t *testing.T) {
+
+	// Configuration served through http, so that the routing rules may be changed. There are no
+	// peers and the peers table is checked rarely, so that no peer event publishes a new snapshot
+	var routes atomic.Value
+	routes.Store(`[{"realm": "igorone", "applicationId": "*"}]`)
+	var configServer *httptest.Server
+	configServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/searchRules.json":
+			fmt.Fprintf(w, `{"rules": [{"nameRegex": "(.*)", "origin": "%s/"}]}`, configServer.URL)
+		case "/testRoutingRules/diameterServer.json":
+			fmt.Fprint(w, `{"bindAddress": "127.0.0.1", "bindPort": 3870, "diameterHost": "rules.igorrules", "diameterRealm": "igorrules", "peerCheckTimeSeconds": 3600}`)
+		case "/testRoutingRules/diameterPeers.json":
+			fmt.Fprint(w, `{}`)
+		case "/testRoutingRules/diameterRoutes.json":
+			fmt.Fprint(w, routes.Load().(string))
+		default:
+			http.FileServer(http.Dir("../resources")).ServeHTTP(w, r)
+		}
+	}))
+	defer configServer.Close()
+
+	ci := core.InitPolicyConfigInstance(configServer.URL+"/searchRules.json", "testRoutingRules", nil, false)
+	router := NewDiameterRouter("testRoutingRules", localDiameterHandler).Start()
+	defer router.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	request, _ := core.NewDiameterRequest("Gx", "Credit-Control")
+	request.AddOriginAVPs(ci)
+	request.Add("Destination-Realm", "igortwo")
+	if _, err := router.RouteDiameterRequest(request, 1*time.Second); err == nil {
+		t.Fatal("request routed without a matching rule")
+	}
+
+	// Add a rule for the realm. The request is now handled locally
+	routes.Store(`[{"realm": "igorone", "applicationId": "*"}, {"realm": "igortwo", "applicationId": "*"}]`)
+	if err := ci.UpdateDiameterRoutingRules(); err != nil {
+		t.Fatalf("could not update the diameter routing rules: %s", err)
+	}
+	response, err := router.RouteDiameterRequest(request, 1*time.Second)
+	if err != nil {
+		t.Fatalf("request not routed after updating the rules: %s", err)
+	} else if response.GetStringAVP("User-Name") != "EchoLocal" {
+		t.Fatalf("Echoed User-Name incorrect %s", response.GetStringAVP("User-Name"))
+	}
+}
+
+func TestDiameterHandlerPanic(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	panicHandler := func(request *core.DiameterMessage) (*core.DiameterMessage, error) {
+		panic("panic in handler")
+	}
+
+	// Start Routers
+	superServer := NewDiameterRouter("testSuperServer", panicHandler, core.DiameterLoggingMiddleware).Start()
+	server := NewDiameterRouter("testServer", nil).Start()
+	time.Sleep(150 * time.Millisecond)
+	client := NewDiameterRouter("testClient", nil).Start()
+
+	// Some time to settle
+	time.Sleep(300 * time.Millisecond)
+
+	// Build request
+	request, err := core.NewDiameterRequest("Gx", "Credit-Control")
+	if err != nil {
+		t.Fatalf("NewDiameterRequest error %s", err)
+	}
+	request.AddOriginAVPs(core.GetPolicyConfig())
+	request.Add("Destination-Realm", "igorsuperserver")
+	response, err := client.RouteDiameterRequest(request, time.Duration(1000*time.Millisecond))
+	if err != nil {
+		t.Fatalf("route message returned error %s", err)
+	} else if response.GetIntAVP("Result-Code") != core.DIAMETER_UNABLE_TO_COMPLY {
+		t.Fatalf("Result-Code not unable to comply %d", response.GetIntAVP("Result-Code"))
+	}
+
+	val, err := core.GetMetricWithLabels("diameter_handler_panics", `{ap="Gx",cm="Credit-Control"}`)
+	if err != nil {
+		t.Fatalf("error getting diameter_handler_panics %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("diameter_handler_panics is %d", val)
+	}
+
+	superServer.Close()
+	server.Close()
+	client.Close()
+}
+
 // Notice that http2 and local handlers do not get cancelled upon router termination
 // and are not waited
 func TestDiameterRequestCancellation(t *testing.T) {
@@ -398,6 +497,22 @@ func TestRadiusRouteToHTTP(t *testing.T) {
 		t.Fatalf("number of radius_client_requests messages was not 2")
 	}
 
+	// Send to named group using RadSec
+	resp, err = client.RouteRadiusRequest(req, "igor-server-radsec-group", 2*time.Second, 1, 1, "")
+	if err != nil {
+		t.Fatalf("error sending request to igor-server-radsec-group %s", err)
+	}
+	if resp.GetStringAVP("User-Name") != "EchoHTTP" {
+		t.Fatalf("bad response from server igor-server-radsec-group. Got %s", resp.GetStringAVP("User-Name"))
+	}
+	val, err = core.GetMetricWithLabels("radius_client_requests", `{.*endpoint="127.0.0.1:2083"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_client_requests %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("number of radius_client_requests messages to RadSec server was not 1")
+	}
+
 	client.Close()
 	server.Close()
 
@@ -429,6 +544,72 @@ func TestRadiusHandleLocal(t *testing.T) {
 	client.Close()
 }
 
+func TestRadiusHandlerMiddlewares(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	// Panics or takes too long depending on the User-Name, and echoes the Class
+	handler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		switch request.GetStringAVP("User-Name") {
+		case "panic":
+			panic("panic in handler")
+		case "slow":
+			time.Sleep(500 * time.Millisecond)
+		}
+		return core.NewRadiusResponse(request, true).Add("Class", request.GetStringAVP("Class")), nil
+	}
+
+	enricher := core.NewRadiusEnrichmentMiddleware(func(request *core.RadiusPacket) error {
+		request.Add("Class", "enriched")
+		return nil
+	})
+
+	client := NewRadiusRouter("testClient", handler, core.RadiusMetricsMiddleware, core.NewRadiusTimeoutMiddleware(200*time.Millisecond), enricher).Start()
+	defer client.Close()
+
+	// The panic is reported as an error
+	_, err := client.RouteRadiusRequest(core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "panic"), "", 1*time.Second, 1, 1, "")
+	if err == nil {
+		t.Fatal("panic in handler not reported as error")
+	}
+	val, err := core.GetMetricWithLabels("radius_handler_panics", `{code="1"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_handler_panics %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_handler_panics is %d", val)
+	}
+
+	// Timeout
+	_, err = client.RouteRadiusRequest(core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "slow"), "", 1*time.Second, 1, 1, "")
+	if err == nil {
+		t.Fatal("slow handler did not time out")
+	}
+	val, err = core.GetMetricWithLabels("radius_handler_timeouts", `{code="1"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_handler_timeouts %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_handler_timeouts is %d", val)
+	}
+
+	// The router keeps working, and the request is enriched
+	resp, err := client.RouteRadiusRequest(core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "myUserName"), "", 1*time.Second, 1, 1, "")
+	if err != nil {
+		t.Fatalf("error after panic in handler %s", err)
+	}
+	if resp.GetStringAVP("Class") != "enriched" {
+		t.Fatalf("request was not enriched. Got Class %s", resp.GetStringAVP("Class"))
+	}
+	val, err = core.GetMetricWithLabels("radius_handler_duration_seconds_count", `{code="1",result="success"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_handler_duration_seconds_count %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("radius_handler_duration_seconds_count is %d", val)
+	}
+}
+
 func TestRadiusTimeout(t *testing.T) {
 
 	core.IS.ResetMetrics()
@@ -570,6 +751,286 @@ func TestRadiusTimeout(t *testing.T) {
 
 }
 
+func TestRadiusProbes(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	// The superserver is not yet started
+	server := NewRadiusRouter("testServer", localRadiusHandler).Start()
+
+	req := core.NewRadiusRequest(core.ACCESS_REQUEST)
+	req.Add("User-Name", "myUserName")
+
+	// One timeout puts the server in quarantine
+	_, err := server.RouteRadiusRequest(req, "igor-superserver-probed-group", 100*time.Millisecond, 1, 1, "")
+	if err == nil {
+		t.Fatal("request did not get a timeout")
+	}
+	time.Sleep(50 * time.Millisecond)
+	serverTable := core.IS.RadiusServersTableQuery()
+	if findRadiusServer("igor-superserver-probed", serverTable["testServer"]).IsAvailable {
+		t.Fatal("igor-superserver-probed is available")
+	}
+
+	// The quarantine has elapsed, but the probes are not answered
+	time.Sleep(1500 * time.Millisecond)
+	if _, err = server.RouteRadiusRequest(req, "igor-superserver-probed-group", 100*time.Millisecond, 1, 1, ""); err == nil {
+		t.Fatal("request to unavailable server did not fail")
+	}
+	serverTable = core.IS.RadiusServersTableQuery()
+	if findRadiusServer("igor-superserver-probed", serverTable["testServer"]).IsAvailable {
+		t.Fatal("igor-superserver-probed is available without answering probes")
+	}
+
+	// Now the probes are answered
+	superserver := NewRadiusRouter("testSuperServer", localRadiusHandler).Start()
+
+	var entry core.RadiusServerTableEntry
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		serverTable = core.IS.RadiusServersTableQuery()
+		if entry = findRadiusServer("igor-superserver-probed", serverTable["testServer"]); entry.IsAvailable {
+			break
+		}
+	}
+	if !entry.IsAvailable {
+		t.Fatal("igor-superserver-probed not available after probes answered")
+	}
+	if entry.ProbeSuccesses != 2 {
+		t.Fatalf("probe successes is %d", entry.ProbeSuccesses)
+	}
+	if entry.LastProbeRTTMillis <= 0 || entry.LastProbeTime.IsZero() {
+		t.Fatal("last probe not recorded")
+	}
+
+	val, err := core.GetMetricWithLabels("radius_server_responses", `{code="12",endpoint="127.0.0.1"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_server_responses %s", err)
+	}
+	if val < 2 {
+		t.Fatalf("number of Status-Server responses was %d", val)
+	}
+
+	// The server is used again
+	if _, err = server.RouteRadiusRequest(req, "igor-superserver-probed-group", 1*time.Second, 1, 1, ""); err != nil {
+		t.Fatalf("request to probed server failed %s", err)
+	}
+
+	server.Close()
+	superserver.Close()
+}
+
+func TestRadiusRouteTCP(t *testing.T) {
+
+	core.IS.ResetMetrics()
+
+	// Start Routers
+	superserver := NewRadiusRouter("testSuperServer", localRadiusHandler).Start()
+	time.Sleep(50 * time.Millisecond)
+	server := NewRadiusRouter("testServer", localRadiusHandler).Start()
+
+	// Send several requests, that will reuse the connection
+	for i := 0; i < 3; i++ {
+		req := core.NewRadiusRequest(core.ACCESS_REQUEST)
+		req.Add("User-Name", "myUserName")
+		resp, err := server.RouteRadiusRequest(req, "igor-superserver-tcp-group", 1*time.Second, 1, 1, "")
+		if err != nil {
+			t.Fatalf("error sending request to igor-superserver-tcp-group %s", err)
+		}
+		if resp.GetStringAVP("User-Name") != "EchoLocal" {
+			t.Fatalf("bad response from server igor-superserver-tcp-group. Got %s", resp.GetStringAVP("User-Name"))
+		}
+	}
+
+	// Accounting goes to another port
+	req := core.NewRadiusRequest(core.ACCOUNTING_REQUEST)
+	req.Add("User-Name", "myUserName")
+	resp, err := server.RouteRadiusRequest(req, "igor-superserver-tcp-group", 1*time.Second, 1, 1, "")
+	if err != nil {
+		t.Fatalf("error sending accounting request to igor-superserver-tcp-group %s", err)
+	}
+	if resp.Code != core.ACCOUNTING_RESPONSE {
+		t.Fatalf("bad response code %d from server igor-superserver-tcp-group", resp.Code)
+	}
+
+	val, err := core.GetMetricWithLabels("radius_client_requests", `{code="1",endpoint="127.0.0.1:11812"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_client_requests %s", err)
+	}
+	if val != 3 {
+		t.Fatalf("number of radius_client_requests was %d", val)
+	}
+	val, err = core.GetMetricWithLabels("radius_client_responses", `{code="5",endpoint="127.0.0.1:11813"}`)
+	if err != nil {
+		t.Fatalf("error getting radius_client_responses %s", err)
+	}
+	if val != 1 {
+		t.Fatalf("number of radius_client_responses was %d", val)
+	}
+
+	server.Close()
+	superserver.Close()
+}
+
+// Client --> radiusPacket to --> Server --> routed as per radiusRoutes.json to SuperServer, proxying
+// transparently, or httpHandler
+func TestRadiusRoutes(t *testing.T) {
+
+	// Rejects if the password, when present, is not "thePassword". Echoes the User-Name received in the Class attribute,
+	// the number of Igor-StringAttribute received in the Igor-IntegerAttribute and the Proxy-State attributes
+	superServerHandler := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		isSuccess := true
+		if request.GetStringAVP("User-Password") != "" || len(request.GetOctetsAVP("CHAP-Password")) > 0 {
+			isSuccess, _ = request.Auth("thePassword")
+		}
+		resp := core.NewRadiusResponse(request, isSuccess)
+		resp.Add("Class", request.GetStringAVP("User-Name"))
+		resp.Add("Igor-StringAttribute", "upstream")
+		resp.Add("Igor-IntegerAttribute", len(request.GetAllAVP("Igor-StringAttribute")))
+		resp.AddAVPs(request.GetAllAVP("Proxy-State"))
+		return resp, nil
+	}
+
+	// Start handler
+	httpHandler := httphandler.NewHttpHandler("testServer", httpDiameterHandler, httpRadiusHandler)
+	time.Sleep(150 * time.Millisecond)
+
+	// Start Routers
+	superserver := NewRadiusRouter("testSuperServer", superServerHandler).Start()
+	server := NewRadiusRouter("testServer", localRadiusHandler).Start()
+	time.Sleep(150 * time.Millisecond)
+
+	// The origin ports of the server are also used by the routers of the client, so that
+	// a radius client with other origin port is used to send the requests to the server
+	client := radiusclient.NewRadiusClient()
+	sendToServer := func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		endpoint := "127.0.0.1:1812"
+		if request.Code == core.ACCOUNTING_REQUEST {
+			endpoint = "127.0.0.1:1813"
+		}
+		rchan := make(chan interface{}, 1)
+		client.RadiusExchange(endpoint, 9100, request, 2*time.Second, 1, "secret", rchan)
+		switch v := (<-rchan).(type) {
+		case *core.RadiusPacket:
+			return v, nil
+		case error:
+			return nil, v
+		}
+		panic("got an answer that was not error or pointer to radius packet")
+	}
+
+	// Proxied to the superserver with the realm stripped and the filters applied
+	req := core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", "user@igorsuperserver.com").
+		Add("User-Password", "thePassword").
+		Add("Igor-StringAttribute", "removed").
+		Add("Proxy-State", []byte("nas-state"))
+	resp, err := sendToServer(req)
+	if err != nil {
+		t.Fatalf("error sending request for igorsuperserver.com realm %s", err)
+	}
+	if resp.Code != core.ACCESS_ACCEPT {
+		t.Fatalf("bad response code %d for igorsuperserver.com realm", resp.Code)
+	}
+	if resp.GetStringAVP("Class") != "user" {
+		t.Fatalf("bad response for igorsuperserver.com realm. Got Class %s", resp.GetStringAVP("Class"))
+	}
+	if resp.GetIntAVP("Igor-IntegerAttribute") != 0 {
+		t.Fatalf("request filter not applied")
+	}
+	if _, err := resp.GetAVP("Igor-StringAttribute"); err == nil || resp.GetStringAVP("Reply-Message") != "filtered" {
+		t.Fatalf("response filter not applied %s", resp)
+	}
+	if proxyStates := resp.GetAllAVP("Proxy-State"); len(proxyStates) != 1 || string(proxyStates[0].GetOctets()) != "nas-state" {
+		t.Fatalf("bad Proxy-State in response %v", proxyStates)
+	}
+
+	// Rejects are relayed
+	req = core.NewRadiusRequest(core.ACCESS_REQUEST).
+		Add("User-Name", "user@igorsuperserver.com").
+		Add("User-Password", "badPassword")
+	resp, err = sendToServer(req)
+	if err != nil {
+		t.Fatalf("error sending request with bad password for igorsuperserver.com realm %s", err)
+	}
+	if resp.Code != core.ACCESS_REJECT {
+		t.Fatalf("bad response code %d for bad password", resp.Code)
+	}
+
+	// Accounting for the same realm is handled locally
+	req = core.NewRadiusRequest(core.ACCOUNTING_REQUEST).Add("User-Name", "user@igorsuperserver.com")
+	resp, err = sendToServer(req)
+	if err != nil {
+		t.Fatalf("error sending accounting request for igorsuperserver.com realm %s", err)
+	}
+	if resp.GetStringAVP("User-Name") != "EchoHTTP" {
+		t.Fatalf("accounting request for igorsuperserver.com realm not handled locally. Got %s", resp.GetStringAVP("User-Name"))
+	}
+
+	// Prefix realm, not stripped
+	req = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "igorsuperserver/user")
+	resp, err = sendToServer(req)
+	if err != nil {
+		t.Fatalf("error sending request for igorsuperserver prefix realm %s", err)
+	}
+	if resp.GetStringAVP("Class") != "igorsuperserver/user" {
+		t.Fatalf("bad response for igorsuperserver prefix realm. Got Class %s", resp.GetStringAVP("Class"))
+	}
+	if resp.GetStringAVP("Igor-StringAttribute") != "upstream" || len(resp.GetAllAVP("Proxy-State")) != 0 {
+		t.Fatalf("bad response for igorsuperserver prefix realm %s", resp)
+	}
+
+	// No route, handled locally
+	req = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "user@other.com")
+	resp, err = sendToServer(req)
+	if err != nil {
+		t.Fatalf("error sending request for other.com realm %s", err)
+	}
+	if resp.GetStringAVP("User-Name") != "EchoHTTP" {
+		t.Fatalf("request for other.com realm not handled locally. Got %s", resp.GetStringAVP("User-Name"))
+	}
+
+	// CHAP without challenge, proxied directly
+	req = core.NewRadiusRequest(core.ACCESS_REQUEST).Add("User-Name", "user")
+	req.Identifier = 33
+	req.Authenticator = [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	hasher := md5.New()
+	hasher.Write([]byte{1})
+	hasher.Write([]byte("thePassword"))
+	hasher.Write(req.Authenticator[:])
+	req.Add("CHAP-Password", append([]byte{1}, hasher.Sum(nil)...))
+	resp, err = server.ProxyRadiusRequest(req, "igor-superserver-group", 1*time.Second, 1, 1, "", nil, nil)
+	if err != nil {
+		t.Fatalf("error proxying CHAP request %s", err)
+	}
+	if resp.Code != core.ACCESS_ACCEPT {
+		t.Fatalf("bad response code %d for CHAP request", resp.Code)
+	}
+	if resp.Identifier != req.Identifier || resp.Authenticator != req.Authenticator {
+		t.Fatalf("response not adapted to the received request")
+	}
+
+	client.SetDown()
+	client.Close()
+	server.Close()
+	superserver.Close()
+	httpHandler.Close()
+}
+
+func TestRadiusRoutingFilterValidation(t *testing.T) {
+	filters := handler.RadiusAVPFilters{"myFilter": &handler.RadiusAVPFilter{}}
+
+	rules := core.RadiusRoutingRules{{Realm: "myrealm", RequestFilter: "myFilter", ResponseFilter: "myFilter"}}
+	if _, err := newRadiusRouting(rules, filters); err != nil {
+		t.Fatalf("routing with existing filters rejected: %s", err)
+	}
+
+	rules = core.RadiusRoutingRules{{Realm: "myrealm", ResponseFilter: "missingFilter"}}
+	if _, err := newRadiusRouting(rules, filters); err == nil {
+		t.Fatal("routing with missing filter was accepted")
+	}
+}
+
 func TestRadiusRequestCancellation(t *testing.T) {
 
 	// Start Routers
@@ -599,6 +1060,89 @@ func TestRadiusRequestCancellation(t *testing.T) {
 	}
 }
 
+// Reference numbers, with -benchtime 3s, before and after dispatching the requests out of the event loop.
+// Taken in a single core host, so they show the cost of the handoff to the event loop, not the scalability
+// with the number of cores, which has to be measured in a host with 8 or more cores
+//
+//	                                  before          after
+//	BenchmarkDiameterRouteLocal       22780 ns/op     17812 ns/op
+//	BenchmarkDiameterRouteLocal-8     26574 ns/op     21440 ns/op
+//	BenchmarkDiameterRouteLocal-16    26543 ns/op     22112 ns/op
+//	BenchmarkDiameterRouteToPeer      224403 ns/op    173073 ns/op
+//	BenchmarkDiameterRouteToPeer-8    273963 ns/op    212276 ns/op
+//	BenchmarkDiameterRouteToPeer-16   238085 ns/op    217242 ns/op
+
+// Requests handled locally, launched from many goroutines. Execute with -cpu 1,8,16 to check scalability
+func BenchmarkDiameterRouteLocal(b *testing.B) {
+	server := NewDiameterRouter("testServer", localDiameterHandler).Start()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request, _ := core.NewDiameterRequest("NASREQ", "AA")
+			request.AddOriginAVPs(core.GetPolicyConfig())
+			request.Add("Destination-Realm", "igor")
+			if _, err := server.RouteDiameterRequest(request, 1*time.Second); err != nil {
+				b.Fatalf("route message returned error %s", err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	server.Close()
+}
+
+// Requests sent to a diameter peer, launched from many goroutines. Execute with -cpu 1,8,16 to check scalability
+func BenchmarkDiameterRouteToPeer(b *testing.B) {
+	superserver := NewDiameterRouter("testSuperServer", localDiameterHandler).Start()
+	server := NewDiameterRouter("testServer", localDiameterHandler).Start()
+
+	// Wait for the peers to be engaged
+	time.Sleep(300 * time.Millisecond)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			request, _ := core.NewDiameterRequest("NASREQ", "AA")
+			request.AddOriginAVPs(core.GetPolicyConfig())
+			request.Add("Destination-Realm", "igorsuperserver")
+			if _, err := server.RouteDiameterRequest(request, 1*time.Second); err != nil {
+				b.Fatalf("route message returned error %s", err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	server.Close()
+	superserver.Close()
+}
+
+// Tracking of in flight requests with a single WaitGroup and with the shardedWaitGroup used by the
+// DiameterRouter. Execute with -cpu 1,8,16 to check the contention between cores
+func BenchmarkInFlightTracking(b *testing.B) {
+	b.Run("WaitGroup", func(b *testing.B) {
+		var wg sync.WaitGroup
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				wg.Add(1)
+				wg.Done()
+			}
+		})
+	})
+	b.Run("Sharded", func(b *testing.B) {
+		var swg shardedWaitGroup
+		var goroutineId uint32
+		b.RunParallel(func(pb *testing.PB) {
+			// Each goroutine uses its own sequence of hints, as the HopByHopIds of the requests
+			hint := atomic.AddUint32(&goroutineId, 1) * 7919
+			for pb.Next() {
+				swg.Add(hint).Done()
+				hint++
+			}
+		})
+	})
+}
+
 ///////////////////////////////////////////////////////////////////////////////////
 
 // Helper to navigate through peers
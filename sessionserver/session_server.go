@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"strconv"
 	"sync"
@@ -79,6 +80,9 @@ type RadiusSessionServer struct {
 	// Status. Can be one of the constants above
 	status int
 
+	// Name of the instance, to reload the configuration
+	instanceName string
+
 	// Holds the radius server for incoming session storage requests
 	radiusServer *radiusserver.RadiusServer
 
@@ -127,6 +131,7 @@ func NewRadiusSessionServer(instanceName string) *RadiusSessionServer {
 
 	// Build and initialize the underlying store
 	rss := RadiusSessionServer{
+		instanceName:         instanceName,
 		config:               ssConf,
 		updateChannel:        make(chan *SessionStoreRequest, 1),
 		queryChannel:         make(chan *SessionQueryRequest, 1),
@@ -144,7 +149,19 @@ func NewRadiusSessionServer(instanceName string) *RadiusSessionServer {
 
 	mux.HandleFunc("/sessionserver/v1/sessions", rss.getQueryHandler())
 
-	// Start event loop, radius and http servers (this last blocks the call. For this reason is executed
+	// Instantiate the radius server. It starts operating right after instantiation, and the
+	// packets will wait for the event loop to be started
+	rss.radiusServer = radiusserver.NewRadiusServerWithOptions(ssConf.ReceiveFrom, ssConf.RadiusBindAddress, ssConf.RadiusBindPort, radiusserver.RadiusServerOptions{
+		DuplicateCacheLifetime:   radiusserver.DEFAULT_DUPLICATE_CACHE_LIFETIME,
+		StatusServerResponseCode: core.ACCOUNTING_RESPONSE,
+	}, func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
+		return rss.HandlePacket(request)
+	})
+
+	// Instantiate the radius client.
+	rss.radiusClient = radiusclient.NewRadiusClient()
+
+	// Start event loop and http server (this last blocks the call. For this reason is executed
 	// in a goroutine)
 	go rss.run()
 
@@ -152,20 +169,12 @@ func NewRadiusSessionServer(instanceName string) *RadiusSessionServer {
 	return &rss
 }
 
-// Execute the event loop, radius and http servers
+// Execute the event loop and http server
 func (rss *RadiusSessionServer) run() {
 
 	// Start event loop
 	go rss.eventLoop()
 
-	// Instantiate the radius server. It starts operating right after instantiation.
-	rss.radiusServer = radiusserver.NewRadiusServer(rss.config.ReceiveFrom, rss.config.RadiusBindAddress, rss.config.RadiusBindPort, func(request *core.RadiusPacket) (*core.RadiusPacket, error) {
-		return rss.HandlePacket(request)
-	})
-
-	// Instantiate the radius client.
-	rss.radiusClient = radiusclient.NewRadiusClient()
-
 	// Make sure the certificates exists in the current directory
 	certFile, keyFile := core.EnsureCertificates()
 
@@ -180,6 +189,20 @@ func (rss *RadiusSessionServer) run() {
 	close(rss.httpDoneChannel)
 }
 
+// Reloads the session server configuration and sets the radius clients in the ReceiveFrom property
+// in the running radius server. The rest of the configuration is not updated.
+// If the configuration cannot be read, the previous radius clients are kept
+func (ss *RadiusSessionServer) UpdateConfiguration() error {
+	ci := core.GetRadiusSessionServerConfigInstance(ss.instanceName)
+	if err := ci.UpdateRadiusSessionServerConfig(); err != nil {
+		core.GetLogger().Errorf("could not update session server configuration: %s", err)
+		return err
+	}
+
+	ss.radiusServer.UpdateRadiusClients(ci.RadiusSessionServerConf().ReceiveFrom)
+	return nil
+}
+
 // Graceful shutdown
 func (ss *RadiusSessionServer) Close() {
 
@@ -309,9 +332,14 @@ func (ss *RadiusSessionServer) eventLoop() {
 						// Will only use server tries (not tries, since we are not sending to a group)
 						// Replication metrics will be shown as radius client metrics
 						ch := make(chan interface{}, 1)
-						ss.radiusClient.RadiusExchange(fmt.Sprintf("%s:%d", destination.IPAddress, destination.AcctPort), originPort,
-							packetToSend, time.Duration(ss.config.ReplicationParams.TimeoutSecs)*time.Second, ss.config.ReplicationParams.ServerTries,
-							destination.Secret, ch)
+						ss.radiusClient.RadiusExchangeWithOptions(net.JoinHostPort(destination.IPAddress, strconv.Itoa(destination.AcctPort)), packetToSend, radiusclient.RadiusExchangeOptions{
+							OriginPort:                 originPort,
+							Timeout:                    time.Duration(ss.config.ReplicationParams.TimeoutSecs) * time.Second,
+							ServerTries:                ss.config.ReplicationParams.ServerTries,
+							Secret:                     destination.Secret,
+							MessageAuthenticatorPolicy: destination.MessageAuthenticator,
+							Transport:                  destination.Transport,
+						}, ch)
 
 						// Block here until response or error
 						response := <-ch